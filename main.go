@@ -1,29 +1,272 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
 	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/feeds"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
+	htmltemplate "html/template"
+	"io"
+	"math"
+	"math/rand"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/text/unicode/norm"
 )
 
 const MAX_RSS_POSTS_COUNT = 20
 
+// DEFAULT_PRUNE_INTERVAL schedules -maxpostage pruning without -vacuuminterval.
+const DEFAULT_PRUNE_INTERVAL = 24 * time.Hour
+
+// DEFAULT_HARD_LIMIT is the default -hardlimit, the most posts read from
+// the cache for one request.
+const DEFAULT_HARD_LIMIT = 200
+
+// DEFAULT_JSON_LIMIT is the default -jsonlimit, the number of results of
+// JSON responses without a limit parameter.
+const DEFAULT_JSON_LIMIT = 50
+
+// DEFAULT_CONTENT_TEMPLATE renders an item description from a DbPost.
+const DEFAULT_CONTENT_TEMPLATE = "{{.Content}}" +
+	"{{range .Media}}<br>{{if eq .Type \"video\"}}<video src=\"{{.Url}}\" poster=\"{{.Thumbnail}}\" controls></video>{{else if or (eq .Type \"audio\") (eq .Type \"voice\")}}<audio src=\"{{.Url}}\" controls></audio>{{else}}<img src=\"{{.Url}}\">{{end}}{{end}}" +
+	"\n\n<a href=\"{{.Link}}\">[link]</a>"
+
+var defaultContentTemplate = template.Must(template.New("content").Parse(DEFAULT_CONTENT_TEMPLATE))
+
+// DEFAULT_ROBOTS is served at /robots.txt without -robotsfile. Every path
+// but the index page is a feed or an API, so crawlers get only the index.
+const DEFAULT_ROBOTS = "User-agent: *\nAllow: /$\nDisallow: /\n"
+
+// indexTemplate renders the GET / page listing cached channels.
+var indexTemplate = htmltemplate.Must(htmltemplate.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>tg-feeds</title>
+{{- range .}}
+<link rel="alternate" type="application/rss+xml" title="{{if .DisplayTitle}}{{.DisplayTitle}}{{else}}{{.Name}}{{end}}" href="/{{.Name}}.rss">
+<link rel="alternate" type="application/atom+xml" title="{{if .DisplayTitle}}{{.DisplayTitle}}{{else}}{{.Name}}{{end}}" href="/{{.Name}}.atom">
+<link rel="alternate" type="application/feed+json" title="{{if .DisplayTitle}}{{.DisplayTitle}}{{else}}{{.Name}}{{end}}" href="/{{.Name}}.json">
+{{- end}}
+</head>
+<body>
+<h1>Channels</h1>
+<ul>
+{{- range .}}
+<li>{{if .DisplayTitle}}{{.DisplayTitle}}{{else}}{{.Name}}{{end}}: <a href="/{{.Name}}.rss">RSS</a> <a href="/{{.Name}}.atom">Atom</a> <a href="/{{.Name}}.json">JSON</a></li>
+{{- else}}
+<li>No channels are cached yet.</li>
+{{- end}}
+</ul>
+</body>
+</html>
+`))
+
+// ARCHIVE_PAGE_SIZE is the number of posts per archive page.
+const ARCHIVE_PAGE_SIZE = 50
+
+// archiveTemplate renders GET /:channel/archive.html.
+var archiveTemplate = htmltemplate.Must(htmltemplate.New("archive").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{if .Channel.DisplayTitle}}{{.Channel.DisplayTitle}}{{else}}{{.Channel.Name}}{{end}} archive</title>
+</head>
+<body style="max-width: 40em; margin: 0 auto; padding: 1em; font-family: sans-serif; line-height: 1.5">
+<h1><a href="{{.Channel.Link}}">{{if .Channel.DisplayTitle}}{{.Channel.DisplayTitle}}{{else}}{{.Channel.Name}}{{end}}</a></h1>
+{{- if .Channel.Description}}
+<p>{{.Channel.Description}}</p>
+{{- end}}
+{{- range .Posts}}
+<article style="border-top: 1px solid #ddd; padding: 1em 0">
+<p style="color: #666; font-size: 0.9em"><a href="{{.Link}}">{{.CreatedAt.Format "2006-01-02 15:04"}}</a></p>
+<div style="white-space: pre-wrap">{{.Content}}</div>
+{{- range .Media}}
+{{- if eq .Type "video"}}
+<video src="{{.Url}}" poster="{{.Thumbnail}}" controls style="max-width: 100%"></video>
+{{- else}}
+<img src="{{.Url}}" style="max-width: 100%">
+{{- end}}
+{{- end}}
+</article>
+{{- else}}
+<p>No posts.</p>
+{{- end}}
+<nav style="border-top: 1px solid #ddd; padding: 1em 0">
+{{- if .PreviousPage}}
+<a href="?order={{.Order}}&amp;page={{.PreviousPage}}">Previous</a>
+{{- end}}
+{{- if .NextPage}}
+<a href="?order={{.Order}}&amp;page={{.NextPage}}">Next</a>
+{{- end}}
+</nav>
+</body>
+</html>
+`))
+
+// parserDriftCount counts channel pages which parsed to zero posts after
+// their markup structure changed, an early sign that Telegram changed the
+// page layout.
+var parserDriftCount = expvar.NewInt("possible_parser_drift")
+
+// dbQueryDurations holds a durationHistogram per Cache operation.
+var dbQueryDurations = expvar.NewMap("db_query_duration_seconds")
+
+// feedRequests counts channel feeds served by whether they were cache hits,
+// fetchedPosts the posts downloaded for them.
+var feedRequests = expvar.NewMap("feed_requests")
+var fetchedPosts = expvar.NewInt("fetched_posts")
+
+// Build information, injected at build time via
+// -ldflags "-X main.version=... -X main.commit=... -X main.date=...".
+var version, commit, date string
+
+// ErrChannelPreviewOnly is returned when Telegram serves the channel's
+// contact page instead of the /s/ web preview, so there are no messages
+// to parse.
+var ErrChannelPreviewOnly = errors.New("Channel has no public web preview")
+
+// ErrChannelRestricted is returned when Telegram serves a restriction
+// notice instead of the channel, e.g. for channels blocked in the region
+// the server runs in.
+var ErrChannelRestricted = errors.New("Channel is restricted")
+
+// ErrChannelNotForum is returned for topic feeds of channels and groups
+// that don't have forum topics.
+var ErrChannelNotForum = errors.New("Channel is not a forum")
+
+// ErrTopicsUnsupported is returned for topic feeds when the fetcher can't
+// scrape forum topics.
+var ErrTopicsUnsupported = errors.New("Forum topics are not supported")
+
+// ErrCommentsUnsupported is returned for comment refreshes when the
+// fetcher doesn't fetch comments.
+var ErrCommentsUnsupported = errors.New("Comments are not fetched")
+
+// ErrNotModified is returned by conditional channel fetches when Telegram
+// answers 304 Not Modified.
+var ErrNotModified = errors.New("Channel page is not modified")
+
+// ErrPageNotFound is returned for feed pages past the cached posts.
+var ErrPageNotFound = errors.New("Feed page not found")
+
+// ErrFetchBusy is returned when no fetch slot frees up in time.
+var ErrFetchBusy = errors.New("Too many channels are being fetched")
+
+// ErrAsyncFetchesFull is returned when MAX_ASYNC_FETCHES channels are
+// already being fetched in the background.
+var ErrAsyncFetchesFull = errors.New("Too many channels are being fetched in the background")
+
+// ErrTelegramUnavailable wraps failures of Telegram itself, such as
+// network errors, rate limiting and server errors, as opposed to missing
+// posts or channels.
+var ErrTelegramUnavailable = errors.New("Telegram is unavailable")
+
+// ErrCircuitOpen is returned instead of requesting Telegram while the
+// circuit breaker is open.
+var ErrCircuitOpen = errors.New("Telegram requests are paused after repeated failures")
+
+// DEGRADED_HEADER marks responses served from the cache because Telegram
+// requests are paused.
+const DEGRADED_HEADER = "X-Tg-Feeds-Degraded"
+
+// STALE_HEADER and STALE_WARNING mark feeds served from the cache because
+// fetching the channel failed.
+const (
+	STALE_HEADER  = "X-Stale"
+	STALE_WARNING = `110 - "Response is Stale"`
+)
+
+// CACHE_HEADER is HIT for feeds of channels without new posts and MISS
+// when posts were downloaded, FETCHED_POSTS_HEADER counts those posts.
+const (
+	CACHE_HEADER         = "X-Cache"
+	FETCHED_POSTS_HEADER = "X-Tg-Feeds-Fetched-Posts"
+)
+
 type Channel struct {
 	Name        string
 	Title       string
 	LastId      int
 	Link        string
 	Description string
+
+	// NewestPostAt is the publish time of the newest message on the channel
+	// page, zero if it couldn't be parsed.
+	NewestPostAt time.Time
+
+	// Views maps message ids on the channel page to their view counts.
+	Views map[int]int
+
+	// Edited lists the ids of messages marked as edited on the channel
+	// page.
+	Edited []int
+
+	// PinnedId is the message pinned by the newest pin service message on
+	// the channel page, zero without one.
+	PinnedId int
+
+	// Albums maps the ids of messages on the channel page that show an
+	// album to the album.
+	Albums map[int]Album
+
+	// Validators are the ETag and Last-Modified of the channel page.
+	Validators PageValidators
+}
+
+// PageValidators are the HTTP cache validators of a page, sent back on
+// the next request to skip it while it's unchanged.
+type PageValidators struct {
+	ETag         string
+	LastModified string
+}
+
+func (validators PageValidators) IsZero() bool {
+	return validators.ETag == "" && validators.LastModified == ""
+}
+
+// PageState is what a channel page tells about its cached posts, stored
+// with its validators to be applied again when the page is not modified.
+type PageState struct {
+	Views  map[int]int `json:"views,omitempty"`
+	Edited []int       `json:"edited,omitempty"`
+}
+
+// Album is a group of media Telegram sends as separate messages, with
+// consecutive ids, and shows as one message with the first id.
+type Album struct {
+	// Parts are the ids of the other messages of the album.
+	Parts []int
+	Media []Media
 }
 
 type Post struct {
@@ -31,6 +274,56 @@ type Post struct {
 	Content   string
 	Link      string
 	CreatedAt time.Time
+
+	// MessageId is the Telegram message id.
+	MessageId int
+	// Views is the view count at fetch time, zero if unknown.
+	Views int
+	// Media lists the post's photos and videos, all of them for albums.
+	Media []Media
+	// Author is the post signature of channels that sign messages, empty
+	// otherwise.
+	Author string
+	// Reactions are the post's reaction counts at fetch time.
+	Reactions []Reaction
+	// ContentHtml is the post text with its formatting, set only when the
+	// fetcher extracts it.
+	ContentHtml string
+	// Edited is set when Telegram marks the post as edited.
+	Edited bool
+	// Comments counts the comments in the linked discussion group and
+	// TopComments holds the first of them, both set only when the fetcher
+	// follows discussions.
+	Comments    int
+	TopComments []Comment
+}
+
+// Reaction is the number of times a post was reacted to with an emoji.
+type Reaction struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+}
+
+// Comment is a message of a post's discussion.
+type Comment struct {
+	Author string `json:"author"`
+	Text   string `json:"text"`
+}
+
+// Media types.
+const (
+	MediaPhoto = "photo"
+	MediaVideo = "video"
+	MediaAudio = "audio"
+	MediaVoice = "voice"
+)
+
+// Media is a photo, video, audio file or voice message attached to a post.
+type Media struct {
+	Type string `json:"type"`
+	Url  string `json:"url"`
+	// Thumbnail is the preview image of a video.
+	Thumbnail string `json:"thumbnail,omitempty"`
 }
 
 type DbChannel struct {
@@ -40,6 +333,42 @@ type DbChannel struct {
 	LastId      int
 	Link        string
 	Description string
+
+	// RefreshInterval overrides the global background refresh interval,
+	// zero means the global one is used.
+	RefreshInterval time.Duration
+
+	// NewestPostAt is the channel page's newest message time as of the
+	// last fetch of its posts.
+	NewestPostAt time.Time
+
+	// PostIntervalEma is the moving average of the time between posts and
+	// NextRefreshAt the next adaptive background refresh, both zero until
+	// the channel is refreshed with -adaptiverefresh.
+	PostIntervalEma time.Duration
+	NextRefreshAt   time.Time
+
+	// TitleOverride is set with POST /:channel/config and replaces the
+	// scraped title in feeds, empty uses the scraped one.
+	TitleOverride string
+
+	// Validators are the ones of the last fetched channel page.
+	Validators PageValidators
+
+	// PinnedId is the pinned message last seen on the channel page, it's
+	// kept when the pin service message scrolls off the page.
+	PinnedId int
+
+	// PageState is the one of the page the Validators are of.
+	PageState PageState
+}
+
+// DisplayTitle is the title override, or the scraped title without one.
+func (channel DbChannel) DisplayTitle() string {
+	if channel.TitleOverride != "" {
+		return channel.TitleOverride
+	}
+	return channel.Title
 }
 
 type DbPost struct {
@@ -49,395 +378,8964 @@ type DbPost struct {
 	Link      string
 	CreatedAt time.Time
 
+	// FirstSeenAt is when the post was first stored, as opposed to its
+	// Telegram publish time. Zero for posts cached by older versions.
+	FirstSeenAt time.Time
+
+	// MessageId is the Telegram message id, zero if unknown.
+	MessageId int
+	// Views is the latest known view count, zero if unknown.
+	Views     int
+	Media     []Media
+	Author    string
+	Reactions []Reaction
+
+	// UpdatedAt is when an edit of the post was noticed and its text
+	// refreshed, zero if it wasn't edited since it was cached.
+	UpdatedAt time.Time
+
+	// ContentHtml is the formatted post text, empty unless it was fetched
+	// with -contenthtml.
+	ContentHtml string
+
+	// Edited is set when the post was edited before it was cached or its
+	// edit was noticed later, see UpdatedAt.
+	Edited bool
+
+	// Pinned puts the post at the top of the feed, it's set by pinPost
+	// and never cached.
+	Pinned bool
+
+	Comments    int
+	TopComments []Comment
+
 	ChannelId int
 }
 
+// SearchResult is a cached post matching a search query, along with the
+// name of the channel it belongs to.
+type SearchResult struct {
+	Channel string
+	Post    DbPost
+}
+
 type Feed struct {
 	Channel Channel
 	Posts   []Post
 }
 
+const (
+	SortByCreated   = "created"
+	SortByFirstSeen = "firstseen"
+)
+
+// FeedOptions controls how cached posts are rendered into a feed.
+type FeedOptions struct {
+	// SortBy orders feed items by publish time (SortByCreated, the default)
+	// or by the time they were first seen (SortByFirstSeen).
+	SortBy string
+
+	// Location converts item timestamps for display, nil keeps them as
+	// stored (UTC).
+	Location *time.Location
+
+	// ContentTemplate renders item descriptions from posts, nil uses
+	// DEFAULT_CONTENT_TEMPLATE.
+	ContentTemplate *template.Template
+
+	// MinViews keeps only posts with at least this many views, posts with
+	// unknown view counts are dropped too. Zero disables the filter.
+	MinViews int
+
+	// TitleIds prefixes item titles with the Telegram message id, e.g.
+	// "[#272] ...".
+	TitleIds bool
+
+	// FetchOrder is the order new posts are downloaded in, FetchDescending
+	// (the default) or FetchAscending.
+	FetchOrder string
+
+	// DescriptionFallback fills in the feed description of channels without
+	// one, DescriptionFallbackTitle or DescriptionFallbackPost. Empty keeps
+	// the description empty.
+	DescriptionFallback string
+
+	// LinkDomain replaces t.me in channel and post links of the feed, e.g.
+	// telegram.me or a mirror. Empty keeps t.me.
+	LinkDomain string
+
+	// IncludeReactions appends reaction counts to item descriptions.
+	IncludeReactions bool
+
+	// TextOnly leaves photos, videos and other embedded media out of item
+	// descriptions.
+	TextOnly bool
+
+	// FeedLink is FeedLinkChannel (the default) to link the feed to the
+	// channel itself, or FeedLinkPreview to link it to the /s/ web preview.
+	FeedLink string
+
+	// CollapseSameTime keeps posts published at the same time when
+	// fetching, instead of dropping them as duplicates, and merges runs of
+	// them with adjacent ids into one item.
+	CollapseSameTime bool
+
+	// SplitContent puts the rendered post into the item content and a
+	// short summary, the post header, into its description.
+	SplitContent bool
+
+	// MediaOnly keeps only posts with photos, videos or audio and attaches
+	// their first one to the item as an enclosure. Audio is attached to
+	// items either way.
+	MediaOnly bool
+
+	// EditedMarker appends " (edited)" to the titles of edited posts.
+	EditedMarker bool
+
+	// Enclosures looks up the type and size of MediaOnly enclosures, nil
+	// guesses the type from the url.
+	Enclosures *EnclosureSniffer
+
+	// LeanStorage fetches the content of posts stored by a LeanCache when
+	// the feed is built.
+	LeanStorage bool
+
+	// Contents keeps the contents fetched for LeanStorage posts, nil
+	// fetches them on every feed.
+	Contents *PostContents
+
+	// PinnedFirst puts the channel's pinned post at the top of the feed,
+	// fetching it when it isn't among the served posts.
+	PinnedFirst bool
+
+	// KeepNameCase caches fetched channels under the name as requested or
+	// as Telegram cases it, otherwise the name is normalized.
+	KeepNameCase bool
+
+	// Filters drop or flag posts by their content when the feed is built,
+	// nil keeps every post.
+	Filters *FilterRules
+
+	// FetchLimit caps the new posts downloaded per fetch, zero uses the
+	// ServeLimit. It doesn't limit the feed, which is filled up with cached
+	// posts, and is at most the ServeLimit.
+	FetchLimit int
+
+	// ServeLimit is the number of cached posts in the feed, zero uses
+	// MAX_RSS_POSTS_COUNT.
+	ServeLimit int
+}
+
+func (options FeedOptions) fetchLimit() int {
+	if options.FetchLimit > 0 {
+		return options.FetchLimit
+	}
+	return options.serveLimit()
+}
+
+func (options FeedOptions) serveLimit() int {
+	if options.ServeLimit > 0 {
+		return options.ServeLimit
+	}
+	return MAX_RSS_POSTS_COUNT
+}
+
+// Feed links.
+const (
+	FeedLinkChannel = "channel"
+	FeedLinkPreview = "preview"
+)
+
+// Feed description fallbacks.
+const (
+	DescriptionFallbackNone  = "none"
+	DescriptionFallbackTitle = "title"
+	DescriptionFallbackPost  = "post"
+)
+
+// Post fetch orders.
+const (
+	FetchDescending = "desc"
+	FetchAscending  = "asc"
+)
+
 type Cache interface {
 	GetChannel(name string) (DbChannel, error)
+	GetChannels() ([]DbChannel, error)
 	SaveChannel(channel Channel) (DbChannel, error)
+	// RenameChannel changes the name and link of a cached channel, keeping
+	// its posts, when Telegram moved it to a new username.
+	RenameChannel(channelId int, name string, link string) error
 	UpdateLastPostId(channelId int, lastPostId int) error
+	UpdateRefreshInterval(channelId int, interval time.Duration) error
+	UpdateTitleOverride(channelId int, title string) error
+	UpdateNewestPostAt(channelId int, newestPostAt time.Time) error
+	UpdateRefreshSchedule(channelId int, postIntervalEma time.Duration, nextRefreshAt time.Time) error
+	UpdateValidators(channelId int, validators PageValidators) error
+	UpdatePinnedId(channelId int, pinnedId int) error
+	UpdatePageState(channelId int, state PageState) error
 
 	GetPosts(channelId int, count int) ([]DbPost, error)
+	// GetPostsPage skips offset posts, newest first unless oldestFirst is
+	// set, and returns up to count of the rest.
+	GetPostsPage(channelId int, offset int, count int, oldestFirst bool) ([]DbPost, error)
+	// GetPostsById returns the cached posts with the given message ids, in
+	// no particular order.
+	GetPostsById(channelId int, messageIds []int) ([]DbPost, error)
 	SavePosts(channelId int, posts []Post) ([]DbPost, error)
+	GetNewestPostTime(channelId int) (time.Time, error)
+	CountPosts(channelId int) (int, error)
+	UpdatePostViews(channelId int, views map[int]int) error
+	// UpdateEditedPosts replaces the text and media of cached posts by
+	// message id and marks them as updated.
+	UpdateEditedPosts(channelId int, posts []Post) error
+	// UpdatePostComments replaces the comment counts and top comments of
+	// cached posts by message id.
+	UpdatePostComments(channelId int, posts []Post) error
+	// PrunePosts deletes posts created before olderThan, always keeping
+	// the newest keepMin of them, and returns how many were deleted.
+	PrunePosts(channelId int, olderThan time.Time, keepMin int) (int, error)
+
+	SearchPosts(query string, limit int) ([]SearchResult, error)
+
+	// GetAliases maps alias names to the channel names they stand for.
+	GetAliases() (map[string]string, error)
+	// SaveAlias points alias to a channel, an empty channelName removes it.
+	SaveAlias(alias string, channelName string) error
+
+	Ping() error
 }
 
 func main() {
-	var dbPath, port string
+	var cacheBackend, cacheDecorators, feedProcessorNames string
+	var dbPath, dbPathTemplate, port, tz, contentTemplate, adminToken, fetchOrder, descFallback, linkDomain, feedLinkMode, fetchHeaders, seedFile, maxPostAge, rssUrlTemplate, robotsFile, filterRulesFile string
+	var autoMigrate bool
+	var refreshInterval, vacuumInterval, failureTtl time.Duration
+	var refreshJitter float64
+	var adaptiveRefresh bool
+	var minRefreshInterval, maxRefreshInterval time.Duration
+	var ttl int
+	var pool PoolOptions
+	var httpClient HttpClientOptions
+	var maxConcurrentFetches, breakerThreshold, fetchRetries, hardLimit, maxPosts, jsonLimit, keepPosts, fetchLimit int
+	var fetchFullText, contentHtml, fetchComments bool
+	var topComments int
+	var breakerCooldown, fetchRetryBackoff time.Duration
+	var readyCheckTelegram, titleIds, indexPage, includeReactions, textOnly, persistentQueue, debugEndpoints, collapseSameTime, splitContent, feedLog, editedMarker, sniffEnclosures, leanStorage, pinnedFirst, mediaRss, keepNameCase, serveStale, asyncFetch bool
+	var fetchWaitTimeout, seedTimeout time.Duration
+	flag.StringVar(&cacheBackend, "cache", CacheSqlite, "cache backend, sqlite or memory (lost on restart)")
+	flag.StringVar(&feedProcessorNames, "feedprocessors", "", "comma-separated feed processors applied in order to every feed before it's written: "+FeedProcessorUntitled)
+	flag.StringVar(&cacheDecorators, "cachedecorators", DecoratorMetrics, "comma-separated cache decorators applied in order: metrics, logging")
 	flag.StringVar(&dbPath, "dbpath", "file:./tg-feeds.db?cache=shared&mode=rwc", "path to the SQLite database file")
+	flag.DurationVar(&failureTtl, "failurettl", 5*time.Minute, "how long channels that don't exist or are restricted answer with the same error without being fetched again, 0 disables it")
+	flag.StringVar(&rssUrlTemplate, "rssurltemplate", "", "RSS or Atom feed url read instead of scraping channels that have one, with {channel} replaced by the channel name")
+	flag.StringVar(&dbPathTemplate, "dbpathtemplate", "", "store each channel in its own SQLite file at this path, with {channel} replaced by the channel name, instead of -dbpath")
 	flag.StringVar(&port, "port", "4567", "GIN server port")
+	flag.BoolVar(&autoMigrate, "automigrate", true, "apply pending database migrations on startup")
+	flag.StringVar(&adminToken, "admintoken", "", "bearer token for /admin endpoints, which are disabled when empty")
+	flag.DurationVar(&refreshInterval, "refreshinterval", 0, "default interval for background channel refresh, 0 disables the worker")
+	flag.Float64Var(&refreshJitter, "refreshjitter", DEFAULT_REFRESH_JITTER, "fraction of the refresh interval background refreshes are moved by at random, spreading channels with the same interval")
+	flag.BoolVar(&adaptiveRefresh, "adaptiverefresh", false, "refresh channels without their own interval as often as they post, within -minrefreshinterval and -maxrefreshinterval")
+	flag.DurationVar(&minRefreshInterval, "minrefreshinterval", 5*time.Minute, "shortest adaptive refresh interval")
+	flag.DurationVar(&maxRefreshInterval, "maxrefreshinterval", 24*time.Hour, "longest adaptive refresh interval")
+	flag.BoolVar(&persistentQueue, "persistentqueue", false, "queue background refreshes and warmups in the database, so they resume after a restart")
+	flag.StringVar(&seedFile, "seedfile", "", "file with channel names, one per line, fetched and cached on startup")
+	flag.DurationVar(&seedTimeout, "seedtimeout", time.Minute, "how long /readyz waits for -seedfile channels to be cached")
+	flag.DurationVar(&vacuumInterval, "vacuuminterval", 0, "interval for database VACUUM and ANALYZE maintenance, 0 disables it")
+	flag.StringVar(&maxPostAge, "maxpostage", "", "delete cached posts older than this, e.g. 90d or 720h, on the maintenance schedule, empty keeps them forever")
+	flag.IntVar(&keepPosts, "keepposts", MAX_RSS_POSTS_COUNT, "newest posts of every channel kept by -maxpostage whatever their age")
+	flag.IntVar(&ttl, "ttl", 0, "RSS ttl in minutes, defaults to the refresh interval")
+	flag.BoolVar(&leanStorage, "leanstorage", false, "cache only post metadata and fetch post contents from Telegram when serving channel feeds")
+	flag.IntVar(&maxPosts, "maxposts", MAX_RSS_POSTS_COUNT, "posts in channel feeds and items of RSS and Atom combined feeds without a limit parameter")
+	flag.IntVar(&jsonLimit, "jsonlimit", DEFAULT_JSON_LIMIT, "items of JSON combined feeds and search results without a limit parameter, channel feeds have -maxposts in every format")
+	flag.IntVar(&hardLimit, "hardlimit", DEFAULT_HARD_LIMIT, "most posts read from the cache for one request, whatever its limit, 0 means unlimited")
+	flag.IntVar(&maxConcurrentFetches, "maxconcurrentfetches", 8, "maximum number of channels fetched from Telegram at the same time, 0 means unlimited")
+	flag.IntVar(&fetchRetries, "fetchretries", 2, "retries of Telegram requests failing with network errors, 429 or 5xx")
+	flag.DurationVar(&fetchRetryBackoff, "fetchretrybackoff", time.Second, "wait before the first retry of a Telegram request, doubled for each next one")
+	flag.DurationVar(&httpClient.Timeout, "fetchtimeout", 30*time.Second, "timeout of a single Telegram request, 0 means none")
+	flag.IntVar(&httpClient.MaxIdleConnsPerHost, "fetchidleconns", 16, "keep-alive connections to Telegram kept open between requests")
+	flag.DurationVar(&httpClient.IdleConnTimeout, "fetchidletimeout", 90*time.Second, "how long an idle keep-alive connection to Telegram stays open")
+	flag.StringVar(&fetchHeaders, "fetchheaders", "", "JSON object of headers added to every Telegram request, e.g. {\"Accept-Language\": \"en\"}")
+	flag.BoolVar(&fetchComments, "comments", false, "fetch the comment count of posts from their linked discussion group, an extra request per post")
+	flag.IntVar(&topComments, "topcomments", 0, "first comments of each post shown with its comment count, needs -comments")
+	flag.BoolVar(&fetchFullText, "fetchfulltext", true, "fetch the full text of posts truncated with \"Show more\" from the channel page")
+	flag.BoolVar(&contentHtml, "contenthtml", false, "also store the formatted text of posts, returned as contentHtml next to the plain content by /search")
+	flag.IntVar(&breakerThreshold, "breakerthreshold", 5, "consecutive Telegram failures that pause requests to it, 0 disables the circuit breaker")
+	flag.DurationVar(&breakerCooldown, "breakercooldown", time.Minute, "how long Telegram requests are paused by the circuit breaker")
+	flag.DurationVar(&fetchWaitTimeout, "fetchwaittimeout", 30*time.Second, "how long a request waits for a fetch slot before failing with 503")
+	flag.StringVar(&contentTemplate, "contenttemplate", DEFAULT_CONTENT_TEMPLATE, "Go text/template rendering item descriptions from post fields")
+	flag.BoolVar(&readyCheckTelegram, "readychecktelegram", false, "make /readyz also check that Telegram is reachable")
+	flag.BoolVar(&titleIds, "titleids", false, "prefix item titles with the Telegram message id, e.g. [#272]")
+	flag.BoolVar(&includeReactions, "includereactions", false, "append post reaction counts to item descriptions")
+	flag.BoolVar(&textOnly, "textonly", false, "leave media out of item descriptions by default, overridden by ?textonly")
+	flag.BoolVar(&feedLog, "feedlog", false, "log a JSON line with the channel, format, item count, cache status, size and duration of every served feed")
+	flag.BoolVar(&mediaRss, "mediarss", false, "add Media RSS media:content and media:thumbnail elements to RSS items with images or videos")
+	flag.BoolVar(&sniffEnclosures, "sniffenclosures", false, "look up the type and size of ?mediaonly enclosures with a HEAD request, cached per media url")
+	flag.BoolVar(&asyncFetch, "asyncfetch", false, "answer 202 Accepted with Retry-After for channels that aren't cached yet and fetch them in the background, instead of waiting for the fetch")
+	flag.BoolVar(&serveStale, "servestale", false, "serve the cached feed with a Warning header when fetching the channel fails, instead of an error")
+	flag.BoolVar(&keepNameCase, "keepnamecase", false, "cache channels under the name as requested instead of lowercasing it, so differently cased requests are cached separately")
+	flag.BoolVar(&pinnedFirst, "pinnedfirst", false, "show the channel's pinned post at the top of its feed, whether or not it's among the newest posts")
+	flag.BoolVar(&editedMarker, "editedmarker", false, "append \"(edited)\" to the titles of posts Telegram marks as edited")
+	flag.BoolVar(&splitContent, "splitcontent", false, "put posts into the item content (content:encoded in RSS, content in Atom) and their header into the description")
+	flag.BoolVar(&debugEndpoints, "debugendpoints", false, "serve debugging endpoints such as /:channel/diff")
+	flag.BoolVar(&collapseSameTime, "collapsesametime", false, "keep posts published at the same time and merge runs of them with adjacent ids into one item")
+	flag.StringVar(&filterRulesFile, "filterrules", "", "file with regex rules excluding, including or flagging posts by their content")
+	flag.StringVar(&robotsFile, "robotsfile", "", "file served at /robots.txt, by default crawlers are only allowed the index page")
+	flag.BoolVar(&indexPage, "indexpage", false, "serve a page listing cached channels at /")
+	flag.StringVar(&fetchOrder, "fetchorder", FetchDescending, "order new posts are downloaded in, desc (newest first) or asc (oldest first)")
+	flag.IntVar(&fetchLimit, "fetchlimit", 0, "most new posts downloaded per channel fetch, at most -maxposts, feeds are filled up with cached posts, 0 downloads up to -maxposts")
+	flag.StringVar(&descFallback, "descfallback", DescriptionFallbackNone, "feed description for channels without one: none, title or post (the newest post's header)")
+	flag.StringVar(&linkDomain, "linkdomain", "", "domain replacing t.me in feed links, e.g. telegram.me, channels are still fetched from t.me")
+	flag.StringVar(&feedLinkMode, "feedlink", FeedLinkChannel, "feed link: channel (https://t.me/<channel>, opens Telegram) or preview (the https://t.me/s/<channel> web preview)")
+	flag.StringVar(&tz, "tz", "", "time zone for feed timestamps, e.g. Europe/Berlin, defaults to UTC")
+	flag.IntVar(&pool.MaxOpenConns, "dbmaxopenconns", 0, "maximum open database connections, 0 means unlimited (always 1 for SQLite without WAL)")
+	flag.IntVar(&pool.MaxIdleConns, "dbmaxidleconns", 0, "maximum idle database connections, 0 keeps the driver default")
+	flag.DurationVar(&pool.ConnMaxLifetime, "dbconnmaxlifetime", 0, "maximum lifetime of a database connection, 0 means unlimited")
+	flag.IntVar(&pool.CacheSize, "dbcachesize", 0, "SQLite page cache of each database connection in KiB, 0 keeps the SQLite default of 2 MiB")
+	flag.Int64Var(&pool.MmapSize, "dbmmapsize", 0, "bytes of the database file SQLite maps into memory for each connection, 0 disables memory-mapped I/O")
+	flag.IntVar(&pool.MaxWriters, "dbmaxwriters", 1, "cache writes run at once against a database file, further ones queue")
 
 	flag.Parse()
 
-	db, err := initDB(dbPath)
-	if err != nil {
-		fmt.Println(err)
+	if ttl == 0 {
+		ttl = int(refreshInterval.Minutes())
+	}
+
+	if fetchOrder != FetchDescending && fetchOrder != FetchAscending {
+		fmt.Printf("Invalid fetch order %s\n", fetchOrder)
 		return
 	}
-	defer db.Close()
 
-	cache := &SqliteCache{db: db}
-	fetcher := &TelegramWebFetcher{}
+	if fetchLimit < 0 {
+		fmt.Printf("Invalid fetch limit %d\n", fetchLimit)
+		return
+	}
 
-	r := gin.Default()
+	// Posts fetched beyond the feed size would be cached without being
+	// served.
+	serveLimit := (FeedOptions{ServeLimit: capLimit(maxPosts, hardLimit)}).serveLimit()
+	if fetchLimit > serveLimit {
+		fmt.Printf("-fetchlimit %d must not be above the %d posts of channel feeds, see -maxposts\n", fetchLimit, serveLimit)
+		return
+	}
 
-	r.GET("/ping", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
-			"message": "pong",
-		})
-	})
+	if descFallback != DescriptionFallbackNone && descFallback != DescriptionFallbackTitle && descFallback != DescriptionFallbackPost {
+		fmt.Printf("Invalid description fallback %s\n", descFallback)
+		return
+	}
 
-	r.GET("/:channel", func(c *gin.Context) {
-		channelName := c.Param("channel")
-		feed, err := prepareFeed(channelName, cache, fetcher)
-		if err != nil {
-			fmt.Println(err)
+	if feedLinkMode != FeedLinkChannel && feedLinkMode != FeedLinkPreview {
+		fmt.Printf("Invalid feed link %s\n", feedLinkMode)
+		return
+	}
+
+	if linkDomain != "" {
+		if parsed, err := url.Parse("https://" + linkDomain); err != nil || parsed.Host != linkDomain {
+			fmt.Printf("Invalid link domain %s\n", linkDomain)
 			return
 		}
+	}
 
-		rss, _ := feed.ToRss()
-		c.Data(http.StatusOK, "application/xml", []byte(rss))
-	})
-
-	r.Run(":" + port)
-}
-
-type SqliteCache struct {
-	db *sql.DB
-}
+	var seedChannels []string
+	if seedFile != "" {
+		var err error
+		seedChannels, err = readSeedFile(seedFile)
+		if err != nil {
+			fmt.Printf("Invalid seed file: %s\n", err)
+			return
+		}
+		if !keepNameCase {
+			for i, name := range seedChannels {
+				seedChannels[i] = normalizeChannelName(name)
+			}
+		}
+	}
 
-func (cache *SqliteCache) GetChannel(name string) (DbChannel, error) {
-	var channel DbChannel
-	query := "SELECT id, name, title, lastId, link, description FROM channels WHERE name = ?"
-	err := cache.db.QueryRow(query, name).Scan(&channel.Id, &channel.Name, &channel.Title, &channel.LastId, &channel.Link, &channel.Description)
-	return channel, err
-}
+	var robots string
+	if robotsFile != "" {
+		content, err := os.ReadFile(robotsFile)
+		if err != nil {
+			fmt.Printf("Invalid robots file: %s\n", err)
+			return
+		}
+		robots = string(content)
+	}
 
-func (cache *SqliteCache) SaveChannel(channel Channel) (DbChannel, error) {
-	query := `
-		INSERT INTO channels (name, title, lastId, link, description)
-		VALUES (?, ?, ?, ?, ?)`
-	res, err := cache.db.Exec(query, channel.Name, channel.Title, channel.LastId, channel.Link, channel.Description)
+	var filterRules *FilterRules
+	if filterRulesFile != "" {
+		var err error
+		filterRules, err = readFilterRules(filterRulesFile)
+		if err != nil {
+			fmt.Printf("Invalid filter rules: %s\n", err)
+			return
+		}
+	}
 
-	lastInsertId, err := res.LastInsertId()
+	parsedFetchHeaders, err := parseFetchHeaders(fetchHeaders)
 	if err != nil {
-		return DbChannel{}, err
+		fmt.Printf("Invalid fetch headers: %s\n", err)
+		return
 	}
 
-	dbChannel := DbChannel{
-		Id:          int(lastInsertId),
-		Name:        channel.Name,
-		Title:       channel.Title,
-		LastId:      channel.LastId,
-		Link:        channel.Link,
-		Description: channel.Description,
+	parsedMaxPostAge, err := parseAge(maxPostAge)
+	if err != nil {
+		fmt.Printf("Invalid max post age: %s\n", err)
+		return
 	}
 
-	return dbChannel, err
-}
+	if topComments < 0 || (topComments > 0 && !fetchComments) {
+		fmt.Println("-topcomments must not be negative and needs -comments")
+		return
+	}
 
-func (cache *SqliteCache) UpdateLastPostId(channelId int, lastPostId int) error {
-	query := "UPDATE channels SET lastId = ? WHERE id = ?"
-	_, err := cache.db.Exec(query, lastPostId, channelId)
-	return err
-}
+	if refreshJitter < 0 || refreshJitter > 1 {
+		fmt.Println("-refreshjitter must be between 0 and 1")
+		return
+	}
 
-func (cache *SqliteCache) GetPosts(channelId int, count int) ([]DbPost, error) {
-	posts := []DbPost{}
-	query := "SELECT id, header, content, link, createdAt FROM posts WHERE channelId = ? ORDER BY createdAt DESC LIMIT ?"
-	rows, err := cache.db.Query(query, channelId, count)
-	if err != nil {
-		return nil, err
+	if adaptiveRefresh && (minRefreshInterval <= 0 || minRefreshInterval > maxRefreshInterval) {
+		fmt.Println("-minrefreshinterval must be positive and not above -maxrefreshinterval")
+		return
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var post DbPost
-		err := rows.Scan(&post.Id, &post.Header, &post.Content, &post.Link, &post.CreatedAt)
+	var location *time.Location
+	if tz != "" {
+		var err error
+		location, err = time.LoadLocation(tz)
 		if err != nil {
-			return nil, err
+			fmt.Printf("Invalid time zone %s: %s\n", tz, err)
+			return
 		}
-		posts = append(posts, post)
 	}
-	return posts, nil
-}
-
-func (cache *SqliteCache) SavePosts(channelId int, posts []Post) ([]DbPost, error) {
-	tx, err := cache.db.Begin()
-	var savedPosts []DbPost
 
+	parsedContentTemplate, err := template.New("content").Parse(contentTemplate)
 	if err != nil {
-		return savedPosts, err
+		fmt.Printf("Invalid content template: %s\n", err)
+		return
 	}
 
-	stmt, err := tx.Prepare("INSERT INTO posts (header, content, link, createdAt, channelId) VALUES (?, ?, ?, ?, ?)")
+	var decorators []string
+	if cacheDecorators != "" {
+		decorators = strings.Split(cacheDecorators, ",")
+	}
+
+	processors, err := parseFeedProcessors(feedProcessorNames)
 	if err != nil {
-		return savedPosts, err
+		fmt.Println(err)
+		return
 	}
-	defer stmt.Close()
 
-	for _, post := range posts {
-		res, err := stmt.Exec(post.Header, post.Content, post.Link, post.CreatedAt, channelId)
-		if err != nil {
-			tx.Rollback()
-			return savedPosts, err
-		}
+	cache, db, err := NewCache(CacheOptions{
+		Backend:        cacheBackend,
+		DbPath:         dbPath,
+		DbPathTemplate: dbPathTemplate,
+		Pool:           pool,
+		AutoMigrate:    autoMigrate,
+		HardLimit:      hardLimit,
+		LeanStorage:    leanStorage,
+		Decorators:     decorators,
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer closeCache(cache)
 
-		insertedId, err := res.LastInsertId()
-		if err != nil {
-			tx.Rollback()
-			return savedPosts, err
+	if !keepNameCase {
+		if err := normalizeCachedChannels(cache); err != nil {
+			fmt.Printf("Can't normalize cached channel names: %s\n", err)
 		}
+	}
 
-		savedPost := DbPost{Id: int(insertedId), Header: post.Header, Content: post.Content, Link: post.Link, CreatedAt: post.CreatedAt, ChannelId: channelId}
-		savedPosts = append(savedPosts, savedPost)
+	var limiter *FetchLimiter
+	if maxConcurrentFetches > 0 {
+		limiter = NewFetchLimiter(maxConcurrentFetches, fetchWaitTimeout)
 	}
 
-	if err := tx.Commit(); err != nil {
-		return savedPosts, err
+	client := newTelegramClient(httpClient)
+	var fetcher Fetcher = &TelegramWebFetcher{Retries: fetchRetries, RetryBackoff: fetchRetryBackoff, Limiter: limiter, FullText: fetchFullText, ContentHtml: contentHtml, Comments: fetchComments, TopComments: topComments, Headers: parsedFetchHeaders, Client: client}
+	if rssUrlTemplate != "" {
+		fetcher = &RssFetcher{UrlTemplate: rssUrlTemplate, Fallback: fetcher, Client: client, ContentHtml: contentHtml}
+	}
+	if failureTtl > 0 {
+		fetcher = NewFailureCache(fetcher, failureTtl)
+	}
+	if breakerThreshold > 0 {
+		fetcher = NewCircuitBreaker(fetcher, breakerThreshold, breakerCooldown)
 	}
 
-	return savedPosts, nil
-}
+	// Held by the refresh worker while it writes and by maintenance, so a
+	// VACUUM never runs in the middle of a refresh.
+	maintenanceLock := &sync.Mutex{}
 
-type Fetcher interface {
-	FetchChannel(channelName string) (Channel, error)
-	FetchPost(channelName string, id int) (Post, error)
-}
+	var queue *FetchQueue
+	if persistentQueue && db == nil {
+		fmt.Println("-persistentqueue needs a single SQLite database")
+		return
+	} else if persistentQueue {
+		queue, err = NewFetchQueue(db, cacheWriteLock(cache))
+		if err != nil {
+			fmt.Printf("Can't open fetch queue: %s\n", err)
+			return
+		}
+	}
 
-type TelegramWebFetcher struct{}
+	// Canceled on SIGINT or SIGTERM. Background workers stop with it, and
+	// are joined before the deferred closeCache.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var workers sync.WaitGroup
 
-func (fetcher *TelegramWebFetcher) FetchChannel(channelName string) (Channel, error) {
-	url := tgChannelFeedUrl(channelName)
-	resp, err := http.Get(url)
-	if err != nil {
-		fmt.Println(err)
-		return Channel{}, err
+	if queue != nil {
+		queueWorkers := maxConcurrentFetches
+		if queueWorkers == 0 {
+			queueWorkers = DEFAULT_QUEUE_WORKERS
+		}
+		queueWorker := NewQueueWorker(queue, cache, fetcher, limiter, maintenanceLock, queueWorkers, FeedOptions{FetchOrder: fetchOrder, CollapseSameTime: collapseSameTime, FetchLimit: fetchLimit, ServeLimit: serveLimit, KeepNameCase: keepNameCase})
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			queueWorker.Run(ctx)
+		}()
 	}
-	defer resp.Body.Close()
 
-	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	if refreshInterval > 0 {
+		var adaptive *AdaptiveRefresh
+		if adaptiveRefresh {
+			adaptive = &AdaptiveRefresh{MinInterval: minRefreshInterval, MaxInterval: maxRefreshInterval}
+		}
+		worker := NewRefreshWorker(cache, fetcher, limiter, maintenanceLock, queue, refreshInterval, adaptive, refreshJitter, FeedOptions{FetchOrder: fetchOrder, CollapseSameTime: collapseSameTime, FetchLimit: fetchLimit, ServeLimit: serveLimit, KeepNameCase: keepNameCase})
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			worker.Run(ctx)
+		}()
+	}
 
-	var description, dataPost, title string
+	// Pruning runs on the vacuum schedule, or daily when vacuuming is off.
+	maintenanceInterval := vacuumInterval
+	if maintenanceInterval == 0 && parsedMaxPostAge > 0 {
+		maintenanceInterval = DEFAULT_PRUNE_INTERVAL
+	}
+
+	vacuumDb := db
+	if vacuumInterval == 0 {
+		vacuumDb = nil
+	} else if db == nil {
+		fmt.Println("-vacuuminterval needs a single SQLite database")
+	}
+
+	if vacuumDb != nil || parsedMaxPostAge > 0 {
+		prune := PruneOptions{MaxAge: parsedMaxPostAge, KeepMin: keepPosts}
+		maintenance := NewMaintenance(vacuumDb, cache, maintenanceLock, maintenanceInterval, prune)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			maintenance.Run(ctx)
+		}()
+	}
+
+	// Warmups, the seed among them, stop starting fetches with ctx. They
+	// and async fetches are joined once the server stops starting them.
+	warmups := NewWarmups(ctx, cache, fetcher, limiter, queue, FeedOptions{FetchOrder: fetchOrder, CollapseSameTime: collapseSameTime, FetchLimit: fetchLimit, ServeLimit: serveLimit, KeepNameCase: keepNameCase})
+	asyncFetches := NewAsyncFetches()
+
+	var seed *Seed
+	if len(seedChannels) > 0 {
+		var err error
+		seed, err = StartSeed(warmups, seedChannels, seedTimeout)
+		if err != nil {
+			fmt.Printf("Can't seed channels: %s\n", err)
+		} else {
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				seed.Run(ctx)
+			}()
+		}
+	}
+
+	var parsedFeedLog *FeedLog
+	if feedLog {
+		parsedFeedLog = NewFeedLog(os.Stdout)
+	}
+
+	var enclosures *EnclosureSniffer
+	if sniffEnclosures {
+		enclosures = NewEnclosureSniffer(client)
+	}
+
+	r := setupRouter(cache, fetcher, limiter, ServerConfig{
+		TTL:                 ttl,
+		Location:            location,
+		ContentTemplate:     parsedContentTemplate,
+		ReadyCheckTelegram:  readyCheckTelegram,
+		AdminToken:          adminToken,
+		TitleIds:            titleIds,
+		IndexPage:           indexPage,
+		Robots:              robots,
+		KeepNameCase:        keepNameCase,
+		ServeStale:          serveStale,
+		AsyncFetch:          asyncFetch,
+		FeedProcessors:      processors,
+		MediaRss:            mediaRss,
+		FilterRules:         filterRules,
+		FetchOrder:          fetchOrder,
+		FetchLimit:          fetchLimit,
+		DescriptionFallback: descFallback,
+		LinkDomain:          linkDomain,
+		FeedLink:            feedLinkMode,
+		IncludeReactions:    includeReactions,
+		TextOnly:            textOnly,
+		Queue:               queue,
+		HardLimit:           hardLimit,
+		MaxPosts:            maxPosts,
+		JsonLimit:           jsonLimit,
+		DebugEndpoints:      debugEndpoints,
+		Warmups:             warmups,
+		Seed:                seed,
+		AsyncFetches:        asyncFetches,
+		CollapseSameTime:    collapseSameTime,
+		ContentHtml:         contentHtml,
+		SplitContent:        splitContent,
+		FeedLog:             parsedFeedLog,
+		EditedMarker:        editedMarker,
+		Enclosures:          enclosures,
+		LeanStorage:         leanStorage,
+		PinnedFirst:         pinnedFirst,
+	})
+
+	server := &http.Server{Addr: ":" + port, Handler: r}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		fmt.Printf("Server failed: %s\n", err)
+	case <-ctx.Done():
+		fmt.Println("Shutting down")
+	}
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		fmt.Printf("Can't shut down server: %s\n", err)
+	}
+	warmups.Wait()
+	asyncFetches.Wait()
+	workers.Wait()
+}
+
+// SHUTDOWN_TIMEOUT is how long in-flight requests get to finish on
+// shutdown.
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
+// Error codes of API error responses.
+const (
+	ErrorCodeInvalidRequest      = "invalid_request"
+	ErrorCodeUnauthorized        = "unauthorized"
+	ErrorCodeNotFound            = "not_found"
+	ErrorCodeChannelNotFound     = "channel_not_found"
+	ErrorCodeChannelRestricted   = "channel_restricted"
+	ErrorCodeFetchBusy           = "fetch_busy"
+	ErrorCodeFetchFailed         = "fetch_failed"
+	ErrorCodeTelegramUnavailable = "telegram_unavailable"
+	ErrorCodeDatabaseUnavailable = "database_unavailable"
+	ErrorCodeNotImplemented      = "not_implemented"
+	ErrorCodeInternal            = "internal_error"
+	ErrorCodeStarting            = "starting"
+)
+
+// apiError is the error object of API responses.
+func apiError(code string, message string) gin.H {
+	return gin.H{"code": code, "message": message}
+}
+
+// renderError answers with {"error": {"code": ..., "message": ...}} and
+// stops the remaining handlers.
+func renderError(c *gin.Context, status int, code string, message string) {
+	c.AbortWithStatusJSON(status, gin.H{"error": apiError(code, message)})
+}
+
+// adminAuth rejects requests without the admin bearer token. Without a
+// configured token admin endpoints aren't available at all.
+func adminAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token == "" {
+			renderError(c, http.StatusNotFound, ErrorCodeNotFound, "Admin endpoints are disabled")
+			return
+		}
+
+		provided := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			renderError(c, http.StatusUnauthorized, ErrorCodeUnauthorized, "Unauthorized")
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// ServerConfig holds the settings of the HTTP handlers.
+type ServerConfig struct {
+	// TTL is the RSS ttl in minutes.
+	TTL             int
+	Location        *time.Location
+	ContentTemplate *template.Template
+
+	// ReadyCheckTelegram makes readiness depend on Telegram being reachable.
+	ReadyCheckTelegram bool
+
+	// AdminToken is the bearer token required by /admin endpoints, which are
+	// disabled when it's empty.
+	AdminToken string
+
+	// TitleIds prefixes item titles with Telegram message ids.
+	TitleIds bool
+
+	// IndexPage serves a page listing cached channels at GET /.
+	IndexPage bool
+
+	// Robots is served at /robots.txt, empty serves DEFAULT_ROBOTS.
+	Robots string
+
+	// FeedProcessors transform every feed, in order, before it's written.
+	FeedProcessors []FeedProcessor
+
+	// AsyncFetch fetches channels that aren't cached yet in the background,
+	// answering 202 Accepted until they are.
+	AsyncFetch bool
+
+	// ServeStale serves the cached feed of channels whose fetch failed,
+	// marked with STALE_HEADER.
+	ServeStale bool
+
+	// KeepNameCase serves channels under the name as requested, otherwise
+	// names are lowercased so all spellings share one cached channel.
+	KeepNameCase bool
+
+	// MediaRss adds Media RSS elements to the items of RSS feeds.
+	MediaRss bool
+
+	// FilterRules drop or flag posts of feeds by their content, nil keeps
+	// every post.
+	FilterRules *FilterRules
+
+	// FetchOrder is the order new posts are downloaded in.
+	FetchOrder string
+
+	// FetchLimit caps the new posts downloaded per channel fetch, zero
+	// downloads up to the posts of channel feeds.
+	FetchLimit int
+
+	// DescriptionFallback fills in empty feed descriptions.
+	DescriptionFallback string
+
+	// LinkDomain replaces t.me in displayed links.
+	LinkDomain string
+
+	// FeedLink chooses between the channel and its web preview as the feed
+	// link.
+	FeedLink string
+
+	// IncludeReactions appends reaction counts to item descriptions.
+	IncludeReactions bool
+
+	// TextOnly leaves photos, videos and other embedded media out of item
+	// descriptions.
+	TextOnly bool
+
+	// Queue keeps warmups across restarts, nil keeps them in memory.
+	Queue *FetchQueue
+
+	// HardLimit caps limit parameters, zero doesn't cap them.
+	HardLimit int
+
+	// MaxPosts is the default limit of RSS and Atom combined feeds and
+	// the number of posts in channel feeds and their pages, JsonLimit the
+	// default limit of JSON combined feeds and search results. Zero uses
+	// MAX_RSS_POSTS_COUNT and DEFAULT_JSON_LIMIT.
+	MaxPosts  int
+	JsonLimit int
+
+	// DebugEndpoints serves /:channel/diff.
+	DebugEndpoints bool
+
+	// Warmups runs /admin/warmup jobs, nil starts its own.
+	Warmups *Warmups
+
+	// Seed is the warmup of the channels fetched on startup, /readyz fails
+	// until it's done. Nil doesn't wait for anything.
+	Seed *Seed
+
+	// AsyncFetches runs the background fetches of AsyncFetch, nil starts
+	// its own.
+	AsyncFetches *AsyncFetches
+
+	// CollapseSameTime merges posts published at the same time.
+	CollapseSameTime bool
+
+	// ContentHtml adds the formatted text of posts to /search results.
+	ContentHtml bool
+
+	// SplitContent serves posts as item content with their header as the
+	// description.
+	SplitContent bool
+
+	// FeedLog logs served channel feeds, nil disables it.
+	FeedLog *FeedLog
+
+	// EditedMarker marks the titles of edited posts.
+	EditedMarker bool
+
+	// Enclosures sniffs the enclosures of ?mediaonly feeds, nil guesses
+	// their type.
+	Enclosures *EnclosureSniffer
+
+	// LeanStorage fetches the content of channel feed posts, which the
+	// cache stores without it.
+	LeanStorage bool
+
+	// PinnedFirst shows the pinned post first in channel feeds.
+	PinnedFirst bool
+}
+
+// defaultLimit is the limit of requests for format without one. API
+// consumers of JSON usually want more results than feed readers.
+func (config ServerConfig) defaultLimit(format string) int {
+	if format == FormatJson {
+		if config.JsonLimit > 0 {
+			return config.JsonLimit
+		}
+		return DEFAULT_JSON_LIMIT
+	}
+	if config.MaxPosts > 0 {
+		return config.MaxPosts
+	}
+	return MAX_RSS_POSTS_COUNT
+}
+
+func setupRouter(cache Cache, fetcher Fetcher, limiter *FetchLimiter, config ServerConfig) *gin.Engine {
+	r := gin.Default()
+
+	if config.IndexPage {
+		r.GET("/", func(c *gin.Context) {
+			channels, err := cache.GetChannels()
+			if err != nil {
+				fmt.Println(err)
+				renderError(c, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+				return
+			}
+
+			sort.Slice(channels, func(i, j int) bool {
+				return channels[i].Name < channels[j].Name
+			})
+
+			c.Header("Content-Type", "text/html; charset=utf-8")
+			c.Status(http.StatusOK)
+			if err := indexTemplate.Execute(c.Writer, channels); err != nil {
+				fmt.Printf("Can't render index page: %s\n", err)
+			}
+		})
+	}
+
+	robots := config.Robots
+	if robots == "" {
+		robots = DEFAULT_ROBOTS
+	}
+	r.GET("/robots.txt", func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(robots))
+	})
+
+	r.GET("/ping", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"message": "pong",
+		})
+	})
+
+	// Liveness only fails when the process can't serve requests at all, so
+	// an orchestrator doesn't restart it because a dependency is down.
+	r.GET("/livez", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	warmups := config.Warmups
+	if warmups == nil {
+		warmups = NewWarmups(context.Background(), cache, fetcher, limiter, config.Queue, FeedOptions{FetchOrder: config.FetchOrder, CollapseSameTime: config.CollapseSameTime, FetchLimit: config.FetchLimit, ServeLimit: capLimit(config.MaxPosts, config.HardLimit), KeepNameCase: config.KeepNameCase})
+	}
+
+	r.GET("/readyz", func(c *gin.Context) {
+		if err := cache.Ping(); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": apiError(ErrorCodeDatabaseUnavailable, "Database: "+err.Error())})
+			return
+		}
+
+		if pending, total := config.Seed.Pending(); pending > 0 {
+			message := fmt.Sprintf("Seeding channels: %d of %d fetched", total-pending, total)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": apiError(ErrorCodeStarting, message)})
+			return
+		}
+
+		if config.ReadyCheckTelegram {
+			if err := pingTelegram(); err != nil {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": apiError(ErrorCodeTelegramUnavailable, "Telegram: "+err.Error())})
+				return
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	r.GET("/metrics", gin.WrapH(expvar.Handler()))
+
+	r.GET("/version", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"version":   version,
+			"commit":    commit,
+			"date":      date,
+			"goVersion": runtime.Version(),
+		})
+	})
+
+	aliases := newChannelAliases(cache, config.KeepNameCase)
+	coldFetches := config.AsyncFetches
+	if coldFetches == nil {
+		coldFetches = NewAsyncFetches()
+	}
+
+	var contents *PostContents
+	if config.LeanStorage {
+		contents = NewPostContents()
+	}
+
+	admin := r.Group("/admin", adminAuth(config.AdminToken))
+
+	admin.GET("/alias", func(c *gin.Context) {
+		c.JSON(http.StatusOK, aliases.all())
+	})
+
+	admin.POST("/alias", func(c *gin.Context) {
+		var request AliasRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+		if !shardChannelName.MatchString(request.Alias) || (request.Channel != "" && !shardChannelName.MatchString(request.Channel)) {
+			renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, "Invalid alias or channel name")
+			return
+		}
+		request.Alias, request.Channel = aliases.normalize(request.Alias), aliases.normalize(request.Channel)
+		if request.Alias == request.Channel {
+			renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, "Alias is the channel name")
+			return
+		}
+		for _, route := range r.Routes() {
+			if segment, _, _ := strings.Cut(strings.TrimPrefix(route.Path, "/"), "/"); segment == request.Alias {
+				renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, "Alias is a reserved path")
+				return
+			}
+		}
+
+		if err := cache.SaveAlias(request.Alias, request.Channel); err != nil {
+			fmt.Println(err)
+			renderError(c, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+			return
+		}
+		aliases.set(request.Alias, request.Channel)
+
+		c.JSON(http.StatusOK, request)
+	})
+
+	admin.POST("/warmup", func(c *gin.Context) {
+		var channels []string
+		if err := c.ShouldBindJSON(&channels); err != nil {
+			renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+		if len(channels) == 0 {
+			renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, "No channels")
+			return
+		}
+		for i, name := range channels {
+			channels[i] = aliases.resolve(name)
+		}
+
+		id, err := warmups.Start(channels)
+		if err != nil {
+			fmt.Println(err)
+			renderError(c, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"id": id})
+	})
+
+	admin.GET("/warmup/:id", func(c *gin.Context) {
+		job, ok := warmups.Get(c.Param("id"))
+		if !ok {
+			renderError(c, http.StatusNotFound, ErrorCodeNotFound, "Warmup not found")
+			return
+		}
+
+		c.JSON(http.StatusOK, job)
+	})
+
+	admin.GET("/failures", func(c *gin.Context) {
+		failures, ok := fetcherFailures(fetcher)
+		if !ok {
+			renderError(c, http.StatusNotImplemented, ErrorCodeNotImplemented, "Failure cache is disabled")
+			return
+		}
+
+		c.JSON(http.StatusOK, failures.Failures())
+	})
+
+	admin.DELETE("/failures/:channel", func(c *gin.Context) {
+		failures, ok := fetcherFailures(fetcher)
+		if !ok {
+			renderError(c, http.StatusNotImplemented, ErrorCodeNotImplemented, "Failure cache is disabled")
+			return
+		}
+
+		if !failures.Clear(c.Param("channel")) {
+			renderError(c, http.StatusNotFound, ErrorCodeNotFound, "Failure not found")
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	admin.GET("/schema", func(c *gin.Context) {
+		migrator, ok := cacheMigrator(cache)
+		if !ok {
+			renderError(c, http.StatusNotImplemented, ErrorCodeNotImplemented, "Cache has no schema migrations")
+			return
+		}
+
+		version, err := migrator.SchemaVersion()
+		if err != nil {
+			renderError(c, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+			return
+		}
+
+		pending, err := migrator.PendingMigrations()
+		if err != nil {
+			renderError(c, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+			return
+		}
+
+		pendingNames := []string{}
+		for _, migration := range pending {
+			pendingNames = append(pendingNames, migration.Name)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"version": version, "pending": pendingNames})
+	})
+
+	admin.POST("/migrate", func(c *gin.Context) {
+		migrator, ok := cacheMigrator(cache)
+		if !ok {
+			renderError(c, http.StatusNotImplemented, ErrorCodeNotImplemented, "Cache has no schema migrations")
+			return
+		}
+
+		applied, err := migrator.Migrate()
+		if err != nil {
+			fmt.Println(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": apiError(ErrorCodeInternal, err.Error()), "applied": applied})
+			return
+		}
+
+		version, _ := migrator.SchemaVersion()
+		c.JSON(http.StatusOK, gin.H{"version": version, "applied": applied})
+	})
+
+	r.GET("/search", func(c *gin.Context) {
+		query := strings.TrimSpace(c.Query("q"))
+		if query == "" {
+			renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, "Missing q")
+			return
+		}
+
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(config.defaultLimit(FormatJson))))
+		if err != nil || limit <= 0 {
+			renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, "Invalid limit")
+			return
+		}
+
+		results, err := cache.SearchPosts(query, capLimit(limit, config.HardLimit))
+		if err != nil {
+			fmt.Println(err)
+			renderError(c, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+			return
+		}
+
+		items := []gin.H{}
+		for _, result := range results {
+			item := gin.H{
+				"channel":   result.Channel,
+				"header":    result.Post.Header,
+				"content":   result.Post.Content,
+				"link":      displayLink(result.Post.Link, config.LinkDomain),
+				"createdAt": result.Post.CreatedAt,
+			}
+			if config.ContentHtml {
+				item["contentHtml"] = result.Post.ContentHtml
+			}
+			items = append(items, item)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"results": items})
+	})
+
+	r.GET("/combined", func(c *gin.Context) {
+		var channelNames []string
+		for _, name := range strings.Split(c.Query("channels"), ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				channelNames = append(channelNames, aliases.resolve(name))
+			}
+		}
+		if len(channelNames) == 0 {
+			renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, "Missing channels")
+			return
+		}
+
+		_, format, err := parseChannelFormat("", c.DefaultQuery("format", FormatRss))
+		if err != nil {
+			renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(config.defaultLimit(format))))
+		if err != nil || limit <= 0 {
+			renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, "Invalid limit")
+			return
+		}
+
+		perChannel, err := strconv.Atoi(c.DefaultQuery("perchannel", strconv.Itoa(limit)))
+		if err != nil || perChannel <= 0 {
+			renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, "Invalid perchannel")
+			return
+		}
+
+		var channels []DbChannel
+		for _, name := range channelNames {
+			channel, err := cache.GetChannel(name)
+			if errors.Is(err, sql.ErrNoRows) {
+				renderError(c, http.StatusNotFound, ErrorCodeChannelNotFound, "Channel is not cached: "+name)
+				return
+			} else if err != nil {
+				fmt.Println(err)
+				renderError(c, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+				return
+			}
+			channels = append(channels, channel)
+		}
+
+		posts, err := combinedPosts(cache, channels, capLimit(perChannel, config.HardLimit), capLimit(limit, config.HardLimit), config.FilterRules)
+		if err != nil {
+			fmt.Println(err)
+			renderError(c, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+			return
+		}
+
+		combined := DbChannel{
+			Name:        strings.Join(channelNames, ", "),
+			Link:        tgChannelFeedUrl(channels[0].Name),
+			Description: "Posts of " + strings.Join(channelNames, ", "),
+		}
+		feed := generateFeed(combined, posts, FeedOptions{
+			Location:         config.Location,
+			ContentTemplate:  config.ContentTemplate,
+			TitleIds:         config.TitleIds,
+			LinkDomain:       config.LinkDomain,
+			FeedLink:         config.FeedLink,
+			IncludeReactions: config.IncludeReactions,
+			TextOnly:         config.TextOnly,
+			CollapseSameTime: config.CollapseSameTime,
+			SplitContent:     config.SplitContent,
+			EditedMarker:     config.EditedMarker,
+		})
+
+		config.processFeed(feed)
+		c.Header("Content-Type", feedContentType(format))
+		c.Status(http.StatusOK)
+		if err := writeFeed(flushWriter{c.Writer}, feed, format, config.TTL, config.MediaRss); err != nil {
+			fmt.Printf("Can't write feed: %s\n", err)
+		}
+	})
+
+	r.GET("/:channel", func(c *gin.Context) {
+		start := time.Now()
+		channelName := c.Param("channel")
+
+		channelName, format, err := parseChannelFormat(channelName, c.DefaultQuery("format", FormatRss))
+		if err != nil {
+			renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+		channelName = aliases.resolve(channelName)
+
+		options := FeedOptions{
+			SortBy:              c.DefaultQuery("sort", SortByCreated),
+			Location:            config.Location,
+			ContentTemplate:     config.ContentTemplate,
+			TitleIds:            config.TitleIds,
+			FetchOrder:          config.FetchOrder,
+			CollapseSameTime:    config.CollapseSameTime,
+			DescriptionFallback: config.DescriptionFallback,
+			LinkDomain:          config.LinkDomain,
+			FeedLink:            config.FeedLink,
+			IncludeReactions:    config.IncludeReactions,
+			SplitContent:        config.SplitContent,
+			EditedMarker:        config.EditedMarker,
+			Enclosures:          config.Enclosures,
+			LeanStorage:         config.LeanStorage,
+			Contents:            contents,
+			PinnedFirst:         config.PinnedFirst,
+			KeepNameCase:        config.KeepNameCase,
+			Filters:             config.FilterRules,
+			FetchLimit:          config.FetchLimit,
+			ServeLimit:          capLimit(config.MaxPosts, config.HardLimit),
+		}
+		if options.SortBy != SortByCreated && options.SortBy != SortByFirstSeen {
+			renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, "Invalid sort")
+			return
+		}
+
+		if minViews := c.Query("minviews"); minViews != "" {
+			options.MinViews, err = strconv.Atoi(minViews)
+			if err != nil || options.MinViews < 0 {
+				renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, "Invalid minviews")
+				return
+			}
+		}
+
+		cachedOnly, err := strconv.ParseBool(c.DefaultQuery("cached", "false"))
+		if err != nil {
+			renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, "Invalid cached")
+			return
+		}
+
+		options.TextOnly, err = strconv.ParseBool(c.DefaultQuery("textonly", strconv.FormatBool(config.TextOnly)))
+		if err != nil {
+			renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, "Invalid textonly")
+			return
+		}
+
+		options.MediaOnly, err = strconv.ParseBool(c.DefaultQuery("mediaonly", "false"))
+		if err != nil {
+			renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, "Invalid mediaonly")
+			return
+		}
+
+		page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+		if err != nil || page < 1 {
+			renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, "Invalid page")
+			return
+		}
+
+		var feed *feeds.Feed
+		cacheStatus := FeedCacheOnly
+		if page > 1 {
+			// Older pages are only cached posts.
+			feed, err = cachedFeedPage(channelName, cache, fetcher, limiter, options, page)
+		} else if cachedOnly {
+			// Nothing is fetched, lean posts only get the contents kept.
+			feed, err = cachedFeed(channelName, cache, nil, limiter, options)
+		} else {
+			var started bool
+			if config.AsyncFetch {
+				started, err = coldFetches.start(channelName, cache, func() error {
+					_, err := prepareFeed(channelName, cache, fetcher, limiter, options)
+					return err
+				})
+			}
+			if started {
+				c.Header("Retry-After", strconv.Itoa(ASYNC_FETCH_RETRY_AFTER))
+				c.JSON(http.StatusAccepted, gin.H{"status": "fetching"})
+				return
+			}
+
+			var result FeedResult
+			if err == nil {
+				result, err = prepareFeed(channelName, cache, fetcher, limiter, options)
+			}
+			if err == nil {
+				feed = result.Feed
+				cacheStatus = recordFeedResult(c, result)
+			} else if config.ServeStale && isStaleable(err) {
+				if stale, staleErr := cachedFeed(channelName, cache, fetcher, limiter, options); staleErr == nil {
+					fmt.Printf("[%s] Serving cached feed, fetch failed: %s\n", channelName, err)
+					c.Header(STALE_HEADER, "true")
+					c.Header("Warning", STALE_WARNING)
+					feed, err, cacheStatus = stale, nil, FeedCacheStale
+				}
+			}
+		}
+		if errors.Is(err, ErrCircuitOpen) {
+			c.Header(DEGRADED_HEADER, "circuit-open")
+			cacheStatus = FeedCacheDegraded
+			feed, err = cachedFeed(channelName, cache, fetcher, limiter, options)
+			if errors.Is(err, sql.ErrNoRows) {
+				if breaker, ok := fetcher.(*CircuitBreaker); ok {
+					c.Header("Retry-After", strconv.Itoa(breaker.RetryAfter()))
+				}
+				renderError(c, http.StatusServiceUnavailable, ErrorCodeTelegramUnavailable, ErrCircuitOpen.Error())
+				return
+			}
+		}
+
+		if errors.Is(err, sql.ErrNoRows) {
+			renderError(c, http.StatusNotFound, ErrorCodeChannelNotFound, "Channel is not cached")
+			return
+		} else if errors.Is(err, ErrPageNotFound) {
+			renderError(c, http.StatusNotFound, ErrorCodeNotFound, err.Error())
+			return
+		} else if errors.Is(err, ErrChannelPreviewOnly) {
+			renderError(c, http.StatusNotFound, ErrorCodeChannelNotFound, err.Error())
+			return
+		} else if errors.Is(err, ErrChannelRestricted) {
+			renderError(c, http.StatusUnavailableForLegalReasons, ErrorCodeChannelRestricted, err.Error())
+			return
+		} else if errors.Is(err, ErrAsyncFetchesFull) {
+			c.Header("Retry-After", strconv.Itoa(ASYNC_FETCH_RETRY_AFTER))
+			renderError(c, http.StatusServiceUnavailable, ErrorCodeFetchBusy, err.Error())
+			return
+		} else if errors.Is(err, ErrFetchBusy) {
+			c.Header("Retry-After", strconv.Itoa(limiter.RetryAfter()))
+			renderError(c, http.StatusServiceUnavailable, ErrorCodeFetchBusy, err.Error())
+			return
+		} else if errors.Is(err, ErrTelegramUnavailable) {
+			renderError(c, http.StatusBadGateway, ErrorCodeTelegramUnavailable, err.Error())
+			return
+		} else if err != nil {
+			fmt.Println(err)
+			renderError(c, http.StatusBadGateway, ErrorCodeFetchFailed, err.Error())
+			return
+		}
+
+		links, err := feedPageLinks(channelName, cache, page, options.serveLimit(), func(page int) string { return pageUrl(c, page) })
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			fmt.Printf("Can't link feed pages: %s\n", err)
+		}
+
+		config.processFeed(feed)
+		c.Header("Content-Type", feedContentType(format))
+		c.Status(http.StatusOK)
+		if err := writeFeedPage(flushWriter{c.Writer}, feed, format, config.TTL, config.MediaRss, links); err != nil {
+			fmt.Printf("Can't write feed: %s\n", err)
+		}
+
+		config.FeedLog.Log(ServedFeed{
+			Channel:  channelName,
+			Format:   format,
+			Items:    len(feed.Items),
+			Cache:    cacheStatus,
+			Bytes:    c.Writer.Size(),
+			Duration: time.Since(start),
+		})
+	})
+
+	r.GET("/:channel/topic/:topicId", func(c *gin.Context) {
+		channelName := aliases.resolve(c.Param("channel"))
+
+		topicId, err := strconv.Atoi(c.Param("topicId"))
+		if err != nil || topicId <= 0 {
+			renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, "Invalid topic id")
+			return
+		}
+
+		_, format, err := parseChannelFormat("", c.DefaultQuery("format", FormatRss))
+		if err != nil {
+			renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+
+		feed, err := prepareTopicFeed(channelName, topicId, cache, fetcher, limiter, FeedOptions{
+			Location:         config.Location,
+			ContentTemplate:  config.ContentTemplate,
+			TitleIds:         config.TitleIds,
+			LinkDomain:       config.LinkDomain,
+			FeedLink:         config.FeedLink,
+			IncludeReactions: config.IncludeReactions,
+			TextOnly:         config.TextOnly,
+			CollapseSameTime: config.CollapseSameTime,
+			SplitContent:     config.SplitContent,
+			EditedMarker:     config.EditedMarker,
+			LeanStorage:      config.LeanStorage,
+			Contents:         contents,
+			Filters:          config.FilterRules,
+		})
+		if errors.Is(err, ErrChannelNotForum) || errors.Is(err, ErrChannelPreviewOnly) {
+			renderError(c, http.StatusNotFound, ErrorCodeChannelNotFound, err.Error())
+			return
+		} else if errors.Is(err, ErrChannelRestricted) {
+			renderError(c, http.StatusUnavailableForLegalReasons, ErrorCodeChannelRestricted, err.Error())
+			return
+		} else if errors.Is(err, ErrTopicsUnsupported) {
+			renderError(c, http.StatusNotImplemented, ErrorCodeNotImplemented, err.Error())
+			return
+		} else if errors.Is(err, ErrFetchBusy) {
+			c.Header("Retry-After", strconv.Itoa(limiter.RetryAfter()))
+			renderError(c, http.StatusServiceUnavailable, ErrorCodeFetchBusy, err.Error())
+			return
+		} else if errors.Is(err, ErrCircuitOpen) {
+			if breaker, ok := fetcher.(*CircuitBreaker); ok {
+				c.Header("Retry-After", strconv.Itoa(breaker.RetryAfter()))
+			}
+			renderError(c, http.StatusServiceUnavailable, ErrorCodeTelegramUnavailable, err.Error())
+			return
+		} else if errors.Is(err, ErrTelegramUnavailable) {
+			renderError(c, http.StatusBadGateway, ErrorCodeTelegramUnavailable, err.Error())
+			return
+		} else if err != nil {
+			fmt.Println(err)
+			renderError(c, http.StatusBadGateway, ErrorCodeFetchFailed, err.Error())
+			return
+		}
+
+		config.processFeed(feed)
+		c.Header("Content-Type", feedContentType(format))
+		c.Status(http.StatusOK)
+		if err := writeFeed(flushWriter{c.Writer}, feed, format, config.TTL, config.MediaRss); err != nil {
+			fmt.Printf("Can't write feed: %s\n", err)
+		}
+	})
+
+	r.GET("/:channel/post/:postId", func(c *gin.Context) {
+		channelName := aliases.resolve(c.Param("channel"))
+
+		postId, err := strconv.Atoi(c.Param("postId"))
+		if err != nil || postId <= 0 {
+			renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, "Invalid post id")
+			return
+		}
+
+		_, format, err := parseChannelFormat("", c.DefaultQuery("format", FormatRss))
+		if err != nil {
+			renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+
+		feed, err := preparePostFeed(channelName, postId, fetcher, limiter, FeedOptions{
+			Location:         config.Location,
+			ContentTemplate:  config.ContentTemplate,
+			TitleIds:         config.TitleIds,
+			LinkDomain:       config.LinkDomain,
+			FeedLink:         config.FeedLink,
+			IncludeReactions: config.IncludeReactions,
+			TextOnly:         config.TextOnly,
+			SplitContent:     config.SplitContent,
+			EditedMarker:     config.EditedMarker,
+			Filters:          config.FilterRules,
+		})
+		if errors.Is(err, ErrFetchBusy) {
+			c.Header("Retry-After", strconv.Itoa(limiter.RetryAfter()))
+			renderError(c, http.StatusServiceUnavailable, ErrorCodeFetchBusy, err.Error())
+			return
+		} else if errors.Is(err, ErrCircuitOpen) {
+			if breaker, ok := fetcher.(*CircuitBreaker); ok {
+				c.Header("Retry-After", strconv.Itoa(breaker.RetryAfter()))
+			}
+			renderError(c, http.StatusServiceUnavailable, ErrorCodeTelegramUnavailable, err.Error())
+			return
+		} else if errors.Is(err, ErrTelegramUnavailable) {
+			renderError(c, http.StatusBadGateway, ErrorCodeTelegramUnavailable, err.Error())
+			return
+		} else if err != nil {
+			// Deleted, private and missing posts all come back as an
+			// error message on the embed page.
+			renderError(c, http.StatusNotFound, ErrorCodeNotFound, err.Error())
+			return
+		}
+
+		config.processFeed(feed)
+		c.Header("Content-Type", feedContentType(format))
+		c.Status(http.StatusOK)
+		if err := writeFeed(flushWriter{c.Writer}, feed, format, config.TTL, config.MediaRss); err != nil {
+			fmt.Printf("Can't write feed: %s\n", err)
+		}
+	})
+
+	if config.DebugEndpoints {
+		r.GET("/:channel/diff", func(c *gin.Context) {
+			diff, err := diffChannel(aliases.resolve(c.Param("channel")), cache, fetcher, limiter)
+			if errors.Is(err, sql.ErrNoRows) {
+				renderError(c, http.StatusNotFound, ErrorCodeChannelNotFound, "Channel is not cached")
+				return
+			} else if errors.Is(err, ErrChannelPreviewOnly) {
+				renderError(c, http.StatusNotFound, ErrorCodeChannelNotFound, err.Error())
+				return
+			} else if errors.Is(err, ErrChannelRestricted) {
+				renderError(c, http.StatusUnavailableForLegalReasons, ErrorCodeChannelRestricted, err.Error())
+				return
+			} else if errors.Is(err, ErrFetchBusy) {
+				c.Header("Retry-After", strconv.Itoa(limiter.RetryAfter()))
+				renderError(c, http.StatusServiceUnavailable, ErrorCodeFetchBusy, err.Error())
+				return
+			} else if errors.Is(err, ErrTelegramUnavailable) || errors.Is(err, ErrCircuitOpen) {
+				renderError(c, http.StatusBadGateway, ErrorCodeTelegramUnavailable, err.Error())
+				return
+			} else if err != nil {
+				fmt.Println(err)
+				renderError(c, http.StatusBadGateway, ErrorCodeFetchFailed, err.Error())
+				return
+			}
+
+			c.JSON(http.StatusOK, diff)
+		})
+	}
+
+	r.GET("/:channel/archive.html", func(c *gin.Context) {
+		order := c.DefaultQuery("order", "newest")
+		if order != "newest" && order != "oldest" {
+			renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, "Invalid order")
+			return
+		}
+
+		page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+		if err != nil || page < 1 {
+			renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, "Invalid page")
+			return
+		}
+
+		channel, err := cache.GetChannel(aliases.resolve(c.Param("channel")))
+		if errors.Is(err, sql.ErrNoRows) {
+			renderError(c, http.StatusNotFound, ErrorCodeChannelNotFound, "Channel is not cached")
+			return
+		} else if err != nil {
+			fmt.Println(err)
+			renderError(c, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+			return
+		}
+
+		// One extra post tells whether there is a next page.
+		posts, err := cache.GetPostsPage(channel.Id, (page-1)*ARCHIVE_PAGE_SIZE, ARCHIVE_PAGE_SIZE+1, order == "oldest")
+		if err != nil {
+			fmt.Println(err)
+			renderError(c, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+			return
+		}
+
+		var previousPage, nextPage int
+		if page > 1 {
+			previousPage = page - 1
+		}
+		if len(posts) > ARCHIVE_PAGE_SIZE {
+			posts = posts[:ARCHIVE_PAGE_SIZE]
+			nextPage = page + 1
+		}
+
+		channel.Link = displayLink(channel.Link, config.LinkDomain)
+		for i := range posts {
+			posts[i].Link = displayLink(posts[i].Link, config.LinkDomain)
+			if config.Location != nil {
+				posts[i].CreatedAt = posts[i].CreatedAt.In(config.Location)
+			}
+		}
+
+		// Archive pages of large channels are rendered whole, so range
+		// requests can resume or fetch parts of them. The ETag lets
+		// If-Range tell when the page changed in between.
+		var body bytes.Buffer
+		err = archiveTemplate.Execute(&body, gin.H{
+			"Channel":      channel,
+			"Posts":        posts,
+			"Order":        order,
+			"PreviousPage": previousPage,
+			"NextPage":     nextPage,
+		})
+		if err != nil {
+			fmt.Printf("Can't render archive of %s: %s\n", channel.Name, err)
+			renderError(c, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+			return
+		}
+
+		sum := sha256.Sum256(body.Bytes())
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		c.Header("ETag", `"`+hex.EncodeToString(sum[:8])+`"`)
+		http.ServeContent(c.Writer, c.Request, "archive.html", time.Time{}, bytes.NewReader(body.Bytes()))
+	})
+
+	r.POST("/:channel/config", func(c *gin.Context) {
+		var channelConfig ChannelConfig
+		if err := c.ShouldBindJSON(&channelConfig); err != nil {
+			renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+
+		channel, err := cache.GetChannel(aliases.resolve(c.Param("channel")))
+		if errors.Is(err, sql.ErrNoRows) {
+			renderError(c, http.StatusNotFound, ErrorCodeChannelNotFound, "Channel not found")
+			return
+		} else if err != nil {
+			fmt.Println(err)
+			renderError(c, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+			return
+		}
+
+		if channelConfig.RefreshInterval != nil {
+			var interval time.Duration
+			if *channelConfig.RefreshInterval != "" {
+				interval, err = time.ParseDuration(*channelConfig.RefreshInterval)
+				if err != nil || interval <= 0 {
+					renderError(c, http.StatusBadRequest, ErrorCodeInvalidRequest, "Invalid refreshInterval")
+					return
+				}
+			}
+
+			if err := cache.UpdateRefreshInterval(channel.Id, interval); err != nil {
+				fmt.Println(err)
+				renderError(c, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+				return
+			}
+		}
+
+		if channelConfig.Title != nil {
+			if err := cache.UpdateTitleOverride(channel.Id, strings.TrimSpace(*channelConfig.Title)); err != nil {
+				fmt.Println(err)
+				renderError(c, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+				return
+			}
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	return r
+}
+
+// Migrator is implemented by caches with a versioned schema.
+type Migrator interface {
+	SchemaVersion() (int, error)
+	PendingMigrations() ([]Migration, error)
+	Migrate() ([]string, error)
+}
+
+// cacheMigrator finds the Migrator of a cache, looking through decorators
+// that implement Unwrap.
+func cacheMigrator(cache Cache) (Migrator, bool) {
+	for {
+		if migrator, ok := cache.(Migrator); ok {
+			return migrator, true
+		}
+
+		wrapper, ok := cache.(interface{ Unwrap() Cache })
+		if !ok {
+			return nil, false
+		}
+		cache = wrapper.Unwrap()
+	}
+}
+
+// durationBuckets are the upper bounds of durationHistogram buckets.
+var durationBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// durationHistogram is an expvar.Var counting durations in cumulative
+// buckets, rendered as {"count": ..., "sum": ..., "buckets": {"0.001": ...}}
+// with seconds as units.
+type durationHistogram struct {
+	mu     sync.Mutex
+	count  int64
+	sum    time.Duration
+	counts []int64
+}
+
+func newDurationHistogram() *durationHistogram {
+	return &durationHistogram{counts: make([]int64, len(durationBuckets))}
+}
+
+func (histogram *durationHistogram) Observe(duration time.Duration) {
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+
+	histogram.count++
+	histogram.sum += duration
+	for i, bound := range durationBuckets {
+		if duration <= bound {
+			histogram.counts[i]++
+		}
+	}
+}
+
+func (histogram *durationHistogram) Count() int64 {
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+	return histogram.count
+}
+
+func (histogram *durationHistogram) String() string {
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+
+	buckets := map[string]int64{"+Inf": histogram.count}
+	for i, bound := range durationBuckets {
+		buckets[strconv.FormatFloat(bound.Seconds(), 'f', -1, 64)] = histogram.counts[i]
+	}
+
+	encoded, _ := json.Marshal(map[string]any{
+		"count":   histogram.count,
+		"sum":     histogram.sum.Seconds(),
+		"buckets": buckets,
+	})
+	return string(encoded)
+}
+
+var dbQueryDurationsMu sync.Mutex
+
+// dbQueryHistogram returns the histogram of a Cache operation, creating it
+// on first use.
+func dbQueryHistogram(operation string) *durationHistogram {
+	dbQueryDurationsMu.Lock()
+	defer dbQueryDurationsMu.Unlock()
+
+	if histogram, ok := dbQueryDurations.Get(operation).(*durationHistogram); ok {
+		return histogram
+	}
+	histogram := newDurationHistogram()
+	dbQueryDurations.Set(operation, histogram)
+	return histogram
+}
+
+// MetricsCache times the operations of another Cache, exporting them as
+// db_query_duration_seconds on /metrics.
+type MetricsCache struct {
+	Cache
+}
+
+func NewMetricsCache(cache Cache) *MetricsCache {
+	return &MetricsCache{Cache: cache}
+}
+
+func (cache *MetricsCache) Unwrap() Cache {
+	return cache.Cache
+}
+
+func (cache *MetricsCache) observe(operation string, start time.Time) {
+	dbQueryHistogram(operation).Observe(time.Since(start))
+}
+
+func (cache *MetricsCache) GetChannel(name string) (DbChannel, error) {
+	defer cache.observe("GetChannel", time.Now())
+	return cache.Cache.GetChannel(name)
+}
+
+func (cache *MetricsCache) GetChannels() ([]DbChannel, error) {
+	defer cache.observe("GetChannels", time.Now())
+	return cache.Cache.GetChannels()
+}
+
+func (cache *MetricsCache) SaveChannel(channel Channel) (DbChannel, error) {
+	defer cache.observe("SaveChannel", time.Now())
+	return cache.Cache.SaveChannel(channel)
+}
+
+func (cache *MetricsCache) RenameChannel(channelId int, name string, link string) error {
+	defer cache.observe("RenameChannel", time.Now())
+	return cache.Cache.RenameChannel(channelId, name, link)
+}
+
+func (cache *MetricsCache) UpdateLastPostId(channelId int, lastPostId int) error {
+	defer cache.observe("UpdateLastPostId", time.Now())
+	return cache.Cache.UpdateLastPostId(channelId, lastPostId)
+}
+
+func (cache *MetricsCache) UpdateTitleOverride(channelId int, title string) error {
+	defer cache.observe("UpdateTitleOverride", time.Now())
+	return cache.Cache.UpdateTitleOverride(channelId, title)
+}
+
+func (cache *MetricsCache) UpdateRefreshInterval(channelId int, interval time.Duration) error {
+	defer cache.observe("UpdateRefreshInterval", time.Now())
+	return cache.Cache.UpdateRefreshInterval(channelId, interval)
+}
+
+func (cache *MetricsCache) UpdateNewestPostAt(channelId int, newestPostAt time.Time) error {
+	defer cache.observe("UpdateNewestPostAt", time.Now())
+	return cache.Cache.UpdateNewestPostAt(channelId, newestPostAt)
+}
+
+func (cache *MetricsCache) UpdateValidators(channelId int, validators PageValidators) error {
+	defer cache.observe("UpdateValidators", time.Now())
+	return cache.Cache.UpdateValidators(channelId, validators)
+}
+
+func (cache *MetricsCache) UpdatePinnedId(channelId int, pinnedId int) error {
+	defer cache.observe("UpdatePinnedId", time.Now())
+	return cache.Cache.UpdatePinnedId(channelId, pinnedId)
+}
+
+func (cache *MetricsCache) UpdatePageState(channelId int, state PageState) error {
+	defer cache.observe("UpdatePageState", time.Now())
+	return cache.Cache.UpdatePageState(channelId, state)
+}
+
+func (cache *MetricsCache) UpdateRefreshSchedule(channelId int, postIntervalEma time.Duration, nextRefreshAt time.Time) error {
+	defer cache.observe("UpdateRefreshSchedule", time.Now())
+	return cache.Cache.UpdateRefreshSchedule(channelId, postIntervalEma, nextRefreshAt)
+}
+
+func (cache *MetricsCache) GetPosts(channelId int, count int) ([]DbPost, error) {
+	defer cache.observe("GetPosts", time.Now())
+	return cache.Cache.GetPosts(channelId, count)
+}
+
+func (cache *MetricsCache) GetPostsPage(channelId int, offset int, count int, oldestFirst bool) ([]DbPost, error) {
+	defer cache.observe("GetPostsPage", time.Now())
+	return cache.Cache.GetPostsPage(channelId, offset, count, oldestFirst)
+}
+
+func (cache *MetricsCache) GetPostsById(channelId int, messageIds []int) ([]DbPost, error) {
+	defer cache.observe("GetPostsById", time.Now())
+	return cache.Cache.GetPostsById(channelId, messageIds)
+}
+
+func (cache *MetricsCache) SavePosts(channelId int, posts []Post) ([]DbPost, error) {
+	defer cache.observe("SavePosts", time.Now())
+	return cache.Cache.SavePosts(channelId, posts)
+}
+
+func (cache *MetricsCache) GetNewestPostTime(channelId int) (time.Time, error) {
+	defer cache.observe("GetNewestPostTime", time.Now())
+	return cache.Cache.GetNewestPostTime(channelId)
+}
+
+func (cache *MetricsCache) CountPosts(channelId int) (int, error) {
+	defer cache.observe("CountPosts", time.Now())
+	return cache.Cache.CountPosts(channelId)
+}
+
+func (cache *MetricsCache) UpdatePostViews(channelId int, views map[int]int) error {
+	defer cache.observe("UpdatePostViews", time.Now())
+	return cache.Cache.UpdatePostViews(channelId, views)
+}
+
+func (cache *MetricsCache) UpdateEditedPosts(channelId int, posts []Post) error {
+	defer cache.observe("UpdateEditedPosts", time.Now())
+	return cache.Cache.UpdateEditedPosts(channelId, posts)
+}
+
+func (cache *MetricsCache) UpdatePostComments(channelId int, posts []Post) error {
+	defer cache.observe("UpdatePostComments", time.Now())
+	return cache.Cache.UpdatePostComments(channelId, posts)
+}
+
+func (cache *MetricsCache) PrunePosts(channelId int, olderThan time.Time, keepMin int) (int, error) {
+	defer cache.observe("PrunePosts", time.Now())
+	return cache.Cache.PrunePosts(channelId, olderThan, keepMin)
+}
+
+func (cache *MetricsCache) SearchPosts(query string, limit int) ([]SearchResult, error) {
+	defer cache.observe("SearchPosts", time.Now())
+	return cache.Cache.SearchPosts(query, limit)
+}
+
+func (cache *MetricsCache) GetAliases() (map[string]string, error) {
+	defer cache.observe("GetAliases", time.Now())
+	return cache.Cache.GetAliases()
+}
+
+func (cache *MetricsCache) SaveAlias(alias string, channelName string) error {
+	defer cache.observe("SaveAlias", time.Now())
+	return cache.Cache.SaveAlias(alias, channelName)
+}
+
+func (cache *MetricsCache) Ping() error {
+	defer cache.observe("Ping", time.Now())
+	return cache.Cache.Ping()
+}
+
+// LimitCache caps the number of posts read from another Cache, so a
+// crafted limit can't load a whole channel into memory.
+type LimitCache struct {
+	Cache
+	limit int
+}
+
+func NewLimitCache(cache Cache, limit int) *LimitCache {
+	return &LimitCache{Cache: cache, limit: limit}
+}
+
+func (cache *LimitCache) Unwrap() Cache {
+	return cache.Cache
+}
+
+func (cache *LimitCache) GetPosts(channelId int, count int) ([]DbPost, error) {
+	return cache.Cache.GetPosts(channelId, capLimit(count, cache.limit))
+}
+
+func (cache *LimitCache) GetPostsPage(channelId int, offset int, count int, oldestFirst bool) ([]DbPost, error) {
+	return cache.Cache.GetPostsPage(channelId, offset, capLimit(count, cache.limit), oldestFirst)
+}
+
+func (cache *LimitCache) SearchPosts(query string, limit int) ([]SearchResult, error) {
+	return cache.Cache.SearchPosts(query, capLimit(limit, cache.limit))
+}
+
+// LeanCache stores posts in another Cache with only their metadata: the
+// link, times, header, views, author, edited flag and comment count.
+// Contents, formatted contents, media, reactions and top comments are
+// dropped to keep the database small, and hydratePosts fetches them back
+// when a feed is built.
+type LeanCache struct {
+	Cache
+}
+
+func NewLeanCache(cache Cache) *LeanCache {
+	return &LeanCache{Cache: cache}
+}
+
+func (cache *LeanCache) Unwrap() Cache {
+	return cache.Cache
+}
+
+func (cache *LeanCache) SavePosts(channelId int, posts []Post) ([]DbPost, error) {
+	return cache.Cache.SavePosts(channelId, leanPosts(posts))
+}
+
+func (cache *LeanCache) UpdateEditedPosts(channelId int, posts []Post) error {
+	return cache.Cache.UpdateEditedPosts(channelId, leanPosts(posts))
+}
+
+func (cache *LeanCache) UpdatePostComments(channelId int, posts []Post) error {
+	return cache.Cache.UpdatePostComments(channelId, leanPosts(posts))
+}
+
+func leanPosts(posts []Post) []Post {
+	lean := make([]Post, len(posts))
+	for i, post := range posts {
+		lean[i] = Post{
+			Header:    post.Header,
+			Link:      post.Link,
+			CreatedAt: post.CreatedAt,
+			MessageId: post.MessageId,
+			Views:     post.Views,
+			Author:    post.Author,
+			Edited:    post.Edited,
+			Comments:  post.Comments,
+		}
+	}
+	return lean
+}
+
+// capLimit lowers limit to hardLimit, a zero hardLimit doesn't cap it.
+func capLimit(limit int, hardLimit int) int {
+	if hardLimit > 0 && limit > hardLimit {
+		return hardLimit
+	}
+	return limit
+}
+
+// LoggingCache logs the operations of another Cache with their durations
+// and errors.
+type LoggingCache struct {
+	Cache
+	out io.Writer
+}
+
+func NewLoggingCache(cache Cache, out io.Writer) *LoggingCache {
+	return &LoggingCache{Cache: cache, out: out}
+}
+
+func (cache *LoggingCache) Unwrap() Cache {
+	return cache.Cache
+}
+
+func (cache *LoggingCache) log(operation string, start time.Time, err error) {
+	if err != nil {
+		fmt.Fprintf(cache.out, "[cache] %s failed after %s: %s\n", operation, time.Since(start), err)
+		return
+	}
+	fmt.Fprintf(cache.out, "[cache] %s took %s\n", operation, time.Since(start))
+}
+
+func (cache *LoggingCache) GetChannel(name string) (channel DbChannel, err error) {
+	defer func(start time.Time) { cache.log("GetChannel", start, err) }(time.Now())
+	return cache.Cache.GetChannel(name)
+}
+
+func (cache *LoggingCache) GetChannels() (channels []DbChannel, err error) {
+	defer func(start time.Time) { cache.log("GetChannels", start, err) }(time.Now())
+	return cache.Cache.GetChannels()
+}
+
+func (cache *LoggingCache) SaveChannel(channel Channel) (dbChannel DbChannel, err error) {
+	defer func(start time.Time) { cache.log("SaveChannel", start, err) }(time.Now())
+	return cache.Cache.SaveChannel(channel)
+}
+
+func (cache *LoggingCache) RenameChannel(channelId int, name string, link string) (err error) {
+	defer func(start time.Time) { cache.log("RenameChannel", start, err) }(time.Now())
+	return cache.Cache.RenameChannel(channelId, name, link)
+}
+
+func (cache *LoggingCache) UpdateLastPostId(channelId int, lastPostId int) (err error) {
+	defer func(start time.Time) { cache.log("UpdateLastPostId", start, err) }(time.Now())
+	return cache.Cache.UpdateLastPostId(channelId, lastPostId)
+}
+
+func (cache *LoggingCache) UpdateTitleOverride(channelId int, title string) (err error) {
+	defer func(start time.Time) { cache.log("UpdateTitleOverride", start, err) }(time.Now())
+	return cache.Cache.UpdateTitleOverride(channelId, title)
+}
+
+func (cache *LoggingCache) UpdateRefreshInterval(channelId int, interval time.Duration) (err error) {
+	defer func(start time.Time) { cache.log("UpdateRefreshInterval", start, err) }(time.Now())
+	return cache.Cache.UpdateRefreshInterval(channelId, interval)
+}
+
+func (cache *LoggingCache) UpdateNewestPostAt(channelId int, newestPostAt time.Time) (err error) {
+	defer func(start time.Time) { cache.log("UpdateNewestPostAt", start, err) }(time.Now())
+	return cache.Cache.UpdateNewestPostAt(channelId, newestPostAt)
+}
+
+func (cache *LoggingCache) UpdateValidators(channelId int, validators PageValidators) (err error) {
+	defer func(start time.Time) { cache.log("UpdateValidators", start, err) }(time.Now())
+	return cache.Cache.UpdateValidators(channelId, validators)
+}
+
+func (cache *LoggingCache) UpdatePinnedId(channelId int, pinnedId int) (err error) {
+	defer func(start time.Time) { cache.log("UpdatePinnedId", start, err) }(time.Now())
+	return cache.Cache.UpdatePinnedId(channelId, pinnedId)
+}
+
+func (cache *LoggingCache) UpdatePageState(channelId int, state PageState) (err error) {
+	defer func(start time.Time) { cache.log("UpdatePageState", start, err) }(time.Now())
+	return cache.Cache.UpdatePageState(channelId, state)
+}
+
+func (cache *LoggingCache) UpdateRefreshSchedule(channelId int, postIntervalEma time.Duration, nextRefreshAt time.Time) (err error) {
+	defer func(start time.Time) { cache.log("UpdateRefreshSchedule", start, err) }(time.Now())
+	return cache.Cache.UpdateRefreshSchedule(channelId, postIntervalEma, nextRefreshAt)
+}
+
+func (cache *LoggingCache) GetPosts(channelId int, count int) (posts []DbPost, err error) {
+	defer func(start time.Time) { cache.log("GetPosts", start, err) }(time.Now())
+	return cache.Cache.GetPosts(channelId, count)
+}
+
+func (cache *LoggingCache) GetPostsPage(channelId int, offset int, count int, oldestFirst bool) (posts []DbPost, err error) {
+	defer func(start time.Time) { cache.log("GetPostsPage", start, err) }(time.Now())
+	return cache.Cache.GetPostsPage(channelId, offset, count, oldestFirst)
+}
+
+func (cache *LoggingCache) GetPostsById(channelId int, messageIds []int) (posts []DbPost, err error) {
+	defer func(start time.Time) { cache.log("GetPostsById", start, err) }(time.Now())
+	return cache.Cache.GetPostsById(channelId, messageIds)
+}
+
+func (cache *LoggingCache) SavePosts(channelId int, posts []Post) (savedPosts []DbPost, err error) {
+	defer func(start time.Time) { cache.log("SavePosts", start, err) }(time.Now())
+	return cache.Cache.SavePosts(channelId, posts)
+}
+
+func (cache *LoggingCache) GetNewestPostTime(channelId int) (createdAt time.Time, err error) {
+	defer func(start time.Time) { cache.log("GetNewestPostTime", start, err) }(time.Now())
+	return cache.Cache.GetNewestPostTime(channelId)
+}
+
+func (cache *LoggingCache) CountPosts(channelId int) (count int, err error) {
+	defer func(start time.Time) { cache.log("CountPosts", start, err) }(time.Now())
+	return cache.Cache.CountPosts(channelId)
+}
+
+func (cache *LoggingCache) UpdatePostViews(channelId int, views map[int]int) (err error) {
+	defer func(start time.Time) { cache.log("UpdatePostViews", start, err) }(time.Now())
+	return cache.Cache.UpdatePostViews(channelId, views)
+}
+
+func (cache *LoggingCache) UpdateEditedPosts(channelId int, posts []Post) (err error) {
+	defer func(start time.Time) { cache.log("UpdateEditedPosts", start, err) }(time.Now())
+	return cache.Cache.UpdateEditedPosts(channelId, posts)
+}
+
+func (cache *LoggingCache) UpdatePostComments(channelId int, posts []Post) (err error) {
+	defer func(start time.Time) { cache.log("UpdatePostComments", start, err) }(time.Now())
+	return cache.Cache.UpdatePostComments(channelId, posts)
+}
+
+func (cache *LoggingCache) PrunePosts(channelId int, olderThan time.Time, keepMin int) (deleted int, err error) {
+	defer func(start time.Time) { cache.log("PrunePosts", start, err) }(time.Now())
+	return cache.Cache.PrunePosts(channelId, olderThan, keepMin)
+}
+
+func (cache *LoggingCache) SearchPosts(query string, limit int) (results []SearchResult, err error) {
+	defer func(start time.Time) { cache.log("SearchPosts", start, err) }(time.Now())
+	return cache.Cache.SearchPosts(query, limit)
+}
+
+func (cache *LoggingCache) GetAliases() (aliases map[string]string, err error) {
+	defer func(start time.Time) { cache.log("GetAliases", start, err) }(time.Now())
+	return cache.Cache.GetAliases()
+}
+
+func (cache *LoggingCache) SaveAlias(alias string, channelName string) (err error) {
+	defer func(start time.Time) { cache.log("SaveAlias", start, err) }(time.Now())
+	return cache.Cache.SaveAlias(alias, channelName)
+}
+
+func (cache *LoggingCache) Ping() (err error) {
+	defer func(start time.Time) { cache.log("Ping", start, err) }(time.Now())
+	return cache.Cache.Ping()
+}
+
+type SqliteCache struct {
+	db *sql.DB
+
+	// fts is set when the posts_fts full-text index is available.
+	fts bool
+
+	// writes queues writes beyond the allowed number of concurrent ones,
+	// see PoolOptions.MaxWriters. Reads don't wait for it.
+	writes *WriteLock
+}
+
+// NewSqliteCache serializes writes unless maxWriters allows more of them
+// at once. SQLite has a single writer anyway, so concurrent writes from
+// refreshes, warmups and requests would otherwise collide on the file
+// lock and spin in the driver's busy handler instead of queueing.
+func NewSqliteCache(db *sql.DB, maxWriters int) *SqliteCache {
+	fts, err := ftsAvailable(db)
+	if err != nil {
+		fmt.Printf("Can't check FTS5 support: %s\n", err)
+	}
+
+	return &SqliteCache{db: db, fts: fts, writes: NewWriteLock(maxWriters)}
+}
+
+// Writes returns the lock the cache writes under, for other writers to
+// the same database such as the FetchQueue and Maintenance.
+func (cache *SqliteCache) Writes() *WriteLock {
+	return cache.writes
+}
+
+func (cache *SqliteCache) lockWrites() {
+	cache.writes.Lock()
+}
+
+func (cache *SqliteCache) unlockWrites() {
+	cache.writes.Unlock()
+}
+
+// WriteLock lets a number of writers to a database write at once and
+// queues the others. A nil WriteLock doesn't queue them.
+type WriteLock struct {
+	slots chan struct{}
+
+	// all keeps two LockAll calls from each taking part of the slots.
+	all sync.Mutex
+}
+
+func NewWriteLock(maxWriters int) *WriteLock {
+	if maxWriters <= 0 {
+		maxWriters = 1
+	}
+	return &WriteLock{slots: make(chan struct{}, maxWriters)}
+}
+
+// Lock waits for a write slot.
+func (lock *WriteLock) Lock() {
+	if lock != nil {
+		lock.slots <- struct{}{}
+	}
+}
+
+func (lock *WriteLock) Unlock() {
+	if lock != nil {
+		<-lock.slots
+	}
+}
+
+// LockAll waits for every write slot, so nothing else writes until
+// UnlockAll, e.g. during a VACUUM.
+func (lock *WriteLock) LockAll() {
+	if lock == nil {
+		return
+	}
+	lock.all.Lock()
+	for i := 0; i < cap(lock.slots); i++ {
+		lock.slots <- struct{}{}
+	}
+}
+
+func (lock *WriteLock) UnlockAll() {
+	if lock == nil {
+		return
+	}
+	for i := 0; i < cap(lock.slots); i++ {
+		<-lock.slots
+	}
+	lock.all.Unlock()
+}
+
+// cacheWriteLock finds the WriteLock of a SQLite cache, looking through
+// decorators that implement Unwrap. Other backends have none.
+func cacheWriteLock(cache Cache) *WriteLock {
+	for {
+		if sqliteCache, ok := cache.(*SqliteCache); ok {
+			return sqliteCache.Writes()
+		}
+
+		wrapper, ok := cache.(interface{ Unwrap() Cache })
+		if !ok {
+			return nil
+		}
+		cache = wrapper.Unwrap()
+	}
+}
+
+const channelColumns = "id, name, title, lastId, link, description, refreshInterval, newestPostAt, postIntervalEma, nextRefreshAt, titleOverride, etag, lastModified, pinnedId, pageState"
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanChannel(row rowScanner) (DbChannel, error) {
+	var channel DbChannel
+	var refreshInterval sql.NullInt64
+	var newestPostAt, nextRefreshAt sql.NullTime
+	var postIntervalEma, pinnedId sql.NullInt64
+	var titleOverride, etag, lastModified, pageState sql.NullString
+	err := row.Scan(&channel.Id, &channel.Name, &channel.Title, &channel.LastId, &channel.Link, &channel.Description, &refreshInterval, &newestPostAt, &postIntervalEma, &nextRefreshAt, &titleOverride, &etag, &lastModified, &pinnedId, &pageState)
+	if refreshInterval.Valid {
+		channel.RefreshInterval = time.Duration(refreshInterval.Int64) * time.Second
+	}
+	channel.NewestPostAt = newestPostAt.Time
+	channel.PostIntervalEma = time.Duration(postIntervalEma.Int64) * time.Second
+	channel.NextRefreshAt = nextRefreshAt.Time
+	channel.TitleOverride = titleOverride.String
+	channel.Validators = PageValidators{ETag: etag.String, LastModified: lastModified.String}
+	channel.PinnedId = int(pinnedId.Int64)
+	if err == nil && pageState.Valid {
+		err = json.Unmarshal([]byte(pageState.String), &channel.PageState)
+	}
+	return channel, err
+}
+
+func (cache *SqliteCache) GetChannel(name string) (DbChannel, error) {
+	query := "SELECT " + channelColumns + " FROM channels WHERE name = ?"
+	return scanChannel(cache.db.QueryRow(query, name))
+}
+
+func (cache *SqliteCache) GetChannels() ([]DbChannel, error) {
+	channels := []DbChannel{}
+	query := "SELECT " + channelColumns + " FROM channels ORDER BY name"
+	rows, err := cache.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		channel, err := scanChannel(rows)
+		if err != nil {
+			return nil, err
+		}
+		channels = append(channels, channel)
+	}
+	return channels, rows.Err()
+}
+
+func (cache *SqliteCache) SaveChannel(channel Channel) (DbChannel, error) {
+	cache.lockWrites()
+	defer cache.unlockWrites()
+
+	query := `
+		INSERT INTO channels (name, title, lastId, link, description)
+		VALUES (?, ?, ?, ?, ?)`
+	res, err := cache.db.Exec(query, channel.Name, channel.Title, channel.LastId, channel.Link, channel.Description)
+
+	lastInsertId, err := res.LastInsertId()
+	if err != nil {
+		return DbChannel{}, err
+	}
+
+	dbChannel := DbChannel{
+		Id:          int(lastInsertId),
+		Name:        channel.Name,
+		Title:       channel.Title,
+		LastId:      channel.LastId,
+		Link:        channel.Link,
+		Description: channel.Description,
+	}
+
+	return dbChannel, err
+}
+
+func (cache *SqliteCache) RenameChannel(channelId int, name string, link string) error {
+	cache.lockWrites()
+	defer cache.unlockWrites()
+
+	_, err := cache.db.Exec("UPDATE channels SET name = ?, link = ? WHERE id = ?", name, link, channelId)
+	return err
+}
+
+func (cache *SqliteCache) UpdateLastPostId(channelId int, lastPostId int) error {
+	cache.lockWrites()
+	defer cache.unlockWrites()
+
+	query := "UPDATE channels SET lastId = ? WHERE id = ?"
+	_, err := cache.db.Exec(query, lastPostId, channelId)
+	return err
+}
+
+// UpdateRefreshInterval stores a per-channel refresh interval, zero resets
+// the channel to the global interval.
+func (cache *SqliteCache) UpdateRefreshInterval(channelId int, interval time.Duration) error {
+	cache.lockWrites()
+	defer cache.unlockWrites()
+
+	var value sql.NullInt64
+	if interval > 0 {
+		value = sql.NullInt64{Int64: int64(interval / time.Second), Valid: true}
+	}
+
+	query := "UPDATE channels SET refreshInterval = ? WHERE id = ?"
+	_, err := cache.db.Exec(query, value, channelId)
+	return err
+}
+
+// UpdateTitleOverride stores the title used in feeds instead of the scraped
+// one, empty removes the override. It's kept apart from the scraped title
+// so fetches don't overwrite it.
+func (cache *SqliteCache) UpdateTitleOverride(channelId int, title string) error {
+	cache.lockWrites()
+	defer cache.unlockWrites()
+
+	_, err := cache.db.Exec("UPDATE channels SET titleOverride = ? WHERE id = ?", nullString(title), channelId)
+	return err
+}
+
+func (cache *SqliteCache) UpdateNewestPostAt(channelId int, newestPostAt time.Time) error {
+	cache.lockWrites()
+	defer cache.unlockWrites()
+
+	var value sql.NullTime
+	if !newestPostAt.IsZero() {
+		value = sql.NullTime{Time: newestPostAt.UTC(), Valid: true}
+	}
+
+	query := "UPDATE channels SET newestPostAt = ? WHERE id = ?"
+	_, err := cache.db.Exec(query, value, channelId)
+	return err
+}
+
+func (cache *SqliteCache) UpdateValidators(channelId int, validators PageValidators) error {
+	cache.lockWrites()
+	defer cache.unlockWrites()
+
+	_, err := cache.db.Exec("UPDATE channels SET etag = ?, lastModified = ? WHERE id = ?", nullString(validators.ETag), nullString(validators.LastModified), channelId)
+	return err
+}
+
+func (cache *SqliteCache) UpdatePinnedId(channelId int, pinnedId int) error {
+	cache.lockWrites()
+	defer cache.unlockWrites()
+
+	_, err := cache.db.Exec("UPDATE channels SET pinnedId = ? WHERE id = ?", nullInt(pinnedId), channelId)
+	return err
+}
+
+func (cache *SqliteCache) UpdatePageState(channelId int, state PageState) error {
+	cache.lockWrites()
+	defer cache.unlockWrites()
+
+	encoded, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	_, err = cache.db.Exec("UPDATE channels SET pageState = ? WHERE id = ?", string(encoded), channelId)
+	return err
+}
+
+func (cache *SqliteCache) UpdateRefreshSchedule(channelId int, postIntervalEma time.Duration, nextRefreshAt time.Time) error {
+	cache.lockWrites()
+	defer cache.unlockWrites()
+
+	query := "UPDATE channels SET postIntervalEma = ?, nextRefreshAt = ? WHERE id = ?"
+	_, err := cache.db.Exec(query, nullInt(int(postIntervalEma/time.Second)), nextRefreshAt.UTC(), channelId)
+	return err
+}
+
+func (cache *SqliteCache) GetPosts(channelId int, count int) ([]DbPost, error) {
+	return cache.GetPostsPage(channelId, 0, count, false)
+}
+
+func (cache *SqliteCache) GetPostsPage(channelId int, offset int, count int, oldestFirst bool) ([]DbPost, error) {
+	order := "DESC"
+	if oldestFirst {
+		order = "ASC"
+	}
+
+	query := "SELECT " + postColumns + " FROM posts WHERE channelId = ? ORDER BY createdAt " + order + ", messageId " + order + " NULLS LAST, id " + order + " LIMIT ? OFFSET ?"
+	rows, err := cache.db.Query(query, channelId, count, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanPosts(rows, channelId)
+}
+
+func (cache *SqliteCache) GetPostsById(channelId int, messageIds []int) ([]DbPost, error) {
+	if len(messageIds) == 0 {
+		return []DbPost{}, nil
+	}
+
+	args := []any{channelId}
+	for _, id := range messageIds {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(messageIds)), ", ")
+	rows, err := cache.db.Query("SELECT "+postColumns+" FROM posts WHERE channelId = ? AND messageId IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanPosts(rows, channelId)
+}
+
+const postColumns = "id, header, content, link, createdAt, firstSeenAt, messageId, views, media, author, reactions, updatedAt, contentHtml, edited, comments, topComments"
+
+// scanPosts reads posts selected with postColumns.
+func scanPosts(rows *sql.Rows, channelId int) ([]DbPost, error) {
+	posts := []DbPost{}
+	for rows.Next() {
+		var post DbPost
+		var firstSeenAt, updatedAt sql.NullTime
+		var messageId, views, comments sql.NullInt64
+		var media, author, reactions, contentHtml, topComments sql.NullString
+		var edited sql.NullBool
+		err := rows.Scan(&post.Id, &post.Header, &post.Content, &post.Link, &post.CreatedAt, &firstSeenAt, &messageId, &views, &media, &author, &reactions, &updatedAt, &contentHtml, &edited, &comments, &topComments)
+		if err != nil {
+			return nil, err
+		}
+		post.Edited = edited.Bool
+		post.Comments = int(comments.Int64)
+		post.FirstSeenAt = firstSeenAt.Time
+		post.UpdatedAt = updatedAt.Time
+		post.ContentHtml = contentHtml.String
+		post.MessageId = int(messageId.Int64)
+		post.Views = int(views.Int64)
+		post.Author = author.String
+		if media.Valid {
+			if err := json.Unmarshal([]byte(media.String), &post.Media); err != nil {
+				return nil, err
+			}
+		}
+		if reactions.Valid {
+			if err := json.Unmarshal([]byte(reactions.String), &post.Reactions); err != nil {
+				return nil, err
+			}
+		}
+		if topComments.Valid {
+			if err := json.Unmarshal([]byte(topComments.String), &post.TopComments); err != nil {
+				return nil, err
+			}
+		}
+		post.ChannelId = channelId
+		posts = append(posts, post)
+	}
+	return posts, rows.Err()
+}
+
+func (cache *SqliteCache) SavePosts(channelId int, posts []Post) ([]DbPost, error) {
+	cache.lockWrites()
+	defer cache.unlockWrites()
+
+	tx, err := cache.db.Begin()
+	var savedPosts []DbPost
+
+	if err != nil {
+		return savedPosts, err
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO posts (header, content, link, createdAt, firstSeenAt, messageId, views, media, author, reactions, contentHtml, edited, comments, topComments, channelId) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return savedPosts, err
+	}
+	defer stmt.Close()
+
+	firstSeenAt := time.Now().UTC()
+	for _, post := range posts {
+		var media sql.NullString
+		if len(post.Media) > 0 {
+			encoded, err := json.Marshal(post.Media)
+			if err != nil {
+				tx.Rollback()
+				return savedPosts, err
+			}
+			media = sql.NullString{String: string(encoded), Valid: true}
+		}
+
+		var reactions sql.NullString
+		if len(post.Reactions) > 0 {
+			encoded, err := json.Marshal(post.Reactions)
+			if err != nil {
+				tx.Rollback()
+				return savedPosts, err
+			}
+			reactions = sql.NullString{String: string(encoded), Valid: true}
+		}
+
+		var topComments sql.NullString
+		if len(post.TopComments) > 0 {
+			encoded, err := json.Marshal(post.TopComments)
+			if err != nil {
+				tx.Rollback()
+				return savedPosts, err
+			}
+			topComments = sql.NullString{String: string(encoded), Valid: true}
+		}
+
+		res, err := stmt.Exec(post.Header, post.Content, post.Link, post.CreatedAt, firstSeenAt, nullInt(post.MessageId), nullInt(post.Views), media, nullString(post.Author), reactions, nullString(post.ContentHtml), post.Edited, nullInt(post.Comments), topComments, channelId)
+		if err != nil {
+			tx.Rollback()
+			return savedPosts, err
+		}
+
+		insertedId, err := res.LastInsertId()
+		if err != nil {
+			tx.Rollback()
+			return savedPosts, err
+		}
+
+		savedPost := DbPost{
+			Id:          int(insertedId),
+			Header:      post.Header,
+			Content:     post.Content,
+			Link:        post.Link,
+			CreatedAt:   post.CreatedAt,
+			FirstSeenAt: firstSeenAt,
+			MessageId:   post.MessageId,
+			Views:       post.Views,
+			Media:       post.Media,
+			Author:      post.Author,
+			Reactions:   post.Reactions,
+			ContentHtml: post.ContentHtml,
+			Edited:      post.Edited,
+			Comments:    post.Comments,
+			TopComments: post.TopComments,
+			ChannelId:   channelId,
+		}
+		savedPosts = append(savedPosts, savedPost)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return savedPosts, err
+	}
+
+	return savedPosts, nil
+}
+
+// UpdatePostViews refreshes view counts, which keep growing after a post is
+// cached, by Telegram message id.
+func (cache *SqliteCache) UpdatePostViews(channelId int, views map[int]int) error {
+	cache.lockWrites()
+	defer cache.unlockWrites()
+
+	tx, err := cache.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("UPDATE posts SET views = ? WHERE channelId = ? AND messageId = ?")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for messageId, count := range views {
+		if _, err := stmt.Exec(count, channelId, messageId); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (cache *SqliteCache) UpdateEditedPosts(channelId int, posts []Post) error {
+	cache.lockWrites()
+	defer cache.unlockWrites()
+
+	tx, err := cache.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("UPDATE posts SET header = ?, content = ?, media = ?, contentHtml = ?, edited = 1, updatedAt = ? WHERE channelId = ? AND messageId = ?")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	updatedAt := time.Now().UTC()
+	for _, post := range posts {
+		var media sql.NullString
+		if len(post.Media) > 0 {
+			encoded, err := json.Marshal(post.Media)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			media = sql.NullString{String: string(encoded), Valid: true}
+		}
+
+		if _, err := stmt.Exec(post.Header, post.Content, media, nullString(post.ContentHtml), updatedAt, channelId, post.MessageId); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (cache *SqliteCache) UpdatePostComments(channelId int, posts []Post) error {
+	cache.lockWrites()
+	defer cache.unlockWrites()
+
+	tx, err := cache.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("UPDATE posts SET comments = ?, topComments = ? WHERE channelId = ? AND messageId = ?")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, post := range posts {
+		var topComments sql.NullString
+		if len(post.TopComments) > 0 {
+			encoded, err := json.Marshal(post.TopComments)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			topComments = sql.NullString{String: string(encoded), Valid: true}
+		}
+
+		if _, err := stmt.Exec(nullInt(post.Comments), topComments, channelId, post.MessageId); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// PrunePosts compares the creation times in Go rather than in SQL, the
+// stored timestamps keep the offset they were parsed with.
+func (cache *SqliteCache) PrunePosts(channelId int, olderThan time.Time, keepMin int) (int, error) {
+	cache.lockWrites()
+	defer cache.unlockWrites()
+
+	rows, err := cache.db.Query("SELECT id, createdAt FROM posts WHERE channelId = ? ORDER BY createdAt DESC, messageId DESC NULLS LAST, id DESC", channelId)
+	if err != nil {
+		return 0, err
+	}
+
+	var ids []int
+	for kept := 0; rows.Next(); kept++ {
+		var id int
+		var createdAt time.Time
+		if err := rows.Scan(&id, &createdAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if kept >= keepMin && createdAt.Before(olderThan) {
+			ids = append(ids, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, err
+	}
+	rows.Close()
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	tx, err := cache.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.Prepare("DELETE FROM posts WHERE id = ?")
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	defer stmt.Close()
+
+	for _, id := range ids {
+		if _, err := stmt.Exec(id); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
+
+func nullInt(value int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(value), Valid: value != 0}
+}
+
+// nullString stores empty strings as NULL.
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
+
+func (cache *SqliteCache) GetNewestPostTime(channelId int) (time.Time, error) {
+	var createdAt time.Time
+	query := "SELECT createdAt FROM posts WHERE channelId = ? ORDER BY createdAt DESC LIMIT 1"
+	err := cache.db.QueryRow(query, channelId).Scan(&createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	return createdAt, err
+}
+
+func (cache *SqliteCache) CountPosts(channelId int) (int, error) {
+	var count int
+	err := cache.db.QueryRow("SELECT COUNT(*) FROM posts WHERE channelId = ?", channelId).Scan(&count)
+	return count, err
+}
+
+func (cache *SqliteCache) GetAliases() (map[string]string, error) {
+	rows, err := cache.db.Query("SELECT alias, channel FROM aliases")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aliases := map[string]string{}
+	for rows.Next() {
+		var alias, channelName string
+		if err := rows.Scan(&alias, &channelName); err != nil {
+			return nil, err
+		}
+		aliases[alias] = channelName
+	}
+	return aliases, rows.Err()
+}
+
+func (cache *SqliteCache) SaveAlias(alias string, channelName string) error {
+	cache.lockWrites()
+	defer cache.unlockWrites()
+
+	var err error
+	if channelName == "" {
+		_, err = cache.db.Exec("DELETE FROM aliases WHERE alias = ?", alias)
+	} else {
+		_, err = cache.db.Exec("INSERT OR REPLACE INTO aliases (alias, channel) VALUES (?, ?)", alias, channelName)
+	}
+	return err
+}
+
+func (cache *SqliteCache) Ping() error {
+	return cache.db.Ping()
+}
+
+func (cache *SqliteCache) Close() error {
+	return cache.db.Close()
+}
+
+func (cache *SqliteCache) SchemaVersion() (int, error) {
+	return schemaVersion(cache.db)
+}
+
+func (cache *SqliteCache) PendingMigrations() ([]Migration, error) {
+	return pendingMigrations(cache.db)
+}
+
+func (cache *SqliteCache) Migrate() ([]string, error) {
+	cache.lockWrites()
+	defer cache.unlockWrites()
+
+	return migrateDB(cache.db)
+}
+
+// SearchPosts finds cached posts of all channels matching the query. With
+// the full-text index results are ranked by relevance, otherwise it falls
+// back to a substring match ordered newest first.
+func (cache *SqliteCache) SearchPosts(query string, limit int) ([]SearchResult, error) {
+	var rows *sql.Rows
+	var err error
+
+	if cache.fts {
+		sqlQuery := `
+			SELECT channels.name, posts.id, posts.header, posts.content, posts.link, posts.createdAt, posts.channelId, posts.contentHtml
+			FROM posts_fts
+			JOIN posts ON posts.id = posts_fts.rowid
+			JOIN channels ON channels.id = posts.channelId
+			WHERE posts_fts MATCH ?
+			ORDER BY posts_fts.rank LIMIT ?`
+		rows, err = cache.db.Query(sqlQuery, ftsQuery(query), limit)
+	} else {
+		pattern := "%" + escapeLike(query) + "%"
+		sqlQuery := `
+			SELECT channels.name, posts.id, posts.header, posts.content, posts.link, posts.createdAt, posts.channelId, posts.contentHtml
+			FROM posts JOIN channels ON channels.id = posts.channelId
+			WHERE posts.header LIKE ? ESCAPE '\' OR posts.content LIKE ? ESCAPE '\'
+			ORDER BY posts.createdAt DESC, posts.messageId DESC NULLS LAST, posts.id DESC LIMIT ?`
+		rows, err = cache.db.Query(sqlQuery, pattern, pattern, limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var result SearchResult
+		post := &result.Post
+		var contentHtml sql.NullString
+		err := rows.Scan(&result.Channel, &post.Id, &post.Header, &post.Content, &post.Link, &post.CreatedAt, &post.ChannelId, &contentHtml)
+		if err != nil {
+			return nil, err
+		}
+		post.ContentHtml = contentHtml.String
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// ftsQuery quotes every term so user input is matched literally instead of
+// being parsed as FTS5 query syntax.
+func ftsQuery(query string) string {
+	var terms []string
+	for _, term := range strings.Fields(query) {
+		terms = append(terms, "\""+strings.ReplaceAll(term, "\"", "\"\"")+"\"")
+	}
+	return strings.Join(terms, " ")
+}
+
+func escapeLike(text string) string {
+	replacer := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_")
+	return replacer.Replace(text)
+}
+
+type Fetcher interface {
+	FetchChannel(channelName string) (Channel, error)
+	FetchPost(channelName string, id int) (Post, error)
+}
+
+// ConditionalFetcher is implemented by fetchers that can skip channel
+// pages that didn't change since the validators of the last fetch.
+type ConditionalFetcher interface {
+	// FetchChannelIfModified is FetchChannel failing with ErrNotModified
+	// when the page is unchanged.
+	FetchChannelIfModified(channelName string, validators PageValidators) (Channel, error)
+}
+
+// fetchChannelIfModified fetches the channel conditionally when fetcher
+// supports it, and in full otherwise.
+func fetchChannelIfModified(fetcher Fetcher, channelName string, validators PageValidators) (Channel, error) {
+	if conditional, ok := fetcher.(ConditionalFetcher); ok && !validators.IsZero() {
+		return conditional.FetchChannelIfModified(channelName, validators)
+	}
+	return fetcher.FetchChannel(channelName)
+}
+
+// TopicFetcher is implemented by fetchers that can scrape forum topics.
+type TopicFetcher interface {
+	FetchTopic(channelName string, topicId int) (ForumTopic, error)
+}
+
+// CommentsFetcher is implemented by fetchers that can fetch the comment
+// count and top comments of a post on their own, to refresh them.
+type CommentsFetcher interface {
+	FetchComments(channelName string, id int) (int, []Comment, error)
+}
+
+// ForumTopic is a topic thread of a forum group.
+type ForumTopic struct {
+	Title string
+	Link  string
+	// PostIds are the message ids on the topic page, newest first.
+	PostIds []int
+}
+
+type TelegramWebFetcher struct {
+	// Retries is how many times a request failing with
+	// ErrTelegramUnavailable is repeated. The first retry waits
+	// RetryBackoff, each next one twice as long, or as long as Telegram's
+	// Retry-After asks when that's longer.
+	Retries      int
+	RetryBackoff time.Duration
+
+	// Limiter is the FetchLimiter whose slot callers hold while fetching,
+	// it's given back while waiting to retry.
+	Limiter *FetchLimiter
+
+	// FullText replaces the text of posts truncated with "Show more" by
+	// their full text from the channel page.
+	FullText bool
+
+	// ContentHtml also extracts the formatted post text into
+	// Post.ContentHtml.
+	ContentHtml bool
+
+	// Comments fetches the discussion of every post for its comment count,
+	// an extra request per post. TopComments is how many of the first
+	// comments are kept with it.
+	Comments    bool
+	TopComments int
+
+	// Headers are added to every request to Telegram.
+	Headers http.Header
+
+	// Client sends the requests, nil uses http.DefaultClient.
+	Client *http.Client
+
+	mu              sync.Mutex
+	structureHashes map[string]string
+}
+
+// get is telegramGet with the fetcher's retries.
+func (fetcher *TelegramWebFetcher) get(url string) (*http.Response, error) {
+	return fetcher.getWithHeaders(url, fetcher.Headers)
+}
+
+func (fetcher *TelegramWebFetcher) getWithHeaders(url string, headers http.Header) (*http.Response, error) {
+	backoff := fetcher.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		resp, retryAfter, err := telegramRequest(fetcher.Client, url, headers)
+		if err == nil || attempt >= fetcher.Retries || !errors.Is(err, ErrTelegramUnavailable) || retryAfter > MAX_RETRY_AFTER {
+			return resp, err
+		}
+
+		wait := backoff
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		fmt.Printf("Retrying %s in %s: %s\n", url, wait, err)
+		fetcher.Limiter.Sleep(wait)
+		backoff *= 2
+	}
+}
+
+// MAX_RETRY_AFTER is the longest Retry-After of Telegram that is waited
+// for, requests asked to wait longer fail right away.
+const MAX_RETRY_AFTER = time.Minute
+
+// parseRetryAfter reads a Retry-After header, in seconds or an HTTP date.
+// It's zero when the header is missing or invalid.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(at); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// parseAge parses -maxpostage, a Go duration or a number of days like 90d.
+func parseAge(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		count, err := strconv.Atoi(days)
+		if err != nil || count < 0 {
+			return 0, fmt.Errorf("Invalid age %q", value)
+		}
+		return time.Duration(count) * 24 * time.Hour, nil
+	}
+
+	age, err := time.ParseDuration(value)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("Invalid age %q", value)
+	}
+	return age, nil
+}
+
+// headerName matches valid HTTP header names (RFC 7230 tokens).
+var headerName = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// parseFetchHeaders parses -fetchheaders, a JSON object of header names
+// to values, e.g. {"Accept-Language": "en-US,en;q=0.9"}.
+func parseFetchHeaders(value string) (http.Header, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var values map[string]string
+	if err := json.Unmarshal([]byte(value), &values); err != nil {
+		return nil, err
+	}
+
+	headers := http.Header{}
+	for name, value := range values {
+		if !headerName.MatchString(name) {
+			return nil, fmt.Errorf("Invalid header name %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("Invalid value of header %s", name)
+		}
+		headers.Set(name, value)
+	}
+	return headers, nil
+}
+
+// HttpClientOptions tunes the client of Telegram requests.
+type HttpClientOptions struct {
+	// Timeout limits a whole request including reading the body, 0 means
+	// no limit.
+	Timeout time.Duration
+	// MaxIdleConnsPerHost is how many keep-alive connections to t.me are
+	// kept open between requests.
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+}
+
+// newTelegramClient builds the client shared by all Telegram requests.
+// They all go to t.me, so the per-host idle pool decides how many
+// connections are reused; Go's default of 2 makes concurrent fetches open
+// and close a connection each.
+func newTelegramClient(options HttpClientOptions) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = options.MaxIdleConnsPerHost
+	if transport.MaxIdleConns < options.MaxIdleConnsPerHost {
+		transport.MaxIdleConns = options.MaxIdleConnsPerHost
+	}
+	transport.IdleConnTimeout = options.IdleConnTimeout
+	return &http.Client{Transport: transport, Timeout: options.Timeout}
+}
+
+// telegramGet requests a Telegram page, reporting transport errors, rate
+// limiting and server errors as ErrTelegramUnavailable.
+func telegramGet(client *http.Client, url string, headers http.Header) (*http.Response, error) {
+	resp, _, err := telegramRequest(client, url, headers)
+	return resp, err
+}
+
+// telegramRequest is telegramGet that also returns the Retry-After of
+// rate limited and unavailable responses.
+func telegramRequest(client *http.Client, url string, headers http.Header) (*http.Response, time.Duration, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %s", ErrTelegramUnavailable, err)
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError {
+		resp.Body.Close()
+		return nil, parseRetryAfter(resp.Header.Get("Retry-After")), fmt.Errorf("%w: %s", ErrTelegramUnavailable, resp.Status)
+	}
+	return resp, 0, nil
+}
+
+func (fetcher *TelegramWebFetcher) FetchChannel(channelName string) (Channel, error) {
+	return fetcher.FetchChannelIfModified(channelName, PageValidators{})
+}
+
+// FetchChannelIfModified sends If-None-Match and If-Modified-Since with
+// the validators, and doesn't parse the page when Telegram answers 304.
+func (fetcher *TelegramWebFetcher) FetchChannelIfModified(channelName string, validators PageValidators) (Channel, error) {
+	headers := fetcher.Headers
+	if !validators.IsZero() {
+		headers = headers.Clone()
+		if headers == nil {
+			headers = http.Header{}
+		}
+		if validators.ETag != "" {
+			headers.Set("If-None-Match", validators.ETag)
+		}
+		if validators.LastModified != "" {
+			headers.Set("If-Modified-Since", validators.LastModified)
+		}
+	}
+
+	url := tgChannelFeedUrl(channelName)
+	resp, err := fetcher.getWithHeaders(url, headers)
+	if err != nil {
+		fmt.Println(err)
+		return Channel{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return Channel{}, fmt.Errorf("%w: %s", ErrNotModified, channelName)
+	}
+	pageValidators := PageValidators{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
+
+	if canonical := canonicalChannelName(resp, channelName); canonical != channelName {
+		fmt.Printf("[%s] Channel was renamed to %s\n", channelName, canonical)
+		channelName, url = canonical, tgChannelFeedUrl(canonical)
+	}
+
+	structureHash := pageStructureHash(doc)
+	previousHash := fetcher.swapStructureHash(channelName, structureHash)
+	structureChanged := previousHash != "" && previousHash != structureHash
+	if structureChanged {
+		fmt.Printf("[%s] Page structure hash changed: %s -> %s\n", channelName, previousHash, structureHash)
+	}
+
+	var description, dataPost, title string
 	var split []string
 	var currentId int
+	var newestPostAt time.Time
+	views := map[int]int{}
+	var edited []int
+	var pinnedId, pinnedBy int
+	albums := map[int]Album{}
 	lastId := -1
 
-	doc.Find(".tgme_widget_message").Each(func(i int, s *goquery.Selection) {
-		dataPost, _ = s.Attr("data-post")
-		split = strings.Split(dataPost, "/")
-		currentId, _ = strconv.Atoi(split[1])
+	doc.Find(".tgme_widget_message").Each(func(i int, s *goquery.Selection) {
+		dataPost, _ = s.Attr("data-post")
+		split = strings.Split(dataPost, "/")
+		if len(split) != 2 {
+			fmt.Printf("[%s] Skipping message with malformed data-post %q\n", channelName, dataPost)
+			return
+		}
+		id, err := strconv.Atoi(split[1])
+		if err != nil || id <= 0 {
+			fmt.Printf("[%s] Skipping message with malformed data-post %q\n", channelName, dataPost)
+			return
+		}
+		currentId = id
+
+		if count := parseViews(s.Find(".tgme_widget_message_views").First().Text()); count > 0 {
+			views[currentId] = count
+		}
+		if isEdited(s) {
+			edited = append(edited, currentId)
+		}
+		if pinned := pinnedMessageId(s, channelName); pinned > 0 && currentId > pinnedBy {
+			pinnedId, pinnedBy = pinned, currentId
+		}
+		if album, ok := parseAlbum(s, channelName, currentId); ok {
+			albums[currentId] = album
+		}
+
+		if lastId == -1 || currentId > lastId {
+			lastId = currentId
+
+			datetime, _ := s.Find(".tgme_widget_message_date time").Attr("datetime")
+			newestPostAt, _ = time.Parse(time.RFC3339, datetime)
+		}
+	})
+
+	if lastId == -1 {
+		if notice, ok := restrictionNotice(doc.Selection); ok {
+			return Channel{}, fmt.Errorf("%w: %s: %s", ErrChannelRestricted, channelName, notice)
+		}
+		if doc.Find(".tgme_page").Length() > 0 {
+			return Channel{}, fmt.Errorf("%w: %s", ErrChannelPreviewOnly, channelName)
+		}
+		if structureChanged {
+			fmt.Printf("[%s] Warning: possible_parser_drift, page structure changed and no posts were parsed\n", channelName)
+			parserDriftCount.Add(1)
+		}
+		if doc.Find(".tgme_channel_info").Length() == 0 {
+			return Channel{}, errors.New("Can't parse channel page")
+		}
+
+		// A channel header without messages is a channel that hasn't
+		// posted yet.
+		lastId = 0
+	}
+
+	// Some RTL and localized pages render the title without the inner span.
+	doc.Find(".tgme_channel_info_header_title").Each(func(i int, s *goquery.Selection) {
+		if span := s.Find("span"); span.Length() > 0 {
+			title = span.Text()
+		} else {
+			title = strings.TrimSpace(s.Text())
+		}
+	})
+
+	doc.Find(".tgme_channel_info_description").Each(func(i int, s *goquery.Selection) {
+		description = s.Text()
+	})
+
+	channel := Channel{Name: channelName, Title: title, LastId: lastId, Link: url, Description: description, NewestPostAt: newestPostAt, Views: views, Edited: edited, PinnedId: pinnedId, Albums: albums, Validators: pageValidators}
+	return normalizeChannel(channel), nil
+}
+
+// normalizeChannel puts the title and description of a scraped channel in
+// Unicode NFC.
+func normalizeChannel(channel Channel) Channel {
+	channel.Title = norm.NFC.String(channel.Title)
+	channel.Description = norm.NFC.String(channel.Description)
+	return channel
+}
+
+// normalizePost puts the texts of a scraped post in Unicode NFC. Telegram
+// serves text in the form it was sent in, so the same words would otherwise
+// be stored, deduplicated and searched as different strings.
+func normalizePost(post Post) Post {
+	post.Header = norm.NFC.String(post.Header)
+	post.Content = norm.NFC.String(post.Content)
+	post.ContentHtml = norm.NFC.String(post.ContentHtml)
+	post.Author = norm.NFC.String(post.Author)
+	for i, comment := range post.TopComments {
+		post.TopComments[i] = Comment{Author: norm.NFC.String(comment.Author), Text: norm.NFC.String(comment.Text)}
+	}
+	return post
+}
+
+// canonicalChannelName is the username of the channel page that was
+// served, which differs from the requested one when Telegram redirected
+// the old username of a renamed channel. Case differences are ignored.
+func canonicalChannelName(resp *http.Response, channelName string) string {
+	if resp.Request == nil || resp.Request.URL == nil {
+		return channelName
+	}
+
+	path := strings.TrimPrefix(strings.Trim(resp.Request.URL.Path, "/"), "s/")
+	name, _, _ := strings.Cut(path, "/")
+	if !shardChannelName.MatchString(name) || strings.EqualFold(name, channelName) {
+		return channelName
+	}
+	return name
+}
+
+// FetchTopic scrapes the web preview of a forum topic. Messages of topics
+// are addressed as channel/topic/message, so a page with only
+// channel/message posts means the channel isn't a forum.
+func (fetcher *TelegramWebFetcher) FetchTopic(channelName string, topicId int) (ForumTopic, error) {
+	url := tgTopicFeedUrl(channelName, topicId)
+	resp, err := fetcher.get(url)
+	if err != nil {
+		fmt.Println(err)
+		return ForumTopic{}, err
+	}
+	defer resp.Body.Close()
+
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	if err != nil {
+		return ForumTopic{}, err
+	}
+
+	if notice, ok := restrictionNotice(doc.Selection); ok {
+		return ForumTopic{}, fmt.Errorf("%w: %s: %s", ErrChannelRestricted, channelName, notice)
+	}
+	if doc.Find(".tgme_page").Length() > 0 {
+		return ForumTopic{}, fmt.Errorf("%w: %s", ErrChannelPreviewOnly, channelName)
+	}
+
+	var ids []int
+	doc.Find(".tgme_widget_message").Each(func(i int, s *goquery.Selection) {
+		dataPost, _ := s.Attr("data-post")
+		split := strings.Split(dataPost, "/")
+		if len(split) != 3 || split[1] != strconv.Itoa(topicId) {
+			return
+		}
+		id, err := strconv.Atoi(split[2])
+		if err != nil || id <= 0 {
+			fmt.Printf("[%s] Skipping message with malformed data-post %q\n", channelName, dataPost)
+			return
+		}
+		ids = append(ids, id)
+	})
+
+	if len(ids) == 0 {
+		return ForumTopic{}, fmt.Errorf("%w: %s", ErrChannelNotForum, channelName)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+
+	var title string
+	doc.Find(".tgme_channel_info_header_title").Each(func(i int, s *goquery.Selection) {
+		title = strings.TrimSpace(s.Text())
+	})
+	if title == "" {
+		title = channelName
+	}
+
+	return ForumTopic{Title: title, Link: url, PostIds: ids}, nil
+}
+
+// isEdited reports whether a message is marked as edited, which Telegram
+// shows in the message meta next to the date.
+func isEdited(s *goquery.Selection) bool {
+	meta := strings.ToLower(s.Find(".tgme_widget_message_meta").First().Text())
+	return strings.Contains(meta, "edited")
+}
+
+// parseAlbum reads the album a channel page message shows. Every item of
+// the grouped layout links to its own message as <channel>/<id>?single.
+func parseAlbum(s *goquery.Selection, channelName string, id int) (Album, bool) {
+	grouped := s.Find(".tgme_widget_message_grouped_wrap")
+	if grouped.Length() == 0 {
+		return Album{}, false
+	}
+
+	album := Album{Media: parseMedia(grouped)}
+	grouped.Find("a[href]").Each(func(i int, link *goquery.Selection) {
+		href, _ := link.Attr("href")
+		if part := feedItemId(channelName, href); part > 0 && part != id {
+			album.Parts = append(album.Parts, part)
+		}
+	})
+	return album, true
+}
+
+// albumParts are the ids of the channel's album messages that are shown
+// with the album's first message rather than as posts of their own.
+func albumParts(channel Channel) map[int]bool {
+	parts := map[int]bool{}
+	for _, album := range channel.Albums {
+		for _, part := range album.Parts {
+			parts[part] = true
+		}
+	}
+	return parts
+}
+
+// mergeAlbum gives a post all media of its album, embeds of some album
+// messages show only their own item.
+func mergeAlbum(post *Post, channel Channel) {
+	if album, ok := channel.Albums[post.MessageId]; ok && len(album.Media) > len(post.Media) {
+		post.Media = album.Media
+	}
+}
+
+// pinnedMessageId is the message a pin service message links to, zero
+// for other messages. Telegram renders them as "<channel> pinned «<link>»".
+func pinnedMessageId(s *goquery.Selection, channelName string) int {
+	if !s.HasClass("service_message") || !strings.Contains(strings.ToLower(s.Text()), "pinned") {
+		return 0
+	}
+
+	var id int
+	s.Find("a[href]").EachWithBreak(func(i int, link *goquery.Selection) bool {
+		href, _ := link.Attr("href")
+		id = feedItemId(channelName, href)
+		return id == 0
+	})
+	return id
+}
+
+// parseViews parses view counts as Telegram renders them, e.g. "987",
+// "1.2K" or "3.4M". It returns zero for anything else.
+func parseViews(text string) int {
+	text = strings.TrimSpace(strings.ReplaceAll(text, ",", ""))
+	if text == "" {
+		return 0
+	}
+
+	multiplier := 1.0
+	switch strings.ToUpper(text[len(text)-1:]) {
+	case "K":
+		multiplier = 1e3
+	case "M":
+		multiplier = 1e6
+	case "B":
+		multiplier = 1e9
+	}
+	if multiplier != 1 {
+		text = text[:len(text)-1]
+	}
+
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil || value < 0 {
+		return 0
+	}
+	return int(math.Round(value * multiplier))
+}
+
+// swapStructureHash remembers the latest page structure hash of the channel
+// and returns the previous one, empty if the channel wasn't fetched before.
+func (fetcher *TelegramWebFetcher) swapStructureHash(channelName string, hash string) string {
+	fetcher.mu.Lock()
+	defer fetcher.mu.Unlock()
+
+	if fetcher.structureHashes == nil {
+		fetcher.structureHashes = map[string]string{}
+	}
+
+	previous := fetcher.structureHashes[channelName]
+	fetcher.structureHashes[channelName] = hash
+	return previous
+}
+
+// pageStructureHash hashes the set of CSS classes used on the page. It
+// ignores text and the number of messages, so it stays stable while the
+// channel posts and changes when Telegram changes the markup.
+func pageStructureHash(doc *goquery.Document) string {
+	classes := map[string]bool{}
+	doc.Find("[class]").Each(func(i int, s *goquery.Selection) {
+		class, _ := s.Attr("class")
+		for _, name := range strings.Fields(class) {
+			classes[name] = true
+		}
+	})
+
+	names := make([]string, 0, len(classes))
+	for name := range classes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sum := sha256.Sum256([]byte(strings.Join(names, " ")))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (fetcher *TelegramWebFetcher) FetchPost(channelName string, id int) (Post, error) {
+	url := tgChannelPostUrl(channelName, id)
+
+	resp, err := fetcher.get(url)
+	if err != nil {
+		fmt.Println(err)
+		return Post{}, err
+	}
+	defer resp.Body.Close()
+
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	if err != nil {
+		return Post{}, err
+	}
+
+	error_message := ""
+	doc.Find(".tgme_widget_message_error").Each(func(i int, s *goquery.Selection) {
+		error_message = s.Text()
+	})
+
+	if error_message != "" {
+		return Post{}, errors.New(error_message)
+	}
+
+	var content, contentHtml string
+	var truncated bool
+	doc.Find(".tgme_widget_message_text.js-message_text").Each(func(i int, s *goquery.Selection) {
+		more := s.Find(TEXT_MORE_SELECTOR)
+		truncated = more.Length() > 0
+		more.Remove()
+		content = s.Text()
+		if fetcher.ContentHtml {
+			contentHtml = messageHtml(s)
+		}
+	})
+
+	if truncated {
+		content = strings.TrimSpace(content)
+		fmt.Printf("[%s] Post %d is truncated\n", channelName, id)
+		if fetcher.FullText {
+			if message, err := fetcher.fetchFullText(channelName, id); err != nil {
+				fmt.Printf("[%s] Can't fetch full text of post %d: %s\n", channelName, id, err)
+			} else {
+				content = message.Text()
+				if fetcher.ContentHtml {
+					contentHtml = messageHtml(message)
+				}
+			}
+		}
+	}
+
+	var createdAt time.Time
+	layout := "2006-01-02T15:04:05Z07:00"
+
+	doc.Find(".tgme_widget_message_date").Each(func(i int, s *goquery.Selection) {
+		datetime, _ := s.Find("time").Attr("datetime")
+		createdAt, err = time.Parse(layout, datetime)
+		if err != nil {
+			fmt.Printf("err %s\n", err)
+		}
+	})
+
+	headerContent := postHeader(content)
+
+	// Sticker posts have no text, so they'd be blank items.
+	if strings.TrimSpace(content) == "" {
+		if emoji, ok := parseSticker(doc.Selection); ok {
+			content = "Sticker"
+			if emoji != "" {
+				content += ": " + emoji
+			}
+			headerContent = content
+		}
+	}
+
+	views := parseViews(doc.Find(".tgme_widget_message_views").First().Text())
+	media := parseMedia(doc.Selection)
+
+	// Voice and audio posts are often just the player.
+	if audio, duration, ok := parseAudio(doc.Selection); ok {
+		media = append(media, audio)
+		if strings.TrimSpace(content) == "" {
+			content = "🎵 Audio"
+			if audio.Type == MediaVoice {
+				content = "🎙 Voice message"
+			}
+			if duration != "" {
+				content += " (" + duration + ")"
+			}
+			headerContent = content
+		}
+	}
+	author := strings.TrimSpace(doc.Find(".tgme_widget_message_from_author").First().Text())
+	reactions := parseReactions(doc.Selection)
+
+	var comments int
+	var topComments []Comment
+	if fetcher.Comments {
+		comments, topComments, err = fetcher.fetchDiscussion(channelName, id)
+		if err != nil {
+			fmt.Printf("[%s] Can't fetch comments of post %d: %s\n", channelName, id, err)
+		}
+	}
+
+	return normalizePost(Post{Header: headerContent, Content: content, Link: url, CreatedAt: createdAt, MessageId: id, Views: views, Media: media, Author: author, Reactions: reactions, ContentHtml: contentHtml, Edited: isEdited(doc.Selection), Comments: comments, TopComments: topComments}), nil
+}
+
+// DISCUSSION_COUNT_SELECTOR matches the "N comments" header of the
+// discussion widget.
+const DISCUSSION_COUNT_SELECTOR = ".tgme_widget_discussion_header"
+
+// fetchDiscussion reads the comment count and the first TopComments
+// comments of a post from its discussion widget, the one Telegram embeds
+// under posts of channels with a linked discussion group. Posts without a
+// discussion have no comments rather than an error.
+func (fetcher *TelegramWebFetcher) fetchDiscussion(channelName string, id int) (int, []Comment, error) {
+	resp, err := fetcher.get(tgDiscussionUrl(channelName, id, fetcher.TopComments))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var comments []Comment
+	messages := doc.Find(".tgme_widget_message")
+	messages.Each(func(i int, s *goquery.Selection) {
+		if len(comments) >= fetcher.TopComments {
+			return
+		}
+		text := strings.TrimSpace(s.Find(".tgme_widget_message_text").First().Text())
+		if text == "" {
+			return
+		}
+		author := strings.TrimSpace(s.Find(".tgme_widget_message_author_name").First().Text())
+		comments = append(comments, Comment{Author: author, Text: text})
+	})
+
+	// The header counts all comments, the widget shows only a page of them.
+	count := messages.Length()
+	if header := doc.Find(DISCUSSION_COUNT_SELECTOR).First(); header.Length() > 0 {
+		fields := strings.Fields(header.Text())
+		if len(fields) > 0 {
+			if parsed := parseViews(fields[0]); parsed > 0 {
+				count = parsed
+			}
+		}
+	}
+	return count, comments, nil
+}
+
+// FetchComments refreshes the comments of a post, failing with
+// ErrCommentsUnsupported unless the fetcher fetches Comments.
+func (fetcher *TelegramWebFetcher) FetchComments(channelName string, id int) (int, []Comment, error) {
+	if !fetcher.Comments {
+		return 0, nil, ErrCommentsUnsupported
+	}
+	return fetcher.fetchDiscussion(channelName, id)
+}
+
+// TEXT_MORE_SELECTOR matches the "Show more" link of truncated post texts.
+const TEXT_MORE_SELECTOR = ".tgme_widget_message_text_more"
+
+// fetchFullText finds the text of a post on the channel page, which shows
+// long posts in full. The page is requested from just after the post so
+// it's on the page.
+func (fetcher *TelegramWebFetcher) fetchFullText(channelName string, id int) (*goquery.Selection, error) {
+	resp, err := fetcher.get(tgChannelFeedUrl(channelName) + "?before=" + strconv.Itoa(id+1))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	dataPost := channelName + "/" + strconv.Itoa(id)
+	var text *goquery.Selection
+	doc.Find(".tgme_widget_message").Each(func(i int, s *goquery.Selection) {
+		if value, _ := s.Attr("data-post"); !strings.EqualFold(value, dataPost) {
+			return
+		}
+
+		message := s.Find(".tgme_widget_message_text.js-message_text").Last()
+		if message.Length() == 0 || message.Find(TEXT_MORE_SELECTOR).Length() > 0 {
+			return
+		}
+		text = message
+	})
+
+	if text == nil {
+		return nil, errors.New("Full text is not on the channel page")
+	}
+	return text, nil
+}
+
+// messageHtmlTags are the formatting tags kept by messageHtml.
+var messageHtmlTags = map[string]bool{
+	"b": true, "strong": true, "i": true, "em": true, "u": true, "s": true,
+	"del": true, "code": true, "pre": true, "blockquote": true,
+}
+
+// messageHtml renders a post text with its formatting, keeping only
+// basic tags, line breaks and http(s) links. Telegram's classes, styles
+// and other tags are dropped, with their text kept.
+func messageHtml(s *goquery.Selection) string {
+	var html strings.Builder
+	writeMessageHtml(&html, s)
+	return strings.TrimSpace(html.String())
+}
+
+func writeMessageHtml(html *strings.Builder, s *goquery.Selection) {
+	s.Contents().Each(func(i int, node *goquery.Selection) {
+		name := goquery.NodeName(node)
+		href, _ := node.Attr("href")
+		switch {
+		case name == "#text":
+			html.WriteString(htmltemplate.HTMLEscapeString(node.Text()))
+		case name == "br":
+			html.WriteString("<br>")
+		case name == "script" || name == "style":
+		case node.HasClass("emoji"):
+			// Custom emoji are images with the emoji as their text.
+			html.WriteString(htmltemplate.HTMLEscapeString(node.Text()))
+		case name == "a" && (strings.HasPrefix(href, "https://") || strings.HasPrefix(href, "http://")):
+			html.WriteString(`<a href="` + htmltemplate.HTMLEscapeString(href) + `">`)
+			writeMessageHtml(html, node)
+			html.WriteString("</a>")
+		case messageHtmlTags[name]:
+			html.WriteString("<" + name + ">")
+			writeMessageHtml(html, node)
+			html.WriteString("</" + name + ">")
+		default:
+			writeMessageHtml(html, node)
+		}
+	})
+}
+
+// restrictionNotices are phrases of the notices Telegram shows instead of
+// restricted channels, matched in lower case.
+var restrictionNotices = []string{
+	"can’t be displayed",
+	"can't be displayed",
+	"is not available in your country",
+	"this channel is not available",
+}
+
+// restrictionNotice finds the notice of a restricted channel page. It's
+// only looked for on pages without messages, where it can't be mistaken
+// for post text.
+func restrictionNotice(s *goquery.Selection) (string, bool) {
+	var notice string
+	s.Find(".tgme_page_description, .tgme_channel_info_description, .tgme_widget_message_error, .tgme_channel_history").EachWithBreak(func(i int, s *goquery.Selection) bool {
+		text := strings.TrimSpace(s.Text())
+		for _, phrase := range restrictionNotices {
+			if strings.Contains(strings.ToLower(text), phrase) {
+				notice = text
+				return false
+			}
+		}
+		return true
+	})
+	return notice, notice != ""
+}
+
+// STICKER_SELECTOR matches static, animated and video stickers.
+const STICKER_SELECTOR = ".tgme_widget_message_sticker, .tgme_widget_message_tgsticker, .tgme_widget_message_videosticker"
+
+// parseSticker reports whether the post is a sticker, with the emoji the
+// sticker stands for when Telegram provides one.
+func parseSticker(s *goquery.Selection) (string, bool) {
+	sticker := s.Find(STICKER_SELECTOR).First()
+	if sticker.Length() == 0 {
+		return "", false
+	}
+
+	var emoji string
+	sticker.Find("*").AddBack().EachWithBreak(func(i int, item *goquery.Selection) bool {
+		for _, attr := range []string{"data-emoji", "alt", "title"} {
+			if value := strings.TrimSpace(item.AttrOr(attr, "")); value != "" {
+				emoji = value
+				return false
+			}
+		}
+		return true
+	})
+	return emoji, true
+}
+
+// parseReactions reads the reactions bar, where each .tgme_reaction is an
+// emoji followed by its count, e.g. "👍1.2K". Custom emoji without a
+// character are skipped.
+func parseReactions(s *goquery.Selection) []Reaction {
+	var reactions []Reaction
+	s.Find(".tgme_widget_message_reactions .tgme_reaction").Each(func(i int, item *goquery.Selection) {
+		emoji := strings.TrimSpace(item.Find(".emoji b").First().Text())
+		if emoji == "" {
+			return
+		}
+
+		count := parseViews(strings.TrimPrefix(strings.TrimSpace(item.Text()), emoji))
+		if count > 0 {
+			reactions = append(reactions, Reaction{Emoji: emoji, Count: count})
+		}
+	})
+	return reactions
+}
+
+// AUDIO_SELECTOR matches the players of voice messages and audio files.
+const AUDIO_SELECTOR = ".tgme_widget_message_voice_player, .tgme_widget_message_audio_player"
+
+// parseAudio reads the voice message or audio file of a post, with its
+// duration as Telegram shows it, e.g. "0:42".
+func parseAudio(s *goquery.Selection) (Media, string, bool) {
+	player := s.Find(AUDIO_SELECTOR).First()
+	src, _ := player.Find("audio").Attr("src")
+	if src == "" {
+		return Media{}, "", false
+	}
+
+	audio := Media{Type: MediaAudio, Url: src}
+	if player.HasClass("tgme_widget_message_voice_player") {
+		audio.Type = MediaVoice
+	}
+	duration := strings.TrimSpace(player.Find("time").First().Text())
+	return audio, duration, true
+}
+
+var backgroundImageUrl = regexp.MustCompile(`background-image:\s*url\(['"]?([^'")]+)['"]?\)`)
+
+// parseMedia collects photos and videos in document order. Albums render
+// each of their items as a separate photo or video wrap inside
+// .tgme_widget_message_grouped_wrap, so all of them are captured.
+func parseMedia(s *goquery.Selection) []Media {
+	var media []Media
+	s.Find(".tgme_widget_message_photo_wrap, .tgme_widget_message_video_player").Each(func(i int, item *goquery.Selection) {
+		if item.HasClass("tgme_widget_message_video_player") {
+			src, _ := item.Find("video").Attr("src")
+			if src == "" {
+				// Videos too big for the embed only have a thumbnail.
+				return
+			}
+			thumbnail := styleImageUrl(item.Find(".tgme_widget_message_video_thumb"))
+			media = append(media, Media{Type: MediaVideo, Url: src, Thumbnail: thumbnail})
+			return
+		}
+
+		if url := styleImageUrl(item); url != "" {
+			media = append(media, Media{Type: MediaPhoto, Url: url})
+		}
+	})
+	return media
+}
+
+// styleImageUrl returns the background image url of an element's inline
+// style, which is how Telegram embeds photos.
+func styleImageUrl(s *goquery.Selection) string {
+	style, _ := s.Attr("style")
+	match := backgroundImageUrl.FindStringSubmatch(style)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// postHeader is the start of long post texts, shown as the item title.
+// Short posts have no header.
+func postHeader(content string) string {
+	if len(content) > 100 {
+		return strings.Trim(content[0:100], " ") + "..."
+	}
+	return ""
+}
+
+// RSS_PROBE_INTERVAL is how long a channel without a readable feed is
+// fetched by the RssFetcher fallback before its feed is probed again.
+const RSS_PROBE_INTERVAL = time.Hour
+
+// MAX_RSS_CHANNELS bounds the channels an RssFetcher keeps feed posts and
+// probe times of, each is dropped as a whole when full.
+const MAX_RSS_CHANNELS = 1000
+
+// RssFetcher reads channels that publish their own RSS or Atom feed, so
+// their pages don't have to be scraped. The feed of a channel is probed at
+// UrlTemplate with SHARD_PATH_PLACEHOLDER replaced by its name. Channels
+// without a feed, and posts missing from it, are fetched with Fallback.
+//
+// Items are matched to messages by the t.me/<channel>/<id> in their link
+// or guid, items without one are skipped.
+type RssFetcher struct {
+	UrlTemplate string
+	Fallback    Fetcher
+
+	// Client sends the requests, nil uses http.DefaultClient.
+	Client *http.Client
+
+	// ContentHtml keeps the sanitized item HTML in Post.ContentHtml.
+	ContentHtml bool
+
+	mu       sync.Mutex
+	posts    map[string]map[int]Post
+	probedAt map[string]time.Time
+}
+
+type rssDocument struct {
+	Channel struct {
+		Title       string    `xml:"title"`
+		Description string    `xml:"description"`
+		Items       []rssItem `xml:"item"`
+	} `xml:"channel"`
+
+	// Atom feeds have their entries at the root.
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	Guid        string `xml:"guid"`
+	Description string `xml:"description"`
+	Content     string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	PubDate     string `xml:"pubDate"`
+	Author      string `xml:"http://purl.org/dc/elements/1.1/ creator"`
+}
+
+type atomEntry struct {
+	Id        string `xml:"id"`
+	Published string `xml:"published"`
+	Updated   string `xml:"updated"`
+	Summary   string `xml:"summary"`
+	Content   string `xml:"content"`
+	Links     []struct {
+		Href string `xml:"href,attr"`
+	} `xml:"link"`
+	Author struct {
+		Name string `xml:"name"`
+	} `xml:"author"`
+}
+
+var feedItemMessageId = regexp.MustCompile(`t\.me/(?:s/)?([A-Za-z0-9_]+)/(\d+)`)
+
+func (fetcher *RssFetcher) FetchChannel(channelName string) (Channel, error) {
+	fetcher.mu.Lock()
+	probedAt, probed := fetcher.probedAt[channelName]
+	fetcher.mu.Unlock()
+	if probed && time.Since(probedAt) < RSS_PROBE_INTERVAL {
+		return fetcher.Fallback.FetchChannel(channelName)
+	}
+
+	channel, posts, err := fetcher.readFeed(channelName)
+	if err != nil {
+		fmt.Printf("[%s] No readable feed, scraping the channel: %s\n", channelName, err)
+
+		fetcher.mu.Lock()
+		if fetcher.probedAt == nil || len(fetcher.probedAt) >= MAX_RSS_CHANNELS {
+			fetcher.probedAt = map[string]time.Time{}
+		}
+		fetcher.probedAt[channelName] = time.Now()
+		delete(fetcher.posts, channelName)
+		fetcher.mu.Unlock()
+
+		return fetcher.Fallback.FetchChannel(channelName)
+	}
+
+	fetcher.mu.Lock()
+	if fetcher.posts == nil || len(fetcher.posts) >= MAX_RSS_CHANNELS {
+		fetcher.posts = map[string]map[int]Post{}
+	}
+	fetcher.posts[channelName] = posts
+	delete(fetcher.probedAt, channelName)
+	fetcher.mu.Unlock()
+
+	return channel, nil
+}
+
+func (fetcher *RssFetcher) FetchPost(channelName string, id int) (Post, error) {
+	fetcher.mu.Lock()
+	post, ok := fetcher.posts[channelName][id]
+	fetcher.mu.Unlock()
+	if ok {
+		return post, nil
+	}
+	return fetcher.Fallback.FetchPost(channelName, id)
+}
+
+func (fetcher *RssFetcher) FetchTopic(channelName string, topicId int) (ForumTopic, error) {
+	topicFetcher, ok := fetcher.Fallback.(TopicFetcher)
+	if !ok {
+		return ForumTopic{}, ErrTopicsUnsupported
+	}
+	return topicFetcher.FetchTopic(channelName, topicId)
+}
+
+func (fetcher *RssFetcher) FetchComments(channelName string, id int) (int, []Comment, error) {
+	commentsFetcher, ok := fetcher.Fallback.(CommentsFetcher)
+	if !ok {
+		return 0, nil, ErrCommentsUnsupported
+	}
+	return commentsFetcher.FetchComments(channelName, id)
+}
+
+// readFeed fetches and parses the feed of a channel, keyed by message id.
+func (fetcher *RssFetcher) readFeed(channelName string) (Channel, map[int]Post, error) {
+	client := fetcher.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Get(strings.ReplaceAll(fetcher.UrlTemplate, SHARD_PATH_PLACEHOLDER, url.PathEscape(channelName)))
+	if err != nil {
+		return Channel{}, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Channel{}, nil, fmt.Errorf("Feed responded with %s", resp.Status)
+	}
+
+	var document rssDocument
+	if err := xml.NewDecoder(resp.Body).Decode(&document); err != nil {
+		return Channel{}, nil, err
+	}
+
+	channel := Channel{
+		Name:        channelName,
+		Title:       document.Channel.Title,
+		Link:        tgChannelFeedUrl(channelName),
+		Description: document.Channel.Description,
+	}
+	if channel.Title == "" {
+		channel.Title = document.Title
+		channel.Description = document.Subtitle
+	}
+
+	posts := map[int]Post{}
+	add := func(link string, body string, published string, author string) {
+		id := feedItemId(channelName, link)
+		if id == 0 {
+			return
+		}
+		createdAt, ok := parseFeedTime(published)
+		if !ok {
+			fmt.Printf("[%s] Invalid feed item time of post %d: %s\n", channelName, id, published)
+		}
+
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
+		if err != nil {
+			return
+		}
+		content := strings.TrimSpace(doc.Text())
+		post := Post{
+			Header:    postHeader(content),
+			Content:   content,
+			Link:      tgChannelPostUrl(channelName, id),
+			CreatedAt: createdAt,
+			MessageId: id,
+			Author:    strings.TrimSpace(author),
+		}
+		if fetcher.ContentHtml {
+			post.ContentHtml = messageHtml(doc.Find("body"))
+		}
+		posts[id] = normalizePost(post)
+
+		if id > channel.LastId {
+			channel.LastId = id
+		}
+		if createdAt.After(channel.NewestPostAt) {
+			channel.NewestPostAt = createdAt
+		}
+	}
+
+	for _, item := range document.Channel.Items {
+		body := item.Content
+		if body == "" {
+			body = item.Description
+		}
+		link := item.Link
+		if feedItemId(channelName, link) == 0 {
+			link = item.Guid
+		}
+		add(link, body, item.PubDate, item.Author)
+	}
+	for _, entry := range document.Entries {
+		body := entry.Content
+		if body == "" {
+			body = entry.Summary
+		}
+		published := entry.Published
+		if published == "" {
+			published = entry.Updated
+		}
+		link := entry.Id
+		for _, entryLink := range entry.Links {
+			if feedItemId(channelName, entryLink.Href) > 0 {
+				link = entryLink.Href
+			}
+		}
+		add(link, body, published, entry.Author.Name)
+	}
+
+	if len(posts) == 0 {
+		return Channel{}, nil, errors.New("Feed has no posts of the channel")
+	}
+	return normalizeChannel(channel), posts, nil
+}
+
+// feedItemId is the message id in a t.me link of the channel, 0 if link
+// isn't one.
+func feedItemId(channelName string, link string) int {
+	match := feedItemMessageId.FindStringSubmatch(link)
+	if match == nil || !strings.EqualFold(match[1], channelName) {
+		return 0
+	}
+	id, _ := strconv.Atoi(match[2])
+	return id
+}
+
+// parseFeedTime parses RSS and Atom dates.
+func parseFeedTime(value string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC1123Z, time.RFC1123, time.RFC3339} {
+		if parsed, err := time.Parse(layout, strings.TrimSpace(value)); err == nil {
+			return parsed.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// PoolOptions tunes the database connection pool and the SQLite settings
+// of its connections.
+type PoolOptions struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+
+	// CacheSize is the page cache of each connection in KiB, 0 keeps
+	// SQLite's default of 2 MiB.
+	CacheSize int
+	// MmapSize is how many bytes of the file each connection maps into
+	// memory, 0 keeps memory-mapped I/O off.
+	MmapSize int64
+
+	// MaxWriters is how many cache writes run at once, 0 means one.
+	MaxWriters int
+}
+
+// SHARD_PATH_PLACEHOLDER is replaced by the channel name in -dbpathtemplate.
+const SHARD_PATH_PLACEHOLDER = "{channel}"
+
+var shardChannelName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// SHARD_RENAME_SUFFIX marks the database file of a renamed channel, which
+// stays under its old path while it's open. The marker holds the new name
+// and the file is moved to it once no shard is open.
+const SHARD_RENAME_SUFFIX = ".renamed"
+
+// ShardedCache stores each channel in its own SQLite file, so large
+// archives aren't bound to a single database. Shards are opened on first
+// use and routed to by channel name. Every shard numbers its channels from
+// one, so ShardedCache hands out its own channel ids and maps them to the
+// shard's ones; they are stable while the process runs.
+type ShardedCache struct {
+	pathTemplate string
+	pool         PoolOptions
+	migrate      bool
+
+	mu      sync.Mutex
+	shards  map[string]*SqliteCache
+	ids     map[string]int
+	entries map[int]shardEntry
+	// renamed maps the old names of channels renamed since their shard was
+	// opened to the new ones.
+	renamed map[string]string
+}
+
+type shardEntry struct {
+	cache   *SqliteCache
+	localId int
+}
+
+// NewShardedCache creates a cache with a database per channel at
+// pathTemplate, a plain file path containing SHARD_PATH_PLACEHOLDER. With
+// migrate set, pending migrations are applied to shards when they're
+// opened.
+func NewShardedCache(pathTemplate string, pool PoolOptions, migrate bool) (*ShardedCache, error) {
+	if !strings.Contains(pathTemplate, SHARD_PATH_PLACEHOLDER) {
+		return nil, fmt.Errorf("Database path template %q has no %s", pathTemplate, SHARD_PATH_PLACEHOLDER)
+	}
+
+	cache := &ShardedCache{
+		pathTemplate: pathTemplate,
+		pool:         pool,
+		migrate:      migrate,
+		shards:       map[string]*SqliteCache{},
+		ids:          map[string]int{},
+		renamed:      map[string]string{},
+		entries:      map[int]shardEntry{},
+	}
+	// Renamed channels whose files weren't moved, e.g. on a crash.
+	cache.moveRenamedShards()
+	return cache, nil
+}
+
+func (cache *ShardedCache) shardPath(name string) string {
+	return strings.Replace(cache.pathTemplate, SHARD_PATH_PLACEHOLDER, name, 1)
+}
+
+// shard returns the database of a channel, opening it if needed. Unless
+// create is set, a missing database file is reported as sql.ErrNoRows.
+func (cache *ShardedCache) shard(name string, create bool) (*SqliteCache, error) {
+	if !shardChannelName.MatchString(name) {
+		return nil, fmt.Errorf("Invalid channel name %q", name)
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if shard, ok := cache.shards[name]; ok {
+		return shard, nil
+	}
+
+	path := cache.shardPath(name)
+	if !create {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			return nil, sql.ErrNoRows
+		}
+	}
+
+	db, err := initDB(path, cache.pool)
+	if err != nil {
+		return nil, err
+	}
+
+	if cache.migrate {
+		if _, err := migrateDB(db); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	shard := NewSqliteCache(db, cache.pool.MaxWriters)
+	cache.shards[name] = shard
+	return shard, nil
+}
+
+// register translates a shard's channel into one with a ShardedCache id.
+func (cache *ShardedCache) register(shard *SqliteCache, channel DbChannel) DbChannel {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	id, ok := cache.ids[channel.Name]
+	if !ok {
+		id = len(cache.ids) + 1
+		cache.ids[channel.Name] = id
+	}
+	cache.entries[id] = shardEntry{cache: shard, localId: channel.Id}
+
+	channel.Id = id
+	return channel
+}
+
+func (cache *ShardedCache) entry(channelId int) (shardEntry, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	entry, ok := cache.entries[channelId]
+	if !ok {
+		return shardEntry{}, fmt.Errorf("Unknown channel id %d", channelId)
+	}
+	return entry, nil
+}
+
+// names lists the channels that have a database file, renamed ones under
+// their new name.
+func (cache *ShardedCache) names() ([]string, error) {
+	prefix, suffix, _ := strings.Cut(cache.pathTemplate, SHARD_PATH_PLACEHOLDER)
+	paths, err := filepath.Glob(prefix + "*" + suffix)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	names := []string{}
+	for _, path := range paths {
+		name := strings.TrimSuffix(strings.TrimPrefix(path, prefix), suffix)
+		if renamed, ok := cache.renamed[name]; ok {
+			name = renamed
+		}
+		if shardChannelName.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (cache *ShardedCache) GetChannel(name string) (DbChannel, error) {
+	shard, err := cache.shard(name, false)
+	if err != nil {
+		return DbChannel{}, err
+	}
+
+	channel, err := shard.GetChannel(name)
+	if err != nil {
+		return channel, err
+	}
+	return cache.register(shard, channel), nil
+}
+
+func (cache *ShardedCache) GetChannels() ([]DbChannel, error) {
+	names, err := cache.names()
+	if err != nil {
+		return nil, err
+	}
+
+	channels := []DbChannel{}
+	for _, name := range names {
+		channel, err := cache.GetChannel(name)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		channels = append(channels, channel)
+	}
+	return channels, nil
+}
+
+func (cache *ShardedCache) SaveChannel(channel Channel) (DbChannel, error) {
+	shard, err := cache.shard(channel.Name, true)
+	if err != nil {
+		return DbChannel{}, err
+	}
+
+	dbChannel, err := shard.SaveChannel(channel)
+	if err != nil {
+		return dbChannel, err
+	}
+	return cache.register(shard, dbChannel), nil
+}
+
+// RenameChannel renames the channel in its database, which stays open under
+// the old path for the requests using it. A SHARD_RENAME_SUFFIX marker has
+// the file moved to the new path once the cache is closed or created again.
+func (cache *ShardedCache) RenameChannel(channelId int, name string, link string) error {
+	if !shardChannelName.MatchString(name) {
+		return fmt.Errorf("Invalid channel name %q", name)
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	entry, ok := cache.entries[channelId]
+	if !ok {
+		return fmt.Errorf("Unknown channel id %d", channelId)
+	}
+	var oldName string
+	for shardName, id := range cache.ids {
+		if id == channelId {
+			oldName = shardName
+		}
+	}
+	// A channel renamed before is still in the file of its first name.
+	fileName := oldName
+	for from, to := range cache.renamed {
+		if to == oldName {
+			fileName = from
+		}
+	}
+
+	oldPath, newPath := cache.shardPath(fileName), cache.shardPath(name)
+	if _, err := os.Stat(newPath); err == nil && !sameShardFile(oldPath, newPath) {
+		return fmt.Errorf("Channel %s already exists", name)
+	}
+	for from, to := range cache.renamed {
+		if to == name && from != fileName {
+			return fmt.Errorf("Channel %s already exists", name)
+		}
+	}
+
+	marker := oldPath + SHARD_RENAME_SUFFIX
+	if err := os.WriteFile(marker, []byte(name), 0o644); err != nil {
+		return err
+	}
+	if err := entry.cache.RenameChannel(entry.localId, name, link); err != nil {
+		if fileName != oldName {
+			os.WriteFile(marker, []byte(oldName), 0o644)
+		} else {
+			os.Remove(marker)
+		}
+		return err
+	}
+
+	// The old name keeps the shard too, so the file isn't opened twice. On
+	// case-insensitive file systems a differently cased lookup may have
+	// opened the file under the new name already, which is kept.
+	if _, ok := cache.shards[name]; !ok {
+		cache.shards[name] = entry.cache
+	}
+	cache.renamed[fileName] = name
+	delete(cache.ids, oldName)
+	cache.ids[name] = channelId
+	return nil
+}
+
+// moveRenamedShards moves the database files of renamed channels to the
+// paths of their new names. No shard may be open.
+func (cache *ShardedCache) moveRenamedShards() {
+	markers, err := filepath.Glob(cache.shardPath("*") + SHARD_RENAME_SUFFIX)
+	if err != nil {
+		fmt.Printf("Can't list renamed channels: %s\n", err)
+		return
+	}
+
+	for _, marker := range markers {
+		content, err := os.ReadFile(marker)
+		if err != nil {
+			fmt.Printf("Can't read renamed channel %s: %s\n", marker, err)
+			continue
+		}
+		oldPath, name := strings.TrimSuffix(marker, SHARD_RENAME_SUFFIX), strings.TrimSpace(string(content))
+		if err := cache.moveShard(oldPath, name); err != nil {
+			fmt.Printf("[%s] Can't move database %s of renamed channel: %s\n", name, oldPath, err)
+			continue
+		}
+		if err := os.Remove(marker); err != nil {
+			fmt.Printf("Can't remove renamed channel %s: %s\n", marker, err)
+		}
+	}
+}
+
+// moveShard moves a database file with its WAL to the path of a channel.
+func (cache *ShardedCache) moveShard(oldPath string, name string) error {
+	if !shardChannelName.MatchString(name) {
+		return fmt.Errorf("Invalid channel name %q", name)
+	}
+
+	newPath := cache.shardPath(name)
+	if _, err := os.Stat(newPath); err == nil && !sameShardFile(oldPath, newPath) {
+		return fmt.Errorf("Channel %s already exists", name)
+	}
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Rename(oldPath+suffix, newPath+suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// sameShardFile reports whether two paths are the same file, as names
+// differing only in case are on case-insensitive file systems.
+func sameShardFile(path string, other string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	otherInfo, err := os.Stat(other)
+	return err == nil && os.SameFile(info, otherInfo)
+}
+
+func (cache *ShardedCache) UpdateLastPostId(channelId int, lastPostId int) error {
+	entry, err := cache.entry(channelId)
+	if err != nil {
+		return err
+	}
+	return entry.cache.UpdateLastPostId(entry.localId, lastPostId)
+}
+
+func (cache *ShardedCache) UpdateTitleOverride(channelId int, title string) error {
+	entry, err := cache.entry(channelId)
+	if err != nil {
+		return err
+	}
+	return entry.cache.UpdateTitleOverride(entry.localId, title)
+}
+
+func (cache *ShardedCache) UpdateRefreshInterval(channelId int, interval time.Duration) error {
+	entry, err := cache.entry(channelId)
+	if err != nil {
+		return err
+	}
+	return entry.cache.UpdateRefreshInterval(entry.localId, interval)
+}
+
+func (cache *ShardedCache) UpdateNewestPostAt(channelId int, newestPostAt time.Time) error {
+	entry, err := cache.entry(channelId)
+	if err != nil {
+		return err
+	}
+	return entry.cache.UpdateNewestPostAt(entry.localId, newestPostAt)
+}
+
+func (cache *ShardedCache) UpdateValidators(channelId int, validators PageValidators) error {
+	entry, err := cache.entry(channelId)
+	if err != nil {
+		return err
+	}
+	return entry.cache.UpdateValidators(entry.localId, validators)
+}
+
+func (cache *ShardedCache) UpdatePinnedId(channelId int, pinnedId int) error {
+	entry, err := cache.entry(channelId)
+	if err != nil {
+		return err
+	}
+	return entry.cache.UpdatePinnedId(entry.localId, pinnedId)
+}
+
+func (cache *ShardedCache) UpdatePageState(channelId int, state PageState) error {
+	entry, err := cache.entry(channelId)
+	if err != nil {
+		return err
+	}
+	return entry.cache.UpdatePageState(entry.localId, state)
+}
+
+func (cache *ShardedCache) UpdateRefreshSchedule(channelId int, postIntervalEma time.Duration, nextRefreshAt time.Time) error {
+	entry, err := cache.entry(channelId)
+	if err != nil {
+		return err
+	}
+	return entry.cache.UpdateRefreshSchedule(entry.localId, postIntervalEma, nextRefreshAt)
+}
+
+func (cache *ShardedCache) GetPosts(channelId int, count int) ([]DbPost, error) {
+	entry, err := cache.entry(channelId)
+	if err != nil {
+		return nil, err
+	}
+
+	posts, err := entry.cache.GetPosts(entry.localId, count)
+	for i := range posts {
+		posts[i].ChannelId = channelId
+	}
+	return posts, err
+}
+
+func (cache *ShardedCache) GetPostsPage(channelId int, offset int, count int, oldestFirst bool) ([]DbPost, error) {
+	entry, err := cache.entry(channelId)
+	if err != nil {
+		return nil, err
+	}
+
+	posts, err := entry.cache.GetPostsPage(entry.localId, offset, count, oldestFirst)
+	for i := range posts {
+		posts[i].ChannelId = channelId
+	}
+	return posts, err
+}
+
+func (cache *ShardedCache) SavePosts(channelId int, posts []Post) ([]DbPost, error) {
+	entry, err := cache.entry(channelId)
+	if err != nil {
+		return nil, err
+	}
+
+	savedPosts, err := entry.cache.SavePosts(entry.localId, posts)
+	for i := range savedPosts {
+		savedPosts[i].ChannelId = channelId
+	}
+	return savedPosts, err
+}
+
+func (cache *ShardedCache) GetNewestPostTime(channelId int) (time.Time, error) {
+	entry, err := cache.entry(channelId)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return entry.cache.GetNewestPostTime(entry.localId)
+}
+
+func (cache *ShardedCache) GetPostsById(channelId int, messageIds []int) ([]DbPost, error) {
+	entry, err := cache.entry(channelId)
+	if err != nil {
+		return nil, err
+	}
+
+	posts, err := entry.cache.GetPostsById(entry.localId, messageIds)
+	for i := range posts {
+		posts[i].ChannelId = channelId
+	}
+	return posts, err
+}
+
+func (cache *ShardedCache) CountPosts(channelId int) (int, error) {
+	entry, err := cache.entry(channelId)
+	if err != nil {
+		return 0, err
+	}
+	return entry.cache.CountPosts(entry.localId)
+}
+
+func (cache *ShardedCache) UpdatePostViews(channelId int, views map[int]int) error {
+	entry, err := cache.entry(channelId)
+	if err != nil {
+		return err
+	}
+	return entry.cache.UpdatePostViews(entry.localId, views)
+}
+
+func (cache *ShardedCache) UpdateEditedPosts(channelId int, posts []Post) error {
+	entry, err := cache.entry(channelId)
+	if err != nil {
+		return err
+	}
+	return entry.cache.UpdateEditedPosts(entry.localId, posts)
+}
+
+func (cache *ShardedCache) UpdatePostComments(channelId int, posts []Post) error {
+	entry, err := cache.entry(channelId)
+	if err != nil {
+		return err
+	}
+	return entry.cache.UpdatePostComments(entry.localId, posts)
+}
+
+func (cache *ShardedCache) PrunePosts(channelId int, olderThan time.Time, keepMin int) (int, error) {
+	entry, err := cache.entry(channelId)
+	if err != nil {
+		return 0, err
+	}
+	return entry.cache.PrunePosts(entry.localId, olderThan, keepMin)
+}
+
+// SearchPosts searches every shard and returns the newest matches, as
+// relevance ranks of different databases can't be compared.
+func (cache *ShardedCache) SearchPosts(query string, limit int) ([]SearchResult, error) {
+	channels, err := cache.GetChannels()
+	if err != nil {
+		return nil, err
+	}
+
+	results := []SearchResult{}
+	for _, channel := range channels {
+		entry, err := cache.entry(channel.Id)
+		if err != nil {
+			return nil, err
+		}
+
+		shardResults, err := entry.cache.SearchPosts(query, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range shardResults {
+			result.Post.ChannelId = channel.Id
+			results = append(results, result)
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Post.CreatedAt.After(results[j].Post.CreatedAt)
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// Ping checks the shards opened so far.
+func (cache *ShardedCache) Ping() error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	for name, shard := range cache.shards {
+		if err := shard.Ping(); err != nil {
+			return fmt.Errorf("Shard %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// GetAliases merges the aliases stored in every shard.
+func (cache *ShardedCache) GetAliases() (map[string]string, error) {
+	names, err := cache.names()
+	if err != nil {
+		return nil, err
+	}
+
+	aliases := map[string]string{}
+	for _, name := range names {
+		shard, err := cache.shard(name, false)
+		if err != nil {
+			return nil, err
+		}
+
+		shardAliases, err := shard.GetAliases()
+		if err != nil {
+			return nil, err
+		}
+		for alias, channelName := range shardAliases {
+			aliases[alias] = channelName
+		}
+	}
+	return aliases, nil
+}
+
+// SaveAlias stores the alias in the shard of its channel, after removing
+// it from the shard of the channel it pointed to before.
+func (cache *ShardedCache) SaveAlias(alias string, channelName string) error {
+	aliases, err := cache.GetAliases()
+	if err != nil {
+		return err
+	}
+
+	if previous, ok := aliases[alias]; ok && previous != channelName {
+		shard, err := cache.shard(previous, false)
+		if err != nil {
+			return err
+		}
+		if err := shard.SaveAlias(alias, ""); err != nil {
+			return err
+		}
+	}
+
+	if channelName == "" {
+		return nil
+	}
+	shard, err := cache.shard(channelName, true)
+	if err != nil {
+		return err
+	}
+	return shard.SaveAlias(alias, channelName)
+}
+
+// Close closes all open shards and moves the files of renamed channels.
+func (cache *ShardedCache) Close() error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	var err error
+	closed := map[*SqliteCache]bool{}
+	for name, shard := range cache.shards {
+		if !closed[shard] {
+			err = errors.Join(err, shard.db.Close())
+			closed[shard] = true
+		}
+		delete(cache.shards, name)
+	}
+	if err == nil {
+		cache.moveRenamedShards()
+		cache.renamed = map[string]string{}
+	}
+	return err
+}
+
+// MemoryCache keeps channels and posts in memory only, for tests and
+// throwaway instances. It mirrors SqliteCache, including sql.ErrNoRows for
+// unknown channels.
+type MemoryCache struct {
+	mu         sync.Mutex
+	channels   []DbChannel
+	posts      map[int][]DbPost
+	lastPostId int
+	aliases    map[string]string
+}
+
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{posts: map[int][]DbPost{}, aliases: map[string]string{}}
+}
+
+// channel returns the stored channel with an id, nil if there is none.
+// Callers hold the lock.
+func (cache *MemoryCache) channel(channelId int) *DbChannel {
+	if channelId < 1 || channelId > len(cache.channels) {
+		return nil
+	}
+	return &cache.channels[channelId-1]
+}
+
+func (cache *MemoryCache) GetChannel(name string) (DbChannel, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	for _, channel := range cache.channels {
+		if channel.Name == name {
+			return channel, nil
+		}
+	}
+	return DbChannel{}, sql.ErrNoRows
+}
+
+func (cache *MemoryCache) GetChannels() ([]DbChannel, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	channels := append([]DbChannel{}, cache.channels...)
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Name < channels[j].Name
+	})
+	return channels, nil
+}
+
+func (cache *MemoryCache) SaveChannel(channel Channel) (DbChannel, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	for _, existing := range cache.channels {
+		if existing.Name == channel.Name {
+			return DbChannel{}, fmt.Errorf("Channel %s already exists", channel.Name)
+		}
+	}
+
+	dbChannel := DbChannel{
+		Id:          len(cache.channels) + 1,
+		Name:        channel.Name,
+		Title:       channel.Title,
+		LastId:      channel.LastId,
+		Link:        channel.Link,
+		Description: channel.Description,
+	}
+	cache.channels = append(cache.channels, dbChannel)
+	return dbChannel, nil
+}
+
+func (cache *MemoryCache) RenameChannel(channelId int, name string, link string) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	for _, existing := range cache.channels {
+		if existing.Name == name {
+			return fmt.Errorf("Channel %s already exists", name)
+		}
+	}
+	if channel := cache.channel(channelId); channel != nil {
+		channel.Name = name
+		channel.Link = link
+	}
+	return nil
+}
+
+func (cache *MemoryCache) UpdateLastPostId(channelId int, lastPostId int) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if channel := cache.channel(channelId); channel != nil {
+		channel.LastId = lastPostId
+	}
+	return nil
+}
+
+func (cache *MemoryCache) UpdateTitleOverride(channelId int, title string) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if channel := cache.channel(channelId); channel != nil {
+		channel.TitleOverride = title
+	}
+	return nil
+}
+
+func (cache *MemoryCache) UpdateRefreshInterval(channelId int, interval time.Duration) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if channel := cache.channel(channelId); channel != nil {
+		channel.RefreshInterval = interval.Truncate(time.Second)
+	}
+	return nil
+}
+
+func (cache *MemoryCache) UpdateNewestPostAt(channelId int, newestPostAt time.Time) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if channel := cache.channel(channelId); channel != nil {
+		channel.NewestPostAt = newestPostAt.UTC()
+	}
+	return nil
+}
+
+func (cache *MemoryCache) UpdateValidators(channelId int, validators PageValidators) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if channel := cache.channel(channelId); channel != nil {
+		channel.Validators = validators
+	}
+	return nil
+}
+
+func (cache *MemoryCache) UpdatePinnedId(channelId int, pinnedId int) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if channel := cache.channel(channelId); channel != nil {
+		channel.PinnedId = pinnedId
+	}
+	return nil
+}
+
+func (cache *MemoryCache) UpdatePageState(channelId int, state PageState) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if channel := cache.channel(channelId); channel != nil {
+		channel.PageState = state
+	}
+	return nil
+}
+
+func (cache *MemoryCache) UpdateRefreshSchedule(channelId int, postIntervalEma time.Duration, nextRefreshAt time.Time) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if channel := cache.channel(channelId); channel != nil {
+		channel.PostIntervalEma = postIntervalEma.Truncate(time.Second)
+		channel.NextRefreshAt = nextRefreshAt.UTC()
+	}
+	return nil
+}
+
+func (cache *MemoryCache) GetPosts(channelId int, count int) ([]DbPost, error) {
+	return cache.GetPostsPage(channelId, 0, count, false)
+}
+
+// postBefore orders posts by creation time, breaking ties on the message id
+// in the same direction like the SQLite queries do. Posts without a message
+// id sort last either way and fall back to the stored id.
+func postBefore(a DbPost, b DbPost, oldestFirst bool) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.Before(b.CreatedAt) == oldestFirst
+	}
+	if a.MessageId != b.MessageId {
+		if a.MessageId == 0 || b.MessageId == 0 {
+			return b.MessageId == 0
+		}
+		return (a.MessageId < b.MessageId) == oldestFirst
+	}
+	if a.Id == b.Id {
+		return false
+	}
+	return (a.Id < b.Id) == oldestFirst
+}
+
+func (cache *MemoryCache) GetPostsPage(channelId int, offset int, count int, oldestFirst bool) ([]DbPost, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	posts := append([]DbPost{}, cache.posts[channelId]...)
+	sort.SliceStable(posts, func(i, j int) bool {
+		return postBefore(posts[i], posts[j], oldestFirst)
+	})
+	if offset >= len(posts) {
+		return []DbPost{}, nil
+	}
+	posts = posts[offset:]
+	if len(posts) > count {
+		posts = posts[:count]
+	}
+	return posts, nil
+}
+
+func (cache *MemoryCache) GetPostsById(channelId int, messageIds []int) ([]DbPost, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	ids := map[int]bool{}
+	for _, id := range messageIds {
+		ids[id] = true
+	}
+	posts := []DbPost{}
+	for _, post := range cache.posts[channelId] {
+		if ids[post.MessageId] {
+			posts = append(posts, post)
+		}
+	}
+	return posts, nil
+}
+
+func (cache *MemoryCache) SavePosts(channelId int, posts []Post) ([]DbPost, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	var savedPosts []DbPost
+	firstSeenAt := time.Now().UTC()
+	for _, post := range posts {
+		cache.lastPostId++
+		savedPosts = append(savedPosts, DbPost{
+			Id:          cache.lastPostId,
+			Header:      post.Header,
+			Content:     post.Content,
+			Link:        post.Link,
+			CreatedAt:   post.CreatedAt,
+			FirstSeenAt: firstSeenAt,
+			MessageId:   post.MessageId,
+			Views:       post.Views,
+			Media:       post.Media,
+			Author:      post.Author,
+			Reactions:   post.Reactions,
+			ContentHtml: post.ContentHtml,
+			Edited:      post.Edited,
+			Comments:    post.Comments,
+			TopComments: post.TopComments,
+			ChannelId:   channelId,
+		})
+	}
+	cache.posts[channelId] = append(cache.posts[channelId], savedPosts...)
+	return savedPosts, nil
+}
+
+func (cache *MemoryCache) GetNewestPostTime(channelId int) (time.Time, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	var newest time.Time
+	for _, post := range cache.posts[channelId] {
+		if post.CreatedAt.After(newest) {
+			newest = post.CreatedAt
+		}
+	}
+	return newest, nil
+}
+
+func (cache *MemoryCache) CountPosts(channelId int) (int, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	return len(cache.posts[channelId]), nil
+}
+
+func (cache *MemoryCache) UpdatePostViews(channelId int, views map[int]int) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	posts := cache.posts[channelId]
+	for i := range posts {
+		if count, ok := views[posts[i].MessageId]; ok && posts[i].MessageId != 0 {
+			posts[i].Views = count
+		}
+	}
+	return nil
+}
+
+func (cache *MemoryCache) UpdateEditedPosts(channelId int, posts []Post) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	edited := map[int]Post{}
+	for _, post := range posts {
+		edited[post.MessageId] = post
+	}
+
+	updatedAt := time.Now().UTC()
+	cached := cache.posts[channelId]
+	for i := range cached {
+		if post, ok := edited[cached[i].MessageId]; ok && cached[i].MessageId != 0 {
+			cached[i].Header = post.Header
+			cached[i].Content = post.Content
+			cached[i].Media = post.Media
+			cached[i].ContentHtml = post.ContentHtml
+			cached[i].Edited = true
+			cached[i].UpdatedAt = updatedAt
+		}
+	}
+	return nil
+}
+
+func (cache *MemoryCache) UpdatePostComments(channelId int, posts []Post) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	refreshed := map[int]Post{}
+	for _, post := range posts {
+		refreshed[post.MessageId] = post
+	}
+
+	cached := cache.posts[channelId]
+	for i := range cached {
+		if post, ok := refreshed[cached[i].MessageId]; ok && cached[i].MessageId != 0 {
+			cached[i].Comments = post.Comments
+			cached[i].TopComments = post.TopComments
+		}
+	}
+	return nil
+}
+
+func (cache *MemoryCache) PrunePosts(channelId int, olderThan time.Time, keepMin int) (int, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	newest := append([]DbPost{}, cache.posts[channelId]...)
+	sort.SliceStable(newest, func(i, j int) bool {
+		return postBefore(newest[i], newest[j], false)
+	})
+
+	pruned := map[int]bool{}
+	for i, post := range newest {
+		if i >= keepMin && post.CreatedAt.Before(olderThan) {
+			pruned[post.Id] = true
+		}
+	}
+	if len(pruned) == 0 {
+		return 0, nil
+	}
+
+	var kept []DbPost
+	for _, post := range cache.posts[channelId] {
+		if !pruned[post.Id] {
+			kept = append(kept, post)
+		}
+	}
+	cache.posts[channelId] = kept
+	return len(pruned), nil
+}
+
+// SearchPosts matches case-insensitive substrings, newest posts first.
+func (cache *MemoryCache) SearchPosts(query string, limit int) ([]SearchResult, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	query = strings.ToLower(query)
+	results := []SearchResult{}
+	for _, channel := range cache.channels {
+		for _, post := range cache.posts[channel.Id] {
+			if strings.Contains(strings.ToLower(post.Header), query) || strings.Contains(strings.ToLower(post.Content), query) {
+				results = append(results, SearchResult{Channel: channel.Name, Post: post})
+			}
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Post.CreatedAt.After(results[j].Post.CreatedAt)
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+func (cache *MemoryCache) GetAliases() (map[string]string, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	aliases := map[string]string{}
+	for alias, channelName := range cache.aliases {
+		aliases[alias] = channelName
+	}
+	return aliases, nil
+}
+
+func (cache *MemoryCache) SaveAlias(alias string, channelName string) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if channelName == "" {
+		delete(cache.aliases, alias)
+	} else {
+		cache.aliases[alias] = channelName
+	}
+	return nil
+}
+
+func (cache *MemoryCache) Ping() error {
+	return nil
+}
+
+// Cache backends.
+const (
+	CacheSqlite = "sqlite"
+	CacheMemory = "memory"
+)
+
+// Cache decorators.
+const (
+	DecoratorMetrics = "metrics"
+	DecoratorLogging = "logging"
+)
+
+// CacheOptions describe the cache built by NewCache.
+type CacheOptions struct {
+	// Backend is CacheSqlite (the default) or CacheMemory.
+	Backend string
+
+	// DbPath is the SQLite database, unless DbPathTemplate shards the
+	// cache into a database per channel.
+	DbPath         string
+	DbPathTemplate string
+	Pool           PoolOptions
+	AutoMigrate    bool
+
+	// HardLimit caps the posts returned by a single cache read, zero
+	// doesn't cap them.
+	HardLimit int
+
+	// LeanStorage stores posts without their content, see LeanCache.
+	LeanStorage bool
+
+	// Decorators wrap the backend in order, so the last one is outermost.
+	Decorators []string
+}
+
+// NewCache builds the backend described by options and wraps it in the
+// decorators. The database is returned for maintenance when the backend
+// is a single SQLite file, and is nil otherwise.
+func NewCache(options CacheOptions) (Cache, *sql.DB, error) {
+	var cache Cache
+	var db *sql.DB
+
+	switch {
+	case options.Backend == CacheMemory:
+		cache = NewMemoryCache()
+	case options.Backend != "" && options.Backend != CacheSqlite:
+		return nil, nil, fmt.Errorf("Unknown cache backend %s", options.Backend)
+	case options.DbPathTemplate != "":
+		shardedCache, err := NewShardedCache(options.DbPathTemplate, options.Pool, options.AutoMigrate)
+		if err != nil {
+			return nil, nil, err
+		}
+		cache = shardedCache
+	default:
+		var err error
+		db, err = initDB(options.DbPath, options.Pool)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if options.AutoMigrate {
+			if _, err := migrateDB(db); err != nil {
+				db.Close()
+				return nil, nil, err
+			}
+		} else if pending, err := pendingMigrations(db); err == nil && len(pending) > 0 {
+			fmt.Printf("%d database migrations are pending, apply them with POST /admin/migrate\n", len(pending))
+		}
+
+		cache = NewSqliteCache(db, options.Pool.MaxWriters)
+	}
+
+	if options.HardLimit > 0 {
+		cache = NewLimitCache(cache, options.HardLimit)
+	}
+
+	if options.LeanStorage {
+		cache = NewLeanCache(cache)
+	}
+
+	for _, decorator := range options.Decorators {
+		switch decorator {
+		case DecoratorMetrics:
+			cache = NewMetricsCache(cache)
+		case DecoratorLogging:
+			cache = NewLoggingCache(cache, os.Stdout)
+		default:
+			closeCache(cache)
+			return nil, nil, fmt.Errorf("Unknown cache decorator %s", decorator)
+		}
+	}
+
+	return cache, db, nil
+}
+
+// FeedProcessor transforms a feed after it's built and before it's written,
+// e.g. to add, drop or reorder items.
+type FeedProcessor func(feed *feeds.Feed)
+
+// Feed processors.
+const (
+	FeedProcessorUntitled = "untitled"
+)
+
+// feedProcessors are the processors -feedprocessors can name.
+var feedProcessors = map[string]FeedProcessor{
+	FeedProcessorUntitled: titleUntitledItems,
+}
+
+// RegisterFeedProcessor makes processor available to -feedprocessors under
+// name. Builds with their own processors register them from an init
+// function, a processor registered under a taken name replaces it.
+func RegisterFeedProcessor(name string, processor FeedProcessor) {
+	feedProcessors[name] = processor
+}
+
+// parseFeedProcessors looks up comma-separated processor names.
+func parseFeedProcessors(names string) ([]FeedProcessor, error) {
+	var processors []FeedProcessor
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		processor, ok := feedProcessors[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown feed processor %s", name)
+		}
+		processors = append(processors, processor)
+	}
+	return processors, nil
+}
+
+func (config ServerConfig) processFeed(feed *feeds.Feed) {
+	for _, processor := range config.FeedProcessors {
+		processor(feed)
+	}
+}
+
+// UNTITLED_TITLE_LENGTH is how many characters of their text items without
+// a title are titled with.
+const UNTITLED_TITLE_LENGTH = 60
+
+// titleUntitledItems titles items of short posts, which have no header,
+// with the start of their text, for readers that list items by title only.
+func titleUntitledItems(feed *feeds.Feed) {
+	for _, item := range feed.Items {
+		if item.Title != "" {
+			continue
+		}
+
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(item.Description))
+		if err != nil {
+			continue
+		}
+		item.Title = untitledTitle(doc.Text())
+	}
+}
+
+// untitledTitle is the title of a post without a header, the start of the
+// first line of its text.
+func untitledTitle(text string) string {
+	text, _, _ = strings.Cut(strings.TrimSpace(text), "\n")
+	text = strings.TrimSpace(text)
+	if runes := []rune(text); len(runes) > UNTITLED_TITLE_LENGTH {
+		text = strings.TrimSpace(string(runes[:UNTITLED_TITLE_LENGTH])) + "..."
+	}
+	return text
+}
+
+// closeCache closes the backend of a cache, looking through decorators.
+func closeCache(cache Cache) error {
+	for {
+		if closer, ok := cache.(io.Closer); ok {
+			return closer.Close()
+		}
+
+		wrapper, ok := cache.(interface{ Unwrap() Cache })
+		if !ok {
+			return nil
+		}
+		cache = wrapper.Unwrap()
+	}
+}
+
+func initDB(dbPath string, pool PoolOptions) (*sql.DB, error) {
+	db := sql.OpenDB(sqliteConnector{driver: sqliteDriver(pool), dsn: foreignKeysDsn(dbPath)})
+
+	err := configurePool(db, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	createChannelsTable := `
+        CREATE TABLE IF NOT EXISTS channels (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            name TEXT UNIQUE NOT NULL,
+            title TEXT NOT NULL,
+            lastId INTEGER NOT NULL,
+            link TEXT NOT NULL,
+            description TEXT,
+            refreshInterval INTEGER,
+            newestPostAt DATETIME,
+            postIntervalEma INTEGER,
+            nextRefreshAt DATETIME,
+            titleOverride TEXT,
+            etag TEXT,
+            lastModified TEXT,
+            pinnedId INTEGER,
+            pageState TEXT
+        );
+
+		CREATE UNIQUE INDEX IF NOT EXISTS channel_name ON channels(name);`
+
+	createPostsTable := `
+        CREATE TABLE IF NOT EXISTS posts (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            channelId INTEGER NOT NULL,
+            header TEXT NOT NULL,
+            content TEXT NOT NULL,
+            link TEXT NOT NULL,
+            createdAt DATETIME NOT NULL,
+            firstSeenAt DATETIME,
+            messageId INTEGER,
+            views INTEGER,
+            media TEXT,
+            author TEXT,
+            reactions TEXT,
+            updatedAt DATETIME,
+            contentHtml TEXT,
+            edited INTEGER,
+            comments INTEGER,
+            topComments TEXT,
+            FOREIGN KEY(channelId) REFERENCES channels(id) ON DELETE CASCADE
+        );`
+
+	var existingTables int
+	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'channels'").Scan(&existingTables)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(createChannelsTable)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(createPostsTable)
+	if err != nil {
+		return nil, err
+	}
+
+	// New databases are created with the latest schema.
+	if existingTables == 0 {
+		_, err = db.Exec(createPostIndexes + createAliasesTable + createFetchQueueTable)
+		if err != nil {
+			return nil, err
+		}
+
+		err = setSchemaVersion(db, len(migrations))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = initFts(db)
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// createPostIndexes needs columns added by migrations, so it only runs for
+// new databases and as a migration for existing ones.
+const createPostIndexes = "CREATE INDEX IF NOT EXISTS post_message ON posts(channelId, messageId);"
+
+const createAliasesTable = `
+        CREATE TABLE IF NOT EXISTS aliases (
+            alias TEXT PRIMARY KEY,
+            channel TEXT NOT NULL
+        );`
+
+const createFetchQueueTable = `
+        CREATE TABLE IF NOT EXISTS fetch_queue (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            job INTEGER NOT NULL,
+            channel TEXT NOT NULL,
+            enqueuedAt DATETIME NOT NULL,
+            startedAt DATETIME,
+            doneAt DATETIME,
+            error TEXT
+        );
+
+        CREATE INDEX IF NOT EXISTS fetch_queue_job ON fetch_queue(job, channel);`
+
+// Migration upgrades databases created by older versions. Migrations run
+// once each, in order, and PRAGMA user_version records how many of them
+// were applied.
+type Migration struct {
+	Name string
+	Up   func(db *sql.DB) error
+}
+
+var migrations = []Migration{
+	{"add channels.refreshInterval", addColumnMigration("channels", "refreshInterval", "INTEGER")},
+	{"add channels.newestPostAt", addColumnMigration("channels", "newestPostAt", "DATETIME")},
+	{"add posts.firstSeenAt", addColumnMigration("posts", "firstSeenAt", "DATETIME")},
+	// Content used to be stored with the link appended, which the content
+	// template adds now.
+	{"strip links from stored post content", execMigration(`
+		UPDATE posts
+		SET content = substr(content, 1, length(content) - length(char(10) || char(10) || '<a href="' || link || '">[link]</a>'))
+		WHERE substr(content, -length(char(10) || char(10) || '<a href="' || link || '">[link]</a>')) = char(10) || char(10) || '<a href="' || link || '">[link]</a>'`)},
+	{"add posts.messageId", addColumnMigration("posts", "messageId", "INTEGER")},
+	{"add posts.views", addColumnMigration("posts", "views", "INTEGER")},
+	{"backfill posts.messageId from links", backfillMessageIds},
+	{"index posts by message id", execMigration(createPostIndexes)},
+	{"add posts.media", addColumnMigration("posts", "media", "TEXT")},
+	{"add channels.postIntervalEma", addColumnMigration("channels", "postIntervalEma", "INTEGER")},
+	{"add channels.nextRefreshAt", addColumnMigration("channels", "nextRefreshAt", "DATETIME")},
+	{"add posts.author", addColumnMigration("posts", "author", "TEXT")},
+	{"delete posts of deleted channels", cascadePostsMigration},
+	{"add posts.reactions", addColumnMigration("posts", "reactions", "TEXT")},
+	{"add aliases table", execMigration(createAliasesTable)},
+	{"add fetch queue table", execMigration(createFetchQueueTable)},
+	{"add posts.updatedAt", addColumnMigration("posts", "updatedAt", "DATETIME")},
+	{"add posts.contentHtml", addColumnMigration("posts", "contentHtml", "TEXT")},
+	{"add posts.edited", addColumnMigration("posts", "edited", "INTEGER")},
+	{"add channels.titleOverride", addColumnMigration("channels", "titleOverride", "TEXT")},
+	{"add posts.comments", addColumnMigration("posts", "comments", "INTEGER")},
+	{"add posts.topComments", addColumnMigration("posts", "topComments", "TEXT")},
+	{"add channels.etag", addColumnMigration("channels", "etag", "TEXT")},
+	{"add channels.lastModified", addColumnMigration("channels", "lastModified", "TEXT")},
+	{"add channels.pinnedId", addColumnMigration("channels", "pinnedId", "INTEGER")},
+	{"add channels.pageState", addColumnMigration("channels", "pageState", "TEXT")},
+}
+
+// foreignKeysDsn turns on foreign key enforcement, which SQLite leaves off
+// unless it's set on every connection.
+func foreignKeysDsn(dbPath string) string {
+	if strings.Contains(dbPath, "_foreign_keys=") || strings.Contains(dbPath, "_fk=") {
+		return dbPath
+	}
+	if strings.Contains(dbPath, "?") {
+		return dbPath + "&_foreign_keys=1"
+	}
+	return dbPath + "?_foreign_keys=1"
+}
+
+// cascadePostsMigration rebuilds posts with ON DELETE CASCADE on its channel
+// reference, which SQLite can't add to an existing table. Posts whose
+// channel is already gone are dropped.
+func cascadePostsMigration(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		DELETE FROM posts WHERE channelId NOT IN (SELECT id FROM channels);
+
+		CREATE TABLE posts_cascade (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			channelId INTEGER NOT NULL,
+			header TEXT NOT NULL,
+			content TEXT NOT NULL,
+			link TEXT NOT NULL,
+			createdAt DATETIME NOT NULL,
+			firstSeenAt DATETIME,
+			messageId INTEGER,
+			views INTEGER,
+			media TEXT,
+			author TEXT,
+			FOREIGN KEY(channelId) REFERENCES channels(id) ON DELETE CASCADE
+		);
+
+		INSERT INTO posts_cascade (id, channelId, header, content, link, createdAt, firstSeenAt, messageId, views, media, author)
+		SELECT id, channelId, header, content, link, createdAt, firstSeenAt, messageId, views, media, author FROM posts;
+
+		DROP TABLE posts;
+		ALTER TABLE posts_cascade RENAME TO posts;`)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(createPostIndexes); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	// Dropping the table dropped the search triggers too, ids are kept so
+	// the index itself stays valid.
+	return initFts(db)
+}
+
+// backfillMessageIds parses message ids out of post links such as
+// https://t.me/channel/272?embed=1&mode=tme.
+func backfillMessageIds(db *sql.DB) error {
+	rows, err := db.Query("SELECT id, link FROM posts WHERE messageId IS NULL")
+	if err != nil {
+		return err
+	}
+
+	messageIds := map[int]int{}
+	for rows.Next() {
+		var id int
+		var link string
+		if err := rows.Scan(&id, &link); err != nil {
+			rows.Close()
+			return err
+		}
+
+		if messageId := parseMessageId(link); messageId != 0 {
+			messageIds[id] = messageId
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, messageId := range messageIds {
+		if _, err := db.Exec("UPDATE posts SET messageId = ? WHERE id = ?", messageId, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseMessageId(link string) int {
+	path := strings.SplitN(link, "?", 2)[0]
+	messageId, err := strconv.Atoi(path[strings.LastIndex(path, "/")+1:])
+	if err != nil {
+		return 0
+	}
+	return messageId
+}
+
+func addColumnMigration(table string, column string, definition string) func(db *sql.DB) error {
+	return func(db *sql.DB) error {
+		return addColumnIfMissing(db, table, column, definition)
+	}
+}
+
+func execMigration(query string) func(db *sql.DB) error {
+	return func(db *sql.DB) error {
+		_, err := db.Exec(query)
+		return err
+	}
+}
+
+func schemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	return version, err
+}
+
+func setSchemaVersion(db *sql.DB, version int) error {
+	// PRAGMA doesn't accept bound parameters.
+	_, err := db.Exec("PRAGMA user_version = " + strconv.Itoa(version))
+	return err
+}
+
+// pendingMigrations lists migrations not applied to the database yet.
+func pendingMigrations(db *sql.DB) ([]Migration, error) {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if version >= len(migrations) {
+		return []Migration{}, nil
+	}
+	return migrations[version:], nil
+}
+
+// migrateDB applies pending migrations and returns the names of the applied
+// ones.
+func migrateDB(db *sql.DB) ([]string, error) {
+	applied := []string{}
+
+	version, err := schemaVersion(db)
+	if err != nil {
+		return applied, err
+	}
+
+	for ; version < len(migrations); version++ {
+		migration := migrations[version]
+		fmt.Printf("Applying migration %d: %s\n", version+1, migration.Name)
+
+		if err := migration.Up(db); err != nil {
+			return applied, fmt.Errorf("Migration %q failed: %w", migration.Name, err)
+		}
+
+		if err := setSchemaVersion(db, version+1); err != nil {
+			return applied, err
+		}
+		applied = append(applied, migration.Name)
+	}
+	return applied, nil
+}
+
+func ftsAvailable(db *sql.DB) (bool, error) {
+	var enabled bool
+	err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&enabled)
+	return enabled, err
+}
+
+// initFts maintains the posts_fts full-text index through triggers, so every
+// insert, update and delete of posts is mirrored. SQLite builds without FTS5
+// (go-sqlite3 needs the sqlite_fts5 build tag) skip the index, and drop the
+// triggers of a database created by a build with it, as they could not fire.
+func initFts(db *sql.DB) error {
+	available, err := ftsAvailable(db)
+	if err != nil {
+		return err
+	}
+
+	if !available {
+		fmt.Println("SQLite is built without FTS5, search falls back to LIKE")
+		_, err = db.Exec(`
+			DROP TRIGGER IF EXISTS posts_fts_insert;
+			DROP TRIGGER IF EXISTS posts_fts_delete;
+			DROP TRIGGER IF EXISTS posts_fts_update;`)
+		return err
+	}
+
+	var triggers int
+	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name = 'posts_fts_insert'").Scan(&triggers)
+	if err != nil {
+		return err
+	}
+
+	createFts := `
+        CREATE VIRTUAL TABLE IF NOT EXISTS posts_fts USING fts5(
+            header,
+            content,
+            content='posts',
+            content_rowid='id'
+        );
+
+        CREATE TRIGGER IF NOT EXISTS posts_fts_insert AFTER INSERT ON posts BEGIN
+            INSERT INTO posts_fts(rowid, header, content) VALUES (new.id, new.header, new.content);
+        END;
+
+        CREATE TRIGGER IF NOT EXISTS posts_fts_delete AFTER DELETE ON posts BEGIN
+            INSERT INTO posts_fts(posts_fts, rowid, header, content) VALUES ('delete', old.id, old.header, old.content);
+        END;
+
+        CREATE TRIGGER IF NOT EXISTS posts_fts_update AFTER UPDATE ON posts BEGIN
+            INSERT INTO posts_fts(posts_fts, rowid, header, content) VALUES ('delete', old.id, old.header, old.content);
+            INSERT INTO posts_fts(rowid, header, content) VALUES (new.id, new.header, new.content);
+        END;`
+
+	_, err = db.Exec(createFts)
+	if err != nil {
+		return err
+	}
+
+	// Index posts stored while the triggers were missing.
+	if triggers == 0 {
+		_, err = db.Exec("INSERT INTO posts_fts(posts_fts) VALUES ('rebuild')")
+	}
+	return err
+}
+
+// sqliteConnector opens connections with a driver of its own, so their
+// settings don't depend on the globally registered sqlite3 driver.
+type sqliteConnector struct {
+	driver *sqlite3.SQLiteDriver
+	dsn    string
+}
+
+func (connector sqliteConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return connector.driver.Open(connector.dsn)
+}
+
+func (connector sqliteConnector) Driver() driver.Driver {
+	return connector.driver
+}
+
+// sqliteDriver sets cache_size and mmap_size on every new connection. They
+// are per-connection settings, so running the PRAGMAs once on the pool
+// would only tune whichever connection it picked.
+func sqliteDriver(pool PoolOptions) *sqlite3.SQLiteDriver {
+	var pragmas []string
+	if pool.CacheSize > 0 {
+		// Negative sizes are in KiB rather than pages.
+		pragmas = append(pragmas, "PRAGMA cache_size = -"+strconv.Itoa(pool.CacheSize))
+	}
+	if pool.MmapSize > 0 {
+		pragmas = append(pragmas, "PRAGMA mmap_size = "+strconv.FormatInt(pool.MmapSize, 10))
+	}
+
+	return &sqlite3.SQLiteDriver{ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+		for _, pragma := range pragmas {
+			if _, err := conn.Exec(pragma, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}}
+}
+
+// configurePool applies pool options. Without WAL, SQLite allows a single
+// writer and readers block on it, so concurrent handlers and the refresh
+// worker would only fight over the file lock with "database is locked"
+// errors. In that case the pool is limited to one connection and callers
+// queue in database/sql instead.
+func configurePool(db *sql.DB, pool PoolOptions) error {
+	var journalMode string
+	err := db.QueryRow("PRAGMA journal_mode").Scan(&journalMode)
+	if err != nil {
+		return err
+	}
+
+	maxOpenConns := pool.MaxOpenConns
+	if !strings.EqualFold(journalMode, "wal") {
+		maxOpenConns = 1
+	}
+
+	db.SetMaxOpenConns(maxOpenConns)
+	if pool.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(pool.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+
+	return nil
+}
+
+// addColumnIfMissing upgrades tables created by older versions, which
+// CREATE TABLE IF NOT EXISTS leaves untouched.
+func addColumnIfMissing(db *sql.DB, table string, column string, definition string) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+type ChannelConfig struct {
+	RefreshInterval *string `json:"refreshInterval"`
+	// Title overrides the scraped title in feeds, empty removes the
+	// override.
+	Title *string `json:"title"`
+}
+
+// AliasRequest is the body of POST /admin/alias. An empty Channel removes
+// the alias.
+type AliasRequest struct {
+	Alias   string `json:"alias" binding:"required"`
+	Channel string `json:"channel"`
+}
+
+// normalizeChannelName is the name a channel is cached under. Telegram
+// usernames are case-insensitive, so /LexFridman/ and /lexfridman are the
+// same channel.
+func normalizeChannelName(name string) string {
+	return strings.ToLower(strings.TrimRight(name, "/"))
+}
+
+// normalizeCachedChannels renames channels cached under a differently cased
+// name, by earlier versions, to the normalized one requests look up. When
+// the normalized name is cached too, both are kept and it's the one served.
+// Channels failing to be renamed are logged and the others renamed still.
+func normalizeCachedChannels(cache Cache) error {
+	channels, err := cache.GetChannels()
+	if err != nil {
+		return err
+	}
+
+	for _, channel := range channels {
+		name := normalizeChannelName(channel.Name)
+		if name == channel.Name {
+			continue
+		}
+		if _, err := cache.GetChannel(name); err == nil {
+			fmt.Printf("[%s] Not renamed, %s is cached too\n", channel.Name, name)
+			continue
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			fmt.Printf("[%s] Can't look up %s: %s\n", channel.Name, name, err)
+			continue
+		}
+
+		if err := cache.RenameChannel(channel.Id, name, channel.Link); err != nil {
+			fmt.Printf("[%s] Can't rename cached channel to %s: %s\n", channel.Name, name, err)
+			continue
+		}
+		fmt.Printf("[%s] Renamed cached channel to %s\n", channel.Name, name)
+	}
+	return nil
+}
+
+// channelAliases is the handlers' copy of the cached aliases, so resolving
+// one doesn't query the cache on every request. It normalizes the requested
+// names unless keepCase is set.
+type channelAliases struct {
+	keepCase bool
+
+	mu      sync.RWMutex
+	aliases map[string]string
+}
+
+func newChannelAliases(cache Cache, keepCase bool) *channelAliases {
+	cached, err := cache.GetAliases()
+	if err != nil {
+		fmt.Printf("Can't load channel aliases: %s\n", err)
+		cached = map[string]string{}
+	}
+
+	aliases := &channelAliases{keepCase: keepCase, aliases: map[string]string{}}
+	for alias, channelName := range cached {
+		aliases.aliases[aliases.normalize(alias)] = aliases.normalize(channelName)
+	}
+	return aliases
+}
+
+func (aliases *channelAliases) normalize(name string) string {
+	if aliases.keepCase {
+		return name
+	}
+	return normalizeChannelName(name)
+}
+
+// resolve returns the channel an alias stands for, other names normalized.
+func (aliases *channelAliases) resolve(name string) string {
+	name = aliases.normalize(name)
+
+	aliases.mu.RLock()
+	defer aliases.mu.RUnlock()
+
+	if channelName, ok := aliases.aliases[name]; ok {
+		return channelName
+	}
+	return name
+}
+
+func (aliases *channelAliases) set(alias string, channelName string) {
+	aliases.mu.Lock()
+	defer aliases.mu.Unlock()
+
+	if channelName == "" {
+		delete(aliases.aliases, alias)
+	} else {
+		aliases.aliases[alias] = channelName
+	}
+}
+
+func (aliases *channelAliases) all() map[string]string {
+	aliases.mu.RLock()
+	defer aliases.mu.RUnlock()
+
+	all := map[string]string{}
+	for alias, channelName := range aliases.aliases {
+		all[alias] = channelName
+	}
+	return all
+}
+
+// RefreshWorker periodically refreshes cached channels in the background,
+// honoring per-channel refresh intervals.
+type RefreshWorker struct {
+	cache       Cache
+	fetcher     Fetcher
+	limiter     *FetchLimiter
+	lock        *sync.Mutex
+	interval    time.Duration
+	checkPeriod time.Duration
+
+	// queue receives due channels for a QueueWorker to fetch, nil fetches
+	// them right away.
+	queue *FetchQueue
+
+	lastRefreshed map[string]time.Time
+
+	// jitter is the fraction of the interval refreshes are moved by at
+	// random, so channels sharing an interval aren't fetched all at once.
+	// offsets hold the current move of every channel and firstRefreshAt
+	// spreads the first refreshes after a start.
+	jitter         float64
+	random         func() float64
+	offsets        map[string]float64
+	firstRefreshAt map[string]time.Time
+
+	// adaptive schedules channels without their own refresh interval by
+	// posting frequency, nil refreshes them every interval.
+	adaptive *AdaptiveRefresh
+
+	// options are passed to prepareFeed, only their fetch settings matter.
+	options FeedOptions
+}
+
+// DEFAULT_REFRESH_JITTER moves background refreshes by up to a tenth of
+// their interval.
+const DEFAULT_REFRESH_JITTER = 0.1
+
+// POST_INTERVAL_EMA_ALPHA weighs the newest gap between posts in the moving
+// average of a channel's posting interval.
+const POST_INTERVAL_EMA_ALPHA = 0.3
+
+// AdaptiveRefresh bounds refresh intervals derived from posting frequency,
+// so busy channels are polled often and quiet ones rarely.
+type AdaptiveRefresh struct {
+	MinInterval time.Duration
+	MaxInterval time.Duration
+}
+
+// interval is the average time between posts within the bounds, fallback
+// is used for channels without enough posts to tell.
+func (adaptive *AdaptiveRefresh) interval(postIntervalEma time.Duration, fallback time.Duration) time.Duration {
+	interval := postIntervalEma
+	if interval == 0 {
+		interval = fallback
+	}
+	if interval < adaptive.MinInterval {
+		return adaptive.MinInterval
+	}
+	if interval > adaptive.MaxInterval {
+		return adaptive.MaxInterval
+	}
+	return interval
+}
+
+// postIntervalEma averages the gaps between posts, given newest first.
+// The time since the newest post counts as a gap once it's longer than the
+// average, so channels that went quiet are polled less.
+func postIntervalEma(posts []DbPost, now time.Time) time.Duration {
+	if len(posts) < 2 {
+		return 0
+	}
+
+	ema := float64(posts[len(posts)-2].CreatedAt.Sub(posts[len(posts)-1].CreatedAt))
+	for i := len(posts) - 3; i >= 0; i-- {
+		gap := float64(posts[i].CreatedAt.Sub(posts[i+1].CreatedAt))
+		ema = POST_INTERVAL_EMA_ALPHA*gap + (1-POST_INTERVAL_EMA_ALPHA)*ema
+	}
+
+	if silence := float64(now.Sub(posts[0].CreatedAt)); silence > ema {
+		ema = POST_INTERVAL_EMA_ALPHA*silence + (1-POST_INTERVAL_EMA_ALPHA)*ema
+	}
+
+	if ema < 0 {
+		return 0
+	}
+	return time.Duration(ema).Round(time.Second)
+}
+
+func NewRefreshWorker(cache Cache, fetcher Fetcher, limiter *FetchLimiter, lock *sync.Mutex, queue *FetchQueue, interval time.Duration, adaptive *AdaptiveRefresh, jitter float64, options FeedOptions) *RefreshWorker {
+	return &RefreshWorker{
+		cache:          cache,
+		fetcher:        fetcher,
+		limiter:        limiter,
+		lock:           lock,
+		queue:          queue,
+		interval:       interval,
+		adaptive:       adaptive,
+		jitter:         jitter,
+		random:         rand.Float64,
+		offsets:        map[string]float64{},
+		firstRefreshAt: map[string]time.Time{},
+		options:        options,
+		checkPeriod:    time.Minute,
+		lastRefreshed:  map[string]time.Time{},
+	}
+}
+
+// jittered moves interval by a random part of up to jitter of it either
+// way, drawn anew for every refresh of a channel.
+func (worker *RefreshWorker) jittered(channelName string, interval time.Duration) time.Duration {
+	offset, ok := worker.offsets[channelName]
+	if !ok {
+		offset = worker.jitter * (2*worker.random() - 1)
+		worker.offsets[channelName] = offset
+	}
+	return interval + time.Duration(offset*float64(interval))
+}
+
+// Run refreshes due channels every checkPeriod until ctx is canceled. A
+// refresh in progress is finished, but no new one is started, so the cache
+// can be closed once Run returns.
+func (worker *RefreshWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(worker.checkPeriod)
+	defer ticker.Stop()
+
+	for {
+		worker.refreshDue(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (worker *RefreshWorker) channelInterval(channel DbChannel) time.Duration {
+	if channel.RefreshInterval > 0 {
+		return channel.RefreshInterval
+	}
+	return worker.interval
+}
+
+func (worker *RefreshWorker) refreshDue(ctx context.Context, now time.Time) {
+	if worker.lock != nil {
+		worker.lock.Lock()
+		defer worker.lock.Unlock()
+	}
+
+	channels, err := worker.cache.GetChannels()
+	if err != nil {
+		fmt.Printf("Can't load channels for refresh: %s\n", err)
+		return
+	}
+
+	for _, channel := range channels {
+		if ctx.Err() != nil {
+			return
+		}
+
+		adaptive := worker.adaptive != nil && channel.RefreshInterval == 0
+		if adaptive {
+			if now.Before(channel.NextRefreshAt) {
+				continue
+			}
+		} else if lastRefreshed, ok := worker.lastRefreshed[channel.Name]; ok {
+			if now.Sub(lastRefreshed) < worker.jittered(channel.Name, worker.channelInterval(channel)) {
+				continue
+			}
+		} else if worker.jitter > 0 {
+			// Channels not refreshed yet, e.g. after a start, are spread
+			// over the first jitter of their interval.
+			firstRefreshAt, ok := worker.firstRefreshAt[channel.Name]
+			if !ok {
+				firstRefreshAt = now.Add(time.Duration(worker.jitter * worker.random() * float64(worker.channelInterval(channel))))
+				worker.firstRefreshAt[channel.Name] = firstRefreshAt
+			}
+			if now.Before(firstRefreshAt) {
+				continue
+			}
+		}
+
+		if worker.queue != nil {
+			if err := worker.queue.EnqueueRefresh(channel.Name); err != nil {
+				fmt.Printf("[%s] Can't queue background refresh: %s\n", channel.Name, err)
+				continue
+			}
+		} else {
+			fmt.Printf("[%s] Background refresh\n", channel.Name)
+			if _, err := prepareFeed(channel.Name, worker.cache, worker.fetcher, worker.limiter, worker.options); err != nil {
+				fmt.Printf("[%s] Background refresh failed: %s\n", channel.Name, err)
+			}
+		}
+		worker.lastRefreshed[channel.Name] = now
+		delete(worker.offsets, channel.Name)
+		delete(worker.firstRefreshAt, channel.Name)
+
+		if adaptive {
+			worker.schedule(channel, now)
+		}
+	}
+}
+
+// schedule stores the next adaptive refresh of a channel.
+func (worker *RefreshWorker) schedule(channel DbChannel, now time.Time) {
+	posts, err := worker.cache.GetPosts(channel.Id, MAX_RSS_POSTS_COUNT)
+	if err != nil {
+		fmt.Printf("[%s] Can't load posts for refresh scheduling: %s\n", channel.Name, err)
+		return
+	}
+
+	ema := postIntervalEma(posts, now)
+	nextRefreshAt := now.Add(worker.jittered(channel.Name, worker.adaptive.interval(ema, worker.interval)))
+	delete(worker.offsets, channel.Name)
+	if err := worker.cache.UpdateRefreshSchedule(channel.Id, ema, nextRefreshAt); err != nil {
+		fmt.Printf("[%s] Can't store refresh schedule: %s\n", channel.Name, err)
+	}
+}
+
+// MAX_WARMUP_JOBS is how many finished or running warmup jobs are kept for
+// status requests.
+const MAX_WARMUP_JOBS = 100
+
+// Warmup channel statuses.
+const (
+	WarmupPending = "pending"
+	WarmupOk      = "ok"
+	WarmupFailed  = "failed"
+)
+
+// WarmupJob is the status of a warmup started by POST /admin/warmup.
+type WarmupJob struct {
+	Id       string          `json:"id"`
+	Done     bool            `json:"done"`
+	Channels []WarmupChannel `json:"channels"`
+}
+
+type WarmupChannel struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Warmups fetches lists of channels in the background to fill the cache
+// after a deploy. Fetches go through the shared FetchLimiter, so a warmup
+// never exceeds the concurrent fetch limit.
+type Warmups struct {
+	// ctx stops the jobs, channels that aren't fetched by then fail.
+	ctx     context.Context
+	cache   Cache
+	fetcher Fetcher
+	limiter *FetchLimiter
+	options FeedOptions
+
+	// queue keeps jobs across restarts, a QueueWorker fetches them. Nil
+	// keeps them in memory.
+	queue *FetchQueue
+
+	mu      sync.Mutex
+	lastId  int
+	jobs    map[string]*WarmupJob
+	running sync.WaitGroup
+}
+
+func NewWarmups(ctx context.Context, cache Cache, fetcher Fetcher, limiter *FetchLimiter, queue *FetchQueue, options FeedOptions) *Warmups {
+	return &Warmups{ctx: ctx, cache: cache, fetcher: fetcher, limiter: limiter, queue: queue, options: options, jobs: map[string]*WarmupJob{}}
+}
+
+// Wait waits for the running jobs, which stop fetching once ctx is
+// canceled.
+func (warmups *Warmups) Wait() {
+	warmups.running.Wait()
+}
+
+// ASYNC_FETCH_RETRY_AFTER is the Retry-After, in seconds, of feeds that are
+// fetched in the background with -asyncfetch.
+const ASYNC_FETCH_RETRY_AFTER = 5
+
+// MAX_ASYNC_FETCHES caps the background fetches of -asyncfetch running at
+// once, requests for more uncached channels are turned away.
+const MAX_ASYNC_FETCHES = 100
+
+// AsyncFetches runs the background fetches of -asyncfetch, one at a time per
+// channel and at most MAX_ASYNC_FETCHES at once.
+type AsyncFetches struct {
+	mu      sync.Mutex
+	running map[string]bool
+	// failed channels are fetched by the next request, which waits for the
+	// fetch and answers with its error.
+	failed map[string]bool
+
+	fetches sync.WaitGroup
+}
+
+func NewAsyncFetches() *AsyncFetches {
+	return &AsyncFetches{running: map[string]bool{}, failed: map[string]bool{}}
+}
+
+// Wait waits for the running background fetches.
+func (fetches *AsyncFetches) Wait() {
+	fetches.fetches.Wait()
+}
+
+// start fetches a channel that isn't cached yet in the background and
+// reports whether it's being fetched. Cached channels, and ones whose
+// background fetch failed, are left to the caller. ErrAsyncFetchesFull is
+// returned when too many are fetched already.
+func (fetches *AsyncFetches) start(channelName string, cache Cache, fetch func() error) (bool, error) {
+	// The channel is cached before its posts, so running fetches come first.
+	fetches.mu.Lock()
+	running := fetches.running[channelName]
+	fetches.mu.Unlock()
+	if running {
+		return true, nil
+	}
+	if _, err := cache.GetChannel(channelName); !errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+
+	fetches.mu.Lock()
+	defer fetches.mu.Unlock()
+
+	if fetches.running[channelName] {
+		return true, nil
+	}
+	if fetches.failed[channelName] {
+		delete(fetches.failed, channelName)
+		return false, nil
+	}
+	if len(fetches.running) >= MAX_ASYNC_FETCHES {
+		return false, ErrAsyncFetchesFull
+	}
+
+	fetches.running[channelName] = true
+	fetches.fetches.Add(1)
+	go func() {
+		defer fetches.fetches.Done()
+		err := fetch()
+		if err != nil {
+			fmt.Printf("[%s] Background fetch failed: %s\n", channelName, err)
+		}
+
+		fetches.mu.Lock()
+		defer fetches.mu.Unlock()
+		delete(fetches.running, channelName)
+		if err != nil {
+			if len(fetches.failed) >= MAX_CACHED_FAILURES {
+				fetches.failed = map[string]bool{}
+			}
+			fetches.failed[channelName] = true
+		}
+	}()
+	return true, nil
+}
+
+// Start begins fetching channels and returns the job id.
+func (warmups *Warmups) Start(channels []string) (string, error) {
+	if warmups.queue != nil {
+		job, err := warmups.queue.EnqueueJob(channels)
+		return strconv.Itoa(job), err
+	}
+
+	warmups.mu.Lock()
+	defer warmups.mu.Unlock()
+
+	warmups.lastId++
+	delete(warmups.jobs, strconv.Itoa(warmups.lastId-MAX_WARMUP_JOBS))
+
+	job := &WarmupJob{Id: strconv.Itoa(warmups.lastId)}
+	for _, channel := range channels {
+		job.Channels = append(job.Channels, WarmupChannel{Name: channel, Status: WarmupPending})
+	}
+	warmups.jobs[job.Id] = job
+
+	warmups.running.Add(1)
+	go func() {
+		defer warmups.running.Done()
+		warmups.run(job)
+	}()
+	return job.Id, nil
+}
+
+func (warmups *Warmups) run(job *WarmupJob) {
+	var wg sync.WaitGroup
+	for i := range job.Channels {
+		wg.Add(1)
+		go func(channel *WarmupChannel) {
+			defer wg.Done()
+
+			err := warmups.ctx.Err()
+			if err == nil {
+				_, err = prepareFeed(channel.Name, warmups.cache, warmups.fetcher, warmups.limiter, warmups.options)
+			}
+			// Unlike feed requests a warmup can wait for as long as it
+			// takes, unless it's stopped.
+			for errors.Is(err, ErrFetchBusy) && warmups.ctx.Err() == nil {
+				_, err = prepareFeed(channel.Name, warmups.cache, warmups.fetcher, warmups.limiter, warmups.options)
+			}
+
+			warmups.mu.Lock()
+			defer warmups.mu.Unlock()
+			if err != nil {
+				fmt.Printf("[%s] Warmup failed: %s\n", channel.Name, err)
+				channel.Status = WarmupFailed
+				channel.Error = err.Error()
+			} else {
+				channel.Status = WarmupOk
+			}
+		}(&job.Channels[i])
+	}
+	wg.Wait()
+
+	warmups.mu.Lock()
+	defer warmups.mu.Unlock()
+	job.Done = true
+}
+
+// Get returns a copy of a job's status.
+func (warmups *Warmups) Get(id string) (WarmupJob, bool) {
+	if warmups.queue != nil {
+		job, err := strconv.Atoi(id)
+		if err != nil || job <= 0 {
+			return WarmupJob{}, false
+		}
+
+		status, ok, err := warmups.queue.Job(job)
+		if err != nil {
+			fmt.Printf("Can't load warmup %d: %s\n", job, err)
+		}
+		return status, ok
+	}
+
+	warmups.mu.Lock()
+	defer warmups.mu.Unlock()
+
+	job, ok := warmups.jobs[id]
+	if !ok {
+		return WarmupJob{}, false
+	}
+
+	status := *job
+	status.Channels = append([]WarmupChannel{}, job.Channels...)
+	return status, true
+}
+
+// SEED_PROGRESS_PERIOD is how often seeding progress is logged.
+const SEED_PROGRESS_PERIOD = 5 * time.Second
+
+// Seed is the warmup of the -seedfile channels started on boot.
+type Seed struct {
+	warmups  *Warmups
+	id       string
+	total    int
+	deadline time.Time
+}
+
+// StartSeed warms up channels like POST /admin/warmup, Run logs the
+// progress.
+func StartSeed(warmups *Warmups, channels []string, timeout time.Duration) (*Seed, error) {
+	id, err := warmups.Start(channels)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Seeding %d channels\n", len(channels))
+	return &Seed{warmups: warmups, id: id, total: len(channels), deadline: time.Now().Add(timeout)}, nil
+}
+
+// Pending is how many seed channels are still being fetched, zero once
+// the timeout passed. A nil Seed has nothing pending.
+func (seed *Seed) Pending() (pending int, total int) {
+	if seed == nil || !time.Now().Before(seed.deadline) {
+		return 0, 0
+	}
+
+	job, ok := seed.warmups.Get(seed.id)
+	if !ok {
+		return 0, seed.total
+	}
+	for _, channel := range job.Channels {
+		if channel.Status == WarmupPending {
+			pending++
+		}
+	}
+	return pending, seed.total
+}
+
+// Run logs the progress of the seed until it's done or ctx is canceled.
+func (seed *Seed) Run(ctx context.Context) {
+	ticker := time.NewTicker(SEED_PROGRESS_PERIOD)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		job, ok := seed.warmups.Get(seed.id)
+		if !ok {
+			return
+		}
+
+		var fetched, failed int
+		for _, channel := range job.Channels {
+			switch channel.Status {
+			case WarmupOk:
+				fetched++
+			case WarmupFailed:
+				failed++
+			}
+		}
+
+		if job.Done {
+			fmt.Printf("Seeded %d channels, %d failed\n", fetched, failed)
+			return
+		}
+		fmt.Printf("Seeding: %d of %d channels fetched, %d failed\n", fetched, seed.total, failed)
+	}
+}
+
+// readSeedFile reads channel names, one per line. Blank lines, # comments
+// and repeated names are skipped.
+func readSeedFile(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var channels []string
+	seen := map[string]bool{}
+	for _, line := range strings.Split(string(content), "\n") {
+		name := strings.TrimSpace(line)
+		if name == "" || strings.HasPrefix(name, "#") || seen[name] {
+			continue
+		}
+		if !shardChannelName.MatchString(name) {
+			return nil, fmt.Errorf("Invalid channel name %q", name)
+		}
+		seen[name] = true
+		channels = append(channels, name)
+	}
+	return channels, nil
+}
+
+// QUEUE_REFRESH_JOB is the job of channels queued by the RefreshWorker,
+// warmup jobs are numbered from 1.
+const QUEUE_REFRESH_JOB = 0
+
+// DEFAULT_QUEUE_WORKERS is how many queued channels are fetched at a time
+// without -maxconcurrentfetches.
+const DEFAULT_QUEUE_WORKERS = 8
+
+// QUEUE_POLL_PERIOD is how often an idle QueueWorker looks for channels
+// queued by another process.
+const QUEUE_POLL_PERIOD = 10 * time.Second
+
+// FetchQueue is a queue of channels to fetch, stored in SQLite so scheduled
+// refreshes and warmups resume after a restart. Channels are fetched in the
+// order they were queued.
+type FetchQueue struct {
+	db *sql.DB
+
+	// writes is shared with the cache of the same database.
+	writes *WriteLock
+
+	// mu keeps two workers from dequeuing the same item.
+	mu   sync.Mutex
+	wake chan struct{}
+}
+
+// QueueItem is a queued fetch of a channel.
+type QueueItem struct {
+	Id      int
+	Job     int
+	Channel string
+}
+
+// NewFetchQueue opens the queue of a database, writing under the write
+// lock of its cache. Items that were being fetched when the previous
+// process stopped are queued again.
+func NewFetchQueue(db *sql.DB, writes *WriteLock) (*FetchQueue, error) {
+	writes.Lock()
+	_, err := db.Exec("UPDATE fetch_queue SET startedAt = NULL WHERE doneAt IS NULL")
+	writes.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return &FetchQueue{db: db, writes: writes, wake: make(chan struct{}, 1)}, nil
+}
+
+// notify wakes up a waiting worker.
+func (queue *FetchQueue) notify() {
+	select {
+	case queue.wake <- struct{}{}:
+	default:
+	}
+}
+
+// EnqueueRefresh queues a background refresh, unless the channel already
+// waits for one.
+func (queue *FetchQueue) EnqueueRefresh(channelName string) error {
+	queue.writes.Lock()
+	defer queue.writes.Unlock()
+
+	_, err := queue.db.Exec(`
+		INSERT INTO fetch_queue (job, channel, enqueuedAt)
+		SELECT ?, ?, ?
+		WHERE NOT EXISTS (SELECT 1 FROM fetch_queue WHERE job = ? AND channel = ? AND doneAt IS NULL)`,
+		QUEUE_REFRESH_JOB, channelName, time.Now().UTC(), QUEUE_REFRESH_JOB, channelName)
+	if err == nil {
+		queue.notify()
+	}
+	return err
+}
+
+// EnqueueJob queues the channels of a warmup and returns its job id. Only
+// the last MAX_WARMUP_JOBS jobs are kept.
+func (queue *FetchQueue) EnqueueJob(channels []string) (int, error) {
+	queue.writes.Lock()
+	defer queue.writes.Unlock()
+
+	tx, err := queue.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var job int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(job), 0) + 1 FROM fetch_queue").Scan(&job); err != nil {
+		return 0, err
+	}
+
+	enqueuedAt := time.Now().UTC()
+	for _, channel := range channels {
+		if _, err := tx.Exec("INSERT INTO fetch_queue (job, channel, enqueuedAt) VALUES (?, ?, ?)", job, channel, enqueuedAt); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM fetch_queue WHERE job > ? AND job <= ? AND doneAt IS NOT NULL", QUEUE_REFRESH_JOB, job-MAX_WARMUP_JOBS); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	queue.notify()
+	return job, nil
+}
+
+// Dequeue marks the oldest waiting item as started and returns it, false
+// when nothing waits. An item is only marked while it still waits, so a
+// worker of another process can't take it too.
+func (queue *FetchQueue) Dequeue() (QueueItem, bool, error) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	for {
+		var item QueueItem
+		err := queue.db.QueryRow("SELECT id, job, channel FROM fetch_queue WHERE startedAt IS NULL AND doneAt IS NULL ORDER BY id LIMIT 1").Scan(&item.Id, &item.Job, &item.Channel)
+		if errors.Is(err, sql.ErrNoRows) {
+			return QueueItem{}, false, nil
+		} else if err != nil {
+			return QueueItem{}, false, err
+		}
+
+		queue.writes.Lock()
+		res, err := queue.db.Exec("UPDATE fetch_queue SET startedAt = ? WHERE id = ? AND startedAt IS NULL AND doneAt IS NULL", time.Now().UTC(), item.Id)
+		queue.writes.Unlock()
+		if err != nil {
+			return QueueItem{}, false, err
+		}
+		claimed, err := res.RowsAffected()
+		if err != nil {
+			return QueueItem{}, false, err
+		}
+		if claimed == 1 {
+			return item, true, nil
+		}
+		// Another process took the item first, try the next one.
+	}
+}
+
+// Done records the result of a fetch. Finished refreshes are removed,
+// warmup results are kept for status requests.
+func (queue *FetchQueue) Done(item QueueItem, fetchErr error) error {
+	queue.writes.Lock()
+	defer queue.writes.Unlock()
+
+	if item.Job == QUEUE_REFRESH_JOB {
+		_, err := queue.db.Exec("DELETE FROM fetch_queue WHERE id = ?", item.Id)
+		return err
+	}
+
+	var message sql.NullString
+	if fetchErr != nil {
+		message = sql.NullString{String: fetchErr.Error(), Valid: true}
+	}
+	_, err := queue.db.Exec("UPDATE fetch_queue SET doneAt = ?, error = ? WHERE id = ?", time.Now().UTC(), message, item.Id)
+	return err
+}
+
+// Job returns the status of a warmup job, false if there is none.
+func (queue *FetchQueue) Job(job int) (WarmupJob, bool, error) {
+	rows, err := queue.db.Query("SELECT channel, doneAt, error FROM fetch_queue WHERE job = ? ORDER BY id", job)
+	if err != nil {
+		return WarmupJob{}, false, err
+	}
+	defer rows.Close()
+
+	status := WarmupJob{Id: strconv.Itoa(job), Done: true}
+	for rows.Next() {
+		var channel WarmupChannel
+		var doneAt sql.NullTime
+		var message sql.NullString
+		if err := rows.Scan(&channel.Name, &doneAt, &message); err != nil {
+			return WarmupJob{}, false, err
+		}
+
+		switch {
+		case !doneAt.Valid:
+			channel.Status = WarmupPending
+			status.Done = false
+		case message.Valid:
+			channel.Status = WarmupFailed
+			channel.Error = message.String
+		default:
+			channel.Status = WarmupOk
+		}
+		status.Channels = append(status.Channels, channel)
+	}
+	if err := rows.Err(); err != nil {
+		return WarmupJob{}, false, err
+	}
+	return status, len(status.Channels) > 0, nil
+}
+
+// QueueWorker fetches the channels of a FetchQueue, up to workers at a time
+// within the shared FetchLimiter.
+type QueueWorker struct {
+	queue   *FetchQueue
+	cache   Cache
+	fetcher Fetcher
+	limiter *FetchLimiter
+	// lock is held while refreshes write, like the RefreshWorker does.
+	lock       *sync.Mutex
+	workers    int
+	pollPeriod time.Duration
+	options    FeedOptions
+}
+
+func NewQueueWorker(queue *FetchQueue, cache Cache, fetcher Fetcher, limiter *FetchLimiter, lock *sync.Mutex, workers int, options FeedOptions) *QueueWorker {
+	return &QueueWorker{
+		queue:      queue,
+		cache:      cache,
+		fetcher:    fetcher,
+		limiter:    limiter,
+		lock:       lock,
+		workers:    workers,
+		pollPeriod: QUEUE_POLL_PERIOD,
+		options:    options,
+	}
+}
+
+// Run fetches queued channels until ctx is canceled and the fetches in
+// progress are done.
+func (worker *QueueWorker) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < worker.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if !worker.next(ctx) {
+					select {
+					case <-ctx.Done():
+					case <-worker.queue.wake:
+					case <-time.After(worker.pollPeriod):
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// next fetches one queued channel, false when the queue is empty. Fetches
+// still waiting for a fetch slot when ctx is canceled are left started,
+// the next process queues them again.
+func (worker *QueueWorker) next(ctx context.Context) bool {
+	item, ok, err := worker.queue.Dequeue()
+	if err != nil {
+		fmt.Printf("Can't dequeue fetch: %s\n", err)
+		return false
+	} else if !ok {
+		return false
+	}
+
+	if item.Job == QUEUE_REFRESH_JOB && worker.lock != nil {
+		worker.lock.Lock()
+		defer worker.lock.Unlock()
+	}
+
+	fmt.Printf("[%s] Queued fetch of job %d\n", item.Channel, item.Job)
+	_, err = prepareFeed(item.Channel, worker.cache, worker.fetcher, worker.limiter, worker.options)
+	// Like warmups, queued fetches wait for as long as it takes.
+	for errors.Is(err, ErrFetchBusy) {
+		if ctx.Err() != nil {
+			return true
+		}
+		_, err = prepareFeed(item.Channel, worker.cache, worker.fetcher, worker.limiter, worker.options)
+	}
+	if err != nil {
+		fmt.Printf("[%s] Queued fetch failed: %s\n", item.Channel, err)
+	}
+
+	if err := worker.queue.Done(item, err); err != nil {
+		fmt.Printf("[%s] Can't mark queued fetch done: %s\n", item.Channel, err)
+	}
+	return true
+}
+
+// Maintenance periodically prunes old posts, compacts the database and
+// refreshes the query planner statistics, keeping long-running instances
+// from growing and fragmenting.
+type Maintenance struct {
+	// db is vacuumed when set, it is nil for backends other than a
+	// single SQLite database.
+	db       *sql.DB
+	cache    Cache
+	lock     *sync.Mutex
+	interval time.Duration
+	prune    PruneOptions
+
+	// writes is the write lock of the cache of db, a VACUUM holds all of
+	// its slots.
+	writes *WriteLock
+}
+
+// PruneOptions limit how long posts stay cached, MaxAge 0 keeps them
+// forever. KeepMin newest posts of every channel are kept whatever their
+// age, so quiet channels don't end up with empty feeds.
+type PruneOptions struct {
+	MaxAge  time.Duration
+	KeepMin int
+}
+
+func NewMaintenance(db *sql.DB, cache Cache, lock *sync.Mutex, interval time.Duration, prune PruneOptions) *Maintenance {
+	return &Maintenance{db: db, cache: cache, lock: lock, interval: interval, prune: prune, writes: cacheWriteLock(cache)}
+}
+
+// Run maintains the database every interval until ctx is canceled.
+func (maintenance *Maintenance) Run(ctx context.Context) {
+	ticker := time.NewTicker(maintenance.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := maintenance.run(); err != nil {
+			fmt.Printf("Database maintenance failed: %s\n", err)
+		}
+	}
+}
+
+func (maintenance *Maintenance) run() error {
+	if maintenance.lock != nil {
+		maintenance.lock.Lock()
+		defer maintenance.lock.Unlock()
+	}
+
+	if maintenance.prune.MaxAge > 0 {
+		if err := maintenance.prunePosts(); err != nil {
+			return err
+		}
+	}
+
+	if maintenance.db == nil {
+		return nil
+	}
+	return maintenance.vacuum()
+}
+
+func (maintenance *Maintenance) prunePosts() error {
+	channels, err := maintenance.cache.GetChannels()
+	if err != nil {
+		return err
+	}
+
+	olderThan := time.Now().UTC().Add(-maintenance.prune.MaxAge)
+	total := 0
+	for _, channel := range channels {
+		deleted, err := maintenance.cache.PrunePosts(channel.Id, olderThan, maintenance.prune.KeepMin)
+		if err != nil {
+			return err
+		}
+		total += deleted
+	}
+
+	fmt.Printf("Pruned %d posts older than %s\n", total, olderThan.Format(time.RFC3339))
+	return nil
+}
+
+func (maintenance *Maintenance) vacuum() error {
+	sizeBefore, err := databaseSize(maintenance.db)
+	if err != nil {
+		return err
+	}
+
+	// incremental_vacuum only reclaims pages with auto_vacuum=INCREMENTAL,
+	// otherwise the whole file has to be rebuilt.
+	var autoVacuum int
+	err = maintenance.db.QueryRow("PRAGMA auto_vacuum").Scan(&autoVacuum)
+	if err != nil {
+		return err
+	}
+
+	vacuum := "VACUUM"
+	if autoVacuum == 2 {
+		vacuum = "PRAGMA incremental_vacuum"
+	}
+
+	maintenance.writes.LockAll()
+	_, err = maintenance.db.Exec(vacuum)
+	if err == nil {
+		_, err = maintenance.db.Exec("ANALYZE")
+	}
+	maintenance.writes.UnlockAll()
+	if err != nil {
+		return err
+	}
+
+	sizeAfter, err := databaseSize(maintenance.db)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Database maintenance: %s, size %d -> %d bytes\n", vacuum, sizeBefore, sizeAfter)
+	return nil
+}
+
+func databaseSize(db *sql.DB) (int64, error) {
+	var pageCount, pageSize int64
+	err := db.QueryRow("SELECT page_count, page_size FROM pragma_page_count(), pragma_page_size()").Scan(&pageCount, &pageSize)
+	return pageCount * pageSize, err
+}
+
+// MAX_CACHED_FAILURES bounds the FailureCache, which is dropped as a whole
+// when full.
+const MAX_CACHED_FAILURES = 10000
+
+type channelFailure struct {
+	err error
+	at  time.Time
+}
+
+// FailureCache wraps a Fetcher and remembers channels that don't exist or
+// are restricted for ttl. Their fetches fail with the remembered error
+// right away instead of scraping the channel again, after ttl it's
+// fetched again. Other errors, such as Telegram being down, aren't
+// remembered.
+type FailureCache struct {
+	fetcher Fetcher
+	ttl     time.Duration
+	now     func() time.Time
+
+	mu       sync.Mutex
+	failures map[string]channelFailure
+}
+
+func NewFailureCache(fetcher Fetcher, ttl time.Duration) *FailureCache {
+	return &FailureCache{fetcher: fetcher, ttl: ttl, now: time.Now, failures: map[string]channelFailure{}}
+}
+
+func (cache *FailureCache) FetchChannel(channelName string) (Channel, error) {
+	return cache.fetch(channelName, func() (Channel, error) {
+		return cache.fetcher.FetchChannel(channelName)
+	})
+}
+
+func (cache *FailureCache) FetchChannelIfModified(channelName string, validators PageValidators) (Channel, error) {
+	return cache.fetch(channelName, func() (Channel, error) {
+		return fetchChannelIfModified(cache.fetcher, channelName, validators)
+	})
+}
+
+func (cache *FailureCache) fetch(channelName string, fetch func() (Channel, error)) (Channel, error) {
+	key := strings.ToLower(channelName)
+
+	cache.mu.Lock()
+	failure, ok := cache.failures[key]
+	if ok && cache.now().Sub(failure.at) >= cache.ttl {
+		delete(cache.failures, key)
+		ok = false
+	}
+	cache.mu.Unlock()
+	if ok {
+		return Channel{}, failure.err
+	}
+
+	channel, err := fetch()
+	if errors.Is(err, ErrChannelPreviewOnly) || errors.Is(err, ErrChannelRestricted) {
+		cache.mu.Lock()
+		if len(cache.failures) >= MAX_CACHED_FAILURES {
+			cache.failures = map[string]channelFailure{}
+		}
+		cache.failures[key] = channelFailure{err: err, at: cache.now()}
+		cache.mu.Unlock()
+	}
+	return channel, err
+}
+
+// CachedFailure is a channel failure remembered by a FailureCache until
+// ExpiresAt.
+type CachedFailure struct {
+	Channel   string    `json:"channel"`
+	Error     string    `json:"error"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Failures lists the remembered failures that haven't expired, by channel
+// name.
+func (cache *FailureCache) Failures() []CachedFailure {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	now := cache.now()
+	failures := []CachedFailure{}
+	for key, failure := range cache.failures {
+		expiresAt := failure.at.Add(cache.ttl)
+		if !now.Before(expiresAt) {
+			continue
+		}
+		failures = append(failures, CachedFailure{Channel: key, Error: failure.err.Error(), ExpiresAt: expiresAt})
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		return failures[i].Channel < failures[j].Channel
+	})
+	return failures
+}
+
+// Clear forgets the failure of channelName, so the next fetch requests
+// Telegram again. It's false when no failure was remembered.
+func (cache *FailureCache) Clear(channelName string) bool {
+	key := strings.ToLower(channelName)
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	failure, ok := cache.failures[key]
+	delete(cache.failures, key)
+	return ok && cache.now().Sub(failure.at) < cache.ttl
+}
+
+func (cache *FailureCache) Unwrap() Fetcher {
+	return cache.fetcher
+}
+
+// fetcherFailures finds the FailureCache among fetcher and the fetchers it
+// wraps.
+func fetcherFailures(fetcher Fetcher) (*FailureCache, bool) {
+	for {
+		if failures, ok := fetcher.(*FailureCache); ok {
+			return failures, true
+		}
+
+		wrapper, ok := fetcher.(interface{ Unwrap() Fetcher })
+		if !ok {
+			return nil, false
+		}
+		fetcher = wrapper.Unwrap()
+	}
+}
+
+func (cache *FailureCache) FetchPost(channelName string, id int) (Post, error) {
+	return cache.fetcher.FetchPost(channelName, id)
+}
+
+func (cache *FailureCache) FetchTopic(channelName string, topicId int) (ForumTopic, error) {
+	topicFetcher, ok := cache.fetcher.(TopicFetcher)
+	if !ok {
+		return ForumTopic{}, ErrTopicsUnsupported
+	}
+	return topicFetcher.FetchTopic(channelName, topicId)
+}
+
+func (cache *FailureCache) FetchComments(channelName string, id int) (int, []Comment, error) {
+	commentsFetcher, ok := cache.fetcher.(CommentsFetcher)
+	if !ok {
+		return 0, nil, ErrCommentsUnsupported
+	}
+	return commentsFetcher.FetchComments(channelName, id)
+}
+
+// CircuitBreaker wraps a Fetcher and stops requesting Telegram for a
+// cooldown after threshold consecutive ErrTelegramUnavailable failures.
+// After the cooldown a single request probes whether Telegram recovered,
+// closing the circuit on success and reopening it on failure.
+type CircuitBreaker struct {
+	fetcher   Fetcher
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func (breaker *CircuitBreaker) Unwrap() Fetcher {
+	return breaker.fetcher
+}
+
+func NewCircuitBreaker(fetcher Fetcher, threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{fetcher: fetcher, threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+func (breaker *CircuitBreaker) FetchChannel(channelName string) (Channel, error) {
+	if err := breaker.allow(); err != nil {
+		return Channel{}, err
+	}
+
+	channel, err := breaker.fetcher.FetchChannel(channelName)
+	breaker.record(err)
+	return channel, err
+}
+
+func (breaker *CircuitBreaker) FetchChannelIfModified(channelName string, validators PageValidators) (Channel, error) {
+	if err := breaker.allow(); err != nil {
+		return Channel{}, err
+	}
+
+	channel, err := fetchChannelIfModified(breaker.fetcher, channelName, validators)
+	breaker.record(err)
+	return channel, err
+}
+
+func (breaker *CircuitBreaker) FetchPost(channelName string, id int) (Post, error) {
+	if err := breaker.allow(); err != nil {
+		return Post{}, err
+	}
+
+	post, err := breaker.fetcher.FetchPost(channelName, id)
+	breaker.record(err)
+	return post, err
+}
+
+func (breaker *CircuitBreaker) FetchTopic(channelName string, topicId int) (ForumTopic, error) {
+	topicFetcher, ok := breaker.fetcher.(TopicFetcher)
+	if !ok {
+		return ForumTopic{}, ErrTopicsUnsupported
+	}
+	if err := breaker.allow(); err != nil {
+		return ForumTopic{}, err
+	}
+
+	topic, err := topicFetcher.FetchTopic(channelName, topicId)
+	breaker.record(err)
+	return topic, err
+}
+
+func (breaker *CircuitBreaker) FetchComments(channelName string, id int) (int, []Comment, error) {
+	commentsFetcher, ok := breaker.fetcher.(CommentsFetcher)
+	if !ok {
+		return 0, nil, ErrCommentsUnsupported
+	}
+	if err := breaker.allow(); err != nil {
+		return 0, nil, err
+	}
+
+	count, comments, err := commentsFetcher.FetchComments(channelName, id)
+	breaker.record(err)
+	return count, comments, err
+}
+
+func (breaker *CircuitBreaker) allow() error {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	if breaker.openedAt.IsZero() {
+		return nil
+	}
+	if breaker.probing || breaker.now().Before(breaker.openedAt.Add(breaker.cooldown)) {
+		return ErrCircuitOpen
+	}
+
+	breaker.probing = true
+	return nil
+}
+
+func (breaker *CircuitBreaker) record(err error) {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	probe := breaker.probing
+	breaker.probing = false
+
+	if !errors.Is(err, ErrTelegramUnavailable) {
+		breaker.failures = 0
+		if probe {
+			fmt.Println("Telegram recovered, closing the circuit")
+		}
+		breaker.openedAt = time.Time{}
+		return
+	}
+
+	breaker.failures++
+	if probe || breaker.failures >= breaker.threshold {
+		if breaker.openedAt.IsZero() {
+			fmt.Printf("Telegram failed %d times in a row, pausing requests for %s\n", breaker.failures, breaker.cooldown)
+		}
+		breaker.openedAt = breaker.now()
+	}
+}
+
+// RetryAfter is the number of seconds until the circuit half-opens.
+func (breaker *CircuitBreaker) RetryAfter() int {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	remaining := breaker.openedAt.Add(breaker.cooldown).Sub(breaker.now())
+	return int(math.Max(1, math.Ceil(remaining.Seconds())))
+}
+
+// FetchLimiter bounds how many channels are scraped at the same time, so a
+// burst of requests for distinct channels doesn't get us rate-limited by
+// Telegram. A nil limiter doesn't limit anything.
+type FetchLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+func NewFetchLimiter(size int, timeout time.Duration) *FetchLimiter {
+	return &FetchLimiter{slots: make(chan struct{}, size), timeout: timeout}
+}
+
+// Acquire waits for a free slot, giving up with ErrFetchBusy after the
+// limiter timeout.
+func (limiter *FetchLimiter) Acquire() error {
+	if limiter == nil {
+		return nil
+	}
+
+	timer := time.NewTimer(limiter.timeout)
+	defer timer.Stop()
+
+	select {
+	case limiter.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return ErrFetchBusy
+	}
+}
+
+func (limiter *FetchLimiter) Release() {
+	if limiter == nil {
+		return
+	}
+	<-limiter.slots
+}
+
+// Sleep waits d with the caller's slot given back, so other channels are
+// fetched meanwhile, and takes a slot again before it returns. The caller
+// must hold a slot.
+func (limiter *FetchLimiter) Sleep(d time.Duration) {
+	if limiter == nil {
+		time.Sleep(d)
+		return
+	}
+
+	limiter.Release()
+	time.Sleep(d)
+	limiter.slots <- struct{}{}
+}
+
+// RetryAfter suggests, in seconds, when a client rejected with ErrFetchBusy
+// should try again.
+func (limiter *FetchLimiter) RetryAfter() int {
+	seconds := int(limiter.timeout.Seconds())
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+// prepareTopicFeed scrapes the newest posts of a forum topic. Topic posts
+// are posts of the group, so when the group is cached they're read from its
+// posts, and missing ones are stored with them. Only posts up to the cached
+// LastId are stored, newer ones are left to the next fetch of the group.
+func prepareTopicFeed(channelName string, topicId int, cache Cache, fetcher Fetcher, limiter *FetchLimiter, options FeedOptions) (*feeds.Feed, error) {
+	topicFetcher, ok := fetcher.(TopicFetcher)
+	if !ok {
+		return nil, ErrTopicsUnsupported
+	}
+
+	if err := limiter.Acquire(); err != nil {
+		return nil, err
+	}
+	defer limiter.Release()
+
+	topic, err := topicFetcher.FetchTopic(channelName, topicId)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := topic.PostIds
+	if len(ids) > MAX_RSS_POSTS_COUNT {
+		ids = ids[:MAX_RSS_POSTS_COUNT]
+	}
+
+	cached := map[int]DbPost{}
+	dbChannel, channelErr := cache.GetChannel(channelName)
+	if channelErr == nil {
+		dbPosts, err := cache.GetPostsById(dbChannel.Id, ids)
+		if err != nil {
+			fmt.Printf("[%s] Can't read cached posts of topic %d: %s\n", channelName, topicId, err)
+		}
+		for _, post := range dbPosts {
+			cached[post.MessageId] = post
+		}
+	}
+
+	var posts []DbPost
+	var fetched, stored []Post
+	for _, id := range ids {
+		if post, ok := cached[id]; ok {
+			post.Link = tgTopicPostUrl(channelName, topicId, id)
+			posts = append(posts, post)
+			continue
+		}
+
+		post, err := fetcher.FetchPost(channelName, id)
+		if errors.Is(err, ErrTelegramUnavailable) || errors.Is(err, ErrCircuitOpen) {
+			return nil, err
+		} else if err != nil {
+			fmt.Printf("[%s] Can't fetch post %d of topic %d: %s\n", channelName, id, topicId, err)
+			continue
+		}
+		fetched = append(fetched, post)
+		if channelErr == nil && id <= dbChannel.LastId {
+			stored = append(stored, post)
+		}
+
+		posts = append(posts, DbPost{
+			Header:      post.Header,
+			Content:     post.Content,
+			Link:        tgTopicPostUrl(channelName, topicId, id),
+			CreatedAt:   post.CreatedAt,
+			FirstSeenAt: post.CreatedAt,
+			MessageId:   post.MessageId,
+			Views:       post.Views,
+			Media:       post.Media,
+			Author:      post.Author,
+			Reactions:   post.Reactions,
+			Comments:    post.Comments,
+			TopComments: post.TopComments,
+		})
+	}
+
+	if len(stored) > 0 {
+		if _, err := cache.SavePosts(dbChannel.Id, stored); err != nil {
+			fmt.Printf("[%s] Can't save posts of topic %d: %s\n", channelName, topicId, err)
+		}
+	}
+	if options.LeanStorage {
+		hydratePosts(fetcher, options.Contents, channelName, posts, fetched)
+	}
+
+	channel := DbChannel{
+		Name:        topic.Title + " / topic " + strconv.Itoa(topicId),
+		Link:        topic.Link,
+		Description: "Posts of topic " + strconv.Itoa(topicId) + " of " + topic.Title,
+	}
+	return generateFeed(channel, posts, options), nil
+}
+
+// preparePostFeed fetches a single post and returns it as a one-item feed.
+// Nothing is cached, so it always shows how the post parses right now.
+func preparePostFeed(channelName string, postId int, fetcher Fetcher, limiter *FetchLimiter, options FeedOptions) (*feeds.Feed, error) {
+	if err := limiter.Acquire(); err != nil {
+		return nil, err
+	}
+	defer limiter.Release()
+
+	post, err := fetcher.FetchPost(channelName, postId)
+	if err != nil {
+		return nil, err
+	}
+
+	channel := DbChannel{
+		Name:        channelName + " / post " + strconv.Itoa(postId),
+		Link:        tgChannelFeedUrl(channelName),
+		Description: "Post " + strconv.Itoa(postId) + " of " + channelName,
+	}
+	return generateFeed(channel, []DbPost{{
+		Header:      post.Header,
+		Content:     post.Content,
+		Link:        tgPostUrl(channelName, postId),
+		CreatedAt:   post.CreatedAt,
+		FirstSeenAt: post.CreatedAt,
+		MessageId:   post.MessageId,
+		Views:       post.Views,
+		Media:       post.Media,
+		Author:      post.Author,
+		Reactions:   post.Reactions,
+		ContentHtml: post.ContentHtml,
+		Edited:      post.Edited,
+		Comments:    post.Comments,
+		TopComments: post.TopComments,
+	}}, options), nil
+}
+
+// FeedResult is a prepared feed with how it was prepared.
+type FeedResult struct {
+	Feed *feeds.Feed
+
+	// CacheHit is set when the channel had no new posts and the feed was
+	// built from the cache alone.
+	CacheHit bool
+	// FetchedPosts counts the new posts downloaded from Telegram,
+	// FetchFailures the ones that failed to download.
+	FetchedPosts  int
+	FetchFailures int
+	// Duration includes waiting for a fetch slot.
+	Duration time.Duration
+}
+
+func prepareFeed(channelName string, cache Cache, fetcher Fetcher, limiter *FetchLimiter, options FeedOptions) (result FeedResult, err error) {
+	defer func(start time.Time) { result.Duration = time.Since(start) }(time.Now())
+	result.Feed = &feeds.Feed{}
+
+	if err := limiter.Acquire(); err != nil {
+		return result, err
+	}
+	defer limiter.Release()
+
+	// Unchanged channel pages are served from the cache without parsing.
+	cachedChannel, cachedErr := cache.GetChannel(channelName)
+	var channel Channel
+	if cachedErr == nil {
+		channel, err = fetchChannelIfModified(fetcher, channelName, cachedChannel.Validators)
+	} else {
+		channel, err = fetcher.FetchChannel(channelName)
+	}
+
+	if errors.Is(err, ErrNotModified) {
+		// The page is the one stored last, so its state is applied again.
+		refreshPage(cache, fetcher, cachedChannel, Channel{Name: cachedChannel.Name, Views: cachedChannel.PageState.Views, Edited: cachedChannel.PageState.Edited})
+
+		dbPosts, err := cache.GetPosts(cachedChannel.Id, options.serveLimit())
+		if err != nil {
+			fmt.Printf("Problem with cached posts: %s\n", err)
+			return result, err
+		}
+
+		if options.PinnedFirst {
+			dbPosts = pinPost(cache, fetcher, cachedChannel, dbPosts)
+		}
+		if options.LeanStorage {
+			result.FetchedPosts, result.FetchFailures = hydratePosts(fetcher, options.Contents, cachedChannel.Name, dbPosts, nil)
+		}
+		result.Feed = generateFeed(cachedChannel, dbPosts, options)
+		result.CacheHit = true
+		return result, nil
+	} else if err == nil {
+		// Telegram cases the fetched name as the channel does, it's cached
+		// under the name requests look up.
+		if strings.EqualFold(channel.Name, channelName) {
+			channel.Name = channelName
+		}
+		if !options.KeepNameCase {
+			channel.Name = normalizeChannelName(channel.Name)
+		}
+
+		// Renamed channels are cached under their new username, see
+		// canonicalChannelName. The cached channel is renamed, so its
+		// posts aren't fetched again.
+		dbCachedChannel, err := cache.GetChannel(channel.Name)
+		if errors.Is(err, sql.ErrNoRows) && cachedErr == nil && channel.Name != cachedChannel.Name && shardChannelName.MatchString(channel.Name) {
+			if renameErr := cache.RenameChannel(cachedChannel.Id, channel.Name, channel.Link); renameErr != nil {
+				fmt.Printf("[%s] Can't rename channel to %s: %s\n", cachedChannel.Name, channel.Name, renameErr)
+			} else {
+				fmt.Printf("[%s] Renamed cached channel to %s\n", cachedChannel.Name, channel.Name)
+				dbCachedChannel, err = cache.GetChannel(channel.Name)
+			}
+		}
+
+		if err != nil {
+			newChannel := Channel{Name: channel.Name, Title: channel.Title, LastId: 0, Link: channel.Link, Description: channel.Description}
+			dbCachedChannel, _ = cache.SaveChannel(newChannel)
+		}
+
+		savePinnedId(cache, &dbCachedChannel, channel)
+		refreshPage(cache, fetcher, dbCachedChannel, channel)
+
+		var dbPosts []DbPost
+		var posts []Post
+
+		// The newest message time is a cheaper freshness signal than ids,
+		// which change when messages are deleted.
+		upToDate := dbCachedChannel.LastId == channel.LastId ||
+			(!channel.NewestPostAt.IsZero() && channel.NewestPostAt.Equal(dbCachedChannel.NewestPostAt))
+
+		if upToDate {
+			saveValidators(cache, dbCachedChannel, channel)
+			dbPosts, err = cache.GetPosts(dbCachedChannel.Id, options.serveLimit())
+			if err == nil {
+				if options.PinnedFirst {
+					dbPosts = pinPost(cache, fetcher, dbCachedChannel, dbPosts)
+				}
+				if options.LeanStorage {
+					result.FetchedPosts, result.FetchFailures = hydratePosts(fetcher, options.Contents, channel.Name, dbPosts, nil)
+				}
+				result.Feed = generateFeed(dbCachedChannel, dbPosts, options)
+				result.CacheHit = true
+
+				return result, nil
+			} else {
+				fmt.Printf("Problem with cached posts: %s\n", err)
+
+				return result, err
+			}
+		} else {
+			newestPostTime, err := cache.GetNewestPostTime(dbCachedChannel.Id)
+			if err != nil {
+				fmt.Printf("Can't get newest cached post time: %s\n", err)
+			}
+
+			var fetchedAny bool
+			if options.FetchOrder == FetchAscending {
+				posts, result.FetchFailures, fetchedAny = fetchPostsAscending(fetcher, channel, dbCachedChannel.LastId, newestPostTime, options.CollapseSameTime, options.fetchLimit())
+			} else {
+				posts, result.FetchFailures, fetchedAny = fetchPostsDescending(fetcher, channel, dbCachedChannel.LastId, newestPostTime, options.CollapseSameTime, options.fetchLimit())
+			}
+			result.FetchedPosts = len(posts)
+
+			// When every post failed (e.g. Telegram served error pages), keep
+			// LastId so the posts are retried, and serve what is cached.
+			if result.FetchFailures > 0 && !fetchedAny {
+				fmt.Printf("[%s] All %d posts failed to download, serving cached posts\n", channelName, result.FetchFailures)
+
+				dbPosts, err = cache.GetPosts(dbCachedChannel.Id, options.serveLimit())
+				if err != nil {
+					fmt.Printf("Problem with cached posts: %s\n", err)
+					return result, err
+				}
+
+				if options.PinnedFirst {
+					dbPosts = pinPost(cache, fetcher, dbCachedChannel, dbPosts)
+				}
+				if options.LeanStorage {
+					hydratePosts(fetcher, options.Contents, channel.Name, dbPosts, nil)
+				}
+				result.Feed = generateFeed(dbCachedChannel, dbPosts, options)
+				return result, nil
+			}
+
+			cache.UpdateLastPostId(dbCachedChannel.Id, channel.LastId)
+			cache.UpdateNewestPostAt(dbCachedChannel.Id, channel.NewestPostAt)
+			newDbPosts, err := cache.SavePosts(dbCachedChannel.Id, posts)
+			if err != nil {
+				fmt.Printf("Can't save posts -%s\n", err)
+				return result, nil
+			}
+			saveValidators(cache, dbCachedChannel, channel)
+
+			if options.FetchOrder == FetchAscending {
+				for i, j := 0, len(newDbPosts)-1; i < j; i, j = i+1, j-1 {
+					newDbPosts[i], newDbPosts[j] = newDbPosts[j], newDbPosts[i]
+				}
+			}
+			dbPosts, err = withCachedPosts(cache, dbCachedChannel.Id, newDbPosts, options.serveLimit())
+			if err != nil {
+				fmt.Printf("Problem with cached posts: %s\n", err)
+			}
+			if options.PinnedFirst {
+				dbPosts = pinPost(cache, fetcher, dbCachedChannel, dbPosts)
+			}
+			if options.LeanStorage {
+				hydratePosts(fetcher, options.Contents, channel.Name, dbPosts, posts)
+			}
+
+			result.Feed = generateFeed(dbCachedChannel, dbPosts, options)
+
+			return result, nil
+		}
+	} else {
+		fmt.Printf("Fetch telegram channel failed: %s\n", err)
+
+		return result, err
+	}
+}
+
+// withCachedPosts fills up the just saved posts, newest first, with older
+// cached ones to limit posts, so a fetch of a few new posts still serves a
+// full feed.
+func withCachedPosts(cache Cache, channelId int, saved []DbPost, limit int) ([]DbPost, error) {
+	if len(saved) >= limit {
+		return saved[:limit], nil
+	}
+
+	cached, err := cache.GetPosts(channelId, limit)
+	if err != nil {
+		return saved, err
+	}
+
+	ids := map[int]bool{}
+	for _, post := range saved {
+		ids[post.Id] = true
+	}
+	posts := saved
+	for _, post := range cached {
+		if len(posts) >= limit {
+			break
+		}
+		if !ids[post.Id] {
+			posts = append(posts, post)
+		}
+	}
+	return posts, nil
+}
+
+// saveValidators stores the validators of a fetched channel page once its
+// posts are cached, a 304 for it then serves them, with the page's views
+// and edited posts to refresh them again. They aren't stored when the
+// posts failed to download, so the page is fetched again in full.
+func saveValidators(cache Cache, dbChannel DbChannel, channel Channel) {
+	if channel.Validators == dbChannel.Validators {
+		return
+	}
+	if err := cache.UpdatePageState(dbChannel.Id, PageState{Views: channel.Views, Edited: channel.Edited}); err != nil {
+		fmt.Printf("[%s] Can't store page state: %s\n", channel.Name, err)
+		return
+	}
+	if err := cache.UpdateValidators(dbChannel.Id, channel.Validators); err != nil {
+		fmt.Printf("[%s] Can't store page validators: %s\n", channel.Name, err)
+	}
+}
+
+// refreshPage applies what the channel page tells about cached posts:
+// their views, edits and, through them, comments.
+func refreshPage(cache Cache, fetcher Fetcher, dbChannel DbChannel, channel Channel) {
+	if len(channel.Views) > 0 {
+		if err := cache.UpdatePostViews(dbChannel.Id, channel.Views); err != nil {
+			fmt.Printf("Can't update post views: %s\n", err)
+		}
+	}
+
+	if len(channel.Edited) > 0 {
+		if err := refreshEditedPosts(cache, fetcher, dbChannel, channel.Edited); err != nil {
+			fmt.Printf("Can't refresh edited posts: %s\n", err)
+		}
+	}
+
+	if len(channel.Views) > 0 {
+		if err := refreshPostComments(cache, fetcher, dbChannel, channel.Views); err != nil {
+			fmt.Printf("Can't refresh post comments: %s\n", err)
+		}
+	}
+}
+
+// pinPost marks the channel's stored pinned post to be shown first. When
+// it isn't among posts, e.g. an old announcement, it's read from the
+// cache, and fetched and cached once if it isn't cached yet.
+func pinPost(cache Cache, fetcher Fetcher, channel DbChannel, posts []DbPost) []DbPost {
+	if channel.PinnedId <= 0 {
+		return posts
+	}
+
+	for i := range posts {
+		if posts[i].MessageId == channel.PinnedId {
+			posts[i].Pinned = true
+			return posts
+		}
+	}
+
+	pinned, err := cache.GetPostsById(channel.Id, []int{channel.PinnedId})
+	if err != nil {
+		fmt.Printf("[%s] Can't get pinned post %d: %s\n", channel.Name, channel.PinnedId, err)
+		return posts
+	}
+	if len(pinned) == 0 {
+		post, err := fetcher.FetchPost(channel.Name, channel.PinnedId)
+		if err != nil {
+			fmt.Printf("[%s] Can't fetch pinned post %d: %s\n", channel.Name, channel.PinnedId, err)
+			return posts
+		}
+		post.Link = tgPostUrl(channel.Name, channel.PinnedId)
+		post.MessageId = channel.PinnedId
+
+		pinned, err = cache.SavePosts(channel.Id, []Post{post})
+		if err != nil || len(pinned) == 0 {
+			fmt.Printf("[%s] Can't cache pinned post %d: %v\n", channel.Name, channel.PinnedId, err)
+			return posts
+		}
+	}
+
+	pinned[0].Pinned = true
+	return append([]DbPost{pinned[0]}, posts...)
+}
+
+// savePinnedId stores the pinned message of a fetched channel page. Pages
+// without a pin service message keep the stored one.
+func savePinnedId(cache Cache, dbChannel *DbChannel, channel Channel) {
+	if channel.PinnedId <= 0 || channel.PinnedId == dbChannel.PinnedId {
+		return
+	}
+	if err := cache.UpdatePinnedId(dbChannel.Id, channel.PinnedId); err != nil {
+		fmt.Printf("[%s] Can't store pinned post id: %s\n", channel.Name, err)
+		return
+	}
+	dbChannel.PinnedId = channel.PinnedId
+}
+
+// hydratePosts fills in the contents of posts stored by a LeanCache, taking
+// them from the just fetched posts, from contents or fetching them again
+// with the caller holding a fetch slot. A nil fetcher fetches nothing.
+// Posts failing to download keep their header, and none are fetched once
+// Telegram is unavailable. It returns the posts fetched and failed.
+func hydratePosts(fetcher Fetcher, contents *PostContents, channelName string, dbPosts []DbPost, fetched []Post) (int, int) {
+	byId := map[int]Post{}
+	for _, post := range fetched {
+		byId[post.MessageId] = post
+	}
+
+	var fetchedPosts, failures int
+	for i := range dbPosts {
+		dbPost := &dbPosts[i]
+		if dbPost.Content != "" || dbPost.MessageId <= 0 {
+			continue
+		}
+
+		post, ok := byId[dbPost.MessageId]
+		if !ok {
+			post, ok = contents.Get(channelName, *dbPost)
+		}
+		if !ok && fetcher == nil {
+			continue
+		}
+		if !ok {
+			var err error
+			post, err = fetcher.FetchPost(channelName, dbPost.MessageId)
+			if err != nil {
+				fmt.Printf("[%s] Can't fetch content of post %d: %s\n", channelName, dbPost.MessageId, err)
+				failures++
+				if errors.Is(err, ErrTelegramUnavailable) || errors.Is(err, ErrCircuitOpen) {
+					break
+				}
+				continue
+			}
+			fetchedPosts++
+		}
+		contents.Save(channelName, *dbPost, post)
+
+		dbPost.Content = post.Content
+		dbPost.ContentHtml = post.ContentHtml
+		dbPost.Media = post.Media
+		dbPost.Reactions = post.Reactions
+		dbPost.TopComments = post.TopComments
+	}
+	return fetchedPosts, failures
+}
+
+// hasLeanPosts reports whether hydratePosts left posts without contents.
+func hasLeanPosts(dbPosts []DbPost) bool {
+	for _, dbPost := range dbPosts {
+		if dbPost.Content == "" && dbPost.MessageId > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// MAX_CACHED_CONTENTS bounds the PostContents, which are dropped as a whole
+// when full.
+const MAX_CACHED_CONTENTS = 10000
+
+type postContentKey struct {
+	channel   string
+	messageId int
+}
+
+type postContent struct {
+	post      Post
+	updatedAt time.Time
+}
+
+// PostContents keeps the contents hydratePosts fetched in memory by channel
+// and message id, so LeanStorage feeds don't fetch every post again. A
+// content is dropped once its post is updated. A nil PostContents keeps
+// nothing.
+type PostContents struct {
+	mu       sync.Mutex
+	contents map[postContentKey]postContent
+}
+
+func NewPostContents() *PostContents {
+	return &PostContents{contents: map[postContentKey]postContent{}}
+}
+
+// Get returns the content kept for dbPost of channelName.
+func (contents *PostContents) Get(channelName string, dbPost DbPost) (Post, bool) {
+	if contents == nil {
+		return Post{}, false
+	}
+
+	contents.mu.Lock()
+	defer contents.mu.Unlock()
+	content, ok := contents.contents[postContentKey{strings.ToLower(channelName), dbPost.MessageId}]
+	if !ok || !content.updatedAt.Equal(dbPost.UpdatedAt) {
+		return Post{}, false
+	}
+	return content.post, true
+}
+
+// Save keeps the content of dbPost of channelName.
+func (contents *PostContents) Save(channelName string, dbPost DbPost, post Post) {
+	if contents == nil {
+		return
+	}
+
+	contents.mu.Lock()
+	defer contents.mu.Unlock()
+	if len(contents.contents) >= MAX_CACHED_CONTENTS {
+		contents.contents = map[postContentKey]postContent{}
+	}
+	contents.contents[postContentKey{strings.ToLower(channelName), dbPost.MessageId}] = postContent{post: post, updatedAt: dbPost.UpdatedAt}
+}
+
+// ChannelDiff compares the newest posts on Telegram with the cached ones.
+type ChannelDiff struct {
+	Channel      string `json:"channel"`
+	LiveLastId   int    `json:"liveLastId"`
+	CachedLastId int    `json:"cachedLastId"`
+
+	// New posts are on Telegram but not cached.
+	New []int `json:"new"`
+	// Missing posts are cached but no longer on Telegram, within the range
+	// of fetched ids.
+	Missing []int `json:"missing"`
+	// Changed posts differ between Telegram and the cache.
+	Changed []ChangedPost `json:"changed"`
+
+	// FetchFailures counts posts that failed to download, they can show up
+	// as missing.
+	FetchFailures int `json:"fetchFailures"`
+}
+
+// ChangedPost lists the fields of a post that differ from the cache.
+type ChangedPost struct {
+	Id     int      `json:"id"`
+	Fields []string `json:"fields"`
+}
+
+// diffChannel fetches the newest MAX_RSS_POSTS_COUNT posts of a cached
+// channel and compares them with the cached posts by message id, without
+// saving anything.
+func diffChannel(channelName string, cache Cache, fetcher Fetcher, limiter *FetchLimiter) (ChannelDiff, error) {
+	cachedChannel, err := cache.GetChannel(channelName)
+	if err != nil {
+		return ChannelDiff{}, err
+	}
+	cachedPosts, err := cache.GetPosts(cachedChannel.Id, MAX_RSS_POSTS_COUNT)
+	if err != nil {
+		return ChannelDiff{}, err
+	}
+
+	if err := limiter.Acquire(); err != nil {
+		return ChannelDiff{}, err
+	}
+	defer limiter.Release()
+
+	channel, err := fetcher.FetchChannel(channelName)
+	if err != nil {
+		return ChannelDiff{}, err
+	}
+	livePosts, failures, _ := fetchPostsDescending(fetcher, channel, 0, time.Time{}, false, MAX_RSS_POSTS_COUNT)
+
+	diff := ChannelDiff{
+		Channel:       cachedChannel.Name,
+		LiveLastId:    channel.LastId,
+		CachedLastId:  cachedChannel.LastId,
+		New:           []int{},
+		Missing:       []int{},
+		Changed:       []ChangedPost{},
+		FetchFailures: failures,
+	}
+
+	cached := map[int]DbPost{}
+	for _, post := range cachedPosts {
+		cached[post.MessageId] = post
+	}
+
+	live := map[int]bool{}
+	oldestLiveId := channel.LastId
+	for _, post := range livePosts {
+		live[post.MessageId] = true
+		if post.MessageId < oldestLiveId {
+			oldestLiveId = post.MessageId
+		}
+
+		cachedPost, ok := cached[post.MessageId]
+		if !ok {
+			diff.New = append(diff.New, post.MessageId)
+			continue
+		}
+
+		var fields []string
+		if post.Header != cachedPost.Header {
+			fields = append(fields, "header")
+		}
+		if post.Content != cachedPost.Content {
+			fields = append(fields, "content")
+		}
+		if !post.CreatedAt.Equal(cachedPost.CreatedAt) {
+			fields = append(fields, "createdAt")
+		}
+		if post.Author != cachedPost.Author {
+			fields = append(fields, "author")
+		}
+		if !reflect.DeepEqual(post.Media, cachedPost.Media) && (len(post.Media) > 0 || len(cachedPost.Media) > 0) {
+			fields = append(fields, "media")
+		}
+		if len(fields) > 0 {
+			diff.Changed = append(diff.Changed, ChangedPost{Id: post.MessageId, Fields: fields})
+		}
+	}
+
+	for _, post := range cachedPosts {
+		if post.MessageId >= oldestLiveId && post.MessageId <= channel.LastId && !live[post.MessageId] {
+			diff.Missing = append(diff.Missing, post.MessageId)
+		}
+	}
+	return diff, nil
+}
+
+// refreshEditedPosts downloads cached posts that the channel page marks as
+// edited again and stores their new text. Telegram only tells that a post
+// was edited, not when, so a post is refreshed once, after its first edit
+// is noticed.
+func refreshEditedPosts(cache Cache, fetcher Fetcher, channel DbChannel, edited []int) error {
+	cached, err := cache.GetPosts(channel.Id, MAX_RSS_POSTS_COUNT)
+	if err != nil {
+		return err
+	}
+
+	stale := map[int]bool{}
+	for _, post := range cached {
+		if post.MessageId != 0 && post.UpdatedAt.IsZero() {
+			stale[post.MessageId] = true
+		}
+	}
+
+	var posts []Post
+	for _, id := range edited {
+		if !stale[id] {
+			continue
+		}
+
+		fmt.Printf("[%s] Download edited post: %d\n", channel.Name, id)
+		post, err := fetcher.FetchPost(channel.Name, id)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			if errors.Is(err, ErrCircuitOpen) {
+				break
+			}
+			continue
+		}
+		posts = append(posts, post)
+	}
+
+	if len(posts) == 0 {
+		return nil
+	}
+	return cache.UpdateEditedPosts(channel.Id, posts)
+}
+
+// COMMENTS_REFRESH_AGE is the age of posts after which their comment
+// counts are no longer refreshed, discussions mostly die down by then.
+const COMMENTS_REFRESH_AGE = 24 * time.Hour
+
+// refreshPostComments fetches the comments of cached posts on the channel
+// page again, the ones given views, as their counts keep growing after
+// the posts are downloaded. Only posts newer than COMMENTS_REFRESH_AGE are
+// refreshed, each is a request to the discussion widget.
+func refreshPostComments(cache Cache, fetcher Fetcher, channel DbChannel, views map[int]int) error {
+	commentsFetcher, ok := fetcher.(CommentsFetcher)
+	if !ok {
+		return nil
+	}
+
+	ids := make([]int, 0, len(views))
+	for id := range views {
+		ids = append(ids, id)
+	}
+	cached, err := cache.GetPostsById(channel.Id, ids)
+	if err != nil {
+		return err
+	}
+
+	refreshAfter := time.Now().Add(-COMMENTS_REFRESH_AGE)
+	var posts []Post
+	for _, post := range cached {
+		if post.MessageId == 0 || post.CreatedAt.Before(refreshAfter) {
+			continue
+		}
+
+		comments, topComments, err := commentsFetcher.FetchComments(channel.Name, post.MessageId)
+		if errors.Is(err, ErrCommentsUnsupported) {
+			return nil
+		} else if err != nil {
+			fmt.Printf("[%s] Can't refresh comments of post %d: %s\n", channel.Name, post.MessageId, err)
+			if errors.Is(err, ErrCircuitOpen) {
+				break
+			}
+			continue
+		}
+		if comments != post.Comments || !reflect.DeepEqual(topComments, post.TopComments) {
+			posts = append(posts, Post{MessageId: post.MessageId, Comments: comments, TopComments: topComments})
+		}
+	}
+
+	if len(posts) == 0 {
+		return nil
+	}
+	return cache.UpdatePostComments(channel.Id, posts)
+}
+
+// fetchPostsDescending downloads posts from the newest one down to the
+// cached LastId, until limit posts are fetched. Album parts
+// aren't fetched, their media come with the album's first message. Failed
+// posts are skipped and counted in failures. Posts published at the same time as
+// the previous one are dropped unless keepSameTime is set.
+func fetchPostsDescending(fetcher Fetcher, channel Channel, cachedLastId int, newestPostTime time.Time, keepSameTime bool, limit int) (posts []Post, failures int, fetchedAny bool) {
+	parts := albumParts(channel)
+	for postId := channel.LastId; postId > cachedLastId && len(posts) < limit; postId-- {
+		if parts[postId] {
+			continue
+		}
+		fmt.Printf("[%s] Download Post: %d\n", channel.Name, postId)
+
+		post, err := fetcher.FetchPost(channel.Name, postId)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			failures++
+			if errors.Is(err, ErrCircuitOpen) {
+				break
+			}
+			continue
+		}
+		fetchedAny = true
+		mergeAlbum(&post, channel)
+
+		// Message ids can be sparse or reset, so also stop once we reach
+		// posts that are not newer than the newest cached one.
+		if !newestPostTime.IsZero() && !post.CreatedAt.After(newestPostTime) {
+			break
+		}
+
+		if !keepSameTime && len(posts) > 0 && post.CreatedAt == posts[len(posts)-1].CreatedAt {
+			fmt.Printf("Duplicated post")
+			continue
+		}
+
+		posts = append(posts, post)
+	}
+	return posts, failures, fetchedAny
+}
+
+// fetchPostsAscending downloads the same range as fetchPostsDescending in
+// chronological order, so posts are stored and logged oldest first. The
+// range is the newest limit ids above the cached LastId; failed posts
+// aren't made up for by older ones.
+func fetchPostsAscending(fetcher Fetcher, channel Channel, cachedLastId int, newestPostTime time.Time, keepSameTime bool, limit int) (posts []Post, failures int, fetchedAny bool) {
+	firstId := channel.LastId - limit + 1
+	if firstId <= cachedLastId {
+		firstId = cachedLastId + 1
+	}
+	if firstId < 1 {
+		firstId = 1
+	}
+
+	parts := albumParts(channel)
+	for postId := firstId; postId <= channel.LastId; postId++ {
+		if parts[postId] {
+			continue
+		}
+		fmt.Printf("[%s] Download Post: %d\n", channel.Name, postId)
+
+		post, err := fetcher.FetchPost(channel.Name, postId)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			failures++
+			if errors.Is(err, ErrCircuitOpen) {
+				break
+			}
+			continue
+		}
+		fetchedAny = true
+		mergeAlbum(&post, channel)
+
+		if !newestPostTime.IsZero() && !post.CreatedAt.After(newestPostTime) {
+			continue
+		}
+
+		if !keepSameTime && len(posts) > 0 && post.CreatedAt == posts[len(posts)-1].CreatedAt {
+			fmt.Printf("Duplicated post")
+			continue
+		}
+
+		posts = append(posts, post)
+	}
+	return posts, failures, fetchedAny
+}
+
+// feedDescription is the channel description, or the fallback for channels
+// without one: the title or the newest post's header (its text for short
+// posts, which have no header).
+func feedDescription(channel DbChannel, posts []DbPost, fallback string) string {
+	if channel.Description != "" {
+		return channel.Description
+	}
+
+	switch fallback {
+	case DescriptionFallbackTitle:
+		return channel.DisplayTitle()
+	case DescriptionFallbackPost:
+		var newest *DbPost
+		for i := range posts {
+			if newest == nil || posts[i].CreatedAt.After(newest.CreatedAt) {
+				newest = &posts[i]
+			}
+		}
+		if newest == nil {
+			return ""
+		}
+		if newest.Header != "" {
+			return newest.Header
+		}
+		return newest.Content
+	}
+	return ""
+}
+
+// cachedFeed builds a feed from cached posts only, without fetching the
+// channel from Telegram, though LeanStorage posts still get their contents
+// through fetcher unless it's nil. Channels that aren't cached yet fail
+// with sql.ErrNoRows.
+func cachedFeed(channelName string, cache Cache, fetcher Fetcher, limiter *FetchLimiter, options FeedOptions) (*feeds.Feed, error) {
+	return cachedFeedPage(channelName, cache, fetcher, limiter, options, 1)
+}
+
+// cachedFeedPage builds a page of options.serveLimit() cached posts, newest
+// first, the first page is cachedFeed. Pages past the cached posts fail
+// with ErrPageNotFound.
+func cachedFeedPage(channelName string, cache Cache, fetcher Fetcher, limiter *FetchLimiter, options FeedOptions, page int) (*feeds.Feed, error) {
+	channel, err := cache.GetChannel(channelName)
+	if err != nil {
+		return nil, err
+	}
+
+	pageSize := options.serveLimit()
+	posts, err := cache.GetPostsPage(channel.Id, (page-1)*pageSize, pageSize, false)
+	if err != nil {
+		return nil, err
+	}
+	if page > 1 && len(posts) == 0 {
+		return nil, ErrPageNotFound
+	}
+	if options.LeanStorage {
+		// A fetch slot is only taken for the posts left without contents.
+		hydratePosts(nil, options.Contents, channel.Name, posts, nil)
+		if fetcher != nil && hasLeanPosts(posts) {
+			if err := limiter.Acquire(); err != nil {
+				return nil, err
+			}
+			hydratePosts(fetcher, options.Contents, channel.Name, posts, nil)
+			limiter.Release()
+		}
+	}
+
+	return generateFeed(channel, posts, options), nil
+}
+
+// feedPageLinks links page of a channel feed to its neighbours by the
+// number of cached posts, pageSize per page. Feeds of channels with a
+// single page get no links.
+func feedPageLinks(channelName string, cache Cache, page int, pageSize int, pageUrl func(page int) string) (FeedPage, error) {
+	channel, err := cache.GetChannel(channelName)
+	if err != nil {
+		return FeedPage{}, err
+	}
+	total, err := cache.CountPosts(channel.Id)
+	if err != nil {
+		return FeedPage{}, err
+	}
+
+	var links FeedPage
+	pages := (total + pageSize - 1) / pageSize
+	if page > 1 {
+		links.Prev = pageUrl(page - 1)
+	}
+	if page < pages {
+		links.Next = pageUrl(page + 1)
+	}
+	return links, nil
+}
+
+// recordFeedResult reports how a channel feed was prepared in response
+// headers, with the time taken as Server-Timing, and on /metrics. It
+// returns FeedCacheHit or FeedCacheMiss.
+func recordFeedResult(c *gin.Context, result FeedResult) string {
+	cacheStatus := FeedCacheMiss
+	if result.CacheHit {
+		cacheStatus = FeedCacheHit
+	}
+	c.Header(CACHE_HEADER, strings.ToUpper(cacheStatus))
+	c.Header(FETCHED_POSTS_HEADER, strconv.Itoa(result.FetchedPosts))
+	c.Header("Server-Timing", fmt.Sprintf("prepare;dur=%.1f", float64(result.Duration.Microseconds())/1000))
+
+	feedRequests.Add(cacheStatus, 1)
+	fetchedPosts.Add(int64(result.FetchedPosts))
+	return cacheStatus
+}
+
+// How served feeds were prepared: from the cache because the channel had
+// no new posts, with new posts downloaded, from the cache only as asked by
+// ?cached, from the cache while Telegram requests are paused, or from the
+// cache after the fetch failed.
+const (
+	FeedCacheHit      = "hit"
+	FeedCacheMiss     = "miss"
+	FeedCacheOnly     = "cached"
+	FeedCacheDegraded = "degraded"
+	FeedCacheStale    = "stale"
+)
+
+// isStaleable reports whether a feed that failed with err may be served
+// from the cache with -servestale. Channels that are gone or restricted
+// aren't, and circuit breaker pauses are served degraded instead.
+func isStaleable(err error) bool {
+	return !errors.Is(err, sql.ErrNoRows) && !errors.Is(err, ErrChannelPreviewOnly) &&
+		!errors.Is(err, ErrChannelRestricted) && !errors.Is(err, ErrCircuitOpen)
+}
+
+// ServedFeed is a FeedLog line.
+type ServedFeed struct {
+	Channel  string
+	Format   string
+	Items    int
+	Cache    string
+	Bytes    int
+	Duration time.Duration
+}
+
+// FeedLog writes a JSON line for every served channel feed, for log
+// aggregators. A nil FeedLog logs nothing.
+type FeedLog struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func NewFeedLog(out io.Writer) *FeedLog {
+	return &FeedLog{out: out}
+}
+
+func (feedLog *FeedLog) Log(feed ServedFeed) {
+	if feedLog == nil {
+		return
+	}
+
+	line, err := json.Marshal(map[string]interface{}{
+		"time":       time.Now().UTC().Format(time.RFC3339Nano),
+		"level":      "info",
+		"msg":        "feed served",
+		"channel":    feed.Channel,
+		"format":     feed.Format,
+		"items":      feed.Items,
+		"cache":      feed.Cache,
+		"bytes":      feed.Bytes,
+		"durationMs": float64(feed.Duration.Microseconds()) / 1000,
+	})
+	if err != nil {
+		fmt.Printf("Can't log served feed: %s\n", err)
+		return
+	}
+
+	feedLog.mu.Lock()
+	defer feedLog.mu.Unlock()
+	feedLog.out.Write(append(line, '\n'))
+}
+
+const (
+	FilterExclude = "exclude"
+	FilterInclude = "include"
+	FilterFlag    = "flag"
+)
+
+// FLAGGED_TITLE_PREFIX is put in front of the titles of posts matching a
+// flag rule, or of the start of their text when they have no title.
+const FLAGGED_TITLE_PREFIX = "[Flagged] "
+
+// FilterRule matches the content of posts of one channel, or of every
+// channel when Channel is "*".
+type FilterRule struct {
+	Channel string
+	Action  string
+	Pattern *regexp.Regexp
+}
+
+// FilterRules are applied to posts when feeds are built, so rules can change
+// without fetching the posts again. Posts matching an exclude rule are
+// dropped. When include rules apply to a channel, only its posts matching one
+// of them are kept. Posts matching a flag rule get FLAGGED_TITLE_PREFIX.
+type FilterRules struct {
+	rules []FilterRule
+}
+
+// readFilterRules reads rules, one per line, as "<channel> <action>
+// <regex>", e.g. "* exclude (?i)#ad". Blank lines and # comments are
+// skipped.
+func readFilterRules(path string) (*FilterRules, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := &FilterRules{}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 || strings.TrimSpace(fields[2]) == "" {
+			return nil, fmt.Errorf("Invalid rule %q", line)
+		}
+		channel, action := fields[0], fields[1]
+		if channel != "*" && !shardChannelName.MatchString(channel) {
+			return nil, fmt.Errorf("Invalid channel name %q", channel)
+		}
+		if action != FilterExclude && action != FilterInclude && action != FilterFlag {
+			return nil, fmt.Errorf("Invalid action %q", action)
+		}
+		pattern, err := regexp.Compile(strings.TrimSpace(fields[2]))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pattern %q: %w", fields[2], err)
+		}
+		rules.rules = append(rules.rules, FilterRule{Channel: channel, Action: action, Pattern: pattern})
+	}
+	return rules, nil
+}
+
+// Apply drops and flags posts of channelName, the posts are left as they are
+// with nil rules.
+func (rules *FilterRules) Apply(channelName string, posts []DbPost) []DbPost {
+	if rules == nil || len(rules.rules) == 0 {
+		return posts
+	}
+
+	var filtered []DbPost
+	for _, post := range posts {
+		included, hasInclude, excluded, flagged := false, false, false, false
+		for _, rule := range rules.rules {
+			if rule.Channel != "*" && !strings.EqualFold(rule.Channel, channelName) {
+				continue
+			}
+			if rule.Action == FilterInclude {
+				hasInclude = true
+			}
+			if !rule.Pattern.MatchString(post.Content) {
+				continue
+			}
+			switch rule.Action {
+			case FilterExclude:
+				excluded = true
+			case FilterInclude:
+				included = true
+			case FilterFlag:
+				flagged = true
+			}
+		}
+
+		if excluded || (hasInclude && !included) {
+			continue
+		}
+		if flagged {
+			// Flagged posts without a header are titled with their text,
+			// so the prefix isn't all of the title.
+			header := post.Header
+			if header == "" {
+				header = untitledTitle(post.Content)
+			}
+			post.Header = strings.TrimSpace(FLAGGED_TITLE_PREFIX + header)
+		}
+		filtered = append(filtered, post)
+	}
+	return filtered
+}
+
+// combinedPosts merges the cached posts of several channels, newest first.
+// Each channel contributes at most perChannel posts before the merged list is
+// cut to limit, so a channel posting a lot doesn't crowd out the others.
+// Filters are applied per channel and unsigned posts are attributed to their
+// channel.
+func combinedPosts(cache Cache, channels []DbChannel, perChannel int, limit int, filters *FilterRules) ([]DbPost, error) {
+	var posts []DbPost
+	for _, channel := range channels {
+		channelPosts, err := cache.GetPosts(channel.Id, perChannel)
+		if err != nil {
+			return nil, err
+		}
+		channelPosts = filters.Apply(channel.Name, channelPosts)
+
+		for _, post := range channelPosts {
+			if post.Author == "" {
+				post.Author = channel.DisplayTitle()
+				if post.Author == "" {
+					post.Author = channel.Name
+				}
+			}
+			posts = append(posts, post)
+		}
+	}
+
+	sort.SliceStable(posts, func(i, j int) bool {
+		return posts[i].CreatedAt.After(posts[j].CreatedAt)
+	})
+	if len(posts) > limit {
+		posts = posts[:limit]
+	}
+
+	return posts, nil
+}
+
+func generateFeed(channel DbChannel, posts []DbPost, options FeedOptions) *feeds.Feed {
+	title := channel.Name
+	if channel.TitleOverride != "" {
+		title = channel.TitleOverride
+	}
+
+	feed := &feeds.Feed{
+		Title:       sanitizeXml(title),
+		Link:        &feeds.Link{Href: displayLink(feedLink(channel.Link, options.FeedLink), options.LinkDomain)},
+		Description: sanitizeXml(feedDescription(channel, posts, options.DescriptionFallback)),
+	}
+
+	posts = options.Filters.Apply(channel.Name, posts)
+
+	if options.SortBy == SortByFirstSeen {
+		posts = append([]DbPost{}, posts...)
+		sort.SliceStable(posts, func(i, j int) bool {
+			return posts[i].FirstSeenAt.After(posts[j].FirstSeenAt)
+		})
+	}
+
+	if options.CollapseSameTime {
+		posts = collapseSameTime(posts)
+	}
+
+	for i, post := range posts {
+		if post.Pinned && i > 0 {
+			posts = append([]DbPost{post}, append(posts[:i:i], posts[i+1:]...)...)
+			break
+		}
+	}
+
+	var item *feeds.Item
+	var items []*feeds.Item
+	contentTemplate := options.ContentTemplate
+	if contentTemplate == nil {
+		contentTemplate = defaultContentTemplate
+	}
 
-		if lastId == -1 || currentId > lastId {
-			lastId = currentId
+	for _, post := range posts {
+		if options.MinViews > 0 && post.Views < options.MinViews {
+			continue
+		}
+		if options.MediaOnly && len(post.Media) == 0 {
+			continue
+		}
+		media := post.Media
+		post.Link = displayLink(post.Link, options.LinkDomain)
+		if options.TextOnly {
+			post.Media = nil
 		}
-	})
 
-	if lastId == -1 {
-		return Channel{}, errors.New("Can't parse channel page")
+		var content strings.Builder
+		if err := contentTemplate.Execute(&content, post); err != nil {
+			fmt.Printf("Can't render content of %s: %s\n", post.Link, err)
+			content.Reset()
+			content.WriteString(post.Content)
+		}
+		if options.TextOnly {
+			// Custom templates may embed media themselves.
+			stripped := embeddedMedia.ReplaceAllString(content.String(), "")
+			content.Reset()
+			content.WriteString(stripped)
+		}
+		if options.IncludeReactions && len(post.Reactions) > 0 {
+			content.WriteString("\n\n" + formatReactions(post.Reactions))
+		}
+		if post.Comments > 0 {
+			content.WriteString("\n\n" + formatComments(post.Comments, post.TopComments))
+		}
+
+		createdAt := post.CreatedAt
+		if options.Location != nil {
+			createdAt = createdAt.In(options.Location)
+		}
+
+		title := post.Header
+		if options.TitleIds && post.MessageId > 0 {
+			title = strings.TrimSpace(fmt.Sprintf("[#%d] %s", post.MessageId, title))
+		}
+		if options.EditedMarker && (post.Edited || !post.UpdatedAt.IsZero()) {
+			title = strings.TrimSpace(title + " (edited)")
+		}
+
+		author := post.Author
+		if author == "" {
+			author = channel.DisplayTitle()
+		}
+
+		updatedAt := post.UpdatedAt
+		if options.Location != nil && !updatedAt.IsZero() {
+			updatedAt = updatedAt.In(options.Location)
+		}
+		if updatedAt.After(feed.Updated) {
+			feed.Updated = updatedAt
+		}
+		if createdAt.After(feed.Updated) {
+			feed.Updated = createdAt
+		}
+
+		item = &feeds.Item{
+			Title:       sanitizeXml(title),
+			Link:        &feeds.Link{Href: post.Link},
+			Description: sanitizeXml(content.String()),
+			Created:     createdAt,
+			Updated:     updatedAt,
+		}
+		// Audio is attached for podcast readers, which play enclosures.
+		if audio, ok := audioMedia(media); ok {
+			mimeType, length := options.Enclosures.Sniff(audio)
+			item.Enclosure = &feeds.Enclosure{Url: audio.Url, Length: length, Type: mimeType}
+		} else if options.MediaOnly {
+			mimeType, length := options.Enclosures.Sniff(media[0])
+			item.Enclosure = &feeds.Enclosure{Url: media[0].Url, Length: length, Type: mimeType}
+		}
+		if options.SplitContent {
+			summary := post.Header
+			if summary == "" {
+				summary = post.Content
+			}
+			item.Content = item.Description
+			item.Description = sanitizeXml(htmltemplate.HTMLEscapeString(summary))
+		}
+		if author != "" {
+			item.Author = &feeds.Author{Name: sanitizeXml(author)}
+		}
+
+		items = append(items, item)
 	}
 
-	doc.Find(".tgme_channel_info_header_title").Each(func(i int, s *goquery.Selection) {
-		title = s.Find("span").Text()
-	})
+	feed.Items = items
 
-	doc.Find(".tgme_channel_info_description").Each(func(i int, s *goquery.Selection) {
-		description = s.Text()
-	})
+	return feed
+}
 
-	channel := Channel{Name: channelName, Title: title, LastId: lastId, Link: url, Description: description}
-	return channel, nil
+// mediaMimeTypes maps media file extensions to MIME types.
+var mediaMimeTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".webp": "image/webp",
+	".gif":  "image/gif",
+	".mp4":  "video/mp4",
+	".webm": "video/webm",
+	".mov":  "video/quicktime",
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
 }
 
-func (fetcher *TelegramWebFetcher) FetchPost(channelName string, id int) (Post, error) {
-	url := tgChannelPostUrl(channelName, id)
+// mediaMimeType guesses the MIME type of a media url from its extension,
+// falling back to JPEG photos, MP4 videos and Ogg audio, Telegram's usual
+// formats.
+func mediaMimeType(media Media) string {
+	if parsed, err := url.Parse(media.Url); err == nil {
+		if mimeType, ok := mediaMimeTypes[strings.ToLower(filepath.Ext(parsed.Path))]; ok {
+			return mimeType
+		}
+	}
+	switch media.Type {
+	case MediaVideo:
+		return "video/mp4"
+	case MediaAudio, MediaVoice:
+		return "audio/ogg"
+	}
+	return "image/jpeg"
+}
 
-	resp, err := http.Get(url)
-	if err != nil {
-		fmt.Println(err)
-		return Post{}, err
+// audioMedia is the first voice message or audio file of a post.
+func audioMedia(media []Media) (Media, bool) {
+	for _, item := range media {
+		if item.Type == MediaAudio || item.Type == MediaVoice {
+			return item, true
+		}
 	}
-	defer resp.Body.Close()
+	return Media{}, false
+}
 
-	doc, err := goquery.NewDocumentFromReader(resp.Body)
-	if err != nil {
-		return Post{}, err
+// MAX_SNIFFED_ENCLOSURES bounds the EnclosureSniffer cache, which is
+// dropped as a whole when full.
+const MAX_SNIFFED_ENCLOSURES = 10000
+
+type sniffedEnclosure struct {
+	mimeType string
+	length   string
+}
+
+// EnclosureSniffer finds the MIME type and size of enclosures with a HEAD
+// request to the media url. Results, including failed lookups, are cached
+// by url so every media file is requested at most once. A nil
+// EnclosureSniffer only guesses.
+type EnclosureSniffer struct {
+	client *http.Client
+	mu     sync.Mutex
+	cache  map[string]sniffedEnclosure
+}
+
+func NewEnclosureSniffer(client *http.Client) *EnclosureSniffer {
+	if client == nil {
+		client = http.DefaultClient
 	}
+	return &EnclosureSniffer{client: client, cache: map[string]sniffedEnclosure{}}
+}
 
-	error_message := ""
-	doc.Find(".tgme_widget_message_error").Each(func(i int, s *goquery.Selection) {
-		error_message = s.Text()
-	})
+// Sniff returns the MIME type and length of media as enclosure attributes.
+// When the HEAD request fails or leaves them out, the type is guessed with
+// mediaMimeType and the length is "0", which RSS readers accept for
+// unknown.
+func (sniffer *EnclosureSniffer) Sniff(media Media) (string, string) {
+	if sniffer == nil {
+		return mediaMimeType(media), "0"
+	}
 
-	if error_message != "" {
-		return Post{}, errors.New(error_message)
+	sniffer.mu.Lock()
+	enclosure, ok := sniffer.cache[media.Url]
+	sniffer.mu.Unlock()
+	if ok {
+		return enclosure.mimeType, enclosure.length
 	}
 
-	var content string
-	doc.Find(".tgme_widget_message_text.js-message_text").Each(func(i int, s *goquery.Selection) {
-		content = s.Text()
-	})
+	enclosure = sniffedEnclosure{mimeType: mediaMimeType(media), length: "0"}
+	resp, err := sniffer.client.Head(media.Url)
+	if err != nil {
+		fmt.Printf("Can't sniff enclosure %s: %s\n", media.Url, err)
+	} else {
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			if mimeType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil {
+				enclosure.mimeType = mimeType
+			}
+			if resp.ContentLength > 0 {
+				enclosure.length = strconv.FormatInt(resp.ContentLength, 10)
+			}
+		}
+	}
 
-	var createdAt time.Time
-	layout := "2006-01-02T15:04:05Z07:00"
+	sniffer.mu.Lock()
+	if len(sniffer.cache) >= MAX_SNIFFED_ENCLOSURES {
+		sniffer.cache = map[string]sniffedEnclosure{}
+	}
+	sniffer.cache[media.Url] = enclosure
+	sniffer.mu.Unlock()
 
-	doc.Find(".tgme_widget_message_date").Each(func(i int, s *goquery.Selection) {
-		datetime, _ := s.Find("time").Attr("datetime")
-		createdAt, err = time.Parse(layout, datetime)
-		if err != nil {
-			fmt.Printf("err %s\n", err)
+	return enclosure.mimeType, enclosure.length
+}
+
+// collapseSameTime merges neighbouring posts published at the same time
+// with adjacent message ids, such as the parts of a long post, into the
+// part with the lowest id. Contents are joined in id order.
+func collapseSameTime(posts []DbPost) []DbPost {
+	var collapsed []DbPost
+	for i := 0; i < len(posts); {
+		group := []DbPost{posts[i]}
+		for i+len(group) < len(posts) {
+			next := posts[i+len(group)]
+			last := group[len(group)-1]
+			if next.MessageId == 0 || !next.CreatedAt.Equal(last.CreatedAt) || (next.MessageId-last.MessageId != 1 && last.MessageId-next.MessageId != 1) {
+				break
+			}
+			group = append(group, next)
 		}
-	})
+		i += len(group)
 
-	var headerContent string
-	if len(content) > 100 {
-		headerContent = strings.Trim(content[0:100], " ") + "..."
+		sort.SliceStable(group, func(a, b int) bool {
+			return group[a].MessageId < group[b].MessageId
+		})
+		merged := group[0]
+		for _, part := range group[1:] {
+			if merged.Header == "" {
+				merged.Header = part.Header
+			}
+			if part.Content != "" {
+				merged.Content = strings.TrimSpace(merged.Content + "\n\n" + part.Content)
+			}
+			if part.ContentHtml != "" {
+				merged.ContentHtml = strings.TrimPrefix(merged.ContentHtml+"<br><br>"+part.ContentHtml, "<br><br>")
+			}
+			merged.Media = append(append([]Media{}, merged.Media...), part.Media...)
+			merged.Views = int(math.Max(float64(merged.Views), float64(part.Views)))
+			if part.UpdatedAt.After(merged.UpdatedAt) {
+				merged.UpdatedAt = part.UpdatedAt
+			}
+			merged.Edited = merged.Edited || part.Edited
+		}
+		collapsed = append(collapsed, merged)
 	}
+	return collapsed
+}
 
-	content = content + "\n\n" + "<a href=\"" + url + "\">[link]</a>"
+// embeddedMedia matches the markup of images, videos, audio and frames
+// dropped from text-only item descriptions.
+var embeddedMedia = regexp.MustCompile(`(?is)<(video|audio|picture|iframe)\b.*?</(video|audio|picture|iframe)>|<(img|video|audio|source|iframe|embed)\b[^>]*>`)
 
-	return Post{Header: headerContent, Content: content, Link: url, CreatedAt: createdAt}, nil
+// formatReactions renders reactions as e.g. "👍 1200 · ❤ 35".
+func formatReactions(reactions []Reaction) string {
+	var parts []string
+	for _, reaction := range reactions {
+		parts = append(parts, reaction.Emoji+" "+strconv.Itoa(reaction.Count))
+	}
+	return strings.Join(parts, " · ")
 }
 
-func initDB(dbPath string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", dbPath)
-	if err != nil {
-		return nil, err
+// formatComments renders a comment count with the top comments below it,
+// e.g. "💬 12 comments" and "<br>Alice: Great post". Comments are written
+// by anyone in the discussion group, so they're escaped.
+func formatComments(count int, comments []Comment) string {
+	formatted := "💬 " + strconv.Itoa(count) + " comments"
+	if count == 1 {
+		formatted = "💬 1 comment"
+	}
+	for _, comment := range comments {
+		line := htmltemplate.HTMLEscapeString(comment.Text)
+		if comment.Author != "" {
+			line = htmltemplate.HTMLEscapeString(comment.Author) + ": " + line
+		}
+		formatted += "<br>" + line
 	}
+	return formatted
+}
 
-	createChannelsTable := `
-        CREATE TABLE IF NOT EXISTS channels (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            name TEXT UNIQUE NOT NULL,
-            title TEXT NOT NULL,
-            lastId INTEGER NOT NULL,
-            link TEXT NOT NULL,
-            description TEXT
-        );
+// sanitizeXml drops characters that are not allowed in XML 1.0, such as
+// control characters, which strict readers reject. Escaping of markup is
+// left to encoding/xml.
+func sanitizeXml(text string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t' || r == '\n' || r == '\r':
+			return r
+		case r >= 0x20 && r <= 0xD7FF:
+			return r
+		case r >= 0xE000 && r <= 0xFFFD:
+			return r
+		case r >= 0x10000 && r <= 0x10FFFF:
+			return r
+		}
+		return -1
+	}, text)
+}
 
-		CREATE UNIQUE INDEX IF NOT EXISTS channel_name ON channels(name);`
+// RSS_DOCS_URL points readers to the format of the RSS feeds.
+const RSS_DOCS_URL = "https://www.rssboard.org/rss-specification"
 
-	createPostsTable := `
-        CREATE TABLE IF NOT EXISTS posts (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            channelId INTEGER NOT NULL,
-            header TEXT NOT NULL,
-            content TEXT NOT NULL,
-            link TEXT NOT NULL,
-            createdAt DATETIME NOT NULL,
-            FOREIGN KEY(channelId) REFERENCES channels(id)
-        );`
+// feedGenerator identifies the producer of feeds, e.g. "tg-feeds/1.2.0".
+func feedGenerator() string {
+	if version == "" {
+		return "tg-feeds/dev"
+	}
+	return "tg-feeds/" + version
+}
 
-	_, err = db.Exec(createChannelsTable)
-	if err != nil {
-		return nil, err
+// rssFeed converts a feed to RSS with the channel-level elements that
+// feeds.Feed has no fields for.
+func rssFeed(feed *feeds.Feed, ttl int) *feeds.RssFeed {
+	rss := (&feeds.Rss{Feed: feed}).RssFeed()
+	rss.Ttl = ttl
+	rss.Generator = feedGenerator()
+	rss.Docs = RSS_DOCS_URL
+	return rss
+}
+
+// atomFeed converts a feed to Atom with published dates, which feeds.Atom
+// leaves out. Entry ids are derived from publish dates like feeds.Atom does
+// for entries that weren't updated, so they stay the same after an edit.
+func atomFeed(feed *feeds.Feed) *feeds.AtomFeed {
+	published := *feed
+	published.Items = make([]*feeds.Item, len(feed.Items))
+	for i, item := range feed.Items {
+		copied := *item
+		copied.Updated = time.Time{}
+		published.Items[i] = &copied
 	}
 
-	_, err = db.Exec(createPostsTable)
-	if err != nil {
-		return nil, err
+	atom := (&feeds.Atom{Feed: &published}).AtomFeed()
+	for i, item := range feed.Items {
+		entry := atom.Entries[i]
+		if !item.Created.IsZero() {
+			entry.Published = item.Created.Format(time.RFC3339)
+		}
+		if !item.Updated.IsZero() {
+			entry.Updated = item.Updated.Format(time.RFC3339)
+		}
 	}
+	return atom
+}
 
-	return db, nil
+func toRss(feed *feeds.Feed, ttl int) (string, error) {
+	return feeds.ToXML(rssFeed(feed, ttl))
 }
 
-func prepareFeed(channelName string, cache Cache, fetcher Fetcher) (*feeds.Feed, error) {
-	channel, err := fetcher.FetchChannel(channelName)
-	feed := &feeds.Feed{}
+// writeRss encodes the feed straight into w instead of building the whole
+// document in memory first.
+func writeRss(w io.Writer, feed *feeds.Feed, ttl int) error {
+	return feeds.WriteXML(rssFeed(feed, ttl), w)
+}
 
-	if err == nil {
-		dbCachedChannel, err := cache.GetChannel(channelName)
+// flushWriter flushes the response after every write, so large feeds reach
+// the client while they are encoded rather than piling up in buffers.
+type flushWriter struct {
+	w http.ResponseWriter
+}
 
-		if err != nil {
-			newChannel := Channel{Name: channel.Name, Title: channel.Title, LastId: 0, Link: channel.Link, Description: channel.Description}
-			dbCachedChannel, _ = cache.SaveChannel(newChannel)
-		}
+func (writer flushWriter) Write(data []byte) (int, error) {
+	n, err := writer.w.Write(data)
+	if flusher, ok := writer.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
 
-		var dbPosts []DbPost
-		var posts []Post
+const (
+	FormatRss  = "rss"
+	FormatAtom = "atom"
+	FormatJson = "json"
+)
 
-		if dbCachedChannel.LastId == channel.LastId {
-			dbPosts, err = cache.GetPosts(dbCachedChannel.Id, MAX_RSS_POSTS_COUNT)
-			if err == nil {
-				feed = generateFeed(dbCachedChannel, dbPosts)
+// parseChannelFormat strips a format extension such as ".atom" from the
+// requested channel. Telegram usernames can't contain dots, so anything
+// after one is the format, which takes precedence over the format query
+// parameter.
+func parseChannelFormat(channel string, format string) (string, string, error) {
+	if dot := strings.LastIndex(channel, "."); dot != -1 {
+		channel, format = channel[:dot], channel[dot+1:]
+	}
 
-				return feed, nil
-			} else {
-				fmt.Printf("Problem with cached posts: %s\n", err)
+	switch format {
+	case FormatRss, FormatAtom, FormatJson:
+		return channel, format, nil
+	}
+	return channel, format, fmt.Errorf("Invalid format: %s", format)
+}
 
-				return feed, err
-			}
-		} else {
-			var postId = channel.LastId
+func feedContentType(format string) string {
+	switch format {
+	case FormatAtom:
+		return "application/atom+xml"
+	case FormatJson:
+		return "application/feed+json"
+	}
+	return "application/xml"
+}
 
-			for postId > 0 && len(posts) < MAX_RSS_POSTS_COUNT {
-				fmt.Printf("[%s] Download Post: %d\n", channelName, postId)
+// writeFeed streams the feed to w in the given format, the ttl and mediaRss
+// only apply to RSS.
+func writeFeed(w io.Writer, feed *feeds.Feed, format string, ttl int, mediaRss bool) error {
+	return writeFeedPage(w, feed, format, ttl, mediaRss, FeedPage{})
+}
 
-				post, err := fetcher.FetchPost(channel.Name, postId)
-				postId--
+// FeedPage links a page of a paged feed (RFC 5005) to the page of newer
+// posts, Prev, and of older posts, Next. Empty urls are left out.
+type FeedPage struct {
+	Prev string
+	Next string
+}
 
-				if err != nil {
-					fmt.Printf("Error: %s\n", err)
-					continue
-				}
+// pageLink is an Atom link element, named atom:link in RSS.
+type pageLink struct {
+	XMLName xml.Name
+	Href    string `xml:"href,attr"`
+	Rel     string `xml:"rel,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+}
 
-				if len(posts) > 0 && post.CreatedAt == posts[len(posts)-1].CreatedAt {
-					fmt.Printf("Duplicated post")
-					continue
-				}
+func (page FeedPage) links(name string, linkType string) []pageLink {
+	var links []pageLink
+	if page.Prev != "" {
+		links = append(links, pageLink{XMLName: xml.Name{Local: name}, Href: page.Prev, Rel: "prev", Type: linkType})
+	}
+	if page.Next != "" {
+		links = append(links, pageLink{XMLName: xml.Name{Local: name}, Href: page.Next, Rel: "next", Type: linkType})
+	}
+	return links
+}
 
-				if postId == dbCachedChannel.LastId {
-					break
-				}
+// MEDIA_RSS_NAMESPACE is the namespace of Media RSS elements, which readers
+// use for item previews.
+const MEDIA_RSS_NAMESPACE = "http://search.yahoo.com/mrss/"
 
-				posts = append(posts, post)
-			}
+type mediaThumbnail struct {
+	XMLName xml.Name `xml:"media:thumbnail"`
+	Url     string   `xml:"url,attr"`
+}
 
-			cache.UpdateLastPostId(dbCachedChannel.Id, channel.LastId)
-			newDbPosts, err := cache.SavePosts(dbCachedChannel.Id, posts)
-			if err != nil {
-				fmt.Printf("Can't save posts -%s\n", err)
-				return feed, nil
-			}
+type mediaContent struct {
+	XMLName   xml.Name `xml:"media:content"`
+	Url       string   `xml:"url,attr"`
+	Medium    string   `xml:"medium,attr"`
+	Thumbnail *mediaThumbnail
+}
+
+// mediaRssItem is an RSS item with the Media RSS elements of its images and
+// videos.
+type mediaRssItem struct {
+	XMLName xml.Name `xml:"item"`
+	*feeds.RssItem
+	Thumbnail *mediaThumbnail
+	Media     []mediaContent
+}
+
+// itemMedia finds the images, videos and audio embedded in the description
+// and content of an item, so media left out of them by -textonly or a
+// content template are left out here too. The thumbnail is the first image
+// or video poster.
+func itemMedia(item *feeds.Item) ([]mediaContent, *mediaThumbnail) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(item.Description + item.Content))
+	if err != nil {
+		return nil, nil
+	}
 
-			feed := generateFeed(dbCachedChannel, newDbPosts)
+	var media []mediaContent
+	var thumbnail *mediaThumbnail
+	seen := map[string]bool{}
+	doc.Find("img[src], video[src], audio[src]").Each(func(i int, s *goquery.Selection) {
+		src, _ := s.Attr("src")
+		if src == "" || seen[src] {
+			return
+		}
+		seen[src] = true
 
-			return feed, nil
+		content := mediaContent{Url: src, Medium: "image"}
+		preview := src
+		switch goquery.NodeName(s) {
+		case "video":
+			content.Medium = "video"
+			preview, _ = s.Attr("poster")
+			if preview != "" {
+				content.Thumbnail = &mediaThumbnail{Url: preview}
+			}
+		case "audio":
+			content.Medium = "audio"
+			preview = ""
 		}
-	} else {
-		fmt.Printf("Fetch telegram channel failed: %s\n", err)
+		if thumbnail == nil && preview != "" {
+			thumbnail = &mediaThumbnail{Url: preview}
+		}
+		media = append(media, content)
+	})
+	return media, thumbnail
+}
 
-		return feed, err
-	}
+type pagedRssChannel struct {
+	*feeds.RssFeed
+	Items []*mediaRssItem `xml:"item"`
+	Pages []pageLink
 }
 
-func generateFeed(channel DbChannel, posts []DbPost) *feeds.Feed {
-	feed := &feeds.Feed{
-		Title:       channel.Name,
-		Link:        &feeds.Link{Href: channel.Link},
-		Description: channel.Description,
+type pagedRssFeed struct {
+	XMLName          xml.Name `xml:"rss"`
+	Version          string   `xml:"version,attr"`
+	ContentNamespace string   `xml:"xmlns:content,attr"`
+	AtomNamespace    string   `xml:"xmlns:atom,attr"`
+	MediaNamespace   string   `xml:"xmlns:media,attr,omitempty"`
+	Channel          pagedRssChannel
+}
+
+func (feed *pagedRssFeed) FeedXml() interface{} {
+	return feed
+}
+
+type pagedAtomFeed struct {
+	*feeds.AtomFeed
+	Pages []pageLink
+}
+
+func (feed *pagedAtomFeed) FeedXml() interface{} {
+	return feed
+}
+
+// writeFeedPage is writeFeed with the links of page, atom:link elements in
+// RSS, link elements in Atom and next_url in JSON Feed, which has no link
+// to newer pages. mediaRss adds media:content and media:thumbnail elements
+// to RSS items with images or videos.
+func writeFeedPage(w io.Writer, feed *feeds.Feed, format string, ttl int, mediaRss bool, page FeedPage) error {
+	if page == (FeedPage{}) && (format != FormatRss || !mediaRss) {
+		switch format {
+		case FormatAtom:
+			return feeds.WriteXML(atomFeed(feed), w)
+		case FormatJson:
+			return feed.WriteJSON(w)
+		}
+		return writeRss(w, feed, ttl)
 	}
 
-	var item *feeds.Item
-	var items []*feeds.Item
-	for _, post := range posts {
-		item = &feeds.Item{
-			Title:       post.Header,
-			Link:        &feeds.Link{Href: post.Link},
-			Description: post.Content,
-			Created:     post.CreatedAt,
+	switch format {
+	case FormatAtom:
+		return feeds.WriteXML(&pagedAtomFeed{AtomFeed: atomFeed(feed), Pages: page.links("link", "application/atom+xml")}, w)
+	case FormatJson:
+		jsonFeed := (&feeds.JSON{Feed: feed}).JSONFeed()
+		jsonFeed.NextUrl = page.Next
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(jsonFeed)
+	}
+
+	rss := rssFeed(feed, ttl)
+	document := &pagedRssFeed{
+		Version:          "2.0",
+		ContentNamespace: "http://purl.org/rss/1.0/modules/content/",
+		AtomNamespace:    "http://www.w3.org/2005/Atom",
+		Channel:          pagedRssChannel{RssFeed: rss, Pages: page.links("atom:link", "application/rss+xml")},
+	}
+	if mediaRss {
+		document.MediaNamespace = MEDIA_RSS_NAMESPACE
+	}
+	for i, item := range rss.Items {
+		rssItem := &mediaRssItem{RssItem: item}
+		if mediaRss {
+			rssItem.Media, rssItem.Thumbnail = itemMedia(feed.Items[i])
 		}
+		document.Channel.Items = append(document.Channel.Items, rssItem)
+	}
+	return feeds.WriteXML(document, w)
+}
 
-		items = append(items, item)
+// pageUrl is the url of the request with its page query set to page.
+func pageUrl(c *gin.Context, page int) string {
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
 	}
 
-	feed.Items = items
+	query := c.Request.URL.Query()
+	query.Set("page", strconv.Itoa(page))
+	return (&url.URL{Scheme: scheme, Host: c.Request.Host, Path: c.Request.URL.Path, RawQuery: query.Encode()}).String()
+}
 
-	return feed
+func pingTelegram() error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Head("https://t.me/")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("Unexpected status %d", resp.StatusCode)
+	}
+	return nil
 }
 
 func tgChannelPostUrl(channelName string, id int) string {
@@ -445,7 +9343,57 @@ func tgChannelPostUrl(channelName string, id int) string {
 	return url
 }
 
+func tgDiscussionUrl(channelName string, id int, limit int) string {
+	url := "https://t.me/" + channelName + "/" + strconv.Itoa(id) + "?embed=1&discussion=1&comments_limit=" + strconv.Itoa(limit)
+	return url
+}
+
+func tgPostUrl(channelName string, id int) string {
+	url := "https://t.me/" + channelName + "/" + strconv.Itoa(id)
+	return url
+}
+
 func tgChannelFeedUrl(channelName string) string {
 	url := "https://t.me/s/" + channelName
 	return url
 }
+
+func tgTopicFeedUrl(channelName string, topicId int) string {
+	url := "https://t.me/s/" + channelName + "/" + strconv.Itoa(topicId)
+	return url
+}
+
+func tgTopicPostUrl(channelName string, topicId int, id int) string {
+	url := "https://t.me/" + channelName + "/" + strconv.Itoa(topicId) + "/" + strconv.Itoa(id)
+	return url
+}
+
+// feedLink turns the /s/ web preview link of a channel into the channel
+// link, which opens Telegram, unless mode is FeedLinkPreview.
+func feedLink(link string, mode string) string {
+	if mode == FeedLinkPreview {
+		return link
+	}
+
+	parsed, err := url.Parse(link)
+	if err != nil || parsed.Host != "t.me" || !strings.HasPrefix(parsed.Path, "/s/") {
+		return link
+	}
+	parsed.Path = strings.TrimPrefix(parsed.Path, "/s")
+	return parsed.String()
+}
+
+// displayLink moves a t.me link to domain, keeping its path and query.
+// Other links and an empty domain leave it unchanged.
+func displayLink(link string, domain string) string {
+	if domain == "" {
+		return link
+	}
+
+	parsed, err := url.Parse(link)
+	if err != nil || parsed.Host != "t.me" {
+		return link
+	}
+	parsed.Host = domain
+	return parsed.String()
+}
@@ -1,9 +1,33 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/feeds"
 	"github.com/jarcoal/httpmock"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"text/template"
+	"time"
 )
 
 func readFixture(path string) (string, error) {
@@ -45,6 +69,11 @@ func TestParseChannel(t *testing.T) {
 	if channel.Description != description {
 		t.Errorf("Invalid description, expected - %s, actual - %s", channel.Description, description)
 	}
+
+	newestPostAt := time.Date(2023, 7, 22, 22, 9, 14, 0, time.UTC)
+	if !channel.NewestPostAt.Equal(newestPostAt) {
+		t.Errorf("Invalid newest post time, expected - %s, actual - %s", newestPostAt, channel.NewestPostAt)
+	}
 }
 
 func TestFetchPost(t *testing.T) {
@@ -77,8 +106,5221 @@ func TestFetchPost(t *testing.T) {
 		t.Errorf("Invalid post link, expected - %s, actual - %s", expectedLink, post.Link)
 	}
 
+	if post.Views != 13100 {
+		t.Errorf("Invalid post views, expected - %d, actual - %d", 13100, post.Views)
+	}
+
 	createdAt := "2023-06-16 17:37:03 +0000 +0000"
 	if post.CreatedAt.String() != createdAt {
 		t.Errorf("Invalid time, expected - %s, actual - %s", post.CreatedAt.String(), createdAt)
 	}
 }
+
+type stubFetcher struct {
+	channel Channel
+	posts   map[int]Post
+	fetched []int
+}
+
+func (fetcher *stubFetcher) FetchChannel(channelName string) (Channel, error) {
+	return fetcher.channel, nil
+}
+
+func (fetcher *stubFetcher) FetchPost(channelName string, id int) (Post, error) {
+	fetcher.fetched = append(fetcher.fetched, id)
+	post, ok := fetcher.posts[id]
+	if !ok {
+		return Post{}, errors.New("Post not found")
+	}
+	return post, nil
+}
+
+func newTestCache(t *testing.T) *SqliteCache {
+	db, err := initDB(filepath.Join(t.TempDir(), "test.db"), PoolOptions{})
+	if err != nil {
+		t.Fatalf("Can't init db: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return NewSqliteCache(db, 0)
+}
+
+func TestPrepareFeedStopsAtNewestCachedPost(t *testing.T) {
+	cache := newTestCache(t)
+
+	base := time.Date(2023, 6, 16, 12, 0, 0, 0, time.UTC)
+	dbChannel, err := cache.SaveChannel(Channel{Name: "test", Title: "Test", LastId: 3, Link: "https://t.me/s/test"})
+	if err != nil {
+		t.Fatalf("Can't save channel: %s", err)
+	}
+	_, err = cache.SavePosts(dbChannel.Id, []Post{{Header: "old", Content: "old", Link: "old", CreatedAt: base}})
+	if err != nil {
+		t.Fatalf("Can't save posts: %s", err)
+	}
+
+	newest, err := cache.GetNewestPostTime(dbChannel.Id)
+	if err != nil || !newest.Equal(base) {
+		t.Fatalf("Invalid newest post time, expected - %s, actual - %s (%v)", base, newest, err)
+	}
+
+	// Ids were reset: posts 7 and below are already cached even though
+	// the cached LastId is 3.
+	fetcher := &stubFetcher{
+		channel: Channel{Name: "test", Title: "Test", LastId: 10, Link: "https://t.me/s/test"},
+		posts: map[int]Post{
+			10: {Header: "10", Link: "10", CreatedAt: base.Add(3 * time.Hour)},
+			9:  {Header: "9", Link: "9", CreatedAt: base.Add(2 * time.Hour)},
+			8:  {Header: "8", Link: "8", CreatedAt: base.Add(1 * time.Hour)},
+			7:  {Header: "7", Link: "7", CreatedAt: base},
+			6:  {Header: "6", Link: "6", CreatedAt: base.Add(-1 * time.Hour)},
+		},
+	}
+
+	result, err := prepareFeed("test", cache, fetcher, nil, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Can't prepare feed: %s", err)
+	}
+	feed := result.Feed
+
+	// The 3 new posts and the cached one.
+	if len(feed.Items) != 4 {
+		t.Errorf("Invalid items count, expected - %d, actual - %d", 4, len(feed.Items))
+	}
+
+	if len(fetcher.fetched) != 4 {
+		t.Errorf("Invalid fetched posts, expected - %v, actual - %v", []int{10, 9, 8, 7}, fetcher.fetched)
+	}
+}
+
+func TestFeedResult(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	base := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	fetcher := &stubFetcher{
+		channel: Channel{Name: "test", Title: "Test", LastId: 3, Link: "https://t.me/s/test", NewestPostAt: base.Add(2 * time.Hour)},
+		posts: map[int]Post{
+			3: {Header: "3", Link: "https://t.me/test/3", CreatedAt: base.Add(2 * time.Hour), MessageId: 3},
+			2: {Header: "2", Link: "https://t.me/test/2", CreatedAt: base.Add(time.Hour), MessageId: 2},
+		},
+	}
+	router := setupRouter(newTestCache(t), fetcher, nil, ServerConfig{})
+
+	tests := []struct {
+		cacheStatus  string
+		fetchedPosts string
+	}{
+		// Post 1 fails to download, the two others are new.
+		{"MISS", "2"},
+		{"HIT", "0"},
+	}
+	for i, test := range tests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", "/test", nil))
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Invalid status of request %d, expected - %d, actual - %d", i, http.StatusOK, recorder.Code)
+		}
+		if cacheStatus := recorder.Header().Get(CACHE_HEADER); cacheStatus != test.cacheStatus {
+			t.Errorf("Invalid %s of request %d, expected - %s, actual - %s", CACHE_HEADER, i, test.cacheStatus, cacheStatus)
+		}
+		if fetched := recorder.Header().Get(FETCHED_POSTS_HEADER); fetched != test.fetchedPosts {
+			t.Errorf("Invalid %s of request %d, expected - %s, actual - %s", FETCHED_POSTS_HEADER, i, test.fetchedPosts, fetched)
+		}
+		if !strings.HasPrefix(recorder.Header().Get("Server-Timing"), "prepare;dur=") {
+			t.Errorf("Invalid Server-Timing of request %d: %s", i, recorder.Header().Get("Server-Timing"))
+		}
+	}
+
+	result, err := prepareFeed("test", newTestCache(t), fetcher, nil, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Can't prepare feed: %s", err)
+	}
+	if result.CacheHit || result.FetchedPosts != 2 || result.FetchFailures != 1 || len(result.Feed.Items) != 2 || result.Duration <= 0 {
+		t.Errorf("Invalid feed result: %+v", result)
+	}
+}
+
+func TestLeanStorage(t *testing.T) {
+	base := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	media := []Media{{Type: MediaPhoto, Url: "https://cdn/photo.jpg"}}
+	fetcher := &stubFetcher{
+		channel: Channel{Name: "test", Title: "Test", LastId: 2, Link: "https://t.me/s/test", NewestPostAt: base.Add(time.Hour)},
+		posts: map[int]Post{
+			2: {Header: "Second", Content: "Second post text", Link: "https://t.me/test/2", CreatedAt: base.Add(time.Hour), MessageId: 2, Media: media},
+			1: {Header: "First", Content: "First post text", Link: "https://t.me/test/1", CreatedAt: base, MessageId: 1},
+		},
+	}
+
+	cache, _, err := NewCache(CacheOptions{Backend: CacheMemory, LeanStorage: true})
+	if err != nil {
+		t.Fatalf("Can't create cache: %s", err)
+	}
+	options := FeedOptions{LeanStorage: true}
+
+	// New posts are served with the contents just fetched.
+	result, err := prepareFeed("test", cache, fetcher, nil, options)
+	if err != nil {
+		t.Fatalf("Can't prepare feed: %s", err)
+	}
+	if len(result.Feed.Items) != 2 || !strings.Contains(result.Feed.Items[0].Description, "Second post text") || !strings.Contains(result.Feed.Items[0].Description, "https://cdn/photo.jpg") {
+		t.Fatalf("Invalid feed of new posts: %v", result.Feed.Items)
+	}
+	if len(fetcher.fetched) != 2 {
+		t.Errorf("Invalid fetched posts, expected - %v, actual - %v", []int{2, 1}, fetcher.fetched)
+	}
+
+	channel, _ := cache.GetChannel("test")
+	stored, _ := cache.GetPosts(channel.Id, MAX_RSS_POSTS_COUNT)
+	for _, post := range stored {
+		if post.Content != "" || post.Media != nil || post.Header == "" || post.Link == "" || post.CreatedAt.IsZero() {
+			t.Errorf("Invalid lean post: %+v", post)
+		}
+	}
+
+	// Cached posts are fetched again for their contents.
+	fetcher.fetched = nil
+	result, err = prepareFeed("test", cache, fetcher, nil, options)
+	if err != nil {
+		t.Fatalf("Can't prepare feed: %s", err)
+	}
+	if !result.CacheHit || result.FetchedPosts != 2 {
+		t.Errorf("Invalid feed result: %+v", result)
+	}
+	if len(result.Feed.Items) != 2 || !strings.Contains(result.Feed.Items[1].Description, "First post text") {
+		t.Errorf("Invalid feed of cached posts: %v", result.Feed.Items)
+	}
+
+	// Posts failing to download keep their header.
+	delete(fetcher.posts, 1)
+	result, err = prepareFeed("test", cache, fetcher, nil, options)
+	if err != nil {
+		t.Fatalf("Can't prepare feed: %s", err)
+	}
+	if result.FetchFailures != 1 || len(result.Feed.Items) != 2 || result.Feed.Items[1].Title != "First" {
+		t.Errorf("Invalid feed with a failed post: %+v %v", result, result.Feed.Items)
+	}
+}
+
+func TestLeanStorageContents(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	base := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	fetcher := &stubFetcher{
+		channel: Channel{Name: "test", Title: "Test", LastId: 2, Link: "https://t.me/s/test", NewestPostAt: base.Add(time.Hour)},
+		posts: map[int]Post{
+			2: {Header: "Second", Content: "Second post text", Link: "https://t.me/test/2", CreatedAt: base.Add(time.Hour), MessageId: 2},
+			1: {Header: "First", Content: "First post text", Link: "https://t.me/test/1", CreatedAt: base, MessageId: 1},
+		},
+	}
+	cache, _, err := NewCache(CacheOptions{Backend: CacheMemory, LeanStorage: true})
+	if err != nil {
+		t.Fatalf("Can't create cache: %s", err)
+	}
+	router := setupRouter(cache, fetcher, nil, ServerConfig{LeanStorage: true})
+
+	// The contents fetched for the first feed are kept for the next ones,
+	// including feeds of cached posts only.
+	for _, path := range []string{"/test", "/test", "/test?cached=true"} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "First post text") || !strings.Contains(recorder.Body.String(), "Second post text") {
+			t.Errorf("Invalid %s response: %d %s", path, recorder.Code, recorder.Body.String())
+		}
+	}
+	if len(fetcher.fetched) != 2 {
+		t.Errorf("Invalid fetched posts, expected - %v, actual - %v", []int{2, 1}, fetcher.fetched)
+	}
+}
+
+func TestLeanStorageFailedFetch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "https://t.me/s/lean", httpmock.NewStringResponder(http.StatusBadGateway, ""))
+	httpmock.RegisterResponder("GET", `=~^https://t\.me/lean/\d+\?embed=1&mode=tme$`, httpmock.NewStringResponder(http.StatusBadGateway, ""))
+	postRequests := func() int {
+		return httpmock.GetCallCountInfo()[`GET =~^https://t\.me/lean/\d+\?embed=1&mode=tme$`]
+	}
+
+	cache, _, err := NewCache(CacheOptions{Backend: CacheMemory, LeanStorage: true})
+	if err != nil {
+		t.Fatalf("Can't create cache: %s", err)
+	}
+	base := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	channel, _ := cache.SaveChannel(Channel{Name: "lean", Title: "Lean", LastId: 2, Link: "https://t.me/s/lean"})
+	cache.SavePosts(channel.Id, []Post{
+		{Header: "Second", Content: "Second post text", Link: "https://t.me/lean/2", CreatedAt: base.Add(time.Hour), MessageId: 2},
+		{Header: "First", Content: "First post text", Link: "https://t.me/lean/1", CreatedAt: base, MessageId: 1},
+	})
+
+	// Retries give the fetch slot back while they wait, so hydrating
+	// posts must hold one.
+	limiter := NewFetchLimiter(1, time.Second)
+	fetcher := &TelegramWebFetcher{Retries: 2, RetryBackoff: time.Millisecond, Limiter: limiter}
+	router := setupRouter(cache, fetcher, limiter, ServerConfig{LeanStorage: true, ServeStale: true})
+
+	// Cached feeds fetch nothing, the stale one stops at the first post
+	// once Telegram is unavailable.
+	for path, expected := range map[string]int{"/lean?cached=true": 0, "/lean": 1 + fetcher.Retries} {
+		httpmock.ZeroCallCounters()
+		done := make(chan *httptest.ResponseRecorder)
+		go func() {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+			done <- recorder
+		}()
+
+		select {
+		case recorder := <-done:
+			if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "Second") {
+				t.Errorf("Invalid %s response: %d %s", path, recorder.Code, recorder.Body.String())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Request %s didn't return", path)
+		}
+		if postRequests() != expected {
+			t.Errorf("Invalid post requests of %s, expected - %d, actual - %d", path, expected, postRequests())
+		}
+	}
+}
+
+func TestFeedLog(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	base := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	fetcher := &stubFetcher{
+		channel: Channel{Name: "test", Title: "Test", LastId: 2, Link: "https://t.me/s/test", NewestPostAt: base.Add(time.Hour)},
+		posts: map[int]Post{
+			2: {Header: "2", Link: "https://t.me/test/2", CreatedAt: base.Add(time.Hour), MessageId: 2},
+			1: {Header: "1", Link: "https://t.me/test/1", CreatedAt: base, MessageId: 1},
+		},
+	}
+	var out bytes.Buffer
+	router := setupRouter(newTestCache(t), fetcher, nil, ServerConfig{FeedLog: NewFeedLog(&out)})
+
+	var sizes []int
+	for _, path := range []string{"/test", "/test.atom", "/test?cached=true", "/missing?cached=true"} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		sizes = append(sizes, recorder.Body.Len())
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	// Failed requests aren't logged.
+	if len(lines) != 3 {
+		t.Fatalf("Invalid log lines count, expected - %d, actual - %d: %s", 3, len(lines), out.String())
+	}
+
+	expected := []struct {
+		format string
+		cache  string
+	}{
+		{FormatRss, FeedCacheMiss},
+		{FormatAtom, FeedCacheHit},
+		{FormatRss, FeedCacheOnly},
+	}
+	for i, line := range lines {
+		var entry struct {
+			Time       string  `json:"time"`
+			Level      string  `json:"level"`
+			Msg        string  `json:"msg"`
+			Channel    string  `json:"channel"`
+			Format     string  `json:"format"`
+			Items      int     `json:"items"`
+			Cache      string  `json:"cache"`
+			Bytes      int     `json:"bytes"`
+			DurationMs float64 `json:"durationMs"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Invalid log line %q: %s", line, err)
+		}
+		if entry.Level != "info" || entry.Msg != "feed served" || entry.Time == "" || entry.Channel != "test" || entry.Items != 2 {
+			t.Errorf("Invalid log line %d: %+v", i, entry)
+		}
+		if entry.Format != expected[i].format || entry.Cache != expected[i].cache {
+			t.Errorf("Invalid format and cache of line %d, expected - %s %s, actual - %s %s", i, expected[i].format, expected[i].cache, entry.Format, entry.Cache)
+		}
+		if entry.Bytes != sizes[i] || entry.DurationMs < 0 {
+			t.Errorf("Invalid size and duration of line %d, expected - %d bytes, actual - %d bytes %fms", i, sizes[i], entry.Bytes, entry.DurationMs)
+		}
+	}
+}
+
+func TestRefreshWorkerHonorsChannelInterval(t *testing.T) {
+	cache := newTestCache(t)
+
+	slow, _ := cache.SaveChannel(Channel{Name: "slow", Title: "Slow", Link: "https://t.me/s/slow"})
+	cache.SaveChannel(Channel{Name: "fast", Title: "Fast", Link: "https://t.me/s/fast"})
+
+	if err := cache.UpdateRefreshInterval(slow.Id, time.Hour); err != nil {
+		t.Fatalf("Can't update refresh interval: %s", err)
+	}
+
+	channel, _ := cache.GetChannel("slow")
+	if channel.RefreshInterval != time.Hour {
+		t.Errorf("Invalid refresh interval, expected - %s, actual - %s", time.Hour, channel.RefreshInterval)
+	}
+
+	worker := NewRefreshWorker(cache, &stubFetcher{}, nil, nil, nil, 10*time.Minute, nil, 0, FeedOptions{})
+
+	start := time.Date(2023, 6, 16, 12, 0, 0, 0, time.UTC)
+	worker.refreshDue(context.Background(), start)
+	worker.refreshDue(context.Background(), start.Add(30*time.Minute))
+
+	if !worker.lastRefreshed["slow"].Equal(start) {
+		t.Errorf("Slow channel refreshed too early, last refresh - %s", worker.lastRefreshed["slow"])
+	}
+
+	if !worker.lastRefreshed["fast"].Equal(start.Add(30 * time.Minute)) {
+		t.Errorf("Fast channel not refreshed, last refresh - %s", worker.lastRefreshed["fast"])
+	}
+}
+
+func TestRefreshJitter(t *testing.T) {
+	cache := NewMemoryCache()
+	for i := 0; i < 40; i++ {
+		cache.SaveChannel(Channel{Name: fmt.Sprintf("channel%d", i), Title: "Channel"})
+	}
+
+	interval := time.Hour
+	jitter := 0.2
+	worker := NewRefreshWorker(cache, failingFetcher{}, nil, nil, nil, interval, nil, jitter, FeedOptions{})
+	worker.random = rand.New(rand.NewSource(1)).Float64
+
+	// assertSpread checks durations are within [min, max) and fill all
+	// quarters of it.
+	assertSpread := func(name string, durations []time.Duration, min time.Duration, max time.Duration) {
+		quarters := map[int]int{}
+		for _, duration := range durations {
+			if duration < min || duration >= max {
+				t.Errorf("Invalid %s, expected - within [%s, %s), actual - %s", name, min, max, duration)
+				continue
+			}
+			quarters[int(4*(duration-min)/(max-min))]++
+		}
+		if len(quarters) != 4 {
+			t.Errorf("Invalid %s spread, expected - all 4 quarters, actual - %v", name, quarters)
+		}
+	}
+
+	// First refreshes are spread over the first jitter of the interval.
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	worker.refreshDue(context.Background(), start)
+	var delays []time.Duration
+	for _, firstRefreshAt := range worker.firstRefreshAt {
+		delays = append(delays, firstRefreshAt.Sub(start))
+	}
+	if len(delays) != 40 || len(worker.lastRefreshed) > 1 {
+		t.Fatalf("Invalid first refreshes, expected - 40 scheduled, actual - %d scheduled and %d refreshed", len(delays), len(worker.lastRefreshed))
+	}
+	assertSpread("first refresh delay", delays, 0, time.Duration(jitter*float64(interval)))
+
+	refreshed := start.Add(time.Duration(jitter * float64(interval)))
+	worker.refreshDue(context.Background(), refreshed)
+	if len(worker.lastRefreshed) != 40 {
+		t.Fatalf("Invalid refreshed channels count, expected - %d, actual - %d", 40, len(worker.lastRefreshed))
+	}
+
+	// Later refreshes are moved by up to jitter of the interval either way.
+	var intervals []time.Duration
+	for name := range worker.lastRefreshed {
+		intervals = append(intervals, worker.jittered(name, interval))
+	}
+	assertSpread("refresh interval", intervals, time.Duration((1-jitter)*float64(interval)), time.Duration((1+jitter)*float64(interval)))
+
+	worker.refreshDue(context.Background(), refreshed.Add(interval))
+	var due int
+	for _, lastRefreshed := range worker.lastRefreshed {
+		if lastRefreshed.After(refreshed) {
+			due++
+		}
+	}
+	if due == 0 || due == 40 {
+		t.Errorf("Invalid channels due after an interval, expected - some of 40, actual - %d", due)
+	}
+}
+
+func TestToRssTtl(t *testing.T) {
+	feed := generateFeed(DbChannel{Name: "test", Link: "https://t.me/s/test"}, []DbPost{}, FeedOptions{})
+
+	rss, err := toRss(feed, 30)
+	if err != nil {
+		t.Fatalf("Can't render rss: %s", err)
+	}
+
+	if !strings.Contains(rss, "<ttl>30</ttl>") {
+		t.Errorf("Rss has no ttl element: %s", rss)
+	}
+
+	rss, _ = toRss(feed, 0)
+	if strings.Contains(rss, "<ttl>") {
+		t.Errorf("Rss has unexpected ttl element: %s", rss)
+	}
+}
+
+func TestGenerateFeedSortByFirstSeen(t *testing.T) {
+	base := time.Date(2023, 6, 16, 12, 0, 0, 0, time.UTC)
+	posts := []DbPost{
+		{Header: "newest", CreatedAt: base.Add(time.Hour), FirstSeenAt: base},
+		{Header: "imported", CreatedAt: base, FirstSeenAt: base.Add(time.Hour)},
+	}
+
+	feed := generateFeed(DbChannel{Name: "test"}, posts, FeedOptions{SortBy: SortByFirstSeen})
+	if feed.Items[0].Title != "imported" {
+		t.Errorf("Invalid first item, expected - %s, actual - %s", "imported", feed.Items[0].Title)
+	}
+
+	feed = generateFeed(DbChannel{Name: "test"}, posts, FeedOptions{})
+	if feed.Items[0].Title != "newest" {
+		t.Errorf("Invalid first item, expected - %s, actual - %s", "newest", feed.Items[0].Title)
+	}
+}
+
+func TestParsePreviewOnlyChannel(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	fixture, err := readFixture("fixtures/preview.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+
+	httpmock.RegisterResponder("GET", "https://t.me/s/privatepreview",
+		httpmock.NewStringResponder(200, fixture))
+
+	fetcher := &TelegramWebFetcher{}
+	_, err = fetcher.FetchChannel("privatepreview")
+
+	if !errors.Is(err, ErrChannelPreviewOnly) {
+		t.Errorf("Invalid error, expected - %s, actual - %v", ErrChannelPreviewOnly, err)
+	}
+}
+
+func TestRenamedChannel(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	channelFixture, err := readFixture("fixtures/views.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+	postFixture, err := readFixture("fixtures/post.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+
+	redirect := httpmock.NewStringResponse(http.StatusMovedPermanently, "")
+	redirect.Header.Set("Location", "https://t.me/s/viewstest")
+	httpmock.RegisterResponder("GET", "https://t.me/s/oldviews", httpmock.ResponderFromResponse(redirect))
+	httpmock.RegisterResponder("GET", "https://t.me/s/viewstest", httpmock.NewStringResponder(200, channelFixture))
+	httpmock.RegisterResponder("GET", `=~^https://t\.me/viewstest/\d+\?embed=1&mode=tme$`, httpmock.NewStringResponder(200, postFixture))
+
+	fetcher := &TelegramWebFetcher{}
+	channel, err := fetcher.FetchChannel("oldviews")
+	if err != nil {
+		t.Fatalf("Fetch channel failed: %s", err)
+	}
+	if channel.Name != "viewstest" || channel.Link != "https://t.me/s/viewstest" {
+		t.Errorf("Invalid renamed channel, expected - viewstest, actual - %s %s", channel.Name, channel.Link)
+	}
+
+	cache := newTestCache(t)
+	if _, err := prepareFeed("oldviews", cache, fetcher, nil, FeedOptions{}); err != nil {
+		t.Fatalf("Prepare feed failed: %s", err)
+	}
+	if _, err := cache.GetChannel("oldviews"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Channel was cached under its old name: %v", err)
+	}
+	cached, err := cache.GetChannel("viewstest")
+	if err != nil {
+		t.Fatalf("Channel wasn't cached under its new name: %s", err)
+	}
+	posts, _ := cache.GetPosts(cached.Id, MAX_RSS_POSTS_COUNT)
+	if len(posts) == 0 || !strings.HasPrefix(posts[0].Link, "https://t.me/viewstest/") {
+		t.Errorf("Invalid posts of renamed channel: %v", posts)
+	}
+
+	// A channel cached under its old name is renamed with its posts.
+	dir := t.TempDir()
+	sharded, err := NewShardedCache(filepath.Join(dir, "{channel}.db"), PoolOptions{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sharded.Close()
+	for _, cache := range []Cache{newTestCache(t), sharded} {
+		old, _ := cache.SaveChannel(Channel{Name: "oldviews", Title: "Old", LastId: 11, Link: "https://t.me/s/oldviews"})
+		cache.SavePosts(old.Id, []Post{{Header: "old post", Content: "old post", Link: "https://t.me/oldviews/11", CreatedAt: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), MessageId: 11}})
+		// A shard taken by a request before the rename stays usable.
+		var entry shardEntry
+		if cache == sharded {
+			entry, _ = sharded.entry(old.Id)
+		}
+
+		if _, err := prepareFeed("oldviews", cache, fetcher, nil, FeedOptions{}); err != nil {
+			t.Fatalf("Prepare feed failed: %s", err)
+		}
+		if _, err := cache.GetChannel("oldviews"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("Old channel is still cached: %v", err)
+		}
+		renamed, err := cache.GetChannel("viewstest")
+		if err != nil || renamed.Link != "https://t.me/s/viewstest" {
+			t.Fatalf("Channel wasn't renamed: %+v, %v", renamed, err)
+		}
+		posts, _ := cache.GetPosts(renamed.Id, MAX_RSS_POSTS_COUNT)
+		if len(posts) < 2 || posts[len(posts)-1].Header != "old post" {
+			t.Errorf("Invalid posts of renamed channel: %v", posts)
+		}
+		if channels, _ := cache.GetChannels(); len(channels) != 1 {
+			t.Errorf("Invalid cached channels, expected - %d, actual - %d", 1, len(channels))
+		}
+		if entry.cache != nil {
+			if posts, err := entry.cache.GetPosts(entry.localId, MAX_RSS_POSTS_COUNT); err != nil || len(posts) < 2 {
+				t.Errorf("Invalid posts of the shard taken before the rename: %v, %v", posts, err)
+			}
+		}
+	}
+
+	// The database file is moved to the new name on close.
+	sharded.Close()
+	reopened, err := NewShardedCache(filepath.Join(dir, "{channel}.db"), PoolOptions{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if renamed, err := reopened.GetChannel("viewstest"); err != nil || renamed.Link != "https://t.me/s/viewstest" {
+		t.Errorf("Renamed channel wasn't moved: %+v, %v", renamed, err)
+	}
+	if paths, _ := filepath.Glob(filepath.Join(dir, "*")); len(paths) != 1 || filepath.Base(paths[0]) != "viewstest.db" {
+		t.Errorf("Invalid database files, expected - [viewstest.db], actual - %v", paths)
+	}
+
+	// A case-only difference isn't a rename.
+	caseRedirect := httpmock.NewStringResponse(http.StatusMovedPermanently, "")
+	caseRedirect.Header.Set("Location", "https://t.me/s/viewstest")
+	httpmock.RegisterResponder("GET", "https://t.me/s/ViewsTest", httpmock.ResponderFromResponse(caseRedirect))
+	if channel, _ := fetcher.FetchChannel("ViewsTest"); channel.Name != "ViewsTest" {
+		t.Errorf("Invalid channel name, expected - ViewsTest, actual - %s", channel.Name)
+	}
+}
+
+func TestRestrictedChannel(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	fixture, err := readFixture("fixtures/restricted.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+
+	httpmock.RegisterResponder("GET", "https://t.me/s/restrictedtest",
+		httpmock.NewStringResponder(200, fixture))
+
+	fetcher := &TelegramWebFetcher{}
+	_, err = fetcher.FetchChannel("restrictedtest")
+	if !errors.Is(err, ErrChannelRestricted) || !strings.Contains(err.Error(), "violated local laws") {
+		t.Errorf("Invalid error, expected - %s, actual - %v", ErrChannelRestricted, err)
+	}
+
+	router := setupRouter(newTestCache(t), fetcher, nil, ServerConfig{})
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/restrictedtest", nil))
+	if recorder.Code != http.StatusUnavailableForLegalReasons || !strings.Contains(recorder.Body.String(), ErrorCodeChannelRestricted) {
+		t.Errorf("Invalid response, expected - %d, actual - %d %s", http.StatusUnavailableForLegalReasons, recorder.Code, recorder.Body.String())
+	}
+
+	// The contact page of channels without a web preview isn't a restriction.
+	preview, err := readFixture("fixtures/preview.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+	httpmock.RegisterResponder("GET", "https://t.me/s/privatepreview",
+		httpmock.NewStringResponder(200, preview))
+	if _, err := fetcher.FetchChannel("privatepreview"); errors.Is(err, ErrChannelRestricted) {
+		t.Errorf("Preview-only channel reported as restricted: %v", err)
+	}
+}
+
+func TestGenerateFeedProducesValidXml(t *testing.T) {
+	posts := []DbPost{
+		{Header: "control\x01char", Content: "hello\x01world <b>&amp;</b>", Link: "https://t.me/test/1"},
+	}
+
+	feed := generateFeed(DbChannel{Name: "test", Description: "desc\x0b"}, posts, FeedOptions{})
+	rss, err := toRss(feed, 0)
+	if err != nil {
+		t.Fatalf("Can't render rss: %s", err)
+	}
+
+	assertWellFormedXml(t, rss)
+
+	if !strings.Contains(rss, "helloworld") || strings.Contains(rss, "\x01") {
+		t.Errorf("Control char was not stripped: %s", rss)
+	}
+}
+
+// assertWellFormedXml fails the test unless doc parses with encoding/xml
+// from start to end.
+func assertWellFormedXml(t *testing.T, doc string) {
+	t.Helper()
+
+	decoder := xml.NewDecoder(strings.NewReader(doc))
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatalf("Invalid xml: %s\n%s", err, doc)
+		}
+	}
+}
+
+func TestFeedFormatsRoundTrip(t *testing.T) {
+	createdAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	channel := DbChannel{Name: "tricky", Title: "Tricky", Link: "https://t.me/s/tricky", Description: "Привет & <welcome>\x0b"}
+	posts := []DbPost{
+		{Header: "Café ☕ «quotes» 😀", Content: "Ünïcödé, العربية, 中文 and emoji 🚋", Link: "https://t.me/tricky/3", CreatedAt: createdAt, MessageId: 3},
+		{Header: "Entities &amp; &lt;tags&gt;", Content: "Tom & Jerry <b>bold</b> &nbsp; \"quoted\" 'single' ]]> <![CDATA[", Link: "https://t.me/tricky/2", CreatedAt: createdAt.Add(-time.Hour), MessageId: 2},
+		{Header: "Control\x01\x08\x1f chars", Content: "bell\x07 null\x00 vt\x0b ff\x0c\ttab\nnewline", Link: "https://t.me/tricky/1", CreatedAt: createdAt.Add(-2 * time.Hour), MessageId: 1},
+	}
+	expectedTitles := []string{"Café ☕ «quotes» 😀", "Entities &amp; &lt;tags&gt;", "Control chars"}
+
+	feed := generateFeed(channel, posts, FeedOptions{})
+
+	var rss bytes.Buffer
+	if err := writeFeed(&rss, feed, FormatRss, 0, false); err != nil {
+		t.Fatalf("Can't render rss: %s", err)
+	}
+	assertWellFormedXml(t, rss.String())
+
+	var parsedRss struct {
+		Channel struct {
+			Description string `xml:"description"`
+			Items       []struct {
+				Title       string `xml:"title"`
+				Description string `xml:"description"`
+			} `xml:"item"`
+		} `xml:"channel"`
+	}
+	if err := xml.Unmarshal(rss.Bytes(), &parsedRss); err != nil {
+		t.Fatalf("Can't parse rss: %s", err)
+	}
+	if parsedRss.Channel.Description != "Привет & <welcome>" {
+		t.Errorf("Invalid rss description, expected - %s, actual - %s", "Привет & <welcome>", parsedRss.Channel.Description)
+	}
+	if len(parsedRss.Channel.Items) != len(posts) {
+		t.Fatalf("Invalid rss items count, expected - %d, actual - %d", len(posts), len(parsedRss.Channel.Items))
+	}
+	for i, item := range parsedRss.Channel.Items {
+		if item.Title != expectedTitles[i] {
+			t.Errorf("Invalid rss item title, expected - %s, actual - %s", expectedTitles[i], item.Title)
+		}
+	}
+	if !strings.Contains(parsedRss.Channel.Items[0].Description, "中文 and emoji 🚋") {
+		t.Errorf("Invalid rss item description: %s", parsedRss.Channel.Items[0].Description)
+	}
+	if !strings.Contains(parsedRss.Channel.Items[1].Description, "Tom & Jerry <b>bold</b>") {
+		t.Errorf("Invalid rss item description: %s", parsedRss.Channel.Items[1].Description)
+	}
+
+	var atom bytes.Buffer
+	if err := writeFeed(&atom, feed, FormatAtom, 0, false); err != nil {
+		t.Fatalf("Can't render atom: %s", err)
+	}
+	assertWellFormedXml(t, atom.String())
+
+	var parsedAtom struct {
+		Entries []struct {
+			Title   string `xml:"title"`
+			Summary string `xml:"summary"`
+			Content string `xml:"content"`
+		} `xml:"entry"`
+	}
+	if err := xml.Unmarshal(atom.Bytes(), &parsedAtom); err != nil {
+		t.Fatalf("Can't parse atom: %s", err)
+	}
+	if len(parsedAtom.Entries) != len(posts) {
+		t.Fatalf("Invalid atom entries count, expected - %d, actual - %d", len(posts), len(parsedAtom.Entries))
+	}
+	for i, entry := range parsedAtom.Entries {
+		if entry.Title != expectedTitles[i] {
+			t.Errorf("Invalid atom entry title, expected - %s, actual - %s", expectedTitles[i], entry.Title)
+		}
+	}
+}
+
+func saveSearchFixture(t *testing.T, cache *SqliteCache) {
+	base := time.Date(2023, 6, 16, 12, 0, 0, 0, time.UTC)
+
+	lex, _ := cache.SaveChannel(Channel{Name: "lexfridman", Title: "Lex Fridman"})
+	other, _ := cache.SaveChannel(Channel{Name: "other", Title: "Other"})
+
+	_, err := cache.SavePosts(lex.Id, []Post{
+		{Header: "robots", Content: "robots robots robots", Link: "https://t.me/lexfridman/1", CreatedAt: base},
+		{Header: "podcast", Content: "New episode about humans", Link: "https://t.me/lexfridman/2", CreatedAt: base.Add(time.Hour)},
+	})
+	if err != nil {
+		t.Fatalf("Can't save posts: %s", err)
+	}
+
+	_, err = cache.SavePosts(other.Id, []Post{
+		{Header: "news", Content: "Some news mentioning robots among many other unrelated words", Link: "https://t.me/other/1", CreatedAt: base.Add(2 * time.Hour)},
+	})
+	if err != nil {
+		t.Fatalf("Can't save posts: %s", err)
+	}
+}
+
+func TestSearchPostsLikeFallback(t *testing.T) {
+	cache := newTestCache(t)
+	cache.fts = false
+	saveSearchFixture(t, cache)
+
+	results, err := cache.SearchPosts("Robots", 10)
+	if err != nil {
+		t.Fatalf("Can't search posts: %s", err)
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("Invalid results count, expected - %d, actual - %d", 2, len(results))
+	}
+
+	if results[0].Channel != "other" || results[1].Channel != "lexfridman" {
+		t.Errorf("Invalid results order, actual - %s, %s", results[0].Channel, results[1].Channel)
+	}
+}
+
+func TestSearchPostsFtsRanked(t *testing.T) {
+	cache := newTestCache(t)
+	if !cache.fts {
+		t.Skip("SQLite is built without FTS5, run with -tags sqlite_fts5")
+	}
+	saveSearchFixture(t, cache)
+
+	results, err := cache.SearchPosts("robots", 10)
+	if err != nil {
+		t.Fatalf("Can't search posts: %s", err)
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("Invalid results count, expected - %d, actual - %d", 2, len(results))
+	}
+
+	if results[0].Post.Link != "https://t.me/lexfridman/1" {
+		t.Errorf("Invalid top result, expected - %s, actual - %s", "https://t.me/lexfridman/1", results[0].Post.Link)
+	}
+
+	results, err = cache.SearchPosts(`humans "OR`, 10)
+	if err != nil {
+		t.Fatalf("Can't search posts with quotes: %s", err)
+	}
+
+	if len(results) != 0 {
+		t.Errorf("Invalid results count, expected - %d, actual - %d", 0, len(results))
+	}
+}
+
+func TestFetchLimiter(t *testing.T) {
+	cache := newTestCache(t)
+	limiter := NewFetchLimiter(1, 10*time.Millisecond)
+
+	if err := limiter.Acquire(); err != nil {
+		t.Fatalf("Can't acquire free slot: %s", err)
+	}
+
+	fetcher := &stubFetcher{channel: Channel{Name: "test", Link: "https://t.me/s/test"}}
+	_, err := prepareFeed("test", cache, fetcher, limiter, FeedOptions{})
+	if !errors.Is(err, ErrFetchBusy) {
+		t.Errorf("Invalid error, expected - %s, actual - %v", ErrFetchBusy, err)
+	}
+
+	limiter.Release()
+
+	_, err = prepareFeed("test", cache, fetcher, limiter, FeedOptions{})
+	if err != nil {
+		t.Errorf("Can't prepare feed after release: %s", err)
+	}
+
+	if err := limiter.Acquire(); err != nil {
+		t.Errorf("Slot was not released by prepareFeed: %s", err)
+	}
+}
+
+func TestParserDriftDetection(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	feedFixture, _ := readFixture("fixtures/feed.html")
+	httpmock.RegisterResponder("GET", "https://t.me/s/lexfridman",
+		httpmock.NewStringResponder(200, feedFixture))
+
+	fetcher := &TelegramWebFetcher{}
+	if _, err := fetcher.FetchChannel("lexfridman"); err != nil {
+		t.Fatalf("Can't fetch channel: %s", err)
+	}
+
+	httpmock.RegisterResponder("GET", "https://t.me/s/lexfridman",
+		httpmock.NewStringResponder(200, "<html><body><div class=\"new_layout\"></div></body></html>"))
+
+	before := parserDriftCount.Value()
+	if _, err := fetcher.FetchChannel("lexfridman"); err == nil {
+		t.Fatalf("Expected parse error")
+	}
+
+	if parserDriftCount.Value() != before+1 {
+		t.Errorf("Invalid parser drift count, expected - %d, actual - %d", before+1, parserDriftCount.Value())
+	}
+}
+
+func TestPrepareFeedKeepsCacheWhenAllPostsFail(t *testing.T) {
+	cache := newTestCache(t)
+
+	base := time.Date(2023, 6, 16, 12, 0, 0, 0, time.UTC)
+	dbChannel, _ := cache.SaveChannel(Channel{Name: "test", Title: "Test", LastId: 3, Link: "https://t.me/s/test"})
+	cache.SavePosts(dbChannel.Id, []Post{{Header: "cached", Content: "cached", Link: "cached", CreatedAt: base}})
+
+	fetcher := &stubFetcher{
+		channel: Channel{Name: "test", Title: "Test", LastId: 5, Link: "https://t.me/s/test"},
+		posts:   map[int]Post{},
+	}
+
+	result, err := prepareFeed("test", cache, fetcher, nil, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Can't prepare feed: %s", err)
+	}
+	feed := result.Feed
+
+	if len(feed.Items) != 1 || feed.Items[0].Title != "cached" {
+		t.Errorf("Cached posts were not served, actual - %v", feed.Items)
+	}
+
+	channel, _ := cache.GetChannel("test")
+	if channel.LastId != 3 {
+		t.Errorf("Invalid channel last id, expected - %d, actual - %d", 3, channel.LastId)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	cache := newTestCache(t)
+	saveSearchFixture(t, cache)
+
+	maintenance := NewMaintenance(cache.db, cache, &sync.Mutex{}, time.Hour, PruneOptions{})
+	if err := maintenance.run(); err != nil {
+		t.Errorf("Maintenance failed: %s", err)
+	}
+}
+
+func TestSqlitePragmas(t *testing.T) {
+	path := "file:" + filepath.Join(t.TempDir(), "pragmas.db") + "?_journal_mode=WAL"
+	db, err := initDB(path, PoolOptions{MaxOpenConns: 4, CacheSize: 65536, MmapSize: 1 << 28})
+	if err != nil {
+		t.Fatalf("Can't init db: %s", err)
+	}
+	defer db.Close()
+
+	// Hold connections open so the pool has to open new ones, every one of
+	// them has to be tuned.
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		var cacheSize, mmapSize int64
+		conn.QueryRowContext(ctx, "PRAGMA cache_size").Scan(&cacheSize)
+		conn.QueryRowContext(ctx, "PRAGMA mmap_size").Scan(&mmapSize)
+		if cacheSize != -65536 || mmapSize != 1<<28 {
+			t.Errorf("Invalid pragmas of connection %d, expected - %d %d, actual - %d %d", i, -65536, 1<<28, cacheSize, mmapSize)
+		}
+	}
+}
+
+func TestSqliteWriteSerialization(t *testing.T) {
+	path := "file:" + filepath.Join(t.TempDir(), "writes.db") + "?_journal_mode=WAL"
+	db, err := initDB(path, PoolOptions{MaxOpenConns: 16})
+	if err != nil {
+		t.Fatalf("Can't init db: %s", err)
+	}
+	defer db.Close()
+	cache := NewSqliteCache(db, 1)
+
+	const writers, batches, batchSize = 8, 10, 5
+	var channels []DbChannel
+	for i := 0; i < writers; i++ {
+		channel, err := cache.SaveChannel(Channel{Name: fmt.Sprintf("writes%d", i), Title: "Writes"})
+		if err != nil {
+			t.Fatalf("Can't save channel: %s", err)
+		}
+		channels = append(channels, channel)
+	}
+
+	base := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	errs := make(chan error, writers*batches*3)
+	var wg sync.WaitGroup
+	for _, channel := range channels {
+		channel := channel
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for batch := 0; batch < batches; batch++ {
+				var posts []Post
+				for i := 0; i < batchSize; i++ {
+					id := batch*batchSize + i + 1
+					posts = append(posts, Post{Content: "Post", Link: fmt.Sprintf("https://t.me/%s/%d", channel.Name, id), CreatedAt: base.Add(time.Duration(id) * time.Minute), MessageId: id})
+				}
+				if _, err := cache.SavePosts(channel.Id, posts); err != nil {
+					errs <- err
+				}
+				if err := cache.UpdatePostViews(channel.Id, map[int]int{batch*batchSize + 1: batch}); err != nil {
+					errs <- err
+				}
+				if err := cache.UpdateLastPostId(channel.Id, (batch+1)*batchSize); err != nil {
+					errs <- err
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for batch := 0; batch < batches; batch++ {
+				if _, err := cache.GetPosts(channel.Id, MAX_RSS_POSTS_COUNT); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Concurrent cache access failed: %s", err)
+	}
+
+	for _, channel := range channels {
+		if count, err := cache.CountPosts(channel.Id); err != nil || count != batches*batchSize {
+			t.Errorf("Invalid posts count of %s, expected - %d, actual - %d (%v)", channel.Name, batches*batchSize, count, err)
+		}
+	}
+
+	// Writes queue behind the one in progress, reads don't.
+	cache.lockWrites()
+	done := make(chan error)
+	go func() { done <- cache.UpdateLastPostId(channels[0].Id, 1) }()
+	if _, err := cache.GetChannel(channels[0].Name); err != nil {
+		t.Errorf("Read waited for the write lock: %s", err)
+	}
+	select {
+	case <-done:
+		t.Errorf("Write didn't wait for the write lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	cache.unlockWrites()
+	if err := <-done; err != nil {
+		t.Errorf("Queued write failed: %s", err)
+	}
+
+	// So do the writes of the fetch queue and maintenance of the database.
+	queue, err := NewFetchQueue(db, cache.Writes())
+	if err != nil {
+		t.Fatalf("Can't open fetch queue: %s", err)
+	}
+	maintenance := NewMaintenance(db, cache, nil, time.Hour, PruneOptions{})
+	cache.lockWrites()
+	for name, write := range map[string]func() error{
+		"enqueue": func() error { return queue.EnqueueRefresh(channels[0].Name) },
+		"vacuum":  maintenance.vacuum,
+	} {
+		go func() { done <- write() }()
+		select {
+		case <-done:
+			t.Errorf("%s didn't wait for the write lock", name)
+		case <-time.After(50 * time.Millisecond):
+		}
+		cache.unlockWrites()
+		if err := <-done; err != nil {
+			t.Errorf("Queued %s failed: %s", name, err)
+		}
+		cache.lockWrites()
+	}
+	cache.unlockWrites()
+}
+
+// BenchmarkSqlitePragmas reads pages of posts from a database of 50 000
+// posts with the default page cache and with -dbcachesize and -dbmmapsize.
+func BenchmarkSqlitePragmas(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "bench.db")
+	db, err := initDB(path, PoolOptions{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	cache := NewSqliteCache(db, 0)
+	content := strings.Repeat("A post long enough to fill a few database pages. ", 20)
+	var channelIds []int
+	for i := 0; i < 50; i++ {
+		channel, err := cache.SaveChannel(Channel{Name: fmt.Sprintf("bench%d", i), Title: "Bench"})
+		if err != nil {
+			b.Fatal(err)
+		}
+		channelIds = append(channelIds, channel.Id)
+
+		var posts []Post
+		for id := 1; id <= 1000; id++ {
+			posts = append(posts, Post{Header: "post", Content: content, Link: "https://t.me/bench/1", CreatedAt: time.Unix(int64(id)*60, 0).UTC(), MessageId: id})
+		}
+		if _, err := cache.SavePosts(channel.Id, posts); err != nil {
+			b.Fatal(err)
+		}
+	}
+	db.Close()
+
+	for name, pool := range map[string]PoolOptions{
+		"default": {},
+		"tuned":   {CacheSize: 65536, MmapSize: 1 << 28},
+	} {
+		b.Run(name, func(b *testing.B) {
+			db, err := initDB(path, pool)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			cache := NewSqliteCache(db, 0)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				channelId := channelIds[i%len(channelIds)]
+				if _, err := cache.GetPostsPage(channelId, (i*37)%900, 100, false); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSameTimestampOrder(t *testing.T) {
+	createdAt := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	var posts []Post
+	for id := 1; id <= 5; id++ {
+		posts = append(posts, Post{Content: fmt.Sprintf("Album part %d", id), Link: fmt.Sprintf("https://t.me/test/%d", id), CreatedAt: createdAt, MessageId: id})
+	}
+	posts = append(posts, Post{Content: "Later post", Link: "https://t.me/test/6", CreatedAt: createdAt.Add(time.Minute), MessageId: 6})
+
+	for name, cache := range map[string]Cache{"sqlite": newTestCache(t), "memory": NewMemoryCache()} {
+		channel, _ := cache.SaveChannel(Channel{Name: "test", Title: "Test"})
+		if _, err := cache.SavePosts(channel.Id, posts); err != nil {
+			t.Fatalf("%s: Save posts failed: %s", name, err)
+		}
+
+		// Posts sharing a timestamp come newest stored first, every time.
+		expected := []int{6, 5, 4, 3, 2, 1}
+		for call := 0; call < 5; call++ {
+			cached, err := cache.GetPosts(channel.Id, MAX_RSS_POSTS_COUNT)
+			if err != nil {
+				t.Fatalf("%s: Get posts failed: %s", name, err)
+			}
+			var actual []int
+			for _, post := range cached {
+				actual = append(actual, post.MessageId)
+			}
+			if !reflect.DeepEqual(actual, expected) {
+				t.Errorf("%s: Invalid posts order, expected - %v, actual - %v", name, expected, actual)
+			}
+		}
+
+		oldest, _ := cache.GetPostsPage(channel.Id, 0, 3, true)
+		if len(oldest) != 3 || oldest[0].MessageId != 1 || oldest[2].MessageId != 3 {
+			t.Errorf("%s: Invalid oldest first page: %v", name, oldest)
+		}
+	}
+}
+
+func TestSameTimestampOrderDescendingSave(t *testing.T) {
+	createdAt := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	var posts []Post
+	for id := 3; id >= 1; id-- {
+		posts = append(posts, Post{Content: fmt.Sprintf("Album part %d", id), Link: fmt.Sprintf("https://t.me/test/%d", id), CreatedAt: createdAt, MessageId: id})
+	}
+
+	for name, cache := range map[string]Cache{"sqlite": newTestCache(t), "memory": NewMemoryCache()} {
+		channel, _ := cache.SaveChannel(Channel{Name: "test", Title: "Test"})
+		// Save each post on its own so the stored ids run against the message ids.
+		for _, post := range posts {
+			if _, err := cache.SavePosts(channel.Id, []Post{post}); err != nil {
+				t.Fatalf("%s: Save posts failed: %s", name, err)
+			}
+		}
+
+		for _, test := range []struct {
+			oldestFirst bool
+			expected    []int
+		}{
+			{false, []int{3, 2, 1}},
+			{true, []int{1, 2, 3}},
+		} {
+			cached, err := cache.GetPostsPage(channel.Id, 0, MAX_RSS_POSTS_COUNT, test.oldestFirst)
+			if err != nil {
+				t.Fatalf("%s: Get posts failed: %s", name, err)
+			}
+			var actual []int
+			for _, post := range cached {
+				actual = append(actual, post.MessageId)
+			}
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("%s: Invalid posts order, expected - %v, actual - %v", name, test.expected, actual)
+			}
+		}
+	}
+}
+
+func TestPrunePosts(t *testing.T) {
+	sharded, err := NewShardedCache(filepath.Join(t.TempDir(), "{channel}.db"), PoolOptions{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sharded.Close()
+
+	now := time.Now().UTC()
+	tests := []struct {
+		keepMin int
+		deleted int
+		kept    []int
+	}{
+		// Both recent posts and posts 3 and 2 are kept, 1 and 0 are pruned.
+		{4, 2, []int{5, 4, 3, 2}},
+		// Recent posts are kept even when they exceed keepMin.
+		{1, 4, []int{5, 4}},
+		{0, 4, []int{5, 4}},
+		{6, 0, []int{5, 4, 3, 2, 1, 0}},
+		{10, 0, []int{5, 4, 3, 2, 1, 0}},
+	}
+
+	for name, cache := range map[string]Cache{"sqlite": newTestCache(t), "memory": NewMemoryCache(), "sharded": sharded} {
+		for i, test := range tests {
+			channel, err := cache.SaveChannel(Channel{Name: fmt.Sprintf("prune%d", i), Title: "Prune"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Posts 0-3 are 100 days old, 4 and 5 are from yesterday and today.
+			var posts []Post
+			for id := 0; id < 6; id++ {
+				createdAt := now.Add(-time.Duration(100*24-id) * time.Hour)
+				if id >= 4 {
+					createdAt = now.Add(-time.Duration(5-id) * 24 * time.Hour)
+				}
+				posts = append(posts, Post{Header: "post", Content: "post", CreatedAt: createdAt, MessageId: id + 1})
+			}
+			if _, err := cache.SavePosts(channel.Id, posts); err != nil {
+				t.Fatal(err)
+			}
+
+			deleted, err := cache.PrunePosts(channel.Id, now.Add(-90*24*time.Hour), test.keepMin)
+			if err != nil {
+				t.Fatalf("%s: Prune failed: %s", name, err)
+			}
+			if deleted != test.deleted {
+				t.Errorf("%s: Invalid deleted count for keepMin %d, expected - %d, actual - %d", name, test.keepMin, test.deleted, deleted)
+			}
+
+			stored, _ := cache.GetPosts(channel.Id, 10)
+			var kept []int
+			for _, post := range stored {
+				kept = append(kept, post.MessageId-1)
+			}
+			if !reflect.DeepEqual(kept, test.kept) {
+				t.Errorf("%s: Invalid kept posts for keepMin %d, expected - %v, actual - %v", name, test.keepMin, test.kept, kept)
+			}
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	tests := map[string]time.Duration{"": 0, "90d": 90 * 24 * time.Hour, "36h": 36 * time.Hour, "0d": 0}
+	for value, expected := range tests {
+		if age, err := parseAge(value); err != nil || age != expected {
+			t.Errorf("Invalid age for %q, expected - %v, actual - %v (%v)", value, expected, age, err)
+		}
+	}
+
+	for _, value := range []string{"d", "-1d", "90days", "-5h"} {
+		if _, err := parseAge(value); err == nil {
+			t.Errorf("Invalid age %q was accepted", value)
+		}
+	}
+}
+
+func TestFeedFormatSuffixRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cache := newTestCache(t)
+	fetcher := &stubFetcher{channel: Channel{Name: "test", Title: "Test", Link: "https://t.me/s/test"}}
+	router := setupRouter(cache, fetcher, nil, ServerConfig{})
+
+	tests := []struct {
+		path        string
+		contentType string
+		body        string
+	}{
+		{"/test", "application/xml", "<rss"},
+		{"/test.rss", "application/xml", "<rss"},
+		{"/test.atom", "application/atom+xml", "<feed"},
+		{"/test.json", "application/feed+json", "\"version\""},
+		{"/test?format=atom", "application/atom+xml", "<feed"},
+	}
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", test.path, nil))
+
+		if recorder.Code != http.StatusOK {
+			t.Errorf("Invalid status for %s, expected - %d, actual - %d", test.path, http.StatusOK, recorder.Code)
+		}
+
+		if contentType := recorder.Header().Get("Content-Type"); contentType != test.contentType {
+			t.Errorf("Invalid content type for %s, expected - %s, actual - %s", test.path, test.contentType, contentType)
+		}
+
+		if !strings.Contains(recorder.Body.String(), test.body) {
+			t.Errorf("Invalid body for %s: %s", test.path, recorder.Body.String())
+		}
+	}
+
+	if _, err := cache.GetChannel("test.rss"); err == nil {
+		t.Errorf("Channel name was not stripped of the extension")
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/test.xml", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Invalid status for unknown format, expected - %d, actual - %d", http.StatusBadRequest, recorder.Code)
+	}
+}
+
+func TestGenerateFeedContentTemplate(t *testing.T) {
+	posts := []DbPost{{Header: "header", Content: "content", Link: "https://t.me/test/1"}}
+
+	feed := generateFeed(DbChannel{Name: "test"}, posts, FeedOptions{})
+	expected := "content\n\n<a href=\"https://t.me/test/1\">[link]</a>"
+	if feed.Items[0].Description != expected {
+		t.Errorf("Invalid default content, expected - %s, actual - %s", expected, feed.Items[0].Description)
+	}
+
+	contentTemplate := template.Must(template.New("content").Parse("<a href=\"{{.Link}}\">{{.Header}}</a> {{.Content}}"))
+	feed = generateFeed(DbChannel{Name: "test"}, posts, FeedOptions{ContentTemplate: contentTemplate})
+	expected = "<a href=\"https://t.me/test/1\">header</a> content"
+	if feed.Items[0].Description != expected {
+		t.Errorf("Invalid template content, expected - %s, actual - %s", expected, feed.Items[0].Description)
+	}
+}
+
+func TestMigrationStripsStoredLink(t *testing.T) {
+	cache := newTestCache(t)
+
+	channel, _ := cache.SaveChannel(Channel{Name: "test"})
+	link := "https://t.me/test/1?embed=1&mode=tme"
+	cache.SavePosts(channel.Id, []Post{{Content: "text\n\n<a href=\"" + link + "\">[link]</a>", Link: link}})
+
+	if err := setSchemaVersion(cache.db, 0); err != nil {
+		t.Fatalf("Can't reset schema version: %s", err)
+	}
+
+	if _, err := migrateDB(cache.db); err != nil {
+		t.Fatalf("Can't run migrations: %s", err)
+	}
+
+	posts, _ := cache.GetPosts(channel.Id, 1)
+	if posts[0].Content != "text" {
+		t.Errorf("Invalid migrated content, expected - %s, actual - %s", "text", posts[0].Content)
+	}
+}
+
+func TestDeleteChannelCascadesToPosts(t *testing.T) {
+	cache := newTestCache(t)
+
+	deleted, _ := cache.SaveChannel(Channel{Name: "deleted"})
+	kept, _ := cache.SaveChannel(Channel{Name: "kept"})
+	cache.SavePosts(deleted.Id, []Post{{Header: "deleted", Link: "https://t.me/deleted/1", MessageId: 1}})
+	cache.SavePosts(kept.Id, []Post{{Header: "kept", Link: "https://t.me/kept/1", MessageId: 1}})
+
+	if _, err := cache.db.Exec("DELETE FROM channels WHERE id = ?", deleted.Id); err != nil {
+		t.Fatalf("Can't delete channel: %s", err)
+	}
+
+	var count int
+	cache.db.QueryRow("SELECT COUNT(*) FROM posts WHERE channelId = ?", deleted.Id).Scan(&count)
+	if count != 0 {
+		t.Errorf("Invalid posts of deleted channel, expected - %d, actual - %d", 0, count)
+	}
+	if posts, _ := cache.GetPosts(kept.Id, 10); len(posts) != 1 {
+		t.Errorf("Invalid posts of kept channel, expected - %d, actual - %d", 1, len(posts))
+	}
+
+	if _, err := cache.SavePosts(deleted.Id, []Post{{Header: "orphan", Link: "https://t.me/deleted/2", MessageId: 2}}); err == nil {
+		t.Errorf("Posts of a missing channel were saved")
+	}
+}
+
+func TestCascadePostsMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	legacy, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = legacy.Exec(`
+		CREATE TABLE channels (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT UNIQUE NOT NULL, title TEXT NOT NULL, lastId INTEGER NOT NULL, link TEXT NOT NULL, description TEXT, refreshInterval INTEGER, newestPostAt DATETIME, postIntervalEma INTEGER, nextRefreshAt DATETIME);
+		CREATE TABLE posts (id INTEGER PRIMARY KEY AUTOINCREMENT, channelId INTEGER NOT NULL, header TEXT NOT NULL, content TEXT NOT NULL, link TEXT NOT NULL, createdAt DATETIME NOT NULL, firstSeenAt DATETIME, messageId INTEGER, views INTEGER, media TEXT, author TEXT, FOREIGN KEY(channelId) REFERENCES channels(id));
+		INSERT INTO channels (id, name, title, lastId, link) VALUES (1, 'legacy', 'Legacy', 1, 'https://t.me/s/legacy');
+		INSERT INTO posts (channelId, header, content, link, createdAt, messageId) VALUES (1, 'kept post', 'kept post', 'https://t.me/legacy/1', '2024-01-01 00:00:00', 1);
+		INSERT INTO posts (channelId, header, content, link, createdAt, messageId) VALUES (2, 'orphan', 'orphan', 'https://t.me/gone/1', '2024-01-01 00:00:00', 1);`)
+	if err != nil {
+		t.Fatalf("Can't create legacy database: %s", err)
+	}
+	for version, migration := range migrations {
+		if migration.Name == "delete posts of deleted channels" {
+			setSchemaVersion(legacy, version)
+		}
+	}
+	legacy.Close()
+
+	db, err := initDB(path, PoolOptions{})
+	if err != nil {
+		t.Fatalf("Can't init db: %s", err)
+	}
+	defer db.Close()
+	if _, err := migrateDB(db); err != nil {
+		t.Fatalf("Can't run migrations: %s", err)
+	}
+
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM posts").Scan(&count)
+	if count != 1 {
+		t.Errorf("Invalid post count after migration, expected - %d, actual - %d", 1, count)
+	}
+
+	cache := NewSqliteCache(db, 0)
+	channel, _ := cache.GetChannel("legacy")
+	cache.SavePosts(channel.Id, []Post{{Header: "new post", Content: "new post", Link: "https://t.me/legacy/2", MessageId: 2, CreatedAt: time.Now()}})
+	if results, _ := cache.SearchPosts("new", 10); len(results) != 1 {
+		t.Errorf("Invalid search results after migration, expected - %d, actual - %d", 1, len(results))
+	}
+
+	db.Exec("DELETE FROM channels WHERE id = ?", channel.Id)
+	db.QueryRow("SELECT COUNT(*) FROM posts").Scan(&count)
+	if count != 0 {
+		t.Errorf("Invalid post count after channel delete, expected - %d, actual - %d", 0, count)
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cache := newTestCache(t)
+	router := setupRouter(cache, &stubFetcher{}, nil, ServerConfig{})
+
+	for _, path := range []string{"/livez", "/readyz"} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		if recorder.Code != http.StatusOK {
+			t.Errorf("Invalid status for %s, expected - %d, actual - %d", path, http.StatusOK, recorder.Code)
+		}
+	}
+
+	cache.db.Close()
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Invalid readiness status, expected - %d, actual - %d", http.StatusServiceUnavailable, recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/livez", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Invalid liveness status, expected - %d, actual - %d", http.StatusOK, recorder.Code)
+	}
+}
+
+func TestPrepareFeedSkipsFetchWhenNewestPostUnchanged(t *testing.T) {
+	cache := newTestCache(t)
+
+	newestPostAt := time.Date(2023, 7, 22, 22, 9, 14, 0, time.UTC)
+	dbChannel, _ := cache.SaveChannel(Channel{Name: "test", Title: "Test", LastId: 5, Link: "https://t.me/s/test"})
+	if err := cache.UpdateNewestPostAt(dbChannel.Id, newestPostAt); err != nil {
+		t.Fatalf("Can't update newest post time: %s", err)
+	}
+
+	// The last message was deleted, so ids went down but nothing is new.
+	fetcher := &stubFetcher{
+		channel: Channel{Name: "test", Title: "Test", LastId: 4, Link: "https://t.me/s/test", NewestPostAt: newestPostAt},
+		posts:   map[int]Post{},
+	}
+
+	if _, err := prepareFeed("test", cache, fetcher, nil, FeedOptions{}); err != nil {
+		t.Fatalf("Can't prepare feed: %s", err)
+	}
+
+	if len(fetcher.fetched) != 0 {
+		t.Errorf("Posts were fetched for an unchanged channel: %v", fetcher.fetched)
+	}
+}
+
+func TestAdminSchemaEndpoints(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cache := newTestCache(t)
+	setSchemaVersion(cache.db, len(migrations)-1)
+	router := setupRouter(cache, &stubFetcher{}, nil, ServerConfig{AdminToken: "secret"})
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/admin/schema", nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Invalid status without token, expected - %d, actual - %d", http.StatusUnauthorized, recorder.Code)
+	}
+
+	request := httptest.NewRequest("GET", "/admin/schema", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), migrations[len(migrations)-1].Name) {
+		t.Errorf("Pending migration is not reported: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	request = httptest.NewRequest("POST", "/admin/migrate", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Invalid migrate status, expected - %d, actual - %d", http.StatusOK, recorder.Code)
+	}
+
+	version, _ := schemaVersion(cache.db)
+	if version != len(migrations) {
+		t.Errorf("Invalid schema version, expected - %d, actual - %d", len(migrations), version)
+	}
+
+	disabled := setupRouter(cache, &stubFetcher{}, nil, ServerConfig{})
+	recorder = httptest.NewRecorder()
+	disabled.ServeHTTP(recorder, httptest.NewRequest("GET", "/admin/schema", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Invalid status without admin token, expected - %d, actual - %d", http.StatusNotFound, recorder.Code)
+	}
+}
+
+func TestParseChannelViews(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	fixture, err := readFixture("fixtures/views.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+
+	httpmock.RegisterResponder("GET", "https://t.me/s/viewstest",
+		httpmock.NewStringResponder(200, fixture))
+
+	fetcher := &TelegramWebFetcher{}
+	channel, err := fetcher.FetchChannel("viewstest")
+	if err != nil {
+		t.Fatalf("Can't fetch channel: %s", err)
+	}
+
+	expected := map[int]int{10: 987, 11: 1200, 12: 3400000}
+	for id, views := range expected {
+		if channel.Views[id] != views {
+			t.Errorf("Invalid views of %d, expected - %d, actual - %d", id, views, channel.Views[id])
+		}
+	}
+
+	if _, ok := channel.Views[13]; ok {
+		t.Errorf("Unexpected views for a message without a counter")
+	}
+}
+
+func TestFetchChannelSkipsMalformedDataPost(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	fixture, err := readFixture("fixtures/malformed.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+
+	httpmock.RegisterResponder("GET", "https://t.me/s/malformedtest",
+		httpmock.NewStringResponder(200, fixture))
+
+	fetcher := &TelegramWebFetcher{}
+	channel, err := fetcher.FetchChannel("malformedtest")
+	if err != nil {
+		t.Fatalf("Can't fetch channel: %s", err)
+	}
+
+	if channel.LastId != 12 {
+		t.Errorf("Invalid last id, expected - %d, actual - %d", 12, channel.LastId)
+	}
+	expected := map[int]int{12: 3400000}
+	if !reflect.DeepEqual(channel.Views, expected) {
+		t.Errorf("Invalid views, expected - %v, actual - %v", expected, channel.Views)
+	}
+}
+
+func TestEmptyChannelFeed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	fixture, err := readFixture("fixtures/empty.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+
+	httpmock.RegisterResponder("GET", "https://t.me/s/emptytest",
+		httpmock.NewStringResponder(200, fixture))
+
+	fetcher := &TelegramWebFetcher{}
+	channel, err := fetcher.FetchChannel("emptytest")
+	if err != nil {
+		t.Fatalf("Can't fetch channel: %s", err)
+	}
+	if channel.LastId != 0 || channel.Title != "Empty Test" {
+		t.Errorf("Invalid channel, expected - 0 Empty Test, actual - %d %s", channel.LastId, channel.Title)
+	}
+
+	router := setupRouter(newTestCache(t), fetcher, nil, ServerConfig{})
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/emptytest", nil))
+	body := recorder.Body.String()
+	if recorder.Code != http.StatusOK || !strings.Contains(body, "<description>Channel that has not posted yet.</description>") || strings.Contains(body, "<item>") {
+		t.Errorf("Invalid empty feed: %d %s", recorder.Code, body)
+	}
+}
+
+func TestFetchChannelRtl(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	fixture, err := readFixture("fixtures/rtl.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+
+	httpmock.RegisterResponder("GET", "https://t.me/s/rtltest",
+		httpmock.NewStringResponder(200, fixture))
+
+	fetcher := &TelegramWebFetcher{}
+	channel, err := fetcher.FetchChannel("rtltest")
+	if err != nil {
+		t.Fatalf("Can't fetch channel: %s", err)
+	}
+
+	if channel.Title != "أخبار اليوم" {
+		t.Errorf("Invalid title, expected - %v, actual - %v", "أخبار اليوم", channel.Title)
+	}
+	if channel.Description != "قناة إخبارية يومية. חדשות בעברית." {
+		t.Errorf("Invalid description, expected - %v, actual - %v", "قناة إخبارية يومية. חדשות בעברית.", channel.Description)
+	}
+	if channel.LastId != 7 || channel.Views[7] != 1500 {
+		t.Errorf("Invalid posts, expected - 7 with 1500 views, actual - %d with %d views", channel.LastId, channel.Views[7])
+	}
+}
+
+func TestUpdatePostViews(t *testing.T) {
+	cache := newTestCache(t)
+
+	channel, _ := cache.SaveChannel(Channel{Name: "test"})
+	cache.SavePosts(channel.Id, []Post{{Header: "post", Link: "https://t.me/test/10", MessageId: 10, Views: 500}})
+
+	if err := cache.UpdatePostViews(channel.Id, map[int]int{10: 1200, 11: 5}); err != nil {
+		t.Fatalf("Can't update views: %s", err)
+	}
+
+	posts, _ := cache.GetPosts(channel.Id, 10)
+	if posts[0].Views != 1200 || posts[0].MessageId != 10 {
+		t.Errorf("Invalid post views, expected - %d, actual - %d", 1200, posts[0].Views)
+	}
+}
+
+func TestGenerateFeedMinViews(t *testing.T) {
+	posts := []DbPost{
+		{Header: "popular", Views: 5000},
+		{Header: "quiet", Views: 10},
+		{Header: "unknown"},
+	}
+
+	feed := generateFeed(DbChannel{Name: "test"}, posts, FeedOptions{MinViews: 1000})
+	if len(feed.Items) != 1 || feed.Items[0].Title != "popular" {
+		t.Errorf("Invalid filtered items, expected - %s, actual - %v", "popular", feed.Items)
+	}
+
+	feed = generateFeed(DbChannel{Name: "test"}, posts, FeedOptions{})
+	if len(feed.Items) != 3 {
+		t.Errorf("Invalid items count without filter, expected - %d, actual - %d", 3, len(feed.Items))
+	}
+}
+
+func TestFetchPostAlbum(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	fixture, err := readFixture("fixtures/album.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+
+	httpmock.RegisterResponder("GET", "https://t.me/albumtest/57?embed=1&mode=tme",
+		httpmock.NewStringResponder(200, fixture))
+
+	fetcher := &TelegramWebFetcher{}
+	post, err := fetcher.FetchPost("albumtest", 57)
+	if err != nil {
+		t.Fatalf("Fetch post failed: %s", err)
+	}
+
+	expected := []Media{
+		{Type: MediaPhoto, Url: "https://cdn4.cdn-telegram.org/file/album-photo-1.jpg"},
+		{Type: MediaPhoto, Url: "https://cdn4.cdn-telegram.org/file/album-photo-2.jpg"},
+		{Type: MediaPhoto, Url: "https://cdn4.cdn-telegram.org/file/album-photo-3.jpg"},
+		{Type: MediaVideo, Url: "https://cdn4.cdn-telegram.org/file/album-video.mp4?token=abc", Thumbnail: "https://cdn4.cdn-telegram.org/file/album-video-thumb.jpg"},
+	}
+	if len(post.Media) != len(expected) {
+		t.Fatalf("Invalid media count, expected - %d, actual - %d", len(expected), len(post.Media))
+	}
+	for i := range expected {
+		if post.Media[i] != expected[i] {
+			t.Errorf("Invalid media, expected - %v, actual - %v", expected[i], post.Media[i])
+		}
+	}
+
+	cache := newTestCache(t)
+	channel, err := cache.SaveChannel(Channel{Name: "albumtest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.SavePosts(channel.Id, []Post{post}); err != nil {
+		t.Fatal(err)
+	}
+	posts, err := cache.GetPosts(channel.Id, MAX_RSS_POSTS_COUNT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 1 || len(posts[0].Media) != len(expected) {
+		t.Fatalf("Invalid cached media, expected - %v, actual - %v", expected, posts)
+	}
+
+	feed := generateFeed(channel, posts, FeedOptions{})
+	description := feed.Items[0].Description
+	for _, media := range expected[:3] {
+		if !strings.Contains(description, "<img src=\""+media.Url+"\">") {
+			t.Errorf("Invalid content, expected image - %s, actual - %s", media.Url, description)
+		}
+	}
+	if !strings.Contains(description, "<video src=\""+expected[3].Url+"\"") {
+		t.Errorf("Invalid content, expected video - %s, actual - %s", expected[3].Url, description)
+	}
+}
+
+func TestShardedCache(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewShardedCache(filepath.Join(dir, "{channel}.db"), PoolOptions{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	first, err := cache.SaveChannel(Channel{Name: "first", Title: "First", Link: "https://t.me/s/first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := cache.SaveChannel(Channel{Name: "second", Title: "Second", Link: "https://t.me/s/second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Id == second.Id {
+		t.Errorf("Invalid channel ids, expected different ids, actual - %d and %d", first.Id, second.Id)
+	}
+
+	for _, name := range []string{"first", "second"} {
+		if _, err := os.Stat(filepath.Join(dir, name+".db")); err != nil {
+			t.Errorf("Invalid shard %s: %s", name, err)
+		}
+	}
+
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache.SavePosts(first.Id, []Post{{Header: "first post", Content: "shared word", Link: "https://t.me/first/1", CreatedAt: createdAt, MessageId: 1}})
+	cache.SavePosts(second.Id, []Post{{Header: "second post", Content: "shared word", Link: "https://t.me/second/1", CreatedAt: createdAt.Add(time.Hour), MessageId: 1}})
+
+	posts, err := cache.GetPosts(second.Id, MAX_RSS_POSTS_COUNT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 1 || posts[0].Header != "second post" || posts[0].ChannelId != second.Id {
+		t.Errorf("Invalid posts, expected - second post, actual - %v", posts)
+	}
+
+	if _, err := cache.GetChannel("missing"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Invalid missing channel error, expected - %v, actual - %v", sql.ErrNoRows, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing.db")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Invalid shard for a missing channel, expected none, actual - %v", err)
+	}
+	if _, err := cache.GetChannel("../escape"); err == nil {
+		t.Errorf("Invalid channel name accepted")
+	}
+
+	reopened, _ := NewShardedCache(filepath.Join(dir, "{channel}.db"), PoolOptions{}, true)
+	defer reopened.Close()
+	channels, err := reopened.GetChannels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 2 {
+		t.Errorf("Invalid channels count, expected - %d, actual - %d", 2, len(channels))
+	}
+
+	results, err := reopened.SearchPosts("shared", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Channel != "second" {
+		t.Errorf("Invalid search results, expected - second then first, actual - %v", results)
+	}
+}
+
+func TestAdminWarmup(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cache := newTestCache(t)
+	fetcher := &stubFetcher{
+		channel: Channel{Name: "warm", Title: "Warm", LastId: 2, Link: "https://t.me/s/warm"},
+		posts: map[int]Post{
+			1: {Header: "first", Content: "first", Link: "https://t.me/warm/1", CreatedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), MessageId: 1},
+			2: {Header: "second", Content: "second", Link: "https://t.me/warm/2", CreatedAt: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), MessageId: 2},
+		},
+	}
+	router := setupRouter(cache, fetcher, NewFetchLimiter(1, time.Second), ServerConfig{AdminToken: "secret"})
+
+	request := httptest.NewRequest("POST", "/admin/warmup", strings.NewReader(`["warm"]`))
+	request.Header.Set("Authorization", "Bearer secret")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("Invalid warmup status, expected - %d, actual - %d", http.StatusAccepted, recorder.Code)
+	}
+
+	var started struct{ Id string }
+	if err := json.Unmarshal(recorder.Body.Bytes(), &started); err != nil || started.Id == "" {
+		t.Fatalf("Invalid warmup response: %s", recorder.Body.String())
+	}
+
+	var job WarmupJob
+	for deadline := time.Now().Add(5 * time.Second); !job.Done && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		request = httptest.NewRequest("GET", "/admin/warmup/"+started.Id, nil)
+		request.Header.Set("Authorization", "Bearer secret")
+		recorder = httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		json.Unmarshal(recorder.Body.Bytes(), &job)
+	}
+
+	if !job.Done || len(job.Channels) != 1 || job.Channels[0].Status != WarmupOk {
+		t.Fatalf("Invalid warmup job, expected - done, actual - %+v", job)
+	}
+
+	channel, err := cache.GetChannel("warm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel.LastId != 2 {
+		t.Errorf("Invalid cached last id, expected - %d, actual - %d", 2, channel.LastId)
+	}
+	posts, _ := cache.GetPosts(channel.Id, MAX_RSS_POSTS_COUNT)
+	if len(posts) == 0 || posts[0].MessageId != 2 {
+		t.Errorf("Invalid cached posts, expected - newest post 2, actual - %v", posts)
+	}
+
+	request = httptest.NewRequest("GET", "/admin/warmup/unknown", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Invalid status for unknown warmup, expected - %d, actual - %d", http.StatusNotFound, recorder.Code)
+	}
+}
+
+func TestToRssGeneratorAndDocs(t *testing.T) {
+	defer func(previous string) { version = previous }(version)
+	version = "1.2.3"
+
+	feed := generateFeed(DbChannel{Name: "test", Link: "https://t.me/s/test"}, []DbPost{}, FeedOptions{})
+	rss, err := toRss(feed, 0)
+	if err != nil {
+		t.Fatalf("Can't render rss: %s", err)
+	}
+
+	if !strings.Contains(rss, "<generator>tg-feeds/1.2.3</generator>") {
+		t.Errorf("Rss has no generator element: %s", rss)
+	}
+	if !strings.Contains(rss, "<docs>"+RSS_DOCS_URL+"</docs>") {
+		t.Errorf("Rss has no docs element: %s", rss)
+	}
+}
+
+func TestGenerateFeedTitleIds(t *testing.T) {
+	posts := []DbPost{
+		{Header: "long post...", Content: "long post", Link: "https://t.me/test/2", MessageId: 2},
+		{Header: "", Content: "short", Link: "https://t.me/test/1", MessageId: 1},
+	}
+
+	feed := generateFeed(DbChannel{Name: "test"}, posts, FeedOptions{TitleIds: true})
+	expected := []string{"[#2] long post...", "[#1]"}
+	for i, item := range feed.Items {
+		if item.Title != expected[i] {
+			t.Errorf("Invalid item title, expected - %s, actual - %s", expected[i], item.Title)
+		}
+	}
+
+	feed = generateFeed(DbChannel{Name: "test"}, posts, FeedOptions{})
+	if feed.Items[0].Title != "long post..." {
+		t.Errorf("Invalid item title, expected - %s, actual - %s", "long post...", feed.Items[0].Title)
+	}
+}
+
+func TestIndexPage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cache := newTestCache(t)
+	cache.SaveChannel(Channel{Name: "second", Title: "Second <Channel>", Link: "https://t.me/s/second"})
+	cache.SaveChannel(Channel{Name: "first", Link: "https://t.me/s/first"})
+
+	router := setupRouter(cache, &stubFetcher{}, nil, ServerConfig{IndexPage: true})
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Invalid index status, expected - %d, actual - %d", http.StatusOK, recorder.Code)
+	}
+
+	body := recorder.Body.String()
+	for _, expected := range []string{
+		`first: <a href="/first.rss">RSS</a> <a href="/first.atom">Atom</a> <a href="/first.json">JSON</a>`,
+		`Second &lt;Channel&gt;: <a href="/second.rss">`,
+		`<link rel="alternate" type="application/rss+xml" title="first" href="/first.rss">`,
+		`<link rel="alternate" type="application/atom+xml" title="Second &lt;Channel&gt;" href="/second.atom">`,
+		`<link rel="alternate" type="application/feed+json" title="first" href="/first.json">`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Invalid index page, expected - %s, actual - %s", expected, body)
+		}
+	}
+	if strings.Index(body, "/first.rss") > strings.Index(body, "/second.rss") {
+		t.Errorf("Invalid index page order: %s", body)
+	}
+
+	disabled := setupRouter(cache, &stubFetcher{}, nil, ServerConfig{})
+	recorder = httptest.NewRecorder()
+	disabled.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Invalid status without index page, expected - %d, actual - %d", http.StatusNotFound, recorder.Code)
+	}
+}
+
+func TestRobots(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		robots   string
+		expected string
+	}{
+		{"", DEFAULT_ROBOTS},
+		{"User-agent: *\nDisallow:\n", "User-agent: *\nDisallow:\n"},
+	}
+	for _, test := range tests {
+		router := setupRouter(newTestCache(t), failingFetcher{}, nil, ServerConfig{Robots: test.robots})
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", "/robots.txt", nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Invalid status, expected - %d, actual - %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+		}
+		if recorder.Body.String() != test.expected {
+			t.Errorf("Invalid robots, expected - %q, actual - %q", test.expected, recorder.Body.String())
+		}
+		if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain") {
+			t.Errorf("Invalid content type, expected - text/plain, actual - %s", contentType)
+		}
+	}
+
+	if !strings.Contains(DEFAULT_ROBOTS, "Disallow: /\n") {
+		t.Errorf("Invalid default robots, feeds aren't disallowed: %q", DEFAULT_ROBOTS)
+	}
+}
+
+type failingFetcher struct{}
+
+func (fetcher failingFetcher) FetchChannel(channelName string) (Channel, error) {
+	return Channel{}, errors.New("Unexpected channel fetch")
+}
+
+func (fetcher failingFetcher) FetchPost(channelName string, id int) (Post, error) {
+	return Post{}, errors.New("Unexpected post fetch")
+}
+
+func TestCachedOnlyFeed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cache := newTestCache(t)
+	channel, _ := cache.SaveChannel(Channel{Name: "cached", Title: "Cached", LastId: 1, Link: "https://t.me/s/cached"})
+	cache.SavePosts(channel.Id, []Post{{Header: "cached post", Content: "cached post", Link: "https://t.me/cached/1", CreatedAt: time.Now(), MessageId: 1}})
+
+	router := setupRouter(cache, failingFetcher{}, nil, ServerConfig{})
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/cached?cached=true", nil))
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "cached post") {
+		t.Errorf("Invalid cached feed: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/missing?cached=true", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Invalid status for uncached channel, expected - %d, actual - %d", http.StatusNotFound, recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/cached?cached=maybe", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Invalid status for invalid cached, expected - %d, actual - %d", http.StatusBadRequest, recorder.Code)
+	}
+}
+
+func TestRefreshWorkerAdaptiveSchedule(t *testing.T) {
+	cache := newTestCache(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	busy, _ := cache.SaveChannel(Channel{Name: "busy", Title: "Busy", Link: "https://t.me/s/busy"})
+	quiet, _ := cache.SaveChannel(Channel{Name: "quiet", Title: "Quiet", Link: "https://t.me/s/quiet"})
+
+	var busyPosts, quietPosts []Post
+	for i := 1; i <= 5; i++ {
+		busyPosts = append(busyPosts, Post{Header: "busy", Content: "busy", Link: "https://t.me/busy", CreatedAt: now.Add(-time.Duration(6-i) * 10 * time.Minute), MessageId: i})
+		quietPosts = append(quietPosts, Post{Header: "quiet", Content: "quiet", Link: "https://t.me/quiet", CreatedAt: now.Add(-time.Duration(6-i) * 72 * time.Hour), MessageId: i})
+	}
+	cache.SavePosts(busy.Id, busyPosts)
+	cache.SavePosts(quiet.Id, quietPosts)
+
+	posts, _ := cache.GetPosts(busy.Id, MAX_RSS_POSTS_COUNT)
+	if ema := postIntervalEma(posts, now); ema != 10*time.Minute {
+		t.Errorf("Invalid post interval average, expected - %s, actual - %s", 10*time.Minute, ema)
+	}
+
+	adaptive := &AdaptiveRefresh{MinInterval: 5 * time.Minute, MaxInterval: 24 * time.Hour}
+	worker := NewRefreshWorker(cache, &stubFetcher{}, nil, nil, nil, time.Hour, adaptive, 0, FeedOptions{})
+	worker.refreshDue(context.Background(), now)
+
+	busy, _ = cache.GetChannel("busy")
+	if !busy.NextRefreshAt.Equal(now.Add(10*time.Minute)) || busy.PostIntervalEma != 10*time.Minute {
+		t.Errorf("Invalid busy schedule, expected - %s, actual - %s (%s)", now.Add(10*time.Minute), busy.NextRefreshAt, busy.PostIntervalEma)
+	}
+
+	quiet, _ = cache.GetChannel("quiet")
+	if !quiet.NextRefreshAt.Equal(now.Add(24 * time.Hour)) {
+		t.Errorf("Invalid quiet schedule, expected - %s, actual - %s", now.Add(24*time.Hour), quiet.NextRefreshAt)
+	}
+
+	later := now.Add(15 * time.Minute)
+	worker.refreshDue(context.Background(), later)
+	if !worker.lastRefreshed["busy"].Equal(later) {
+		t.Errorf("Busy channel not refreshed, last refresh - %s", worker.lastRefreshed["busy"])
+	}
+	if !worker.lastRefreshed["quiet"].Equal(now) {
+		t.Errorf("Quiet channel refreshed too early, last refresh - %s", worker.lastRefreshed["quiet"])
+	}
+}
+
+type flakyFetcher struct {
+	calls int
+	err   error
+}
+
+func (fetcher *flakyFetcher) FetchChannel(channelName string) (Channel, error) {
+	fetcher.calls++
+	if fetcher.err != nil {
+		return Channel{}, fetcher.err
+	}
+	return Channel{Name: channelName, LastId: 1}, nil
+}
+
+func (fetcher *flakyFetcher) FetchPost(channelName string, id int) (Post, error) {
+	fetcher.calls++
+	return Post{}, fetcher.err
+}
+
+// registerSequence makes url answer with responders in turn, repeating the
+// last one once the others are used up.
+func registerSequence(method string, url string, responders ...httpmock.Responder) {
+	var mu sync.Mutex
+	calls := 0
+	httpmock.RegisterResponder(method, url, func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		responder := responders[len(responders)-1]
+		if calls < len(responders) {
+			responder = responders[calls]
+		}
+		calls++
+		mu.Unlock()
+
+		return responder(req)
+	})
+}
+
+// statusResponders returns one responder per status, each with an empty body.
+func statusResponders(statuses ...int) []httpmock.Responder {
+	var responders []httpmock.Responder
+	for _, status := range statuses {
+		responders = append(responders, httpmock.NewStringResponder(status, ""))
+	}
+	return responders
+}
+
+// newConnCountingServer serves an empty page, counting the connections
+// opened to it.
+func newConnCountingServer(t testing.TB) (*httptest.Server, *int64) {
+	var conns int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html></html>"))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+	return server, &conns
+}
+
+// getConcurrently sends rounds of concurrent requests, as parallel channel
+// fetches do.
+func getConcurrently(t testing.TB, client *http.Client, url string, rounds int, concurrency int) {
+	for round := 0; round < rounds; round++ {
+		var wg sync.WaitGroup
+		for i := 0; i < concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, err := telegramGet(client, url, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func TestTelegramClientReusesConnections(t *testing.T) {
+	server, conns := newConnCountingServer(t)
+
+	client := newTelegramClient(HttpClientOptions{Timeout: 5 * time.Second, MaxIdleConnsPerHost: 8, IdleConnTimeout: time.Minute})
+	getConcurrently(t, client, server.URL, 5, 8)
+	if opened := atomic.LoadInt64(conns); opened > 8 {
+		t.Errorf("Invalid opened connections, expected - at most %d, actual - %d", 8, opened)
+	}
+
+	// Fetchers send their requests through the client.
+	httpmock.ActivateNonDefault(client)
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder("GET", "https://t.me/durov/1?embed=1&mode=tme", httpmock.NewStringResponder(200, "<html></html>"))
+	if _, err := (&TelegramWebFetcher{Client: client}).FetchPost("durov", 1); err != nil {
+		t.Errorf("Fetch post failed: %s", err)
+	}
+	if calls := httpmock.GetTotalCallCount(); calls != 1 {
+		t.Errorf("Invalid client calls, expected - %d, actual - %d", 1, calls)
+	}
+}
+
+// BenchmarkTelegramClient compares 8 concurrent fetches through Go's
+// default transport, which keeps 2 idle connections per host, with the
+// tuned client.
+func BenchmarkTelegramClient(b *testing.B) {
+	for name, client := range map[string]*http.Client{
+		"default": {Transport: http.DefaultTransport.(*http.Transport).Clone()},
+		"tuned":   newTelegramClient(HttpClientOptions{MaxIdleConnsPerHost: 16, IdleConnTimeout: time.Minute}),
+	} {
+		b.Run(name, func(b *testing.B) {
+			server, conns := newConnCountingServer(b)
+			b.ResetTimer()
+			getConcurrently(b, client, server.URL, b.N, 8)
+			b.ReportMetric(float64(atomic.LoadInt64(conns))/float64(b.N), "conns/op")
+		})
+	}
+}
+
+func TestFetchHeaders(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	fixture, err := readFixture("fixtures/post.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+
+	var received http.Header
+	httpmock.RegisterResponder("GET", "https://t.me/durov/1?embed=1&mode=tme",
+		func(req *http.Request) (*http.Response, error) {
+			received = req.Header
+			return httpmock.NewStringResponse(200, fixture), nil
+		})
+
+	headers, err := parseFetchHeaders(`{"Accept-Language": "en-US,en;q=0.9", "x-mirror-token": "secret"}`)
+	if err != nil {
+		t.Fatalf("Can't parse headers: %s", err)
+	}
+	fetcher := &TelegramWebFetcher{Headers: headers}
+	if _, err := fetcher.FetchPost("durov", 1); err != nil {
+		t.Fatalf("Fetch post failed: %s", err)
+	}
+	if received.Get("Accept-Language") != "en-US,en;q=0.9" || received.Get("X-Mirror-Token") != "secret" {
+		t.Errorf("Invalid request headers: %v", received)
+	}
+
+	for _, value := range []string{`{"Bad Header": "x"}`, `{"X-Test": "a\r\nb"}`, `["X-Test"]`} {
+		if _, err := parseFetchHeaders(value); err == nil {
+			t.Errorf("Invalid headers accepted: %s", value)
+		}
+	}
+}
+
+func TestFetcherRetries(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	fixture, err := readFixture("fixtures/views.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+
+	url := "https://t.me/s/viewstest"
+	registerSequence("GET", url, append(statusResponders(500, 429), httpmock.NewStringResponder(200, fixture))...)
+
+	fetcher := &TelegramWebFetcher{Retries: 2, RetryBackoff: time.Millisecond}
+	channel, err := fetcher.FetchChannel("viewstest")
+	if err != nil {
+		t.Fatalf("Can't fetch channel: %s", err)
+	}
+	if channel.LastId != 13 {
+		t.Errorf("Invalid last id, expected - %d, actual - %d", 13, channel.LastId)
+	}
+	if calls := httpmock.GetCallCountInfo()["GET "+url]; calls != 3 {
+		t.Errorf("Invalid request count, expected - %d, actual - %d", 3, calls)
+	}
+
+	// Retries give up, and the breaker counts the whole fetch as one failure.
+	httpmock.Reset()
+	registerSequence("GET", url, statusResponders(503)...)
+	breaker := NewCircuitBreaker(fetcher, 2, time.Minute)
+	if _, err := breaker.FetchChannel("viewstest"); !errors.Is(err, ErrTelegramUnavailable) {
+		t.Errorf("Invalid error, expected - %v, actual - %v", ErrTelegramUnavailable, err)
+	}
+	if calls := httpmock.GetCallCountInfo()["GET "+url]; calls != 3 {
+		t.Errorf("Invalid request count, expected - %d, actual - %d", 3, calls)
+	}
+	if _, err := breaker.FetchChannel("viewstest"); errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Circuit opened after a single failed fetch")
+	}
+	if _, err := breaker.FetchChannel("viewstest"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Invalid error, expected - %v, actual - %v", ErrCircuitOpen, err)
+	}
+
+	// Other errors aren't retried.
+	httpmock.Reset()
+	registerSequence("GET", tgChannelPostUrl("viewstest", 10), statusResponders(404)...)
+	fetcher.FetchPost("viewstest", 10)
+	if calls := httpmock.GetCallCountInfo()["GET "+tgChannelPostUrl("viewstest", 10)]; calls != 1 {
+		t.Errorf("Invalid request count, expected - %d, actual - %d", 1, calls)
+	}
+}
+
+func TestFetcherRetryAfter(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	fixture, err := readFixture("fixtures/views.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+
+	// The backoff is given back to the limiter, so another channel is
+	// fetched while the first one waits for Retry-After.
+	url := "https://t.me/s/viewstest"
+	limited := httpmock.NewStringResponder(429, "").HeaderSet(http.Header{"Retry-After": []string{"1"}})
+	registerSequence("GET", url, limited, httpmock.NewStringResponder(200, fixture))
+
+	limiter := NewFetchLimiter(1, time.Second)
+	fetcher := &TelegramWebFetcher{Retries: 1, RetryBackoff: time.Millisecond, Limiter: limiter}
+	limiter.Acquire()
+	start := time.Now()
+	done := make(chan error)
+	go func() {
+		defer limiter.Release()
+		_, err := fetcher.FetchChannel("viewstest")
+		done <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if err := limiter.Acquire(); err != nil {
+		t.Errorf("Slot is held while waiting to retry")
+	} else {
+		limiter.Release()
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Can't fetch channel: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Invalid wait, expected - %s, actual - %s", time.Second, elapsed)
+	}
+
+	// Waits longer than MAX_RETRY_AFTER aren't retried.
+	httpmock.Reset()
+	limited = httpmock.NewStringResponder(503, "").HeaderSet(http.Header{"Retry-After": []string{"3600"}})
+	registerSequence("GET", url, limited, httpmock.NewStringResponder(200, fixture))
+	fetcher = &TelegramWebFetcher{Retries: 2, RetryBackoff: time.Millisecond}
+	if _, err := fetcher.FetchChannel("viewstest"); !errors.Is(err, ErrTelegramUnavailable) {
+		t.Errorf("Invalid error, expected - %v, actual - %v", ErrTelegramUnavailable, err)
+	}
+	if calls := httpmock.GetCallCountInfo()["GET "+url]; calls != 1 {
+		t.Errorf("Invalid request count, expected - %d, actual - %d", 1, calls)
+	}
+}
+
+func TestFailureCache(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	flaky := &flakyFetcher{err: fmt.Errorf("%w: missing", ErrChannelPreviewOnly)}
+	failures := NewFailureCache(flaky, 5*time.Minute)
+	failures.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if _, err := failures.FetchChannel("missing"); !errors.Is(err, ErrChannelPreviewOnly) {
+			t.Errorf("Invalid error, expected - %v, actual - %v", ErrChannelPreviewOnly, err)
+		}
+	}
+	if _, err := failures.FetchChannel("Missing"); !errors.Is(err, ErrChannelPreviewOnly) {
+		t.Errorf("Invalid error, expected - %v, actual - %v", ErrChannelPreviewOnly, err)
+	}
+	if flaky.calls != 1 {
+		t.Errorf("Invalid calls within ttl, expected - %d, actual - %d", 1, flaky.calls)
+	}
+
+	// A channel that works again is fetched after the ttl.
+	now = now.Add(5 * time.Minute)
+	flaky.err = nil
+	if channel, err := failures.FetchChannel("missing"); err != nil || channel.Name != "missing" {
+		t.Errorf("Invalid channel after ttl: %+v %v", channel, err)
+	}
+	failures.FetchChannel("missing")
+	if flaky.calls != 3 {
+		t.Errorf("Invalid calls after ttl, expected - %d, actual - %d", 3, flaky.calls)
+	}
+
+	// Transient failures aren't remembered.
+	flaky.err = fmt.Errorf("%w: 502 Bad Gateway", ErrTelegramUnavailable)
+	failures.FetchChannel("down")
+	failures.FetchChannel("down")
+	if flaky.calls != 5 {
+		t.Errorf("Invalid calls of unavailable channel, expected - %d, actual - %d", 5, flaky.calls)
+	}
+
+	gin.SetMode(gin.TestMode)
+	flaky.err = fmt.Errorf("%w: blocked: unavailable in your country", ErrChannelRestricted)
+	router := setupRouter(newTestCache(t), failures, nil, ServerConfig{})
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", "/blocked", nil))
+		if recorder.Code != http.StatusUnavailableForLegalReasons || !strings.Contains(recorder.Body.String(), ErrorCodeChannelRestricted) {
+			t.Errorf("Invalid response, expected - %d %s, actual - %d %s", http.StatusUnavailableForLegalReasons, ErrorCodeChannelRestricted, recorder.Code, recorder.Body.String())
+		}
+	}
+	if flaky.calls != 6 {
+		t.Errorf("Invalid calls of restricted channel, expected - %d, actual - %d", 6, flaky.calls)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	flaky := &flakyFetcher{err: fmt.Errorf("%w: 429 Too Many Requests", ErrTelegramUnavailable)}
+	breaker := NewCircuitBreaker(flaky, 3, time.Minute)
+	breaker.now = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		breaker.FetchChannel("test")
+	}
+	if flaky.calls != 3 {
+		t.Errorf("Invalid calls while open, expected - %d, actual - %d", 3, flaky.calls)
+	}
+	if _, err := breaker.FetchChannel("test"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Invalid error while open, expected - %v, actual - %v", ErrCircuitOpen, err)
+	}
+	if retryAfter := breaker.RetryAfter(); retryAfter != 60 {
+		t.Errorf("Invalid retry after, expected - %d, actual - %d", 60, retryAfter)
+	}
+
+	// A failed probe after the cooldown reopens the circuit.
+	now = now.Add(time.Minute)
+	breaker.FetchChannel("test")
+	breaker.FetchChannel("test")
+	if flaky.calls != 4 {
+		t.Errorf("Invalid calls after failed probe, expected - %d, actual - %d", 4, flaky.calls)
+	}
+
+	// A successful probe closes it.
+	now = now.Add(time.Minute)
+	flaky.err = nil
+	if _, err := breaker.FetchChannel("test"); err != nil {
+		t.Errorf("Invalid probe error, expected - nil, actual - %v", err)
+	}
+	breaker.FetchChannel("test")
+	if flaky.calls != 6 {
+		t.Errorf("Invalid calls after recovery, expected - %d, actual - %d", 6, flaky.calls)
+	}
+
+	// Errors that aren't Telegram's fault don't count.
+	flaky.err = errors.New("Post not found")
+	for i := 0; i < 5; i++ {
+		breaker.FetchPost("test", 1)
+	}
+	if _, err := breaker.FetchPost("test", 1); errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Circuit opened on missing posts")
+	}
+}
+
+func TestCircuitOpenServesCache(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cache := newTestCache(t)
+	channel, _ := cache.SaveChannel(Channel{Name: "cached", Title: "Cached", LastId: 1, Link: "https://t.me/s/cached"})
+	cache.SavePosts(channel.Id, []Post{{Header: "cached post", Content: "cached post", Link: "https://t.me/cached/1", CreatedAt: time.Now(), MessageId: 1}})
+
+	breaker := NewCircuitBreaker(&flakyFetcher{err: ErrTelegramUnavailable}, 1, time.Minute)
+	router := setupRouter(cache, breaker, nil, ServerConfig{})
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/cached", nil))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/cached", nil))
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "cached post") {
+		t.Errorf("Invalid degraded feed: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder.Header().Get(DEGRADED_HEADER) == "" {
+		t.Errorf("Degraded response has no %s header", DEGRADED_HEADER)
+	}
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/missing", nil))
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("Invalid response for uncached channel: %d %v", recorder.Code, recorder.Header())
+	}
+}
+
+func TestFetchPostAuthorSignature(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	fixture, err := readFixture("fixtures/signed.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+
+	httpmock.RegisterResponder("GET", "https://t.me/signedtest/41?embed=1&mode=tme",
+		httpmock.NewStringResponder(200, fixture))
+
+	fetcher := &TelegramWebFetcher{}
+	post, err := fetcher.FetchPost("signedtest", 41)
+	if err != nil {
+		t.Fatalf("Fetch post failed: %s", err)
+	}
+	if post.Author != "Jane Roe" {
+		t.Errorf("Invalid post author, expected - %s, actual - %s", "Jane Roe", post.Author)
+	}
+
+	cache := newTestCache(t)
+	channel, _ := cache.SaveChannel(Channel{Name: "signedtest", Title: "Signed Test", Link: "https://t.me/s/signedtest"})
+	cache.SavePosts(channel.Id, []Post{post, {Header: "unsigned", Content: "unsigned", Link: "https://t.me/signedtest/40", CreatedAt: post.CreatedAt.Add(-time.Hour), MessageId: 40}})
+	posts, _ := cache.GetPosts(channel.Id, MAX_RSS_POSTS_COUNT)
+
+	feed := generateFeed(channel, posts, FeedOptions{})
+	expected := []string{"Jane Roe", "Signed Test"}
+	for i, item := range feed.Items {
+		if item.Author == nil || item.Author.Name != expected[i] {
+			t.Errorf("Invalid item author, expected - %s, actual - %v", expected[i], item.Author)
+		}
+	}
+}
+
+func TestFetchPostReactions(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	fixture, err := readFixture("fixtures/reactions.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+
+	httpmock.RegisterResponder("GET", "https://t.me/reactionstest/12?embed=1&mode=tme",
+		httpmock.NewStringResponder(200, fixture))
+
+	fetcher := &TelegramWebFetcher{}
+	post, err := fetcher.FetchPost("reactionstest", 12)
+	if err != nil {
+		t.Fatalf("Fetch post failed: %s", err)
+	}
+	expected := []Reaction{{Emoji: "👍", Count: 1200}, {Emoji: "❤", Count: 35}}
+	if !reflect.DeepEqual(post.Reactions, expected) {
+		t.Errorf("Invalid reactions, expected - %v, actual - %v", expected, post.Reactions)
+	}
+
+	cache := newTestCache(t)
+	channel, _ := cache.SaveChannel(Channel{Name: "reactionstest", Title: "Reactions Test", Link: "https://t.me/s/reactionstest"})
+	cache.SavePosts(channel.Id, []Post{post})
+	posts, _ := cache.GetPosts(channel.Id, MAX_RSS_POSTS_COUNT)
+	if !reflect.DeepEqual(posts[0].Reactions, expected) {
+		t.Errorf("Invalid cached reactions, expected - %v, actual - %v", expected, posts[0].Reactions)
+	}
+
+	if feed := generateFeed(channel, posts, FeedOptions{}); strings.Contains(feed.Items[0].Description, "👍") {
+		t.Errorf("Reactions included without IncludeReactions: %s", feed.Items[0].Description)
+	}
+	feed := generateFeed(channel, posts, FeedOptions{IncludeReactions: true})
+	if !strings.HasSuffix(feed.Items[0].Description, "\n\n👍 1200 · ❤ 35") {
+		t.Errorf("Invalid reactions in description: %s", feed.Items[0].Description)
+	}
+}
+
+func TestEditedMarker(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	editedFixture, err := readFixture("fixtures/edited_post.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+	signedFixture, err := readFixture("fixtures/signed.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+
+	httpmock.RegisterResponder("GET", "https://t.me/editedtest/21?embed=1&mode=tme",
+		httpmock.NewStringResponder(200, editedFixture))
+	httpmock.RegisterResponder("GET", "https://t.me/signedtest/41?embed=1&mode=tme",
+		httpmock.NewStringResponder(200, signedFixture))
+
+	fetcher := &TelegramWebFetcher{}
+	edited, err := fetcher.FetchPost("editedtest", 21)
+	if err != nil {
+		t.Fatalf("Fetch post failed: %s", err)
+	}
+	if !edited.Edited {
+		t.Errorf("Invalid edited flag, expected - %v, actual - %v", true, edited.Edited)
+	}
+	unedited, err := fetcher.FetchPost("signedtest", 41)
+	if err != nil {
+		t.Fatalf("Fetch post failed: %s", err)
+	}
+	if unedited.Edited {
+		t.Errorf("Invalid edited flag, expected - %v, actual - %v", false, unedited.Edited)
+	}
+	unedited.CreatedAt = edited.CreatedAt.Add(-time.Hour)
+
+	cache := newTestCache(t)
+	channel, _ := cache.SaveChannel(Channel{Name: "editedtest", Title: "Edited Test", Link: "https://t.me/s/editedtest"})
+	cache.SavePosts(channel.Id, []Post{edited, unedited})
+	posts, _ := cache.GetPosts(channel.Id, MAX_RSS_POSTS_COUNT)
+	if len(posts) != 2 || !posts[0].Edited || posts[1].Edited {
+		t.Fatalf("Invalid cached edited flags: %v", posts)
+	}
+
+	if feed := generateFeed(channel, posts, FeedOptions{}); strings.Contains(feed.Items[0].Title, "(edited)") {
+		t.Errorf("Edited marker included without EditedMarker: %s", feed.Items[0].Title)
+	}
+	feed := generateFeed(channel, posts, FeedOptions{EditedMarker: true})
+	if !strings.HasSuffix(feed.Items[0].Title, "(edited)") {
+		t.Errorf("Invalid edited title: %s", feed.Items[0].Title)
+	}
+	if strings.Contains(feed.Items[1].Title, "(edited)") {
+		t.Errorf("Unedited post marked as edited: %s", feed.Items[1].Title)
+	}
+
+	// Edits noticed after caching mark the post as well.
+	unedited.Content = "Updated report"
+	if err := cache.UpdateEditedPosts(channel.Id, []Post{unedited}); err != nil {
+		t.Fatalf("Update edited posts failed: %s", err)
+	}
+	posts, _ = cache.GetPosts(channel.Id, MAX_RSS_POSTS_COUNT)
+	feed = generateFeed(channel, posts, FeedOptions{EditedMarker: true})
+	if !strings.HasSuffix(feed.Items[1].Title, "(edited)") {
+		t.Errorf("Invalid updated title: %s", feed.Items[1].Title)
+	}
+}
+
+func TestSplitContent(t *testing.T) {
+	longContent := strings.Repeat("A long post about trams & buses. ", 5)
+	posts := []DbPost{
+		{Header: "A long post about trams & buses...", Content: longContent, Link: "https://t.me/test/2", CreatedAt: time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC), MessageId: 2},
+		{Content: "Short <post>", Link: "https://t.me/test/1", CreatedAt: time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC), MessageId: 1},
+	}
+	channel := DbChannel{Name: "test", Title: "Test", Link: "https://t.me/s/test"}
+
+	type atomEntry struct {
+		Summary string `xml:"summary"`
+		Content string `xml:"content"`
+	}
+	var atom struct {
+		Entries []atomEntry `xml:"entry"`
+	}
+	var document bytes.Buffer
+	if err := writeFeed(&document, generateFeed(channel, posts, FeedOptions{SplitContent: true}), FormatAtom, 0, false); err != nil {
+		t.Fatalf("Can't render atom: %s", err)
+	}
+	if err := xml.Unmarshal(document.Bytes(), &atom); err != nil || len(atom.Entries) != 2 {
+		t.Fatalf("Can't parse atom: %v %s", err, document.String())
+	}
+
+	if atom.Entries[0].Summary != "A long post about trams &amp; buses..." {
+		t.Errorf("Invalid summary, expected - %s, actual - %s", "A long post about trams &amp; buses...", atom.Entries[0].Summary)
+	}
+	if !strings.Contains(atom.Entries[0].Content, longContent) {
+		t.Errorf("Invalid content, expected - %s, actual - %s", longContent, atom.Entries[0].Content)
+	}
+	// Posts without a header are summarized by their text.
+	if atom.Entries[1].Summary != "Short &lt;post&gt;" || !strings.Contains(atom.Entries[1].Content, "Short <post>") {
+		t.Errorf("Invalid short entry: %+v", atom.Entries[1])
+	}
+
+	rss, err := toRss(generateFeed(channel, posts, FeedOptions{SplitContent: true}), 0)
+	if err != nil {
+		t.Fatalf("Can't render rss: %s", err)
+	}
+	if !strings.Contains(rss, "<content:encoded><![CDATA[") {
+		t.Errorf("Invalid rss, expected content:encoded: %s", rss)
+	}
+
+	// Without the flag the full post stays in the description only.
+	unsplit := generateFeed(channel, posts, FeedOptions{})
+	if unsplit.Items[0].Content != "" || !strings.Contains(unsplit.Items[0].Description, longContent) {
+		t.Errorf("Invalid unsplit item: %+v", unsplit.Items[0])
+	}
+}
+
+func TestAtomUpdatedForEditedPosts(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	for url, path := range map[string]string{
+		"https://t.me/s/editedtest":                   "fixtures/edited.html",
+		"https://t.me/editedtest/11?embed=1&mode=tme": "fixtures/post.html",
+	} {
+		fixture, err := readFixture(path)
+		if err != nil {
+			t.Errorf("Invalid fixture")
+		}
+		httpmock.RegisterResponder("GET", url, httpmock.NewStringResponder(200, fixture))
+	}
+
+	cache := newTestCache(t)
+	channel, _ := cache.SaveChannel(Channel{Name: "editedtest", Title: "Edited Test", LastId: 13, Link: "https://t.me/s/editedtest"})
+	cache.SavePosts(channel.Id, []Post{
+		{Header: "", Content: "Small post", Link: "https://t.me/editedtest/10", CreatedAt: time.Date(2024, 1, 10, 10, 0, 0, 0, time.UTC), MessageId: 10},
+		{Header: "", Content: "Popular post", Link: "https://t.me/editedtest/11", CreatedAt: time.Date(2024, 1, 11, 10, 0, 0, 0, time.UTC), MessageId: 11},
+	})
+
+	type atomEntry struct {
+		Id        string `xml:"id"`
+		Updated   string `xml:"updated"`
+		Published string `xml:"published"`
+		Summary   string `xml:"summary"`
+	}
+	type atomDocument struct {
+		Updated string      `xml:"updated"`
+		Entries []atomEntry `xml:"entry"`
+	}
+	renderAtom := func(feed *feeds.Feed) atomDocument {
+		var atom bytes.Buffer
+		if err := writeFeed(&atom, feed, FormatAtom, 0, false); err != nil {
+			t.Fatalf("Can't render atom: %s", err)
+		}
+		var document atomDocument
+		if err := xml.Unmarshal(atom.Bytes(), &document); err != nil {
+			t.Fatalf("Can't parse atom: %s", err)
+		}
+		return document
+	}
+
+	posts, _ := cache.GetPosts(channel.Id, MAX_RSS_POSTS_COUNT)
+	before := renderAtom(generateFeed(channel, posts, FeedOptions{}))
+	if before.Entries[0].Updated != before.Entries[0].Published || before.Updated != "2024-01-11T10:00:00Z" {
+		t.Errorf("Invalid atom before the edit: %+v", before)
+	}
+
+	fetcher := &TelegramWebFetcher{}
+	result, err := prepareFeed("editedtest", cache, fetcher, nil, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Prepare feed failed: %s", err)
+	}
+	feed := result.Feed
+
+	posts, _ = cache.GetPosts(channel.Id, MAX_RSS_POSTS_COUNT)
+	if posts[0].MessageId != 11 || posts[0].UpdatedAt.IsZero() || posts[0].Content == "Popular post" {
+		t.Errorf("Edited post was not refreshed: %+v", posts[0])
+	}
+	if !posts[1].UpdatedAt.IsZero() {
+		t.Errorf("Unedited post was marked as updated: %+v", posts[1])
+	}
+
+	after := renderAtom(feed)
+	edited := after.Entries[0]
+	if edited.Published != "2024-01-11T10:00:00Z" || edited.Updated == edited.Published {
+		t.Errorf("Invalid edited entry dates, published - %s, updated - %s", edited.Published, edited.Updated)
+	}
+	if edited.Id != before.Entries[0].Id {
+		t.Errorf("Entry id changed after the edit, expected - %s, actual - %s", before.Entries[0].Id, edited.Id)
+	}
+	if after.Updated != edited.Updated {
+		t.Errorf("Invalid feed updated, expected - %s, actual - %s", edited.Updated, after.Updated)
+	}
+	if after.Entries[1].Updated != after.Entries[1].Published {
+		t.Errorf("Invalid unedited entry dates, published - %s, updated - %s", after.Entries[1].Published, after.Entries[1].Updated)
+	}
+
+	// The edit is only downloaded once.
+	prepareFeed("editedtest", cache, fetcher, nil, FeedOptions{})
+	if calls := httpmock.GetCallCountInfo()["GET https://t.me/editedtest/11?embed=1&mode=tme"]; calls != 1 {
+		t.Errorf("Invalid edited post downloads, expected - 1, actual - %d", calls)
+	}
+}
+
+func TestFetchPostSticker(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	fixture, err := readFixture("fixtures/sticker.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+
+	httpmock.RegisterResponder("GET", "https://t.me/stickertest/8?embed=1&mode=tme",
+		httpmock.NewStringResponder(200, fixture))
+
+	fetcher := &TelegramWebFetcher{}
+	post, err := fetcher.FetchPost("stickertest", 8)
+	if err != nil {
+		t.Fatalf("Fetch post failed: %s", err)
+	}
+	if post.Header != "Sticker: 😀" || post.Content != "Sticker: 😀" {
+		t.Errorf("Invalid sticker post, expected - Sticker: 😀, actual - %q %q", post.Header, post.Content)
+	}
+	if len(post.Media) != 0 {
+		t.Errorf("Invalid media, expected - none, actual - %v", post.Media)
+	}
+}
+
+func TestContentHtml(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	fixture, err := readFixture("fixtures/formatted.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+	httpmock.RegisterResponder("GET", "https://t.me/formattest/3?embed=1&mode=tme",
+		httpmock.NewStringResponder(200, fixture))
+
+	post, err := (&TelegramWebFetcher{}).FetchPost("formattest", 3)
+	if err != nil {
+		t.Fatalf("Fetch post failed: %s", err)
+	}
+	if post.ContentHtml != "" {
+		t.Errorf("Invalid content html without -contenthtml: %s", post.ContentHtml)
+	}
+
+	post, err = (&TelegramWebFetcher{ContentHtml: true}).FetchPost("formattest", 3)
+	if err != nil {
+		t.Fatalf("Fetch post failed: %s", err)
+	}
+	expectedHtml := `<b>Release notes</b> 🚀<br><br>Read the <a href="https://example.com/notes?a=1&amp;b=2">full notes</a>, see <code>v2</code> &amp; this.Secret`
+	if post.ContentHtml != expectedHtml {
+		t.Errorf("Invalid content html, expected - %s, actual - %s", expectedHtml, post.ContentHtml)
+	}
+	if !strings.HasPrefix(post.Content, "Release notes 🚀Read the full notes") || strings.Contains(post.Content, "<") {
+		t.Errorf("Invalid plain content: %s", post.Content)
+	}
+
+	for name, cache := range map[string]Cache{"sqlite": newTestCache(t), "memory": NewMemoryCache()} {
+		channel, err := cache.SaveChannel(Channel{Name: "formattest", Title: "Format Test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cache.SavePosts(channel.Id, []Post{post}); err != nil {
+			t.Fatal(err)
+		}
+
+		router := setupRouter(cache, &stubFetcher{}, nil, ServerConfig{ContentHtml: true})
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", "/search?q=notes", nil))
+
+		var response struct {
+			Results []map[string]interface{} `json:"results"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || len(response.Results) != 1 {
+			t.Fatalf("%s: Invalid search response: %d %s", name, recorder.Code, recorder.Body.String())
+		}
+		result := response.Results[0]
+		if result["content"] != post.Content || result["contentHtml"] != expectedHtml {
+			t.Errorf("%s: Invalid search result, expected - both contents, actual - %v", name, result)
+		}
+	}
+}
+
+func TestFetchPostLongText(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	var fullText string
+	for i := 1; i <= 30; i++ {
+		fullText += fmt.Sprintf("Paragraph %d of a long read about how the city rebuilt its tram network, covering the budget, the timeline, the contractors and what residents think of the new routes. ", i)
+	}
+	fullText += "The end."
+
+	for _, name := range []string{"long", "truncated"} {
+		fixture, err := readFixture("fixtures/" + name + ".html")
+		if err != nil {
+			t.Errorf("Invalid fixture")
+		}
+		id := map[string]int{"long": 5, "truncated": 6}[name]
+		httpmock.RegisterResponder("GET", fmt.Sprintf("https://t.me/longtest/%d?embed=1&mode=tme", id),
+			httpmock.NewStringResponder(200, fixture))
+	}
+	channelFixture, err := readFixture("fixtures/long_channel.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+	httpmock.RegisterResponder("GET", "https://t.me/s/longtest?before=7",
+		httpmock.NewStringResponder(200, channelFixture))
+
+	fetcher := &TelegramWebFetcher{}
+	post, err := fetcher.FetchPost("longtest", 5)
+	if err != nil {
+		t.Fatalf("Fetch post failed: %s", err)
+	}
+	if post.Content != fullText {
+		t.Errorf("Invalid content, expected - %d chars, actual - %d chars: %s", len(fullText), len(post.Content), post.Content)
+	}
+
+	post, err = fetcher.FetchPost("longtest", 6)
+	if err != nil {
+		t.Fatalf("Fetch post failed: %s", err)
+	}
+	if strings.Contains(post.Content, "Show more") || !strings.HasPrefix(fullText, strings.TrimSuffix(post.Content, "…")) {
+		t.Errorf("Invalid truncated content: %s", post.Content)
+	}
+	if calls := httpmock.GetCallCountInfo()["GET https://t.me/s/longtest?before=7"]; calls != 0 {
+		t.Errorf("Invalid channel page requests, expected - 0, actual - %d", calls)
+	}
+
+	fetcher = &TelegramWebFetcher{FullText: true}
+	post, err = fetcher.FetchPost("longtest", 6)
+	if err != nil {
+		t.Fatalf("Fetch post failed: %s", err)
+	}
+	if post.Content != fullText {
+		t.Errorf("Invalid full text, expected - %d chars, actual - %d chars: %s", len(fullText), len(post.Content), post.Content)
+	}
+}
+
+func TestPrepareFeedFetchOrders(t *testing.T) {
+	base := time.Date(2023, 6, 16, 12, 0, 0, 0, time.UTC)
+	newFetcher := func() *stubFetcher {
+		posts := map[int]Post{}
+		for id := 1; id <= 30; id++ {
+			header := strconv.Itoa(id)
+			posts[id] = Post{Header: header, Content: header, Link: header, CreatedAt: base.Add(time.Duration(id) * time.Hour), MessageId: id}
+		}
+		return &stubFetcher{channel: Channel{Name: "test", Title: "Test", LastId: 30, Link: "https://t.me/s/test"}, posts: posts}
+	}
+
+	cases := []struct {
+		name         string
+		cachedLastId int
+		expected     int
+		items        int
+	}{
+		{"new channel", 0, MAX_RSS_POSTS_COUNT, MAX_RSS_POSTS_COUNT},
+		{"few new posts", 27, 3, 4},
+		{"single new post", 29, 1, 2},
+	}
+
+	for _, tc := range cases {
+		stored := map[string][]int{}
+		for _, order := range []string{FetchDescending, FetchAscending} {
+			cache := newTestCache(t)
+			if tc.cachedLastId > 0 {
+				channel, _ := cache.SaveChannel(Channel{Name: "test", Title: "Test", LastId: tc.cachedLastId, Link: "https://t.me/s/test"})
+				cache.SavePosts(channel.Id, []Post{{Header: "cached", Content: "cached", Link: "cached", CreatedAt: base.Add(time.Duration(tc.cachedLastId) * time.Hour), MessageId: tc.cachedLastId}})
+			}
+
+			result, err := prepareFeed("test", cache, newFetcher(), nil, FeedOptions{FetchOrder: order})
+			if err != nil {
+				t.Fatalf("Can't prepare feed: %s", err)
+			}
+			feed := result.Feed
+			if len(feed.Items) != tc.items || feed.Items[0].Title != "30" {
+				t.Errorf("%s, %s: invalid feed items, expected - %d newest first, actual - %d", tc.name, order, tc.items, len(feed.Items))
+			}
+
+			channel, _ := cache.GetChannel("test")
+			posts, _ := cache.GetPosts(channel.Id, MAX_RSS_POSTS_COUNT)
+			for _, post := range posts {
+				if post.Header != "cached" {
+					stored[order] = append(stored[order], post.MessageId)
+				}
+			}
+		}
+
+		if len(stored[FetchDescending]) != tc.expected || strings.Trim(fmt.Sprint(stored[FetchDescending]), "[]") != strings.Trim(fmt.Sprint(stored[FetchAscending]), "[]") {
+			t.Errorf("%s: invalid stored posts, descending - %v, ascending - %v", tc.name, stored[FetchDescending], stored[FetchAscending])
+		}
+	}
+}
+
+func TestFetchLimit(t *testing.T) {
+	base := time.Date(2023, 6, 16, 12, 0, 0, 0, time.UTC)
+	cache := newTestCache(t)
+	channel, _ := cache.SaveChannel(Channel{Name: "test", Title: "Test", LastId: 25, Link: "https://t.me/s/test"})
+	var cached []Post
+	for id := 25; id >= 1; id-- {
+		header := strconv.Itoa(id)
+		cached = append(cached, Post{Header: header, Content: header, Link: header, CreatedAt: base.Add(time.Duration(id) * time.Hour), MessageId: id})
+	}
+	cache.SavePosts(channel.Id, cached)
+
+	posts := map[int]Post{}
+	for id := 1; id <= 30; id++ {
+		header := strconv.Itoa(id)
+		posts[id] = Post{Header: header, Content: header, Link: header, CreatedAt: base.Add(time.Duration(id) * time.Hour), MessageId: id}
+	}
+	fetcher := &stubFetcher{channel: Channel{Name: "test", Title: "Test", LastId: 30, Link: "https://t.me/s/test"}, posts: posts}
+
+	result, err := prepareFeed("test", cache, fetcher, nil, FeedOptions{FetchLimit: 3, ServeLimit: 10})
+	if err != nil {
+		t.Fatalf("Can't prepare feed: %s", err)
+	}
+	if !reflect.DeepEqual(fetcher.fetched, []int{30, 29, 28}) {
+		t.Errorf("Invalid fetched posts, expected - %v, actual - %v", []int{30, 29, 28}, fetcher.fetched)
+	}
+
+	var titles []string
+	for _, item := range result.Feed.Items {
+		titles = append(titles, item.Title)
+	}
+	expected := []string{"30", "29", "28", "25", "24", "23", "22", "21", "20", "19"}
+	if !reflect.DeepEqual(titles, expected) {
+		t.Errorf("Invalid feed items, expected - %v, actual - %v", expected, titles)
+	}
+
+	// Without a fetch limit a lowered -maxposts is downloaded.
+	gin.SetMode(gin.TestMode)
+	fetcher = &stubFetcher{channel: fetcher.channel, posts: posts}
+	router := setupRouter(newTestCache(t), fetcher, nil, ServerConfig{MaxPosts: 5})
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/test", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Invalid status, expected - %d, actual - %d", http.StatusOK, recorder.Code)
+	}
+	if !reflect.DeepEqual(fetcher.fetched, []int{30, 29, 28, 27, 26}) {
+		t.Errorf("Invalid fetched posts, expected - %v, actual - %v", []int{30, 29, 28, 27, 26}, fetcher.fetched)
+	}
+}
+
+func TestMetricsCache(t *testing.T) {
+	sqliteCache := newTestCache(t)
+	cache := NewMetricsCache(sqliteCache)
+	before := dbQueryHistogram("SavePosts").Count()
+
+	channel, err := cache.SaveChannel(Channel{Name: "metrics", Title: "Metrics", LastId: 1, Link: "https://t.me/s/metrics"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := cache.SavePosts(channel.Id, []Post{{Header: "post", Content: "post", Link: "https://t.me/metrics/1", CreatedAt: createdAt, MessageId: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	wrapped, err := cache.GetPosts(channel.Id, MAX_RSS_POSTS_COUNT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	direct, _ := sqliteCache.GetPosts(channel.Id, MAX_RSS_POSTS_COUNT)
+	if len(wrapped) != 1 || len(direct) != 1 || wrapped[0].Id != direct[0].Id || wrapped[0].Header != direct[0].Header {
+		t.Errorf("Invalid posts, expected - %v, actual - %v", direct, wrapped)
+	}
+
+	if _, err := cache.GetChannel("missing"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Invalid missing channel error, expected - %v, actual - %v", sql.ErrNoRows, err)
+	}
+
+	if count := dbQueryHistogram("SavePosts").Count(); count != before+1 {
+		t.Errorf("Invalid SavePosts count, expected - %d, actual - %d", before+1, count)
+	}
+	if !strings.Contains(dbQueryDurations.String(), `"GetPosts"`) {
+		t.Errorf("Metrics have no GetPosts histogram: %s", dbQueryDurations.String())
+	}
+
+	if _, ok := cacheMigrator(cache); !ok {
+		t.Errorf("Migrator is hidden by the metrics wrapper")
+	}
+}
+
+func TestCacheDecorators(t *testing.T) {
+	var log bytes.Buffer
+	memory := NewMemoryCache()
+	var cache Cache = NewLoggingCache(NewMetricsCache(memory), &log)
+	before := dbQueryHistogram("SaveChannel").Count()
+
+	channel, err := cache.SaveChannel(Channel{Name: "memory", Title: "Memory", LastId: 2, Link: "https://t.me/s/memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache.SavePosts(channel.Id, []Post{
+		{Header: "older", Content: "older post", Link: "https://t.me/memory/1", CreatedAt: createdAt, MessageId: 1},
+		{Header: "newer", Content: "newer post", Link: "https://t.me/memory/2", CreatedAt: createdAt.Add(time.Hour), MessageId: 2},
+	})
+	cache.UpdatePostViews(channel.Id, map[int]int{2: 100})
+	cache.UpdateLastPostId(channel.Id, 3)
+
+	posts, err := cache.GetPosts(channel.Id, MAX_RSS_POSTS_COUNT)
+	if err != nil || len(posts) != 2 || posts[0].Header != "newer" || posts[0].Views != 100 {
+		t.Errorf("Invalid posts, expected - newer first with 100 views, actual - %v (%v)", posts, err)
+	}
+
+	stored, _ := memory.GetChannel("memory")
+	if stored.LastId != 3 {
+		t.Errorf("Invalid last id, expected - %d, actual - %d", 3, stored.LastId)
+	}
+
+	results, _ := cache.SearchPosts("OLDER", 10)
+	if len(results) != 1 || results[0].Channel != "memory" {
+		t.Errorf("Invalid search results, expected - older post, actual - %v", results)
+	}
+
+	if _, err := cache.GetChannel("missing"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Invalid missing channel error, expected - %v, actual - %v", sql.ErrNoRows, err)
+	}
+
+	if count := dbQueryHistogram("SaveChannel").Count(); count != before+1 {
+		t.Errorf("Invalid SaveChannel count, expected - %d, actual - %d", before+1, count)
+	}
+	for _, expected := range []string{"[cache] SaveChannel took", "[cache] GetChannel failed after"} {
+		if !strings.Contains(log.String(), expected) {
+			t.Errorf("Invalid log, expected - %s, actual - %s", expected, log.String())
+		}
+	}
+
+	if _, _, err := NewCache(CacheOptions{Backend: CacheMemory, Decorators: []string{"unknown"}}); err == nil {
+		t.Errorf("Unknown decorator accepted")
+	}
+}
+
+func TestGenerateFeedDescriptionFallback(t *testing.T) {
+	channel := DbChannel{Name: "test", Title: "Test Channel"}
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	posts := []DbPost{
+		{Header: "", Content: "short newest post", CreatedAt: base.Add(time.Hour)},
+		{Header: "older header...", Content: "older", CreatedAt: base},
+	}
+
+	cases := map[string]string{
+		DescriptionFallbackNone:  "",
+		DescriptionFallbackTitle: "Test Channel",
+		DescriptionFallbackPost:  "short newest post",
+	}
+	for fallback, expected := range cases {
+		feed := generateFeed(channel, posts, FeedOptions{DescriptionFallback: fallback})
+		if feed.Description != expected {
+			t.Errorf("Invalid %s description, expected - %s, actual - %s", fallback, expected, feed.Description)
+		}
+	}
+
+	channel.Description = "About"
+	feed := generateFeed(channel, posts, FeedOptions{DescriptionFallback: DescriptionFallbackTitle})
+	if feed.Description != "About" {
+		t.Errorf("Invalid description, expected - %s, actual - %s", "About", feed.Description)
+	}
+}
+
+func TestArchivePage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cache := newTestCache(t)
+	channel, _ := cache.SaveChannel(Channel{Name: "archive", Title: "Archive", LastId: 60, Link: "https://t.me/s/archive"})
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var posts []Post
+	for id := 1; id <= 60; id++ {
+		content := fmt.Sprintf("post %d", id)
+		if id == 60 {
+			content = "<script>alert(1)</script>"
+		}
+		posts = append(posts, Post{Header: content, Content: content, Link: fmt.Sprintf("https://t.me/archive/%d", id), CreatedAt: base.Add(time.Duration(id) * time.Hour), MessageId: id})
+	}
+	cache.SavePosts(channel.Id, posts)
+
+	router := setupRouter(cache, &stubFetcher{}, nil, ServerConfig{})
+	get := func(url string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", url, nil))
+		return recorder
+	}
+
+	recorder := get("/archive/archive.html")
+	body := recorder.Body.String()
+	if recorder.Code != http.StatusOK || strings.Count(body, "<article") != ARCHIVE_PAGE_SIZE {
+		t.Fatalf("Invalid first page: %d, %d posts", recorder.Code, strings.Count(body, "<article"))
+	}
+	if strings.Contains(body, "<script>") || !strings.Contains(body, "&lt;script&gt;") {
+		t.Errorf("Post content is not escaped")
+	}
+	if !strings.Contains(body, `href="https://t.me/archive/59"`) || !strings.Contains(body, "page=2") || strings.Contains(body, "Previous") {
+		t.Errorf("Invalid first page links: %s", body)
+	}
+
+	body = get("/archive/archive.html?page=2").Body.String()
+	if strings.Count(body, "<article") != 10 || !strings.Contains(body, "Previous") || strings.Contains(body, "Next") {
+		t.Errorf("Invalid second page: %s", body)
+	}
+
+	body = get("/archive/archive.html?order=oldest").Body.String()
+	if strings.Index(body, "https://t.me/archive/1\"") > strings.Index(body, "https://t.me/archive/2\"") {
+		t.Errorf("Invalid oldest first order")
+	}
+
+	if code := get("/missing/archive.html").Code; code != http.StatusNotFound {
+		t.Errorf("Invalid status for uncached channel, expected - %d, actual - %d", http.StatusNotFound, code)
+	}
+	if code := get("/archive/archive.html?page=0").Code; code != http.StatusBadRequest {
+		t.Errorf("Invalid status for invalid page, expected - %d, actual - %d", http.StatusBadRequest, code)
+	}
+
+	full := get("/archive/archive.html")
+	getRange := func(ifRange string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("GET", "/archive/archive.html", nil)
+		request.Header.Set("Range", "bytes=0-99")
+		if ifRange != "" {
+			request.Header.Set("If-Range", ifRange)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	recorder = getRange(full.Header().Get("ETag"))
+	contentRange := fmt.Sprintf("bytes 0-99/%d", full.Body.Len())
+	if recorder.Code != http.StatusPartialContent || recorder.Header().Get("Content-Range") != contentRange || recorder.Body.String() != full.Body.String()[:100] {
+		t.Errorf("Invalid partial response, expected - %d %s, actual - %d %s", http.StatusPartialContent, contentRange, recorder.Code, recorder.Header().Get("Content-Range"))
+	}
+	if recorder := getRange(`"stale"`); recorder.Code != http.StatusOK || recorder.Body.String() != full.Body.String() {
+		t.Errorf("Invalid response for changed page, expected - %d, actual - %d", http.StatusOK, recorder.Code)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cache := newTestCache(t)
+	router := setupRouter(cache, failingFetcher{}, nil, ServerConfig{})
+
+	tests := []struct {
+		url    string
+		status int
+		code   string
+	}{
+		{"/missing/archive.html", http.StatusNotFound, ErrorCodeChannelNotFound},
+		{"/missing?minviews=abc", http.StatusBadRequest, ErrorCodeInvalidRequest},
+		{"/missing?cached=true", http.StatusNotFound, ErrorCodeChannelNotFound},
+		{"/search", http.StatusBadRequest, ErrorCodeInvalidRequest},
+		{"/missing", http.StatusBadGateway, ErrorCodeFetchFailed},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", test.url, nil))
+
+		var body struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Invalid error body for %s: %v", test.url, err)
+		}
+		if recorder.Code != test.status || body.Error.Code != test.code || body.Error.Message == "" {
+			t.Errorf("Invalid error for %s, expected - %d %s, actual - %d %+v", test.url, test.status, test.code, recorder.Code, body.Error)
+		}
+	}
+}
+
+func TestChannelDiff(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cache := newTestCache(t)
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	channel, _ := cache.SaveChannel(Channel{Name: "test", Title: "Test", LastId: 3, Link: "https://t.me/s/test"})
+	cache.SavePosts(channel.Id, []Post{
+		{Header: "one", Content: "one", Link: "https://t.me/test/1", CreatedAt: base.Add(time.Hour), MessageId: 1},
+		{Header: "two", Content: "two", Link: "https://t.me/test/2", CreatedAt: base.Add(2 * time.Hour), MessageId: 2},
+		{Header: "three", Content: "three", Link: "https://t.me/test/3", CreatedAt: base.Add(3 * time.Hour), MessageId: 3},
+	})
+
+	fetcher := &stubFetcher{
+		channel: Channel{Name: "test", LastId: 4},
+		posts: map[int]Post{
+			1: {Header: "one", Content: "one", Link: "https://t.me/test/1", CreatedAt: base.Add(time.Hour), MessageId: 1},
+			3: {Header: "three", Content: "three, edited", Link: "https://t.me/test/3", CreatedAt: base.Add(3 * time.Hour), MessageId: 3},
+			4: {Header: "four", Content: "four", Link: "https://t.me/test/4", CreatedAt: base.Add(4 * time.Hour), MessageId: 4},
+		},
+	}
+
+	router := setupRouter(cache, fetcher, nil, ServerConfig{})
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/test/diff", nil))
+	if recorder.Code == http.StatusOK && strings.Contains(recorder.Body.String(), "liveLastId") {
+		t.Errorf("Diff served without DebugEndpoints: %s", recorder.Body.String())
+	}
+
+	router = setupRouter(cache, fetcher, nil, ServerConfig{DebugEndpoints: true})
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/test/diff", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Invalid status, expected - %d, actual - %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+
+	var diff ChannelDiff
+	if err := json.Unmarshal(recorder.Body.Bytes(), &diff); err != nil {
+		t.Fatalf("Invalid diff: %s", err)
+	}
+	expected := ChannelDiff{
+		Channel:       "test",
+		LiveLastId:    4,
+		CachedLastId:  3,
+		New:           []int{4},
+		Missing:       []int{2},
+		Changed:       []ChangedPost{{Id: 3, Fields: []string{"content"}}},
+		FetchFailures: 1,
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Invalid diff, expected - %+v, actual - %+v", expected, diff)
+	}
+
+	posts, _ := cache.GetPosts(channel.Id, MAX_RSS_POSTS_COUNT)
+	dbChannel, _ := cache.GetChannel("test")
+	if len(posts) != 3 || dbChannel.LastId != 3 {
+		t.Errorf("Diff modified the cache: %d posts, last id %d", len(posts), dbChannel.LastId)
+	}
+}
+
+func TestHardLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cache, _, err := NewCache(CacheOptions{Backend: CacheMemory, HardLimit: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	channel, _ := cache.SaveChannel(Channel{Name: "busy", Title: "Busy", Link: "https://t.me/s/busy"})
+	var posts []Post
+	for id := 1; id <= 10; id++ {
+		posts = append(posts, Post{Header: fmt.Sprintf("busy %d", id), Link: fmt.Sprintf("https://t.me/busy/%d", id), CreatedAt: base.Add(time.Duration(id) * time.Hour), MessageId: id})
+	}
+	cache.SavePosts(channel.Id, posts)
+
+	cached, err := cache.GetPosts(channel.Id, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cached) != 5 {
+		t.Errorf("Invalid posts count, expected - %d, actual - %d", 5, len(cached))
+	}
+	if page, _ := cache.GetPostsPage(channel.Id, 0, 1000, true); len(page) != 5 {
+		t.Errorf("Invalid page size, expected - %d, actual - %d", 5, len(page))
+	}
+
+	router := setupRouter(cache, failingFetcher{}, nil, ServerConfig{HardLimit: 3})
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/combined?channels=busy&limit=100000", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Invalid status, expected - %d, actual - %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+	if items := strings.Count(recorder.Body.String(), "<item>"); items != 3 {
+		t.Errorf("Invalid items count, expected - %d, actual - %d", 3, items)
+	}
+}
+
+func TestJsonLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cache := newTestCache(t)
+	channel, _ := cache.SaveChannel(Channel{Name: "many", Title: "Many", Link: "https://t.me/s/many"})
+	base := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	var posts []Post
+	for id := 1; id <= 100; id++ {
+		posts = append(posts, Post{Header: fmt.Sprintf("needle %d", id), Content: fmt.Sprintf("needle %d", id), Link: fmt.Sprintf("https://t.me/many/%d", id), CreatedAt: base.Add(time.Duration(id) * time.Hour), MessageId: id})
+	}
+	cache.SavePosts(channel.Id, posts)
+
+	count := func(router *gin.Engine, url string) int {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", url, nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Invalid status of %s, expected - %d, actual - %d: %s", url, http.StatusOK, recorder.Code, recorder.Body.String())
+		}
+		var response struct {
+			Items   []json.RawMessage `json:"items"`
+			Results []json.RawMessage `json:"results"`
+		}
+		if strings.Contains(url, "format=json") || strings.HasPrefix(url, "/search") {
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatalf("Can't parse %s: %s", url, err)
+			}
+			return len(response.Items) + len(response.Results)
+		}
+		return strings.Count(recorder.Body.String(), "<item>") + strings.Count(recorder.Body.String(), "<entry>")
+	}
+
+	tests := []struct {
+		config   ServerConfig
+		url      string
+		expected int
+	}{
+		// Defaults without flags.
+		{ServerConfig{}, "/combined?channels=many", MAX_RSS_POSTS_COUNT},
+		{ServerConfig{}, "/combined?channels=many&format=json", DEFAULT_JSON_LIMIT},
+		{ServerConfig{}, "/search?q=needle", DEFAULT_JSON_LIMIT},
+		// Each format has its own default.
+		{ServerConfig{MaxPosts: 10, JsonLimit: 30, HardLimit: 40}, "/combined?channels=many", 10},
+		{ServerConfig{MaxPosts: 10, JsonLimit: 30, HardLimit: 40}, "/combined?channels=many&format=atom", 10},
+		{ServerConfig{MaxPosts: 10, JsonLimit: 30, HardLimit: 40}, "/combined?channels=many&format=json", 30},
+		{ServerConfig{MaxPosts: 10, JsonLimit: 30, HardLimit: 40}, "/search?q=needle", 30},
+		// limit overrides them up to -hardlimit.
+		{ServerConfig{MaxPosts: 10, JsonLimit: 30, HardLimit: 40}, "/combined?channels=many&limit=15", 15},
+		{ServerConfig{MaxPosts: 10, JsonLimit: 30, HardLimit: 40}, "/combined?channels=many&format=json&limit=35", 35},
+		{ServerConfig{MaxPosts: 10, JsonLimit: 30, HardLimit: 40}, "/combined?channels=many&limit=1000", 40},
+		{ServerConfig{MaxPosts: 10, JsonLimit: 30, HardLimit: 40}, "/search?q=needle&limit=1000", 40},
+	}
+	for _, test := range tests {
+		router := setupRouter(cache, failingFetcher{}, nil, test.config)
+		if actual := count(router, test.url); actual != test.expected {
+			t.Errorf("Invalid items count of %s, expected - %d, actual - %d", test.url, test.expected, actual)
+		}
+	}
+}
+
+func TestTopicFeed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	for url, path := range map[string]string{
+		"https://t.me/s/forumtest/3":                 "fixtures/topic.html",
+		"https://t.me/forumtest/40?embed=1&mode=tme": "fixtures/post.html",
+		"https://t.me/forumtest/42?embed=1&mode=tme": "fixtures/post.html",
+		"https://t.me/s/viewstest/3":                 "fixtures/views.html",
+	} {
+		fixture, err := readFixture(path)
+		if err != nil {
+			t.Errorf("Invalid fixture")
+		}
+		httpmock.RegisterResponder("GET", url, httpmock.NewStringResponder(200, fixture))
+	}
+
+	fetcher := &TelegramWebFetcher{}
+	topic, err := fetcher.FetchTopic("forumtest", 3)
+	if err != nil {
+		t.Fatalf("Fetch topic failed: %s", err)
+	}
+	if !reflect.DeepEqual(topic.PostIds, []int{42, 40}) || topic.Title != "Forum Test" {
+		t.Errorf("Invalid topic, expected - [42 40] Forum Test, actual - %v %s", topic.PostIds, topic.Title)
+	}
+
+	router := setupRouter(newTestCache(t), NewCircuitBreaker(fetcher, 5, time.Minute), nil, ServerConfig{})
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/forumtest/topic/3", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Invalid status, expected - %d, actual - %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+	for _, link := range []string{"https://t.me/forumtest/3/42", "https://t.me/forumtest/3/40"} {
+		if !strings.Contains(recorder.Body.String(), link) {
+			t.Errorf("Missing topic post %s: %s", link, recorder.Body.String())
+		}
+	}
+
+	tests := []struct {
+		fetcher Fetcher
+		url     string
+		status  int
+		code    string
+	}{
+		{fetcher, "/viewstest/topic/3", http.StatusNotFound, ErrorCodeChannelNotFound},
+		{fetcher, "/forumtest/topic/abc", http.StatusBadRequest, ErrorCodeInvalidRequest},
+		{failingFetcher{}, "/forumtest/topic/3", http.StatusNotImplemented, ErrorCodeNotImplemented},
+	}
+	for _, test := range tests {
+		router := setupRouter(newTestCache(t), test.fetcher, nil, ServerConfig{})
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", test.url, nil))
+		if recorder.Code != test.status || !strings.Contains(recorder.Body.String(), test.code) {
+			t.Errorf("Invalid response for %s, expected - %d %s, actual - %d %s", test.url, test.status, test.code, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestCachedTopicPosts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	for url, path := range map[string]string{
+		"https://t.me/s/forumtest/3":                 "fixtures/topic.html",
+		"https://t.me/forumtest/40?embed=1&mode=tme": "fixtures/post.html",
+		"https://t.me/forumtest/42?embed=1&mode=tme": "fixtures/post.html",
+	} {
+		fixture, err := readFixture(path)
+		if err != nil {
+			t.Errorf("Invalid fixture")
+		}
+		httpmock.RegisterResponder("GET", url, httpmock.NewStringResponder(200, fixture))
+	}
+
+	// Post 40 is cached with the group, post 42 is newer than its LastId.
+	cache := newTestCache(t)
+	channel, _ := cache.SaveChannel(Channel{Name: "forumtest", Title: "Forum Test", LastId: 41, Link: "https://t.me/s/forumtest"})
+	cache.SavePosts(channel.Id, []Post{{Header: "cached", Content: "cached topic post", Link: "https://t.me/forumtest/40", CreatedAt: time.Now(), MessageId: 40}})
+
+	router := setupRouter(cache, &TelegramWebFetcher{}, nil, ServerConfig{})
+	get := func() string {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", "/forumtest/topic/3", nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Invalid status, expected - %d, actual - %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+		}
+		return recorder.Body.String()
+	}
+
+	body := get()
+	if !strings.Contains(body, "cached topic post") || !strings.Contains(body, "https://t.me/forumtest/3/40") {
+		t.Errorf("Cached post isn't served: %s", body)
+	}
+	calls := httpmock.GetCallCountInfo()
+	if calls["GET https://t.me/forumtest/40?embed=1&mode=tme"] != 0 || calls["GET https://t.me/forumtest/42?embed=1&mode=tme"] != 1 {
+		t.Errorf("Invalid post requests: %v", calls)
+	}
+	if count, _ := cache.CountPosts(channel.Id); count != 1 {
+		t.Errorf("Invalid cached posts count, expected - %d, actual - %d", 1, count)
+	}
+
+	// Once the group reached post 42, the topic stores it.
+	cache.UpdateLastPostId(channel.Id, 50)
+	get()
+	get()
+	if calls := httpmock.GetCallCountInfo()["GET https://t.me/forumtest/42?embed=1&mode=tme"]; calls != 2 {
+		t.Errorf("Invalid post 42 requests, expected - %d, actual - %d", 2, calls)
+	}
+	if count, _ := cache.CountPosts(channel.Id); count != 2 {
+		t.Errorf("Invalid cached posts count, expected - %d, actual - %d", 2, count)
+	}
+}
+
+func TestRssFetcher(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	fixture, err := readFixture("fixtures/channel_feed.xml")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+	httpmock.RegisterResponder("GET", "https://feeds.example/feedtest.xml", httpmock.NewStringResponder(200, fixture))
+	httpmock.RegisterResponder("GET", "https://feeds.example/scraped.xml", httpmock.NewStringResponder(404, "Not found"))
+
+	base := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	fallback := &stubFetcher{
+		channel: Channel{Name: "scraped", Title: "Scraped", LastId: 7, Link: "https://t.me/s/scraped"},
+		posts: map[int]Post{
+			50: {Content: "Older post", Link: "https://t.me/feedtest/50?embed=1&mode=tme", CreatedAt: base, MessageId: 50},
+		},
+	}
+	fetcher := &RssFetcher{UrlTemplate: "https://feeds.example/{channel}.xml", Fallback: fallback}
+
+	channel, err := fetcher.FetchChannel("feedtest")
+	if err != nil {
+		t.Fatalf("Fetch channel failed: %s", err)
+	}
+	expectedChannel := Channel{
+		Name:         "feedtest",
+		Title:        "Feed Test",
+		LastId:       52,
+		Link:         "https://t.me/s/feedtest",
+		Description:  "Channel with its own feed.",
+		NewestPostAt: time.Date(2024, 3, 5, 21, 0, 0, 0, time.UTC),
+	}
+	if !reflect.DeepEqual(channel, expectedChannel) {
+		t.Errorf("Invalid channel, expected - %+v, actual - %+v", expectedChannel, channel)
+	}
+
+	post, err := fetcher.FetchPost("feedtest", 51)
+	if err != nil {
+		t.Fatalf("Fetch post failed: %s", err)
+	}
+	expectedPost := Post{Content: "Line 2 is closed on Saturday & Sunday.", Link: "https://t.me/feedtest/51?embed=1&mode=tme", CreatedAt: time.Date(2024, 3, 4, 9, 30, 0, 0, time.UTC), MessageId: 51}
+	if !reflect.DeepEqual(post, expectedPost) {
+		t.Errorf("Invalid post, expected - %+v, actual - %+v", expectedPost, post)
+	}
+	if len(fallback.fetched) != 0 {
+		t.Errorf("Posts of the feed were scraped: %v", fallback.fetched)
+	}
+
+	// Channels without a feed are scraped, and not probed again for a
+	// while.
+	for i := 0; i < 2; i++ {
+		if channel, err := fetcher.FetchChannel("scraped"); err != nil || channel.Title != "Scraped" {
+			t.Errorf("Invalid fallback channel: %+v %v", channel, err)
+		}
+	}
+	if calls := httpmock.GetCallCountInfo()["GET https://feeds.example/scraped.xml"]; calls != 1 {
+		t.Errorf("Invalid feed probes, expected - %d, actual - %d", 1, calls)
+	}
+
+	// Posts missing from the feed are scraped.
+	result, err := prepareFeed("feedtest", newTestCache(t), fetcher, nil, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Can't prepare feed: %s", err)
+	}
+	var descriptions []string
+	for _, item := range result.Feed.Items {
+		descriptions = append(descriptions, item.Description)
+	}
+	if len(descriptions) != 3 || !strings.Contains(descriptions[0], "Night buses run every 30 minutes from Monday.") || !strings.Contains(descriptions[2], "Older post") {
+		t.Errorf("Invalid feed items: %v", descriptions)
+	}
+	if result.Feed.Items[0].Author == nil || result.Feed.Items[0].Author.Name != "Jane Roe" {
+		t.Errorf("Invalid item author, expected - %s, actual - %v", "Jane Roe", result.Feed.Items[0].Author)
+	}
+}
+
+func TestPostFeed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	fixture, err := readFixture("fixtures/post.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+	httpmock.RegisterResponder("GET", "https://t.me/lexfridman/272?embed=1&mode=tme",
+		httpmock.NewStringResponder(200, fixture))
+	httpmock.RegisterResponder("GET", "https://t.me/lexfridman/9999?embed=1&mode=tme",
+		httpmock.NewStringResponder(200, `<div class="tgme_widget_message_error">Post not found</div>`))
+
+	router := setupRouter(newTestCache(t), &TelegramWebFetcher{}, nil, ServerConfig{})
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/lexfridman/post/272?format=json", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Invalid status, expected - %d, actual - %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+	var feed struct {
+		Items []struct {
+			Url string `json:"url"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &feed); err != nil {
+		t.Fatalf("Can't parse feed: %s", err)
+	}
+	if len(feed.Items) != 1 || feed.Items[0].Url != "https://t.me/lexfridman/272" {
+		t.Errorf("Invalid post feed items: %v", feed.Items)
+	}
+
+	tests := []struct {
+		url    string
+		status int
+		code   string
+	}{
+		{"/lexfridman/post/9999", http.StatusNotFound, ErrorCodeNotFound},
+		{"/lexfridman/post/abc", http.StatusBadRequest, ErrorCodeInvalidRequest},
+		{"/lexfridman/post/272?format=xml", http.StatusBadRequest, ErrorCodeInvalidRequest},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", test.url, nil))
+		if recorder.Code != test.status || !strings.Contains(recorder.Body.String(), test.code) {
+			t.Errorf("Invalid response for %s, expected - %d %s, actual - %d %s", test.url, test.status, test.code, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	// The channel feed routes are unaffected.
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/lexfridman.atom?cached=true", nil))
+	if recorder.Code != http.StatusNotFound || !strings.Contains(recorder.Body.String(), ErrorCodeChannelNotFound) {
+		t.Errorf("Invalid channel response, expected - %d, actual - %d %s", http.StatusNotFound, recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestCombinedFeedPerChannel(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cache := newTestCache(t)
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	busy, _ := cache.SaveChannel(Channel{Name: "busy", Title: "Busy", Link: "https://t.me/s/busy"})
+	var busyPosts []Post
+	for id := 1; id <= 10; id++ {
+		busyPosts = append(busyPosts, Post{Header: fmt.Sprintf("busy %d", id), Link: fmt.Sprintf("https://t.me/busy/%d", id), CreatedAt: base.Add(time.Duration(100+id) * time.Hour), MessageId: id})
+	}
+	cache.SavePosts(busy.Id, busyPosts)
+	quiet, _ := cache.SaveChannel(Channel{Name: "quiet", Title: "Quiet", Link: "https://t.me/s/quiet"})
+	cache.SavePosts(quiet.Id, []Post{
+		{Header: "quiet 1", Link: "https://t.me/quiet/1", CreatedAt: base.Add(time.Hour), MessageId: 1},
+		{Header: "quiet 2", Link: "https://t.me/quiet/2", CreatedAt: base.Add(2 * time.Hour), MessageId: 2},
+	})
+
+	posts, err := combinedPosts(cache, []DbChannel{busy, quiet}, 3, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var links []string
+	for _, post := range posts {
+		links = append(links, post.Link)
+	}
+	expected := []string{"https://t.me/busy/10", "https://t.me/busy/9", "https://t.me/busy/8", "https://t.me/quiet/2"}
+	if !reflect.DeepEqual(links, expected) {
+		t.Errorf("Invalid combined posts, expected - %v, actual - %v", expected, links)
+	}
+	if posts[3].Author != "Quiet" {
+		t.Errorf("Invalid author, expected - %v, actual - %v", "Quiet", posts[3].Author)
+	}
+
+	router := setupRouter(cache, failingFetcher{}, nil, ServerConfig{})
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/combined?channels=busy,quiet&perchannel=2&format=json", nil))
+	body := recorder.Body.String()
+	if recorder.Code != http.StatusOK || strings.Count(body, `"url"`) != 4 || !strings.Contains(body, "quiet/1") || strings.Contains(body, "busy/8") {
+		t.Errorf("Invalid combined feed: %d %s", recorder.Code, body)
+	}
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/combined?channels=busy,missing", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Invalid status for uncached channel, expected - %d, actual - %d", http.StatusNotFound, recorder.Code)
+	}
+}
+
+func TestCollapseSameTime(t *testing.T) {
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	fetcher := &stubFetcher{
+		channel: Channel{Name: "parts", LastId: 11},
+		posts:   map[int]Post{},
+	}
+	for id, offset := range map[int]int{11: 4, 9: 4, 5: 3, 4: 2, 3: 2, 2: 2, 1: 1} {
+		fetcher.posts[id] = Post{Content: fmt.Sprintf("part %d", id), Link: fmt.Sprintf("https://t.me/parts/%d", id), CreatedAt: base.Add(time.Duration(offset) * time.Minute), MessageId: id}
+	}
+	fetcher.posts[3] = Post{Content: "part 3", Link: "https://t.me/parts/3", CreatedAt: base.Add(2 * time.Minute), MessageId: 3, Media: []Media{{Type: MediaPhoto, Url: "https://cdn.example/3.jpg"}}}
+
+	posts, _, _ := fetchPostsDescending(fetcher, fetcher.channel, 0, time.Time{}, false, MAX_RSS_POSTS_COUNT)
+	if len(posts) != 4 {
+		t.Errorf("Invalid deduplicated posts count, expected - %d, actual - %d", 4, len(posts))
+	}
+
+	cache := newTestCache(t)
+	result, err := prepareFeed("parts", cache, fetcher, nil, FeedOptions{CollapseSameTime: true})
+	if err != nil {
+		t.Fatalf("Prepare feed failed: %s", err)
+	}
+	feed := result.Feed
+
+	var links []string
+	for _, item := range feed.Items {
+		links = append(links, item.Link.Href)
+	}
+	expected := []string{"https://t.me/parts/11", "https://t.me/parts/9", "https://t.me/parts/5", "https://t.me/parts/2", "https://t.me/parts/1"}
+	if !reflect.DeepEqual(links, expected) {
+		t.Errorf("Invalid items, expected - %v, actual - %v", expected, links)
+	}
+	if description := feed.Items[3].Description; !strings.HasPrefix(description, "part 2\n\npart 3\n\npart 4") || !strings.Contains(description, "https://cdn.example/3.jpg") {
+		t.Errorf("Invalid collapsed item: %s", description)
+	}
+
+	dbChannel, _ := cache.GetChannel("parts")
+	cached, _ := cache.GetPosts(dbChannel.Id, MAX_RSS_POSTS_COUNT)
+	if len(cached) != 7 {
+		t.Errorf("Invalid cached posts count, expected - %d, actual - %d", 7, len(cached))
+	}
+	if items := generateFeed(dbChannel, cached, FeedOptions{}).Items; len(items) != 7 {
+		t.Errorf("Invalid items count without collapsing, expected - %d, actual - %d", 7, len(items))
+	}
+}
+
+func TestFeedLink(t *testing.T) {
+	channel := DbChannel{Name: "lexfridman", Link: tgChannelFeedUrl("lexfridman")}
+	posts := []DbPost{{Header: "post", Link: "https://t.me/lexfridman/272", CreatedAt: time.Now()}}
+
+	tests := []struct {
+		mode     string
+		expected string
+	}{
+		{"", "https://t.me/lexfridman"},
+		{FeedLinkChannel, "https://t.me/lexfridman"},
+		{FeedLinkPreview, "https://t.me/s/lexfridman"},
+	}
+	for _, test := range tests {
+		feed := generateFeed(channel, posts, FeedOptions{FeedLink: test.mode})
+		if feed.Link.Href != test.expected {
+			t.Errorf("Invalid feed link for %q, expected - %v, actual - %v", test.mode, test.expected, feed.Link.Href)
+		}
+		if feed.Items[0].Link.Href != "https://t.me/lexfridman/272" {
+			t.Errorf("Invalid item link for %q, expected - %v, actual - %v", test.mode, "https://t.me/lexfridman/272", feed.Items[0].Link.Href)
+		}
+	}
+}
+
+func TestLinkDomain(t *testing.T) {
+	tests := []struct {
+		link     string
+		domain   string
+		expected string
+	}{
+		{"https://t.me/lexfridman/272?embed=1&mode=tme", "telegram.me", "https://telegram.me/lexfridman/272?embed=1&mode=tme"},
+		{"https://t.me/s/lexfridman", "tg.example.com", "https://tg.example.com/s/lexfridman"},
+		{"https://t.me/s/lexfridman", "", "https://t.me/s/lexfridman"},
+		{"https://example.com/post", "telegram.me", "https://example.com/post"},
+	}
+	for _, test := range tests {
+		if actual := displayLink(test.link, test.domain); actual != test.expected {
+			t.Errorf("Invalid link, expected - %v, actual - %v", test.expected, actual)
+		}
+	}
+
+	channel := DbChannel{Name: "lexfridman", Link: tgChannelFeedUrl("lexfridman")}
+	posts := []DbPost{{Header: "post", Link: tgChannelPostUrl("lexfridman", 272), CreatedAt: time.Now()}}
+	feed := generateFeed(channel, posts, FeedOptions{LinkDomain: "telegram.me"})
+	if feed.Link.Href != "https://telegram.me/lexfridman" {
+		t.Errorf("Invalid feed link, expected - %v, actual - %v", "https://telegram.me/lexfridman", feed.Link.Href)
+	}
+	if feed.Items[0].Link.Href != "https://telegram.me/lexfridman/272?embed=1&mode=tme" || !strings.Contains(feed.Items[0].Description, `href="https://telegram.me/lexfridman/272`) {
+		t.Errorf("Invalid item link: %v, %v", feed.Items[0].Link.Href, feed.Items[0].Description)
+	}
+	if posts[0].Link != tgChannelPostUrl("lexfridman", 272) {
+		t.Errorf("Cached post link was changed: %v", posts[0].Link)
+	}
+}
+
+func TestChannelAliases(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	sharded, err := NewShardedCache(filepath.Join(t.TempDir(), "{channel}.db"), PoolOptions{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sharded.Close()
+
+	for name, cache := range map[string]Cache{"sqlite": newTestCache(t), "memory": NewMemoryCache(), "sharded": sharded} {
+		feedChannel := Channel{Name: "lexfridman", Title: "Lex Fridman", LastId: 1, Link: "https://t.me/s/lexfridman"}
+		fetcher := &stubFetcher{
+			channel: feedChannel,
+			posts:   map[int]Post{1: {Header: "post", Content: "post", Link: "https://t.me/lexfridman/1", CreatedAt: time.Now(), MessageId: 1}},
+		}
+		router := setupRouter(cache, fetcher, nil, ServerConfig{AdminToken: "secret"})
+		post := func(body string) *httptest.ResponseRecorder {
+			request := httptest.NewRequest("POST", "/admin/alias", strings.NewReader(body))
+			request.Header.Set("Authorization", "Bearer secret")
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+			return recorder
+		}
+
+		if code := post(`{"alias":"lex","channel":"lexfridman"}`).Code; code != http.StatusOK {
+			t.Fatalf("%s: Invalid alias status, expected - %d, actual - %d", name, http.StatusOK, code)
+		}
+		for _, body := range []string{`{"alias":"search","channel":"lexfridman"}`, `{"alias":"../lex","channel":"lexfridman"}`, `{"channel":"lexfridman"}`} {
+			if code := post(body).Code; code != http.StatusBadRequest {
+				t.Errorf("%s: Invalid status for %s, expected - %d, actual - %d", name, body, http.StatusBadRequest, code)
+			}
+		}
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", "/lex.rss", nil))
+		body := recorder.Body.String()
+		if recorder.Code != http.StatusOK || !strings.Contains(body, "<link>https://t.me/lexfridman/1</link>") || !strings.Contains(body, "<link>https://t.me/lexfridman</link>") {
+			t.Errorf("%s: Invalid alias feed: %d %s", name, recorder.Code, body)
+		}
+		if _, err := cache.GetChannel("lex"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("%s: Alias was cached as a channel: %v", name, err)
+		}
+
+		// Aliases survive a restart.
+		if aliases, _ := cache.GetAliases(); aliases["lex"] != "lexfridman" {
+			t.Errorf("%s: Invalid stored aliases: %v", name, aliases)
+		}
+		if resolved := newChannelAliases(cache, false).resolve("lex"); resolved != "lexfridman" {
+			t.Errorf("%s: Invalid resolved alias, expected - %s, actual - %s", name, "lexfridman", resolved)
+		}
+
+		post(`{"alias":"lex","channel":""}`)
+		if aliases, _ := cache.GetAliases(); len(aliases) != 0 {
+			t.Errorf("%s: Alias was not removed: %v", name, aliases)
+		}
+	}
+}
+
+func TestMediaOnlyFeed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cache := newTestCache(t)
+	channel, _ := cache.SaveChannel(Channel{Name: "media", Title: "Media", LastId: 3, Link: "https://t.me/s/media"})
+	base := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	cache.SavePosts(channel.Id, []Post{
+		{Header: "Photo", Content: "Photo", Link: "https://t.me/media/1", CreatedAt: base, MessageId: 1, Media: []Media{{Type: MediaPhoto, Url: "https://cdn/photo.png?size=large"}}},
+		{Header: "Text", Content: "Text", Link: "https://t.me/media/2", CreatedAt: base.Add(time.Hour), MessageId: 2},
+		{Header: "Video", Content: "Video", Link: "https://t.me/media/3", CreatedAt: base.Add(2 * time.Hour), MessageId: 3, Media: []Media{{Type: MediaVideo, Url: "https://cdn/video", Thumbnail: "https://cdn/thumb.jpg"}}},
+	})
+	posts, _ := cache.GetPosts(channel.Id, MAX_RSS_POSTS_COUNT)
+
+	feed := generateFeed(channel, posts, FeedOptions{MediaOnly: true})
+	if len(feed.Items) != 2 {
+		t.Fatalf("Invalid items count, expected - %d, actual - %d", 2, len(feed.Items))
+	}
+	expected := []feeds.Enclosure{
+		{Url: "https://cdn/video", Length: "0", Type: "video/mp4"},
+		{Url: "https://cdn/photo.png?size=large", Length: "0", Type: "image/png"},
+	}
+	for i, item := range feed.Items {
+		if item.Enclosure == nil || *item.Enclosure != expected[i] {
+			t.Errorf("Invalid enclosure of %s, expected - %v, actual - %v", item.Title, expected[i], item.Enclosure)
+		}
+	}
+	if unfiltered := generateFeed(channel, posts, FeedOptions{}); len(unfiltered.Items) != 3 || unfiltered.Items[0].Enclosure != nil {
+		t.Errorf("Invalid feed without mediaonly: %d items", len(unfiltered.Items))
+	}
+
+	router := setupRouter(cache, failingFetcher{}, nil, ServerConfig{})
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/media?cached=true&mediaonly=true", nil))
+	body := recorder.Body.String()
+	if strings.Contains(body, "https://t.me/media/2") || !strings.Contains(body, `<enclosure url="https://cdn/video" length="0" type="video/mp4">`) {
+		t.Errorf("Invalid media-only feed: %s", body)
+	}
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/media?cached=true&mediaonly=maybe", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Invalid status, expected - %d, actual - %d", http.StatusBadRequest, recorder.Code)
+	}
+}
+
+func TestFeedPagination(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cache := newTestCache(t)
+	channel, _ := cache.SaveChannel(Channel{Name: "paged", Title: "Paged", LastId: 50, Link: "https://t.me/s/paged"})
+	base := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	var posts []Post
+	for id := 1; id <= 50; id++ {
+		posts = append(posts, Post{Content: fmt.Sprintf("Post %d", id), Link: fmt.Sprintf("https://t.me/paged/%d", id), CreatedAt: base.Add(time.Duration(id) * time.Hour), MessageId: id})
+	}
+	cache.SavePosts(channel.Id, posts)
+	if count, err := cache.CountPosts(channel.Id); err != nil || count != 50 {
+		t.Fatalf("Invalid posts count, expected - %d, actual - %d (%v)", 50, count, err)
+	}
+
+	router := setupRouter(cache, failingFetcher{}, nil, ServerConfig{})
+	serve := func(url string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", url, nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Invalid status of %s, expected - %d, actual - %d: %s", url, http.StatusOK, recorder.Code, recorder.Body.String())
+		}
+		return recorder
+	}
+
+	// The middle page links both neighbours and holds posts 30 to 11.
+	var rss struct {
+		Channel struct {
+			Links []struct {
+				Rel  string `xml:"rel,attr"`
+				Href string `xml:"href,attr"`
+			} `xml:"http://www.w3.org/2005/Atom link"`
+			Items []struct {
+				Link string `xml:"link"`
+			} `xml:"item"`
+		} `xml:"channel"`
+	}
+	body := serve("/paged?page=2&sort=created").Body.Bytes()
+	if err := xml.Unmarshal(body, &rss); err != nil {
+		t.Fatalf("Can't parse rss: %s", err)
+	}
+	links := map[string]string{}
+	for _, link := range rss.Channel.Links {
+		links[link.Rel] = link.Href
+	}
+	expected := map[string]string{
+		"prev": "http://example.com/paged?page=1&sort=created",
+		"next": "http://example.com/paged?page=3&sort=created",
+	}
+	if !reflect.DeepEqual(links, expected) {
+		t.Errorf("Invalid page links, expected - %v, actual - %v", expected, links)
+	}
+	if len(rss.Channel.Items) != 20 || rss.Channel.Items[0].Link != "https://t.me/paged/30" || rss.Channel.Items[19].Link != "https://t.me/paged/11" {
+		t.Errorf("Invalid page items: %v", rss.Channel.Items)
+	}
+
+	if atom := serve("/paged.atom?page=2").Body.String(); !strings.Contains(atom, `<link href="http://example.com/paged.atom?page=1" rel="prev" type="application/atom+xml"></link>`) || !strings.Contains(atom, `rel="next"`) {
+		t.Errorf("Invalid atom page links: %s", atom)
+	}
+
+	var jsonFeed struct {
+		NextUrl string `json:"next_url"`
+	}
+	json.Unmarshal(serve("/paged?format=json&page=2").Body.Bytes(), &jsonFeed)
+	if jsonFeed.NextUrl != "http://example.com/paged?format=json&page=3" {
+		t.Errorf("Invalid next url, expected - %s, actual - %s", "http://example.com/paged?format=json&page=3", jsonFeed.NextUrl)
+	}
+
+	// The last page only links back.
+	if last := serve("/paged?page=3").Body.String(); strings.Contains(last, `rel="next"`) || !strings.Contains(last, `rel="prev"`) || strings.Count(last, "<item>") != 10 {
+		t.Errorf("Invalid last page: %s", last)
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/paged?page=0", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Invalid status, expected - %d, actual - %d", http.StatusBadRequest, recorder.Code)
+	}
+
+	// Pages past the cached posts don't exist.
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/paged?page=4", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Invalid status, expected - %d, actual - %d", http.StatusNotFound, recorder.Code)
+	}
+
+	// -maxposts sizes the feed and every page alike.
+	router = setupRouter(cache, failingFetcher{}, nil, ServerConfig{MaxPosts: 30})
+	for url, items := range map[string]int{"/paged?cached=true": 30, "/paged?page=2": 20} {
+		if body := serve(url).Body.String(); strings.Count(body, "<item>") != items {
+			t.Errorf("Invalid items of %s, expected - %d, actual - %d", url, items, strings.Count(body, "<item>"))
+		}
+	}
+	if last := serve("/paged?page=2").Body.String(); strings.Contains(last, `rel="next"`) {
+		t.Errorf("Invalid last page links: %s", last)
+	}
+}
+
+func TestEnclosureSniffer(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Method != http.MethodHead {
+			t.Errorf("Invalid method, expected - %s, actual - %s", http.MethodHead, r.Method)
+		}
+		if r.URL.Path == "/missing.mp4" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/webp; charset=binary")
+		w.Header().Set("Content-Length", "48213")
+	}))
+	defer server.Close()
+
+	sniffer := NewEnclosureSniffer(server.Client())
+	tests := []struct {
+		media    Media
+		mimeType string
+		length   string
+	}{
+		{Media{Type: MediaPhoto, Url: server.URL + "/photo.jpg"}, "image/webp", "48213"},
+		// Failed lookups fall back to guessing from the url.
+		{Media{Type: MediaVideo, Url: server.URL + "/missing.mp4"}, "video/mp4", "0"},
+		{Media{Type: MediaPhoto, Url: "http://127.0.0.1:1/photo.png"}, "image/png", "0"},
+	}
+	for round := 0; round < 2; round++ {
+		for _, test := range tests {
+			mimeType, length := sniffer.Sniff(test.media)
+			if mimeType != test.mimeType || length != test.length {
+				t.Errorf("Invalid enclosure of %s, expected - %s %s, actual - %s %s", test.media.Url, test.mimeType, test.length, mimeType, length)
+			}
+		}
+	}
+	if requests := atomic.LoadInt32(&requests); requests != 2 {
+		t.Errorf("Invalid requests count, expected - %d, actual - %d", 2, requests)
+	}
+
+	var nilSniffer *EnclosureSniffer
+	if mimeType, length := nilSniffer.Sniff(tests[0].media); mimeType != "image/jpeg" || length != "0" {
+		t.Errorf("Invalid guessed enclosure, expected - image/jpeg 0, actual - %s %s", mimeType, length)
+	}
+
+	channel := DbChannel{Name: "media", Title: "Media", Link: "https://t.me/s/media"}
+	posts := []DbPost{{Content: "Photo", Link: "https://t.me/media/1", CreatedAt: time.Now(), MessageId: 1, Media: []Media{tests[0].media}}}
+	feed := generateFeed(channel, posts, FeedOptions{MediaOnly: true, Enclosures: sniffer})
+	expected := feeds.Enclosure{Url: server.URL + "/photo.jpg", Length: "48213", Type: "image/webp"}
+	if feed.Items[0].Enclosure == nil || *feed.Items[0].Enclosure != expected {
+		t.Errorf("Invalid enclosure, expected - %v, actual - %v", expected, feed.Items[0].Enclosure)
+	}
+}
+
+func TestTextOnlyFeed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cache := newTestCache(t)
+	channel, _ := cache.SaveChannel(Channel{Name: "media", Title: "Media", LastId: 1, Link: "https://t.me/s/media"})
+	cache.SavePosts(channel.Id, []Post{{
+		Header:    "Album",
+		Content:   "Album",
+		Link:      "https://t.me/media/1",
+		CreatedAt: time.Now(),
+		MessageId: 1,
+		Media:     []Media{{Type: MediaPhoto, Url: "https://cdn/photo.jpg"}, {Type: MediaVideo, Url: "https://cdn/video.mp4", Thumbnail: "https://cdn/thumb.jpg"}},
+	}})
+	posts, _ := cache.GetPosts(channel.Id, MAX_RSS_POSTS_COUNT)
+
+	feed := generateFeed(channel, posts, FeedOptions{TextOnly: true})
+	expected := "Album\n\n<a href=\"https://t.me/media/1\">[link]</a>"
+	if feed.Items[0].Description != expected {
+		t.Errorf("Invalid text-only content, expected - %q, actual - %q", expected, feed.Items[0].Description)
+	}
+
+	custom := template.Must(template.New("content").Parse(`{{.Content}}<img src="https://cdn/extra.jpg"><video src="https://cdn/extra.mp4" controls></video>`))
+	feed = generateFeed(channel, posts, FeedOptions{TextOnly: true, ContentTemplate: custom})
+	if feed.Items[0].Description != "Album" {
+		t.Errorf("Invalid text-only custom content, expected - %q, actual - %q", "Album", feed.Items[0].Description)
+	}
+
+	get := func(router *gin.Engine, url string) string {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", url, nil))
+		return recorder.Body.String()
+	}
+	router := setupRouter(cache, failingFetcher{}, nil, ServerConfig{})
+	if body := get(router, "/media?cached=true&textonly=true"); strings.Contains(body, "photo.jpg") || strings.Contains(body, "video.mp4") {
+		t.Errorf("Media in text-only feed: %s", body)
+	}
+	if body := get(router, "/media?cached=true"); !strings.Contains(body, "photo.jpg") {
+		t.Errorf("Media missing from feed: %s", body)
+	}
+
+	router = setupRouter(cache, failingFetcher{}, nil, ServerConfig{TextOnly: true})
+	if body := get(router, "/media?cached=true"); strings.Contains(body, "photo.jpg") {
+		t.Errorf("Media in text-only feed: %s", body)
+	}
+	if body := get(router, "/media?cached=true&textonly=false"); !strings.Contains(body, "photo.jpg") {
+		t.Errorf("Media missing from feed: %s", body)
+	}
+}
+
+func TestFetchQueue(t *testing.T) {
+	cache := newTestCache(t)
+	queue, err := NewFetchQueue(cache.db, cache.Writes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue.EnqueueRefresh("first")
+	job, err := queue.EnqueueJob([]string{"second", "third"})
+	if err != nil || job != 1 {
+		t.Fatalf("Invalid job, expected - 1, actual - %d, %v", job, err)
+	}
+	queue.EnqueueRefresh("fourth")
+	// Channels waiting for a refresh aren't queued twice.
+	queue.EnqueueRefresh("first")
+
+	var dequeued []string
+	for i := 0; i < 2; i++ {
+		item, ok, err := queue.Dequeue()
+		if err != nil || !ok {
+			t.Fatalf("Can't dequeue: %v", err)
+		}
+		dequeued = append(dequeued, item.Channel)
+		if err := queue.Done(item, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The third item is interrupted by a restart and queued again.
+	item, _, _ := queue.Dequeue()
+	dequeued = append(dequeued, item.Channel)
+	queue, err = NewFetchQueue(cache.db, cache.Writes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		item, ok, err := queue.Dequeue()
+		if err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			break
+		}
+		dequeued = append(dequeued, item.Channel)
+		queue.Done(item, errors.New("boom"))
+	}
+
+	expected := []string{"first", "second", "third", "third", "fourth"}
+	if !reflect.DeepEqual(dequeued, expected) {
+		t.Errorf("Invalid dequeue order, expected - %v, actual - %v", expected, dequeued)
+	}
+
+	status, ok, err := queue.Job(job)
+	if err != nil || !ok || !status.Done {
+		t.Fatalf("Invalid job status: %+v, %v", status, err)
+	}
+	expectedChannels := []WarmupChannel{{Name: "second", Status: WarmupOk}, {Name: "third", Status: WarmupFailed, Error: "boom"}}
+	if !reflect.DeepEqual(status.Channels, expectedChannels) {
+		t.Errorf("Invalid job channels, expected - %+v, actual - %+v", expectedChannels, status.Channels)
+	}
+
+	// Finished refreshes are removed.
+	var count int
+	cache.db.QueryRow("SELECT COUNT(*) FROM fetch_queue WHERE job = ?", QUEUE_REFRESH_JOB).Scan(&count)
+	if count != 0 {
+		t.Errorf("Invalid finished refreshes, expected - %d, actual - %d", 0, count)
+	}
+}
+
+func TestFetchQueueProcesses(t *testing.T) {
+	cache := newTestCache(t)
+	// Queues of two processes share the database but not their mutex.
+	queues := make([]*FetchQueue, 2)
+	for i := range queues {
+		queue, err := NewFetchQueue(cache.db, cache.Writes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		queues[i] = queue
+	}
+
+	var channels []string
+	for i := 0; i < 50; i++ {
+		channels = append(channels, fmt.Sprintf("channel%d", i))
+	}
+	if _, err := queues[0].EnqueueJob(channels); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	dequeued := map[string]int{}
+	for _, queue := range queues {
+		for worker := 0; worker < 2; worker++ {
+			wg.Add(1)
+			go func(queue *FetchQueue) {
+				defer wg.Done()
+				for {
+					item, ok, err := queue.Dequeue()
+					if err != nil {
+						t.Error(err)
+						return
+					} else if !ok {
+						return
+					}
+					mu.Lock()
+					dequeued[item.Channel]++
+					mu.Unlock()
+				}
+			}(queue)
+		}
+	}
+	wg.Wait()
+
+	if len(dequeued) != len(channels) {
+		t.Errorf("Invalid dequeued channels, expected - %d, actual - %d", len(channels), len(dequeued))
+	}
+	for channel, count := range dequeued {
+		if count != 1 {
+			t.Errorf("Invalid dequeues of %s, expected - %d, actual - %d", channel, 1, count)
+		}
+	}
+}
+
+type gatedFetcher struct {
+	*stubFetcher
+	gate chan struct{}
+}
+
+func (fetcher *gatedFetcher) FetchChannel(channelName string) (Channel, error) {
+	<-fetcher.gate
+	return fetcher.stubFetcher.FetchChannel(channelName)
+}
+
+func TestSeedFile(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	path := filepath.Join(t.TempDir(), "seed.txt")
+	os.WriteFile(path, []byte("# channels fetched on boot\nwarm\n\n  other \nwarm\n"), 0644)
+	channels, err := readSeedFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(channels, []string{"warm", "other"}) {
+		t.Errorf("Invalid seed channels, expected - %v, actual - %v", []string{"warm", "other"}, channels)
+	}
+	os.WriteFile(path, []byte("warm\n../etc\n"), 0644)
+	if _, err := readSeedFile(path); err == nil {
+		t.Errorf("Invalid channel name accepted")
+	}
+
+	cache := newTestCache(t)
+	fetcher := &gatedFetcher{
+		stubFetcher: &stubFetcher{
+			channel: Channel{Name: "warm", Title: "Warm", LastId: 1, Link: "https://t.me/s/warm"},
+			posts:   map[int]Post{1: {Header: "first", Content: "first", Link: "https://t.me/warm/1", CreatedAt: time.Now(), MessageId: 1}},
+		},
+		gate: make(chan struct{}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	warmups := NewWarmups(ctx, cache, fetcher, nil, nil, FeedOptions{})
+	seed, err := StartSeed(warmups, []string{"warm"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := setupRouter(cache, fetcher, nil, ServerConfig{Warmups: warmups, Seed: seed})
+	ready := func() int {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+		return recorder.Code
+	}
+
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("Invalid readiness while seeding, expected - %d, actual - %d", http.StatusServiceUnavailable, code)
+	}
+
+	close(fetcher.gate)
+	deadline := time.Now().Add(2 * time.Second)
+	for ready() != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatalf("Not ready after seeding")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if channel, err := cache.GetChannel("warm"); err != nil || channel.LastId != 1 {
+		t.Errorf("Seed channel was not fetched: %+v, %v", channel, err)
+	}
+
+	// Readiness doesn't wait for seeding past the timeout.
+	// The stuck fetch is never released, the cache is closed before it.
+	stuck := &gatedFetcher{stubFetcher: fetcher.stubFetcher, gate: make(chan struct{})}
+	stuckCache := newTestCache(t)
+	warmups = NewWarmups(ctx, stuckCache, stuck, nil, nil, FeedOptions{})
+	seed, err = StartSeed(warmups, []string{"warm"}, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router = setupRouter(stuckCache, stuck, nil, ServerConfig{Warmups: warmups, Seed: seed})
+	time.Sleep(5 * time.Millisecond)
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("Invalid readiness after the seed timeout, expected - %d, actual - %d", http.StatusOK, code)
+	}
+}
+
+func TestQueuedWarmup(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cache := newTestCache(t)
+	queue, err := NewFetchQueue(cache.db, cache.Writes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetcher := &stubFetcher{
+		channel: Channel{Name: "warm", Title: "Warm", LastId: 1, Link: "https://t.me/s/warm"},
+		posts:   map[int]Post{1: {Header: "first", Content: "first", Link: "https://t.me/warm/1", CreatedAt: time.Now(), MessageId: 1}},
+	}
+	router := setupRouter(cache, fetcher, nil, ServerConfig{AdminToken: "secret", Queue: queue})
+	do := func(method string, url string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, url, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer secret")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	recorder := do("POST", "/admin/warmup", `["warm"]`)
+	var started struct{ Id string }
+	json.Unmarshal(recorder.Body.Bytes(), &started)
+	if recorder.Code != http.StatusAccepted || started.Id != "1" {
+		t.Fatalf("Invalid warmup response: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	var job WarmupJob
+	json.Unmarshal(do("GET", "/admin/warmup/1", "").Body.Bytes(), &job)
+	if job.Done || job.Channels[0].Status != WarmupPending {
+		t.Errorf("Invalid queued job, expected - pending, actual - %+v", job)
+	}
+
+	worker := NewQueueWorker(queue, cache, fetcher, nil, nil, 1, FeedOptions{})
+	for worker.next(context.Background()) {
+	}
+
+	json.Unmarshal(do("GET", "/admin/warmup/1", "").Body.Bytes(), &job)
+	if !job.Done || job.Channels[0].Status != WarmupOk {
+		t.Errorf("Invalid finished job, expected - ok, actual - %+v", job)
+	}
+	if channel, err := cache.GetChannel("warm"); err != nil || channel.LastId != 1 {
+		t.Errorf("Channel was not fetched: %+v, %v", channel, err)
+	}
+	if code := do("GET", "/admin/warmup/2", "").Code; code != http.StatusNotFound {
+		t.Errorf("Invalid status for unknown job, expected - %d, actual - %d", http.StatusNotFound, code)
+	}
+}
+
+func TestTitleOverride(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cache := newTestCache(t)
+	cache.SaveChannel(Channel{Name: "titled", Title: "Scraped Title", Link: "https://t.me/s/titled"})
+	base := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	fetcher := &stubFetcher{
+		channel: Channel{Name: "titled", Title: "Scraped Title", LastId: 2, Link: "https://t.me/s/titled"},
+		posts: map[int]Post{
+			1: {Content: "First", Link: "https://t.me/titled/1", CreatedAt: base, MessageId: 1},
+			2: {Content: "Second", Link: "https://t.me/titled/2", CreatedAt: base.Add(time.Hour), MessageId: 2},
+		},
+	}
+	router := setupRouter(cache, fetcher, nil, ServerConfig{})
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("POST", "/titled/config", strings.NewReader(`{"title":" My Clean Title "}`)))
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("Invalid status, expected - %d, actual - %d: %s", http.StatusNoContent, recorder.Code, recorder.Body.String())
+	}
+
+	// The override wins over the scraped title on every refresh.
+	for i := 0; i < 2; i++ {
+		recorder = httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", "/titled.json", nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Invalid status, expected - %d, actual - %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+		}
+		var feed struct {
+			Title string `json:"title"`
+			Items []struct {
+				Author struct {
+					Name string `json:"name"`
+				} `json:"author"`
+			} `json:"items"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &feed); err != nil {
+			t.Fatalf("Can't parse feed: %s", err)
+		}
+		if feed.Title != "My Clean Title" {
+			t.Errorf("Invalid feed title, expected - %v, actual - %v", "My Clean Title", feed.Title)
+		}
+		if len(feed.Items) != 2 || feed.Items[0].Author.Name != "My Clean Title" {
+			t.Errorf("Invalid feed items: %v", feed.Items)
+		}
+	}
+
+	channel, _ := cache.GetChannel("titled")
+	if channel.Title != "Scraped Title" || channel.TitleOverride != "My Clean Title" {
+		t.Errorf("Invalid channel titles, expected - %v/%v, actual - %v/%v", "Scraped Title", "My Clean Title", channel.Title, channel.TitleOverride)
+	}
+
+	// An empty title removes the override.
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("POST", "/titled/config", strings.NewReader(`{"title":""}`)))
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("Invalid status, expected - %d, actual - %d: %s", http.StatusNoContent, recorder.Code, recorder.Body.String())
+	}
+	channel, _ = cache.GetChannel("titled")
+	if channel.DisplayTitle() != "Scraped Title" {
+		t.Errorf("Invalid display title, expected - %v, actual - %v", "Scraped Title", channel.DisplayTitle())
+	}
+
+	memory := NewMemoryCache()
+	dbChannel, _ := memory.SaveChannel(Channel{Name: "titled", Title: "Scraped Title"})
+	memory.UpdateTitleOverride(dbChannel.Id, "My Clean Title")
+	if channel, _ := memory.GetChannel("titled"); channel.DisplayTitle() != "My Clean Title" {
+		t.Errorf("Invalid memory display title, expected - %v, actual - %v", "My Clean Title", channel.DisplayTitle())
+	}
+}
+
+func TestPinnedFirst(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	channelFixture, err := readFixture("fixtures/pinned.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+	postFixture, err := readFixture("fixtures/post.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+	// The page answers 304 once its validators are stored.
+	httpmock.RegisterResponder("GET", "https://t.me/s/pinnedtest", func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			return httpmock.NewStringResponse(http.StatusNotModified, ""), nil
+		}
+		resp := httpmock.NewStringResponse(http.StatusOK, channelFixture)
+		resp.Header.Set("ETag", `"v1"`)
+		return resp, nil
+	})
+	httpmock.RegisterResponder("GET", `=~^https://t\.me/pinnedtest/\d+\?embed=1&mode=tme$`, httpmock.NewStringResponder(200, postFixture))
+
+	fetcher := &TelegramWebFetcher{}
+	channel, err := fetcher.FetchChannel("pinnedtest")
+	if err != nil {
+		t.Fatalf("Can't fetch channel: %s", err)
+	}
+	// The newest pin wins over the older one.
+	if channel.PinnedId != 3 {
+		t.Errorf("Invalid pinned id, expected - %v, actual - %v", 3, channel.PinnedId)
+	}
+
+	cache := newTestCache(t)
+	postRequests := func() int {
+		return httpmock.GetCallCountInfo()[`GET =~^https://t\.me/pinnedtest/\d+\?embed=1&mode=tme$`]
+	}
+	var requests int
+	for i := 0; i < 2; i++ {
+		result, err := prepareFeed("pinnedtest", cache, fetcher, nil, FeedOptions{PinnedFirst: true})
+		if err != nil {
+			t.Fatalf("Can't prepare feed: %s", err)
+		}
+		if len(result.Feed.Items) == 0 || result.Feed.Items[0].Link.Href != "https://t.me/pinnedtest/3" {
+			t.Errorf("Invalid first item, expected - %v, actual - %v", "https://t.me/pinnedtest/3", result.Feed.Items)
+		}
+		if result.CacheHit != (i > 0) {
+			t.Errorf("Invalid cache hit, expected - %v, actual - %v", i > 0, result.CacheHit)
+		}
+		// The pinned post is cached, so it's fetched once.
+		if i > 0 && postRequests() != requests {
+			t.Errorf("Invalid post requests, expected - %d, actual - %d", requests, postRequests())
+		}
+		requests = postRequests()
+	}
+
+	dbChannel, _ := cache.GetChannel("pinnedtest")
+	if dbChannel.PinnedId != 3 {
+		t.Errorf("Invalid stored pinned id, expected - %v, actual - %v", 3, dbChannel.PinnedId)
+	}
+
+	// Without -pinnedfirst the pinned post is only in its place by date.
+	result, err := prepareFeed("pinnedtest", cache, fetcher, nil, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Can't prepare feed: %s", err)
+	}
+	if len(result.Feed.Items) == 0 || result.Feed.Items[0].Link.Href == "https://t.me/pinnedtest/3" {
+		t.Errorf("Pinned post is first in the feed without -pinnedfirst: %v", result.Feed.Items)
+	}
+
+	// A pinned post among the served ones is moved rather than fetched.
+	posts := []DbPost{{MessageId: 12, Link: "https://t.me/pinnedtest/12"}, {MessageId: 11, Link: "https://t.me/pinnedtest/11"}}
+	feed := generateFeed(DbChannel{Name: "pinnedtest"}, pinPost(NewMemoryCache(), failingFetcher{}, DbChannel{Name: "pinnedtest", PinnedId: 11}, posts), FeedOptions{})
+	if len(feed.Items) != 2 || feed.Items[0].Link.Href != "https://t.me/pinnedtest/11" {
+		t.Errorf("Invalid pinned order: %v", feed.Items)
+	}
+}
+
+func TestDiscussionComments(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	postFixture, err := readFixture("fixtures/post.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+	discussionFixture, err := readFixture("fixtures/discussion.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+	httpmock.RegisterResponder("GET", `=~^https://t\.me/lexfridman/\d+\?embed=1&mode=tme$`, httpmock.NewStringResponder(200, postFixture))
+	httpmock.RegisterResponder("GET", "https://t.me/lexfridman/272?embed=1&discussion=1&comments_limit=2",
+		httpmock.NewStringResponder(200, discussionFixture))
+	httpmock.RegisterResponder("GET", "https://t.me/lexfridman/271?embed=1&discussion=1&comments_limit=2",
+		httpmock.NewStringResponder(200, `<div class="tgme_widget_message_error">Discussion is not available</div>`))
+
+	fetcher := &TelegramWebFetcher{Comments: true, TopComments: 2}
+	post, err := fetcher.FetchPost("lexfridman", 272)
+	if err != nil {
+		t.Fatalf("Can't fetch post: %s", err)
+	}
+	expectedComments := []Comment{{Author: "Alice", Text: "Great post <3"}, {Author: "Bob", Text: "Thanks for sharing"}}
+	if post.Comments != 12 || !reflect.DeepEqual(post.TopComments, expectedComments) {
+		t.Errorf("Invalid comments, expected - %d %v, actual - %d %v", 12, expectedComments, post.Comments, post.TopComments)
+	}
+
+	post, err = fetcher.FetchPost("lexfridman", 271)
+	if err != nil || post.Comments != 0 || len(post.TopComments) != 0 {
+		t.Errorf("Invalid comments of a post without discussion, expected - 0, actual - %d %v (%v)", post.Comments, post.TopComments, err)
+	}
+
+	// Discussions aren't requested unless enabled.
+	httpmock.ZeroCallCounters()
+	if _, err := (&TelegramWebFetcher{}).FetchPost("lexfridman", 272); err != nil {
+		t.Fatalf("Can't fetch post: %s", err)
+	}
+	if calls := httpmock.GetCallCountInfo()["GET https://t.me/lexfridman/272?embed=1&discussion=1&comments_limit=2"]; calls != 0 {
+		t.Errorf("Invalid discussion requests, expected - 0, actual - %d", calls)
+	}
+
+	// The count and top comments are cached and shown in the feed.
+	cache := newTestCache(t)
+	channel, _ := cache.SaveChannel(Channel{Name: "lexfridman", Title: "Lex Fridman"})
+	cache.SavePosts(channel.Id, []Post{{Content: "Post", Link: "https://t.me/lexfridman/272", CreatedAt: time.Now(), MessageId: 272, Comments: 12, TopComments: expectedComments}})
+	posts, err := cache.GetPosts(channel.Id, MAX_RSS_POSTS_COUNT)
+	if err != nil || len(posts) != 1 || posts[0].Comments != 12 || !reflect.DeepEqual(posts[0].TopComments, expectedComments) {
+		t.Fatalf("Invalid cached comments: %v (%v)", posts, err)
+	}
+	feed := generateFeed(channel, posts, FeedOptions{})
+	expected := "💬 12 comments<br>Alice: Great post &lt;3<br>Bob: Thanks for sharing"
+	if !strings.Contains(feed.Items[0].Description, expected) {
+		t.Errorf("Invalid description, expected - %s, actual - %s", expected, feed.Items[0].Description)
+	}
+
+	// Counts of recent posts on the channel page are refreshed, older ones
+	// are left alone.
+	refreshCache := newTestCache(t)
+	refreshed, _ := refreshCache.SaveChannel(Channel{Name: "lexfridman", Title: "Lex Fridman"})
+	refreshCache.SavePosts(refreshed.Id, []Post{
+		{Content: "Recent", Link: "https://t.me/lexfridman/272", CreatedAt: time.Now(), MessageId: 272, Comments: 3},
+		{Content: "Old", Link: "https://t.me/lexfridman/270", CreatedAt: time.Now().Add(-2 * COMMENTS_REFRESH_AGE), MessageId: 270, Comments: 5},
+	})
+	if err := refreshPostComments(refreshCache, fetcher, refreshed, map[int]int{272: 100, 270: 50}); err != nil {
+		t.Fatalf("Can't refresh comments: %s", err)
+	}
+	posts, _ = refreshCache.GetPostsById(refreshed.Id, []int{272, 270})
+	for _, post := range posts {
+		expectedCount := map[int]int{272: 12, 270: 5}[post.MessageId]
+		if post.Comments != expectedCount {
+			t.Errorf("Invalid comments of post %d, expected - %d, actual - %d", post.MessageId, expectedCount, post.Comments)
+		}
+	}
+	if len(posts) != 2 || !reflect.DeepEqual(posts[0].TopComments, expectedComments) && !reflect.DeepEqual(posts[1].TopComments, expectedComments) {
+		t.Errorf("Invalid refreshed top comments: %v", posts)
+	}
+}
+
+// blockingFetcher holds every channel fetch until release is closed.
+type blockingFetcher struct {
+	started chan string
+	release chan struct{}
+}
+
+func (fetcher *blockingFetcher) FetchChannel(channelName string) (Channel, error) {
+	fetcher.started <- channelName
+	<-fetcher.release
+	return Channel{}, errors.New("Channel fetch released")
+}
+
+func (fetcher *blockingFetcher) FetchPost(channelName string, id int) (Post, error) {
+	return Post{}, errors.New("Unexpected post fetch")
+}
+
+func TestRefreshWorkerShutdown(t *testing.T) {
+	cache := newTestCache(t)
+	cache.SaveChannel(Channel{Name: "first", Link: "https://t.me/s/first"})
+	cache.SaveChannel(Channel{Name: "second", Link: "https://t.me/s/second"})
+
+	fetcher := &blockingFetcher{started: make(chan string, 2), release: make(chan struct{})}
+	worker := NewRefreshWorker(cache, fetcher, nil, &sync.Mutex{}, nil, time.Hour, nil, 0, FeedOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		worker.Run(ctx)
+		close(done)
+	}()
+
+	// Cancel in the middle of the cycle, while the first fetch is running.
+	select {
+	case <-fetcher.started:
+	case <-time.After(time.Second):
+		t.Fatalf("Worker didn't start refreshing")
+	}
+	cancel()
+	select {
+	case <-done:
+		t.Fatalf("Worker exited before finishing its fetch")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(fetcher.release)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Worker didn't stop after cancel")
+	}
+	if len(fetcher.started) != 0 {
+		t.Errorf("Worker started a refresh after cancel: %s", <-fetcher.started)
+	}
+
+	// The cache can be closed once the worker returned.
+	if err := closeCache(cache); err != nil {
+		t.Errorf("Can't close cache: %s", err)
+	}
+}
+
+func TestBackgroundShutdown(t *testing.T) {
+	cache := newTestCache(t)
+	queue, err := NewFetchQueue(cache.db, cache.Writes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// The queue worker and maintenance return once canceled.
+	var workers sync.WaitGroup
+	for _, run := range []func(ctx context.Context){
+		NewQueueWorker(queue, cache, &stubFetcher{}, nil, nil, 2, FeedOptions{}).Run,
+		NewMaintenance(nil, cache, nil, time.Hour, PruneOptions{}).Run,
+	} {
+		workers.Add(1)
+		go func(run func(ctx context.Context)) {
+			defer workers.Done()
+			run(ctx)
+		}(run)
+	}
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Workers didn't stop after cancel")
+	}
+
+	// Warmups stopped by then don't fetch their channels.
+	fetcher := &stubFetcher{channel: Channel{Name: "warm", Title: "Warm", LastId: 1, Link: "https://t.me/s/warm"}}
+	warmups := NewWarmups(ctx, cache, fetcher, nil, nil, FeedOptions{})
+	id, err := warmups.Start([]string{"warm"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	warmups.Wait()
+	job, _ := warmups.Get(id)
+	if len(job.Channels) != 1 || job.Channels[0].Status != WarmupFailed || !job.Done {
+		t.Errorf("Invalid stopped warmup: %+v", job)
+	}
+	if _, err := cache.GetChannel("warm"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Stopped warmup fetched its channel: %v", err)
+	}
+}
+
+func TestAlbumMerge(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	fixture, err := readFixture("fixtures/album_channel.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+	httpmock.RegisterResponder("GET", "https://t.me/s/albumtest", httpmock.NewStringResponder(200, fixture))
+
+	channel, err := (&TelegramWebFetcher{}).FetchChannel("albumtest")
+	if err != nil {
+		t.Fatalf("Can't fetch channel: %s", err)
+	}
+	album, ok := channel.Albums[21]
+	if !ok || !reflect.DeepEqual(album.Parts, []int{22, 23}) || len(album.Media) != 3 {
+		t.Fatalf("Invalid album, expected - parts [22 23] with 3 media, actual - %v", channel.Albums)
+	}
+	if len(channel.Albums) != 1 {
+		t.Errorf("Invalid albums count, expected - %d, actual - %d", 1, len(channel.Albums))
+	}
+
+	// The parts are neither fetched nor posts of their own, and the album
+	// post gets all media even when its embed shows only one.
+	base := time.Date(2024, 1, 21, 10, 0, 0, 0, time.UTC)
+	single := []Media{{Type: MediaPhoto, Url: "https://cdn4.telegram-cdn.org/file/album21.jpg"}}
+	fetcher := &stubFetcher{posts: map[int]Post{
+		20: {Content: "Before the trip", CreatedAt: base.Add(-24 * time.Hour), MessageId: 20},
+		21: {Content: "Photos from the trip", CreatedAt: base, MessageId: 21, Media: single},
+		22: {CreatedAt: base, MessageId: 22, Media: single},
+		23: {CreatedAt: base, MessageId: 23, Media: single},
+		24: {Content: "After the trip", CreatedAt: base.Add(72 * time.Hour), MessageId: 24},
+	}}
+	for _, ascending := range []bool{false, true} {
+		fetcher.fetched = nil
+		var posts []Post
+		if ascending {
+			posts, _, _ = fetchPostsAscending(fetcher, channel, 0, time.Time{}, true, MAX_RSS_POSTS_COUNT)
+		} else {
+			posts, _, _ = fetchPostsDescending(fetcher, channel, 0, time.Time{}, true, MAX_RSS_POSTS_COUNT)
+		}
+		for _, id := range fetcher.fetched {
+			if id == 22 || id == 23 {
+				t.Errorf("Album part %d was fetched", id)
+			}
+		}
+		if len(posts) != 3 {
+			t.Fatalf("Invalid posts count, expected - %d, actual - %d", 3, len(posts))
+		}
+		for _, post := range posts {
+			if post.MessageId == 21 && !reflect.DeepEqual(post.Media, album.Media) {
+				t.Errorf("Invalid album media, expected - %v, actual - %v", album.Media, post.Media)
+			}
+		}
+	}
+}
+
+func TestConditionalChannelFetch(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	channelFixture, err := readFixture("fixtures/views.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+	postFixture, err := readFixture("fixtures/post.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+
+	var conditionalRequests int
+	httpmock.RegisterResponder("GET", "https://t.me/s/viewstest", func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("If-None-Match") == `"v1"` && req.Header.Get("If-Modified-Since") == "Wed, 10 Jan 2024 10:00:00 GMT" {
+			conditionalRequests++
+			return httpmock.NewStringResponse(http.StatusNotModified, ""), nil
+		}
+		resp := httpmock.NewStringResponse(http.StatusOK, channelFixture)
+		resp.Header.Set("ETag", `"v1"`)
+		resp.Header.Set("Last-Modified", "Wed, 10 Jan 2024 10:00:00 GMT")
+		return resp, nil
+	})
+	httpmock.RegisterResponder("GET", `=~^https://t\.me/viewstest/\d+\?embed=1&mode=tme$`, httpmock.NewStringResponder(200, postFixture))
+
+	cache := newTestCache(t)
+	fetcher := NewCircuitBreaker(NewFailureCache(&TelegramWebFetcher{}, time.Minute), 3, time.Minute)
+	first, err := prepareFeed("viewstest", cache, fetcher, nil, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Can't prepare feed: %s", err)
+	}
+	channel, _ := cache.GetChannel("viewstest")
+	expected := PageValidators{ETag: `"v1"`, LastModified: "Wed, 10 Jan 2024 10:00:00 GMT"}
+	if channel.Validators != expected {
+		t.Errorf("Invalid validators, expected - %v, actual - %v", expected, channel.Validators)
+	}
+
+	// Views of the stored page are applied again on a 304. The post fixture
+	// is message 13 whatever the link, so it's made one the page has views of.
+	if _, err := cache.db.Exec("UPDATE posts SET views = 0, messageId = 12"); err != nil {
+		t.Fatalf("Can't reset views: %s", err)
+	}
+
+	httpmock.ZeroCallCounters()
+	second, err := prepareFeed("viewstest", cache, fetcher, nil, FeedOptions{})
+	if err != nil {
+		t.Fatalf("Can't prepare feed: %s", err)
+	}
+	if conditionalRequests != 1 || !second.CacheHit {
+		t.Errorf("Invalid conditional fetch, expected - 1 request served from cache, actual - %d requests, cache hit %v", conditionalRequests, second.CacheHit)
+	}
+	if len(second.Feed.Items) != len(first.Feed.Items) || len(second.Feed.Items) == 0 {
+		t.Errorf("Invalid items count, expected - %d, actual - %d", len(first.Feed.Items), len(second.Feed.Items))
+	}
+	if calls := httpmock.GetTotalCallCount(); calls != 1 {
+		t.Errorf("Invalid requests count, expected - %d, actual - %d", 1, calls)
+	}
+	posts, _ := cache.GetPosts(channel.Id, 100)
+	if len(posts) == 0 || posts[0].Views != 3400000 {
+		t.Errorf("Invalid refreshed views, expected - %d, actual - %v", 3400000, posts)
+	}
+}
+
+func TestFilterRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	rules := "# promo\n* exclude (?i)#ad\\b\n\nnews include (?i)breaking\nnews flag (?i)sponsored\n"
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatalf("Can't write rules: %s", err)
+	}
+	filters, err := readFilterRules(path)
+	if err != nil {
+		t.Fatalf("Can't read rules: %s", err)
+	}
+
+	posts := []DbPost{
+		{Header: "Breaking", Content: "Breaking news", Link: "https://t.me/news/1"},
+		{Header: "Promo", Content: "Breaking deal #ad", Link: "https://t.me/news/2"},
+		{Header: "Weather", Content: "Sunny today", Link: "https://t.me/news/3"},
+		{Header: "Partner", Content: "Breaking, sponsored", Link: "https://t.me/news/4"},
+		{Content: "Breaking: sponsored\nby a partner", Link: "https://t.me/news/5"},
+	}
+	feed := generateFeed(DbChannel{Name: "news"}, posts, FeedOptions{Filters: filters})
+	var titles []string
+	for _, item := range feed.Items {
+		titles = append(titles, item.Title)
+	}
+	expected := []string{"Breaking", "[Flagged] Partner", "[Flagged] Breaking: sponsored"}
+	if !reflect.DeepEqual(titles, expected) {
+		t.Errorf("Invalid titles, expected - %v, actual - %v", expected, titles)
+	}
+
+	// Include rules of one channel don't apply to the others.
+	feed = generateFeed(DbChannel{Name: "other"}, posts, FeedOptions{Filters: filters})
+	if len(feed.Items) != 4 {
+		t.Errorf("Invalid items count, expected - %d, actual - %d", 4, len(feed.Items))
+	}
+
+	for _, invalid := range []string{"* drop promo", "* exclude", "bad-name exclude promo", "* exclude (unclosed"} {
+		if err := os.WriteFile(path, []byte(invalid), 0o644); err != nil {
+			t.Fatalf("Can't write rules: %s", err)
+		}
+		if _, err := readFilterRules(path); err == nil {
+			t.Errorf("Invalid rules accepted: %q", invalid)
+		}
+	}
+}
+
+func TestAdminFailures(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	flaky := &flakyFetcher{err: fmt.Errorf("%w: missing", ErrChannelPreviewOnly)}
+	failures := NewFailureCache(flaky, 5*time.Minute)
+	failures.now = func() time.Time { return now }
+	failures.FetchChannel("Missing")
+
+	router := setupRouter(newTestCache(t), NewCircuitBreaker(failures, 3, time.Minute), nil, ServerConfig{AdminToken: "secret"})
+	do := func(method string, path string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, nil)
+		request.Header.Set("Authorization", "Bearer secret")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	recorder := do("GET", "/admin/failures")
+	var listed []CachedFailure
+	if err := json.Unmarshal(recorder.Body.Bytes(), &listed); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("Invalid failures response: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if len(listed) != 1 || listed[0].Channel != "missing" || !listed[0].ExpiresAt.Equal(now.Add(5*time.Minute)) || listed[0].Error == "" {
+		t.Errorf("Invalid failures, expected - missing until %v, actual - %+v", now.Add(5*time.Minute), listed)
+	}
+
+	if code := do("DELETE", "/admin/failures/MISSING").Code; code != http.StatusNoContent {
+		t.Errorf("Invalid clear status, expected - %d, actual - %d", http.StatusNoContent, code)
+	}
+	flaky.err = nil
+	if _, err := failures.FetchChannel("missing"); err != nil || flaky.calls != 2 {
+		t.Errorf("Invalid fetch after clear, expected - fetched again, actual - %d calls, %v", flaky.calls, err)
+	}
+	if code := do("DELETE", "/admin/failures/missing").Code; code != http.StatusNotFound {
+		t.Errorf("Invalid clear status, expected - %d, actual - %d", http.StatusNotFound, code)
+	}
+
+	request := httptest.NewRequest("GET", "/admin/failures", nil)
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Invalid status without token, expected - %d, actual - %d", http.StatusUnauthorized, recorder.Code)
+	}
+}
+
+func TestMediaRss(t *testing.T) {
+	channel := DbChannel{Name: "media", Title: "Media", Link: "https://t.me/s/media"}
+	posts := []DbPost{
+		{Header: "Video", Content: "clip", Link: "https://t.me/media/2", MessageId: 2, CreatedAt: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+			Media: []Media{{Type: "video", Url: "https://cdn.example.com/clip.mp4", Thumbnail: "https://cdn.example.com/clip.jpg"}, {Type: "photo", Url: "https://cdn.example.com/photo.jpg"}}},
+		{Header: "Text", Content: "just text", Link: "https://t.me/media/1", MessageId: 1, CreatedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	feed := generateFeed(channel, posts, FeedOptions{})
+
+	var rss bytes.Buffer
+	if err := writeFeed(&rss, feed, FormatRss, 0, true); err != nil {
+		t.Fatalf("Can't render rss: %s", err)
+	}
+	assertWellFormedXml(t, rss.String())
+	if !strings.Contains(rss.String(), `xmlns:media="`+MEDIA_RSS_NAMESPACE+`"`) {
+		t.Errorf("Invalid rss, expected - media namespace, actual - %s", rss.String())
+	}
+
+	type media struct {
+		Url       string `xml:"url,attr"`
+		Medium    string `xml:"medium,attr"`
+		Thumbnail struct {
+			Url string `xml:"url,attr"`
+		} `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+	}
+	var parsed struct {
+		Channel struct {
+			Items []struct {
+				Title     string  `xml:"title"`
+				Media     []media `xml:"http://search.yahoo.com/mrss/ content"`
+				Thumbnail *struct {
+					Url string `xml:"url,attr"`
+				} `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+			} `xml:"item"`
+		} `xml:"channel"`
+	}
+	if err := xml.Unmarshal(rss.Bytes(), &parsed); err != nil {
+		t.Fatalf("Can't parse rss: %s", err)
+	}
+	if len(parsed.Channel.Items) != 2 {
+		t.Fatalf("Invalid items count, expected - %d, actual - %d", 2, len(parsed.Channel.Items))
+	}
+	video := parsed.Channel.Items[0]
+	if len(video.Media) != 2 || video.Media[0].Url != "https://cdn.example.com/clip.mp4" || video.Media[0].Medium != "video" ||
+		video.Media[0].Thumbnail.Url != "https://cdn.example.com/clip.jpg" || video.Media[1].Medium != "image" {
+		t.Errorf("Invalid media content: %+v", video.Media)
+	}
+	if video.Thumbnail == nil || video.Thumbnail.Url != "https://cdn.example.com/clip.jpg" {
+		t.Errorf("Invalid item thumbnail: %+v", video.Thumbnail)
+	}
+	if text := parsed.Channel.Items[1]; len(text.Media) != 0 || text.Thumbnail != nil {
+		t.Errorf("Invalid media of text post: %+v", text)
+	}
+
+	rss.Reset()
+	if err := writeFeed(&rss, feed, FormatRss, 0, false); err != nil {
+		t.Fatalf("Can't render rss: %s", err)
+	}
+	if strings.Contains(rss.String(), "media:") {
+		t.Errorf("Invalid rss without -mediarss: %s", rss.String())
+	}
+}
+
+func TestVoicePost(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	fixture, err := readFixture("fixtures/voice.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+	httpmock.RegisterResponder("GET", "https://t.me/voicetest/5?embed=1&mode=tme",
+		httpmock.NewStringResponder(200, fixture))
+
+	fetcher := &TelegramWebFetcher{}
+	post, err := fetcher.FetchPost("voicetest", 5)
+	if err != nil {
+		t.Fatalf("Fetch post failed: %s", err)
+	}
+	if post.Header != "🎙 Voice message (0:42)" || post.Content != post.Header {
+		t.Errorf("Invalid voice post, expected - 🎙 Voice message (0:42), actual - %q %q", post.Header, post.Content)
+	}
+	expected := []Media{{Type: MediaVoice, Url: "https://cdn4.telesco.pe/file/voice.ogg"}}
+	if !reflect.DeepEqual(post.Media, expected) {
+		t.Errorf("Invalid media, expected - %v, actual - %v", expected, post.Media)
+	}
+
+	feed := generateFeed(DbChannel{Name: "voicetest"}, []DbPost{{Header: post.Header, Content: post.Content, Link: post.Link, CreatedAt: post.CreatedAt, Media: post.Media}}, FeedOptions{})
+	enclosure := feed.Items[0].Enclosure
+	if enclosure == nil || enclosure.Url != "https://cdn4.telesco.pe/file/voice.ogg" || enclosure.Type != "audio/ogg" {
+		t.Errorf("Invalid enclosure, expected - audio/ogg voice.ogg, actual - %+v", enclosure)
+	}
+	if !strings.Contains(feed.Items[0].Description, `<audio src="https://cdn4.telesco.pe/file/voice.ogg" controls></audio>`) {
+		t.Errorf("Invalid description: %s", feed.Items[0].Description)
+	}
+
+	rss, err := toRss(feed, 0)
+	if err != nil || !strings.Contains(rss, `<enclosure url="https://cdn4.telesco.pe/file/voice.ogg" length="0" type="audio/ogg">`) {
+		t.Errorf("Invalid rss enclosure: %s %v", rss, err)
+	}
+}
+
+func TestChannelNameNormalization(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	channelFixture, err := readFixture("fixtures/views.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+	postFixture, err := readFixture("fixtures/post.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+	httpmock.RegisterResponder("GET", "https://t.me/s/viewstest", httpmock.NewStringResponder(200, channelFixture))
+	httpmock.RegisterResponder("GET", `=~^https://t\.me/viewstest/\d+\?embed=1&mode=tme$`, httpmock.NewStringResponder(200, postFixture))
+
+	cache := newTestCache(t)
+	router := setupRouter(cache, &TelegramWebFetcher{}, nil, ServerConfig{})
+	get := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		return recorder
+	}
+
+	for _, path := range []string{"/ViewsTest", "/viewstest", "/VIEWSTEST.atom"} {
+		if recorder := get(path); recorder.Code != http.StatusOK {
+			t.Errorf("Invalid status of %s, expected - %d, actual - %d", path, http.StatusOK, recorder.Code)
+		}
+	}
+	recorder := get("/ViewsTest/")
+	if location := recorder.Header().Get("Location"); recorder.Code != http.StatusMovedPermanently || location != "/ViewsTest" {
+		t.Errorf("Invalid trailing slash redirect, expected - %d to /ViewsTest, actual - %d to %s", http.StatusMovedPermanently, recorder.Code, location)
+	}
+
+	channels, err := cache.GetChannels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 1 || channels[0].Name != "viewstest" {
+		t.Errorf("Invalid cached channels, expected - [viewstest], actual - %v", channels)
+	}
+
+	router = setupRouter(newTestCache(t), &TelegramWebFetcher{}, nil, ServerConfig{KeepNameCase: true})
+	if recorder := get("/ViewsTest"); recorder.Code == http.StatusOK {
+		t.Errorf("Invalid status with -keepnamecase, expected - /s/ViewsTest to be requested, actual - %d", recorder.Code)
+	}
+
+	// Telegram's casing of a fetched channel doesn't make a second entry.
+	cache = newTestCache(t)
+	fetcher := &stubFetcher{
+		channel: Channel{Name: "CasedTest", Title: "Cased", LastId: 1, Link: "https://t.me/s/CasedTest"},
+		posts:   map[int]Post{1: {Header: "post", Content: "post", Link: "https://t.me/CasedTest/1", CreatedAt: time.Now(), MessageId: 1}},
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := prepareFeed("casedtest", cache, fetcher, nil, FeedOptions{}); err != nil {
+			t.Fatalf("Can't prepare feed: %s", err)
+		}
+	}
+	channels, _ = cache.GetChannels()
+	if len(channels) != 1 || channels[0].Name != "casedtest" {
+		t.Errorf("Invalid cached channels, expected - [casedtest], actual - %v", channels)
+	}
+	if len(fetcher.fetched) != 1 {
+		t.Errorf("Invalid fetched posts, expected - %v, actual - %v", []int{1}, fetcher.fetched)
+	}
+
+	// Channels cached under a cased name before are renamed on startup.
+	cache = newTestCache(t)
+	cache.SaveChannel(Channel{Name: "OldCase", Link: "https://t.me/s/OldCase"})
+	cache.SaveChannel(Channel{Name: "BothCases", Link: "https://t.me/s/BothCases"})
+	cache.SaveChannel(Channel{Name: "bothcases", Link: "https://t.me/s/bothcases"})
+	if err := normalizeCachedChannels(cache); err != nil {
+		t.Fatalf("Can't normalize channels: %s", err)
+	}
+	var names []string
+	channels, _ = cache.GetChannels()
+	for _, channel := range channels {
+		names = append(names, channel.Name)
+	}
+	sort.Strings(names)
+	expected := []string{"BothCases", "bothcases", "oldcase"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Invalid normalized channels, expected - %v, actual - %v", expected, names)
+	}
+
+	// A failed rename doesn't stop the others.
+	memory := NewMemoryCache()
+	memory.SaveChannel(Channel{Name: "Failing", Link: "https://t.me/s/Failing"})
+	memory.SaveChannel(Channel{Name: "Later", Link: "https://t.me/s/Later"})
+	if err := normalizeCachedChannels(&failingRenameCache{Cache: memory, name: "failing"}); err != nil {
+		t.Fatalf("Can't normalize channels: %s", err)
+	}
+	if _, err := memory.GetChannel("later"); err != nil {
+		t.Errorf("Channel after a failed rename wasn't renamed: %v", err)
+	}
+
+	// Differently cased paths of one file, as on case-insensitive file
+	// systems, don't stop shard renames. A hard link stands in for them.
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "Cased.db"), nil, 0o644)
+	os.WriteFile(filepath.Join(dir, "other.db"), nil, 0o644)
+	os.Link(filepath.Join(dir, "Cased.db"), filepath.Join(dir, "cased.db"))
+	if !sameShardFile(filepath.Join(dir, "Cased.db"), filepath.Join(dir, "cased.db")) || sameShardFile(filepath.Join(dir, "Cased.db"), filepath.Join(dir, "other.db")) {
+		t.Errorf("Invalid same shard files")
+	}
+}
+
+// failingRenameCache fails renames of channels to name.
+type failingRenameCache struct {
+	Cache
+	name string
+}
+
+func (cache *failingRenameCache) RenameChannel(channelId int, name string, link string) error {
+	if name == cache.name {
+		return errors.New("Rename failed")
+	}
+	return cache.Cache.RenameChannel(channelId, name, link)
+}
+
+func TestServeStale(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cache := newTestCache(t)
+	channel, _ := cache.SaveChannel(Channel{Name: "stale", Title: "Stale", LastId: 1, Link: "https://t.me/s/stale"})
+	cache.SavePosts(channel.Id, []Post{{Header: "cached post", Content: "cached post", Link: "https://t.me/stale/1", CreatedAt: time.Now(), MessageId: 1}})
+
+	flaky := &flakyFetcher{err: fmt.Errorf("%w: 502 Bad Gateway", ErrTelegramUnavailable)}
+	router := setupRouter(cache, flaky, nil, ServerConfig{ServeStale: true})
+	get := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		return recorder
+	}
+
+	recorder := get("/stale")
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "cached post") {
+		t.Fatalf("Invalid stale feed, expected - %d with the cached post, actual - %d %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+	if recorder.Header().Get(STALE_HEADER) != "true" || recorder.Header().Get("Warning") != STALE_WARNING {
+		t.Errorf("Invalid stale headers, expected - %s: true and Warning: %s, actual - %v", STALE_HEADER, STALE_WARNING, recorder.Header())
+	}
+
+	// Without cached posts there's nothing to serve.
+	if recorder := get("/uncached"); recorder.Code != http.StatusBadGateway || recorder.Header().Get(STALE_HEADER) != "" {
+		t.Errorf("Invalid status of uncached channel, expected - %d, actual - %d", http.StatusBadGateway, recorder.Code)
+	}
+
+	router = setupRouter(cache, flaky, nil, ServerConfig{})
+	if recorder := get("/stale"); recorder.Code != http.StatusBadGateway {
+		t.Errorf("Invalid status without -servestale, expected - %d, actual - %d", http.StatusBadGateway, recorder.Code)
+	}
+}
+
+func TestFeedProcessors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	RegisterFeedProcessor("marker", func(feed *feeds.Feed) {
+		feed.Items = append([]*feeds.Item{{Title: "Sponsored note", Link: &feeds.Link{Href: "https://example.com"}}}, feed.Items...)
+	})
+	defer delete(feedProcessors, "marker")
+
+	processors, err := parseFeedProcessors("untitled, marker")
+	if err != nil {
+		t.Fatalf("Can't parse feed processors: %s", err)
+	}
+	if _, err := parseFeedProcessors("untitled,unknown"); err == nil {
+		t.Errorf("Invalid feed processors accepted: unknown")
+	}
+
+	cache := newTestCache(t)
+	channel, _ := cache.SaveChannel(Channel{Name: "processed", Title: "Processed", LastId: 2, Link: "https://t.me/s/processed"})
+	cache.SavePosts(channel.Id, []Post{
+		{Content: "A short post without a header that goes on for a while, longer than a title\nsecond line", Link: "https://t.me/processed/2", CreatedAt: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), MessageId: 2},
+		{Header: "Header", Content: "Header and more", Link: "https://t.me/processed/1", CreatedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), MessageId: 1},
+	})
+
+	router := setupRouter(cache, failingFetcher{}, nil, ServerConfig{FeedProcessors: processors})
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/processed?cached=true", nil))
+
+	var parsed struct {
+		Channel struct {
+			Items []struct {
+				Title string `xml:"title"`
+			} `xml:"item"`
+		} `xml:"channel"`
+	}
+	if err := xml.Unmarshal(recorder.Body.Bytes(), &parsed); err != nil {
+		t.Fatalf("Can't parse rss: %s", err)
+	}
+	var titles []string
+	for _, item := range parsed.Channel.Items {
+		titles = append(titles, item.Title)
+	}
+	expected := []string{"Sponsored note", "A short post without a header that goes on for a while, long...", "Header"}
+	if !reflect.DeepEqual(titles, expected) {
+		t.Errorf("Invalid titles, expected - %q, actual - %q", expected, titles)
+	}
+}
+
+func TestAsyncFetch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cache := newTestCache(t)
+	fetcher := &gatedFetcher{
+		stubFetcher: &stubFetcher{
+			channel: Channel{Name: "cold", Title: "Cold", LastId: 1, Link: "https://t.me/s/cold"},
+			posts:   map[int]Post{1: {Header: "warm post", Content: "warm post", Link: "https://t.me/cold/1", CreatedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), MessageId: 1}},
+		},
+		gate: make(chan struct{}),
+	}
+	fetches := NewAsyncFetches()
+	router := setupRouter(cache, fetcher, nil, ServerConfig{AsyncFetch: true, AsyncFetches: fetches})
+	get := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		return recorder
+	}
+
+	for i := 0; i < 2; i++ {
+		recorder := get("/cold")
+		if recorder.Code != http.StatusAccepted || recorder.Header().Get("Retry-After") != strconv.Itoa(ASYNC_FETCH_RETRY_AFTER) {
+			t.Fatalf("Invalid cold response, expected - %d with Retry-After, actual - %d %v", http.StatusAccepted, recorder.Code, recorder.Header())
+		}
+	}
+
+	// Other cold channels are turned away while the background fetches
+	// are full.
+	fetches.mu.Lock()
+	for i := 1; i < MAX_ASYNC_FETCHES; i++ {
+		fetches.running[fmt.Sprintf("full%d", i)] = true
+	}
+	fetches.mu.Unlock()
+	recorder := get("/other")
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get("Retry-After") != strconv.Itoa(ASYNC_FETCH_RETRY_AFTER) {
+		t.Errorf("Invalid full response, expected - %d with Retry-After, actual - %d %v", http.StatusServiceUnavailable, recorder.Code, recorder.Header())
+	}
+	fetches.mu.Lock()
+	for i := 1; i < MAX_ASYNC_FETCHES; i++ {
+		delete(fetches.running, fmt.Sprintf("full%d", i))
+	}
+	fetches.mu.Unlock()
+
+	close(fetcher.gate)
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if recorder = get("/cold"); recorder.Code != http.StatusAccepted {
+			break
+		}
+	}
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "warm post") {
+		t.Errorf("Invalid warm feed, expected - %d with the post, actual - %d %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+	if len(fetcher.fetched) != 1 {
+		t.Errorf("Invalid fetched posts, expected - %d, actual - %v", 1, fetcher.fetched)
+	}
+}
+
+func TestUnicodeNormalization(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	channelFixture, err := readFixture("fixtures/views.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+	postFixture, err := readFixture("fixtures/post.html")
+	if err != nil {
+		t.Errorf("Invalid fixture")
+	}
+
+	// "Café crème" with combining accents (NFD).
+	decomposed := "Cafe\u0301 cre\u0300me"
+	composed := "Caf\u00e9 cr\u00e8me"
+	channelFixture = strings.ReplaceAll(channelFixture, "<span dir=\"auto\">Views Test</span></div>\n              </div>", "<span dir=\"auto\">"+decomposed+"</span></div>\n              </div>")
+	postFixture = strings.Replace(postFixture, "All humans are capable", decomposed+" all humans are capable", 1)
+	httpmock.RegisterResponder("GET", "https://t.me/s/viewstest", httpmock.NewStringResponder(200, channelFixture))
+	httpmock.RegisterResponder("GET", `=~^https://t\.me/viewstest/\d+\?embed=1&mode=tme$`, httpmock.NewStringResponder(200, postFixture))
+
+	cache := newTestCache(t)
+	if _, err := prepareFeed("viewstest", cache, &TelegramWebFetcher{}, nil, FeedOptions{}); err != nil {
+		t.Fatalf("Can't prepare feed: %s", err)
+	}
+
+	channel, err := cache.GetChannel("viewstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel.Title != composed {
+		t.Errorf("Invalid title, expected - %q, actual - %q", composed, channel.Title)
+	}
+	posts, _ := cache.GetPosts(channel.Id, MAX_RSS_POSTS_COUNT)
+	if len(posts) == 0 || !strings.HasPrefix(posts[0].Content, composed) || !strings.HasPrefix(posts[0].Header, composed) {
+		t.Fatalf("Invalid posts, expected - content starting with %q, actual - %v", composed, posts)
+	}
+
+	results, err := cache.SearchPosts(strings.ToLower(composed), 10)
+	if err != nil || len(results) == 0 {
+		t.Errorf("Invalid search results for %q, expected - matches, actual - %v %v", composed, results, err)
+	}
+}